@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	abuseWindow        = time.Minute
+	throttleFor        = 10 * time.Minute
+	firstBan           = 15 * time.Minute
+	maxBan             = 24 * time.Hour
+	enumerationIDs     = 30 // distinct quote IDs in a window that count as walking the corpus
+	suspiciousDivisor  = 4  // suspicious user agents get this fraction of the rate
+	throttledDivisor   = 4  // and throttled clients this fraction again
+	abuseMemory        = 24 * time.Hour
+	defaultAbuseRate   = 300
+	abuseStateThrottle = "throttled"
+	abuseStateBan      = "banned"
+)
+
+var (
+	abuseDetections = newCounterVec("quote_abuse_detections_total", "Abusive behaviour detected, by signal.", "signal")
+	abuseBlocked    = newCounterVec("quote_abuse_blocked_total", "Requests refused by abuse blocks, by state.", "state")
+)
+
+// Substrings of user agents sent by scripts and scrapers rather than
+// browsers or apps. Matching clients are not blocked for it, but are held
+// to a lower rate.
+var suspiciousAgents = []string{
+	"curl", "wget", "python", "go-http-client", "java/", "okhttp", "libwww", "httpclient",
+	"scrapy", "headless", "phantomjs", "bot", "spider", "crawler",
+}
+
+// abuseDetector watches each client's behaviour and escalates: the first
+// detection throttles the client, and another while throttled bans it,
+// for longer each time. Clients that identify themselves with a valid API
+// key are left to their plan's quota instead, and staff are never blocked,
+// so they can always lift a block.
+//
+// Clients are addresses, or /64 prefixes for IPv6, where one host often
+// has many addresses. Request rates are counted by each replica, but blocks
+// are kept in shared state, so every replica enforces them and admins can
+// list and lift them on any:
+//
+//	abuse:block:<client>   the client's block, as JSON, until a day after it ends
+//	abuse:blocks           hash of the clients with a block
+type abuseDetector struct {
+	rate        int // requests per minute before a client counts as abusive
+	staff       *staffAuth
+	keys        *apiKeys
+	audit       *auditLog
+	state       stateStore
+	onDetection func(netip.Addr) // told about every detection, to raise challenge difficulty
+
+	mu      sync.Mutex
+	clients map[string]*clientBehaviour
+}
+
+// clientBehaviour is what this replica has seen of a client recently.
+type clientBehaviour struct {
+	window   time.Time // start of the current rate window
+	requests int
+	ids      map[int]bool // quote IDs fetched in the window, in any order
+	lastAt   time.Time
+}
+
+// abuseBlock is a client's block. It outlives the block by abuseMemory,
+// so a client that offends again within a day is banned for longer.
+type abuseBlock struct {
+	Address string    `json:"address"` // the client's address, or its /64
+	State   string    `json:"state"`   // "", throttled or banned
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Bans    int       `json:"bans"` // each lengthens the next`
+}
+
+func abuseBlockKey(client string) string { return "abuse:block:" + client }
+
+const abuseBlocksKey = "abuse:blocks"
+
+// abuseFromEnv reads the request rate that triggers detection from
+// ABUSE_RATE, per client per minute (default 300). A rate of 0 turns
+// detection off and returns nil.
+func abuseFromEnv(staff *staffAuth, keys *apiKeys, audit *auditLog, state stateStore) (*abuseDetector, error) {
+	rate := defaultAbuseRate
+	if v := os.Getenv("ABUSE_RATE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid ABUSE_RATE %q", v)
+		}
+		rate = n
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+	return &abuseDetector{rate: rate, staff: staff, keys: keys, audit: audit, state: state, clients: make(map[string]*clientBehaviour)}, nil
+}
+
+func suspiciousAgent(ua string) bool {
+	ua = strings.ToLower(ua)
+	if strings.TrimSpace(ua) == "" {
+		return true
+	}
+	for _, s := range suspiciousAgents {
+		if strings.Contains(ua, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteIDFromPath returns the ID in /v1/quotes/{id}, if the path is one.
+func quoteIDFromPath(path string) (int, bool) {
+	rest, ok := strings.CutPrefix(path, "/v1/quotes/")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(rest)
+	return id, err == nil
+}
+
+// block returns the client's block, which is empty if it has none.
+func (d *abuseDetector) block(ctx context.Context, client string) (abuseBlock, error) {
+	b := abuseBlock{Address: client}
+	_, err := getJSON(ctx, d.state, abuseBlockKey(client), &b)
+	return b, err
+}
+
+// observe records a request and returns the client's state afterwards and,
+// if it is blocked, until when.
+func (d *abuseDetector) observe(r *http.Request, addr netip.Addr, now time.Time) (string, time.Time, error) {
+	ctx := r.Context()
+	client := clientGroup(addr)
+	b, err := d.block(ctx, client)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if b.State != "" && now.After(b.Until) {
+		b.State = ""
+	}
+	if b.State == abuseStateBan {
+		return b.State, b.Until, nil
+	}
+
+	limit, signal := d.rate, "rate"
+	if suspiciousAgent(r.UserAgent()) {
+		limit, signal = max(d.rate/suspiciousDivisor, 1), "user_agent"
+	}
+	var signals []string
+	d.mu.Lock()
+	c, ok := d.clients[client]
+	if !ok {
+		c = &clientBehaviour{}
+		d.clients[client] = c
+	}
+	c.lastAt = now
+	if now.Sub(c.window) >= abuseWindow {
+		c.window, c.requests, c.ids = now, 0, nil
+	}
+	c.requests++
+	if c.requests == limit+1 {
+		signals = append(signals, signal)
+	}
+	if id, ok := quoteIDFromPath(r.URL.Path); ok {
+		if c.ids == nil {
+			c.ids = make(map[int]bool)
+		}
+		c.ids[id] = true
+		if len(c.ids) >= enumerationIDs {
+			c.ids = nil
+			signals = append(signals, "enumeration")
+		}
+	}
+	requests, window := c.requests, c.window
+	d.mu.Unlock()
+
+	for _, signal := range signals {
+		if b, err = d.detect(ctx, b, addr, signal, now); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	switch {
+	case b.State == abuseStateBan:
+		return b.State, b.Until, nil
+	case b.State == abuseStateThrottle && requests > max(limit/throttledDivisor, 1):
+		return b.State, window.Add(abuseWindow), nil
+	}
+	return b.State, time.Time{}, nil
+}
+
+// detect escalates a client after a detection: a first offence throttles
+// it, and another while throttled bans it. It returns the new block.
+func (d *abuseDetector) detect(ctx context.Context, b abuseBlock, addr netip.Addr, signal string, now time.Time) (abuseBlock, error) {
+	abuseDetections.inc(signal)
+	if d.onDetection != nil {
+		d.onDetection(addr)
+	}
+	if b.State == "" {
+		b.State, b.Reason, b.Since, b.Until = abuseStateThrottle, signal, now, now.Add(throttleFor)
+	} else {
+		ban := firstBan << min(b.Bans, 10)
+		b.Bans++
+		b.State, b.Reason, b.Since, b.Until = abuseStateBan, signal, now, now.Add(min(ban, maxBan))
+	}
+	if err := setJSON(ctx, d.state, abuseBlockKey(b.Address), b, b.Until.Sub(now)+abuseMemory); err != nil {
+		return b, err
+	}
+	return b, d.state.hset(ctx, abuseBlocksKey, b.Address, "")
+}
+
+// wrap refuses requests from banned clients, and from throttled ones over
+// their reduced rate.
+func (d *abuseDetector) wrap(next http.Handler) http.Handler {
+	if d == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := clientIP(r)
+		if !addr.IsValid() || r.URL.Path == "/metrics" || d.staff.role(r) != roleNone || d.validKey(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		state, until, err := d.observe(r, addr, time.Now())
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		if until.IsZero() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		abuseBlocked.inc(state)
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		if state == abuseStateBan {
+			writeError(w, http.StatusForbidden, "temporarily blocked for abusive traffic")
+			return
+		}
+		writeError(w, http.StatusTooManyRequests, "too many requests; slow down")
+	})
+}
+
+// validKey reports whether the request carries a live API key. Anything
+// else in the header, or a key that cannot be checked right now, is
+// watched like any anonymous request.
+func (d *abuseDetector) validKey(r *http.Request) bool {
+	secret := r.Header.Get(apiKeyHeader)
+	if secret == "" || d.keys == nil {
+		return false
+	}
+	_, ok, err := d.keys.lookup(r.Context(), secret)
+	return ok && err == nil
+}
+
+// run forgets the request counts of clients that have been quiet for a
+// window.
+func (d *abuseDetector) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			d.mu.Lock()
+			for client, c := range d.clients {
+				if now.Sub(c.lastAt) > abuseWindow {
+					delete(d.clients, client)
+				}
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+func (d *abuseDetector) routes(mux *http.ServeMux, staff *staffAuth) {
+	if d == nil {
+		return
+	}
+	mux.HandleFunc("GET /v1/admin/blocks", staff.require(roleAdmin, d.listHandler))
+	mux.HandleFunc("DELETE /v1/admin/blocks/{address}", staff.require(roleAdmin, d.liftHandler))
+}
+
+// listHandler shows the clients currently throttled or banned, and drops
+// the ones whose blocks are gone from the index.
+func (d *abuseDetector) listHandler(w http.ResponseWriter, r *http.Request, _ role) {
+	ctx := r.Context()
+	clients, err := d.state.hgetAll(ctx, abuseBlocksKey)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	now := time.Now()
+	blocks := []abuseBlock{}
+	for client := range clients {
+		b := abuseBlock{}
+		ok, err := getJSON(ctx, d.state, abuseBlockKey(client), &b)
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		if !ok {
+			if err := d.state.hdel(ctx, abuseBlocksKey, client); err != nil {
+				stateError(w, err)
+				return
+			}
+			continue
+		}
+		if b.State != "" && now.Before(b.Until) {
+			blocks = append(blocks, b)
+		}
+	}
+	slices.SortFunc(blocks, func(a, b abuseBlock) int { return b.Since.Compare(a.Since) })
+	writeJSON(w, http.StatusOK, map[string]any{"blocks": blocks})
+}
+
+// liftHandler lifts the block of the client an address belongs to and
+// forgets its history, so its next offence starts again from throttling.
+func (d *abuseDetector) liftHandler(w http.ResponseWriter, r *http.Request, rl role) {
+	addr, err := netip.ParseAddr(r.PathValue("address"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid address")
+		return
+	}
+	ctx := r.Context()
+	client := clientGroup(addr)
+	b, err := d.block(ctx, client)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if b.State == "" || !time.Now().Before(b.Until) {
+		writeError(w, http.StatusNotFound, "address is not blocked")
+		return
+	}
+	if err := d.state.del(ctx, abuseBlockKey(client)); err != nil {
+		stateError(w, err)
+		return
+	}
+	if err := d.state.hdel(ctx, abuseBlocksKey, client); err != nil {
+		stateError(w, err)
+		return
+	}
+	d.mu.Lock()
+	delete(d.clients, client)
+	d.mu.Unlock()
+	d.audit.record("staff:"+rl.String(), "abuse.lift", client, map[string]any{"state": b.State, "reason": b.Reason})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const browserAgent = "Mozilla/5.0 (X11; Linux x86_64) Firefox/130.0"
+
+var testClient = netip.MustParseAddr("192.0.2.7")
+
+func newTestDetector(rate int) *abuseDetector {
+	return newTestDetectorWith(newMemoryState(), rate)
+}
+
+// newTestDetectorWith returns a detector sharing state with any others made
+// from the same state, like replicas.
+func newTestDetectorWith(state stateStore, rate int) *abuseDetector {
+	audit, _ := newAuditLog("")
+	return &abuseDetector{rate: rate, staff: &staffAuth{}, audit: audit, state: state, clients: make(map[string]*clientBehaviour)}
+}
+
+func abuseRequest(path, agent string) *http.Request {
+	return abuseRequestFrom(testClient, path, agent)
+}
+
+func abuseRequestFrom(addr netip.Addr, path, agent string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("User-Agent", agent)
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, addr))
+}
+
+// flood sends n requests for path at now and returns the state after the
+// last one.
+func flood(t *testing.T, d *abuseDetector, n int, path, agent string, now time.Time) (string, time.Time) {
+	t.Helper()
+	return floodFrom(t, d, testClient, n, path, agent, now)
+}
+
+func floodFrom(t *testing.T, d *abuseDetector, addr netip.Addr, n int, path, agent string, now time.Time) (string, time.Time) {
+	t.Helper()
+	var state string
+	var until time.Time
+	for i := 0; i < n; i++ {
+		var err error
+		if state, until, err = d.observe(abuseRequestFrom(addr, path, agent), addr, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return state, until
+}
+
+// reasonOf returns why the test client was last blocked.
+func reasonOf(t *testing.T, d *abuseDetector) string {
+	t.Helper()
+	b, err := d.block(context.Background(), clientGroup(testClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Reason
+}
+
+func TestAbuseRateEscalates(t *testing.T) {
+	d := newTestDetector(40)
+	detections := 0
+	d.onDetection = func(netip.Addr) { detections++ }
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	if state, until := flood(t, d, 40, "/v1/quotes", browserAgent, now); state != "" || !until.IsZero() {
+		t.Fatalf("state after 40 requests = %q until %v, want none", state, until)
+	}
+	// The request over the rate throttles the client, and requests over a
+	// quarter of the rate are refused for the rest of the window.
+	state, until := flood(t, d, 1, "/v1/quotes", browserAgent, now)
+	if state != abuseStateThrottle || !until.Equal(now.Add(abuseWindow)) {
+		t.Fatalf("state after 41 requests = %q until %v, want throttled until the window ends", state, until)
+	}
+
+	// In the next window a throttled client gets a quarter of the rate.
+	now = now.Add(abuseWindow)
+	if _, until := flood(t, d, 10, "/v1/quotes", browserAgent, now); !until.IsZero() {
+		t.Errorf("throttled client refused within its reduced rate")
+	}
+	if state, until := flood(t, d, 1, "/v1/quotes", browserAgent, now); state != abuseStateThrottle || until.IsZero() {
+		t.Errorf("state over the reduced rate = %q until %v, want throttled and refused", state, until)
+	}
+
+	// Another detection while throttled bans, and bans double.
+	now = now.Add(abuseWindow)
+	state, until = flood(t, d, 41, "/v1/quotes", browserAgent, now)
+	if state != abuseStateBan || !until.Equal(now.Add(firstBan)) {
+		t.Fatalf("state after a second detection = %q until %v, want banned for %v", state, until, firstBan)
+	}
+	if state, _ := flood(t, d, 1, "/", browserAgent, now.Add(firstBan-time.Second)); state != abuseStateBan {
+		t.Errorf("state during the ban = %q, want banned", state)
+	}
+	now = now.Add(firstBan + time.Second)
+	flood(t, d, 41, "/v1/quotes", browserAgent, now) // throttled again
+	now = now.Add(abuseWindow)
+	if state, until := flood(t, d, 41, "/v1/quotes", browserAgent, now); state != abuseStateBan || !until.Equal(now.Add(2*firstBan)) {
+		t.Errorf("second ban = %q until %v, want banned for %v", state, until, 2*firstBan)
+	}
+	if detections != 4 {
+		t.Errorf("onDetection called %d times, want 4", detections)
+	}
+}
+
+func TestAbuseBanIsCapped(t *testing.T) {
+	d := newTestDetector(40)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	b, err := d.detect(context.Background(), abuseBlock{Address: testClient.String(), State: abuseStateThrottle, Bans: 20}, testClient, "rate", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.State != abuseStateBan || !b.Until.Equal(now.Add(maxBan)) {
+		t.Errorf("ban after many = %q until %v, want %v", b.State, b.Until, maxBan)
+	}
+}
+
+func TestAbuseSuspiciousAgentGetsLowerRate(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, agent := range []string{"", "curl/8.5.0", "python-requests/2.31", "Scrapy/2.11"} {
+		d := newTestDetector(40)
+		if state, _ := flood(t, d, 10, "/v1/quotes", agent, now); state != "" {
+			t.Errorf("%q: state after 10 requests = %q, want none", agent, state)
+		}
+		if state, _ := flood(t, d, 1, "/v1/quotes", agent, now); state != abuseStateThrottle {
+			t.Errorf("%q: state after 11 requests = %q, want throttled", agent, state)
+		}
+		if reason := reasonOf(t, d); reason != "user_agent" {
+			t.Errorf("%q: reason = %q, want user_agent", agent, reason)
+		}
+	}
+}
+
+func TestAbuseEnumeration(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		ids  func(i int) int
+		want string
+	}{
+		{"ascending", func(i int) int { return i + 1 }, abuseStateThrottle},
+		{"descending", func(i int) int { return 1000 - i }, abuseStateThrottle},
+		{"shuffled", func(i int) int { return (i * 37) % 101 }, abuseStateThrottle},
+		{"every other", func(i int) int { return 2 * i }, abuseStateThrottle},
+		{"a few favourites", func(i int) int { return i % 5 }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDetector(1000)
+			var state string
+			for i := 0; i < enumerationIDs; i++ {
+				state, _ = flood(t, d, 1, "/v1/quotes/"+strconv.Itoa(tt.ids(i)), browserAgent, now)
+			}
+			if state != tt.want {
+				t.Errorf("state after %d requests = %q, want %q", enumerationIDs, state, tt.want)
+			}
+			if reason := reasonOf(t, d); tt.want != "" && reason != "enumeration" {
+				t.Errorf("reason = %q, want enumeration", reason)
+			}
+		})
+	}
+
+	// Distinct IDs are counted per window.
+	d := newTestDetector(1000)
+	for i := 0; i < enumerationIDs; i++ {
+		at := now.Add(time.Duration(i) * 3 * time.Second)
+		if state, _ := flood(t, d, 1, "/v1/quotes/"+strconv.Itoa(i), browserAgent, at); state != "" {
+			t.Fatalf("state after %d IDs over %v = %q, want none", i+1, time.Duration(i)*3*time.Second, state)
+		}
+	}
+}
+
+func TestAbuseWrapSkipsOnlyValidKeys(t *testing.T) {
+	keys := newAPIKeys(newMemoryState())
+	_, secret, err := keys.create(context.Background(), "u_test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDetector(4)
+	d.staff = &staffAuth{tokens: map[string]role{"staff-token": roleAdmin}}
+	d.keys = keys
+	h := d.wrap(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+
+	send := func(header, value string) int {
+		r := abuseRequest("/v1/quotes", browserAgent)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	for i := 0; i < 10; i++ {
+		if code := send(apiKeyHeader, secret); code != http.StatusOK {
+			t.Fatalf("request %d with a valid key got %d, want 200", i+1, code)
+		}
+	}
+	if _, watched := d.clients[clientGroup(testClient)]; watched {
+		t.Error("requests with a valid key were watched")
+	}
+	for i := 0; i < 10; i++ {
+		if code := send("Authorization", "Bearer staff-token"); code != http.StatusOK {
+			t.Fatalf("staff request %d got %d, want 200", i+1, code)
+		}
+	}
+
+	// A made-up key is no way around detection.
+	codes := make(map[int]int)
+	for i := 0; i < 10; i++ {
+		codes[send(apiKeyHeader, apiKeyPrefix+"garbage")]++
+	}
+	if codes[http.StatusTooManyRequests] == 0 {
+		t.Errorf("requests with an invalid key got %v, want some refused with 429", codes)
+	}
+}
+
+func TestAbuseBlocksAreShared(t *testing.T) {
+	state := newMemoryState()
+	a, b := newTestDetectorWith(state, 4), newTestDetectorWith(state, 4)
+	staff := &staffAuth{tokens: map[string]role{"adm": roleAdmin}}
+	mux := http.NewServeMux()
+	b.routes(mux, staff)
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer adm")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	now := time.Now()
+
+	// A client throttled by one replica is throttled by the other, and
+	// banned there for its next offence.
+	if state, _ := flood(t, a, 5, "/v1/quotes", browserAgent, now); state != abuseStateThrottle {
+		t.Fatalf("state on a = %q, want throttled", state)
+	}
+	if state, until := flood(t, b, 5, "/v1/quotes", browserAgent, now); state != abuseStateBan || until.IsZero() {
+		t.Fatalf("state on b = %q until %v, want banned", state, until)
+	}
+	if state, _ := flood(t, a, 1, "/", browserAgent, now); state != abuseStateBan {
+		t.Errorf("state on a after b banned = %q, want banned", state)
+	}
+
+	// Either replica lists and lifts it.
+	w := admin(http.MethodGet, "/v1/admin/blocks")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"address":"192.0.2.7"`) {
+		t.Fatalf("listing blocks = %d %s, want the client", w.Code, w.Body)
+	}
+	if w := admin(http.MethodDelete, "/v1/admin/blocks/192.0.2.7"); w.Code != http.StatusNoContent {
+		t.Fatalf("lifting = %d %s, want 204", w.Code, w.Body)
+	}
+	if state, until := flood(t, a, 1, "/", browserAgent, now.Add(abuseWindow)); state != "" || !until.IsZero() {
+		t.Errorf("state on a after the lift = %q until %v, want none", state, until)
+	}
+	if w := admin(http.MethodGet, "/v1/admin/blocks"); strings.Contains(w.Body.String(), "192.0.2.7") {
+		t.Errorf("listing after the lift = %s, want no blocks", w.Body)
+	}
+	if w := admin(http.MethodDelete, "/v1/admin/blocks/192.0.2.7"); w.Code != http.StatusNotFound {
+		t.Errorf("lifting again = %d, want 404", w.Code)
+	}
+}
+
+func TestAbuseGroupsIPv6By64(t *testing.T) {
+	d := newTestDetector(4)
+	mux := http.NewServeMux()
+	d.routes(mux, &staffAuth{tokens: map[string]role{"adm": roleAdmin}})
+	now := time.Now()
+
+	// Rotating through the addresses of a /64 does not spread the rate.
+	var state string
+	for i := 1; i <= 5; i++ {
+		state, _ = floodFrom(t, d, netip.MustParseAddr("2001:db8:1:2::"+strconv.Itoa(i)), 1, "/v1/quotes", browserAgent, now)
+	}
+	if state != abuseStateThrottle {
+		t.Fatalf("state after 5 requests from one /64 = %q, want throttled", state)
+	}
+	if state, _ := floodFrom(t, d, netip.MustParseAddr("2001:db8:1:3::1"), 1, "/v1/quotes", browserAgent, now); state != "" {
+		t.Errorf("state of another /64 = %q, want none", state)
+	}
+
+	// Any address in the /64 lifts its block.
+	r := httptest.NewRequest(http.MethodDelete, "/v1/admin/blocks/2001:db8:1:2:ffff::9", nil)
+	r.Header.Set("Authorization", "Bearer adm")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("lifting by another address in the /64 = %d %s, want 204", w.Code, w.Body)
+	}
+}
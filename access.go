@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"gopkg.in/yaml.v3"
+)
+
+// accessGroup applies address and country rules to the requests whose path
+// starts with one of its prefixes.
+type accessGroup struct {
+	Name           string   `yaml:"name"`
+	Paths          []string `yaml:"paths"`
+	Allow          []string `yaml:"allow"`
+	Deny           []string `yaml:"deny"`
+	AllowCountries []string `yaml:"allow_countries"`
+	DenyCountries  []string `yaml:"deny_countries"`
+
+	allow, deny []netip.Prefix
+}
+
+// accessRules is the ACCESS_RULES file.
+type accessRules struct {
+	GeoIPDB string        `yaml:"geoip_db"`
+	Groups  []accessGroup `yaml:"groups"`
+}
+
+// access enforces the rules of the group each request falls into.
+type access struct {
+	groups  []accessGroup
+	geo     *geoIP // nil without a database
+	blocked *counterVec
+}
+
+// loadAccess reads the rules from path. Groups are matched by their longest
+// path prefix, so "/v1/admin/" can be stricter than "/".
+func loadAccess(path string) (*access, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules accessRules
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	a := &access{
+		blocked: newCounterVec("quote_access_blocked_total", "Requests refused by access rules, by group and reason.", "group", "reason"),
+	}
+	needsGeo := false
+	for _, g := range rules.Groups {
+		if g.Name == "" || len(g.Paths) == 0 {
+			return nil, fmt.Errorf("%s: every group needs a name and paths", path)
+		}
+		for _, list := range []struct {
+			in  []string
+			out *[]netip.Prefix
+		}{{g.Allow, &g.allow}, {g.Deny, &g.deny}} {
+			for _, s := range list.in {
+				p, err := parsePrefix(s)
+				if err != nil {
+					return nil, fmt.Errorf("%s: group %s: %w", path, g.Name, err)
+				}
+				*list.out = append(*list.out, p)
+			}
+		}
+		for i, c := range g.AllowCountries {
+			g.AllowCountries[i] = strings.ToUpper(c)
+		}
+		for i, c := range g.DenyCountries {
+			g.DenyCountries[i] = strings.ToUpper(c)
+		}
+		needsGeo = needsGeo || len(g.AllowCountries) > 0 || len(g.DenyCountries) > 0
+		a.groups = append(a.groups, g)
+	}
+	if needsGeo && rules.GeoIPDB == "" {
+		return nil, fmt.Errorf("%s: country rules need geoip_db", path)
+	}
+	if rules.GeoIPDB != "" {
+		if a.geo, err = openGeoIP(rules.GeoIPDB); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// group returns the group for path, or nil if no group covers it.
+func (a *access) group(path string) *accessGroup {
+	var best *accessGroup
+	bestLen := -1
+	for i := range a.groups {
+		for _, p := range a.groups[i].Paths {
+			if strings.HasPrefix(path, p) && len(p) > bestLen {
+				best, bestLen = &a.groups[i], len(p)
+			}
+		}
+	}
+	return best
+}
+
+// check returns the reason ip may not reach g, or "" if it may. Country
+// rules answer with 451 so clients can tell legal blocks from others.
+func (a *access) check(g *accessGroup, ip netip.Addr) (reason string, status int) {
+	if containsAddr(g.deny, ip) {
+		return "ip_denied", http.StatusForbidden
+	}
+	if len(g.allow) > 0 && !containsAddr(g.allow, ip) {
+		return "ip_not_allowed", http.StatusForbidden
+	}
+	if len(g.AllowCountries) == 0 && len(g.DenyCountries) == 0 {
+		return "", 0
+	}
+	country := a.geo.country(ip)
+	if slices.Contains(g.DenyCountries, country) {
+		return "country_denied", http.StatusUnavailableForLegalReasons
+	}
+	if len(g.AllowCountries) > 0 && !slices.Contains(g.AllowCountries, country) {
+		return "country_not_allowed", http.StatusUnavailableForLegalReasons
+	}
+	return "", 0
+}
+
+// wrap refuses requests the rules do not let through. It must run inside
+// realIP. A nil access lets everything through.
+func (a *access) wrap(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g := a.group(r.URL.Path)
+		if g == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if reason, status := a.check(g, clientIP(r)); reason != "" {
+			a.blocked.inc(g.Name, reason)
+			if status == http.StatusUnavailableForLegalReasons {
+				writeError(w, status, "not available in your region")
+			} else {
+				writeError(w, status, "access denied")
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// geoIP looks up countries in a MaxMind-format database, such as
+// GeoLite2-Country, reopening it when the file is replaced.
+type geoIP struct {
+	path string
+
+	mu      sync.RWMutex
+	db      *maxminddb.Reader
+	modTime time.Time
+}
+
+func openGeoIP(path string) (*geoIP, error) {
+	g := &geoIP{path: path}
+	if err := g.reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *geoIP) reload() error {
+	info, err := os.Stat(g.path)
+	if err != nil {
+		return err
+	}
+	g.mu.RLock()
+	unchanged := info.ModTime().Equal(g.modTime)
+	g.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	db, err := maxminddb.Open(g.path)
+	if err != nil {
+		return fmt.Errorf("opening GeoIP database: %w", err)
+	}
+	g.mu.Lock()
+	old := g.db
+	g.db, g.modTime = db, info.ModTime()
+	g.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	log.Printf("access: loaded GeoIP database %s (%s, built %s)", g.path, db.Metadata.DatabaseType,
+		time.Unix(int64(db.Metadata.BuildEpoch), 0).UTC().Format(time.DateOnly))
+	return nil
+}
+
+// watch reopens the database when the file changes, until ctx is done.
+func (g *geoIP) watch(ctx context.Context, interval time.Duration) {
+	if g == nil {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := g.reload(); err != nil {
+				log.Printf("access: %v; keeping the loaded database", err)
+			}
+		}
+	}
+}
+
+// country returns the ISO 3166-1 alpha-2 code for ip, or "" if unknown.
+func (g *geoIP) country(ip netip.Addr) string {
+	if g == nil || !ip.IsValid() {
+		return ""
+	}
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if err := g.db.Lookup(ip.AsSlice(), &rec); err != nil {
+		return ""
+	}
+	return rec.Country.ISOCode
+}
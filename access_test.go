@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeGeoIP writes a minimal IPv4 MaxMind DB mapping each prefix to a
+// country code, laid out as the MaxMind DB format specification describes,
+// and returns its path.
+func writeGeoIP(t *testing.T, countries map[string]string) string {
+	t.Helper()
+	type record struct{ node, data int } // data is an offset into the data section plus one
+	nodes := make([][2]record, 1)
+	var data []byte
+	for prefix, code := range countries {
+		offset := len(data)
+		data = append(data, 7<<5|1)
+		data = append(data, mmdbString("country")...)
+		data = append(data, 7<<5|1)
+		data = append(data, mmdbString("iso_code")...)
+		data = append(data, mmdbString(code)...)
+
+		p := netip.MustParsePrefix(prefix)
+		ip := p.Addr().As4()
+		for i, n := 0, 0; i < p.Bits(); i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == p.Bits()-1 {
+				nodes[n][bit] = record{data: offset + 1}
+				break
+			}
+			if nodes[n][bit].node == 0 {
+				nodes = append(nodes, [2]record{})
+				nodes[n][bit].node = len(nodes) - 1
+			}
+			n = nodes[n][bit].node
+		}
+	}
+
+	// 24-bit records: a node number, the node count for no data, or a
+	// pointer past the 16-byte separator into the data section.
+	var db []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			v := len(nodes)
+			switch {
+			case r.node != 0:
+				v = r.node
+			case r.data != 0:
+				v = len(nodes) + 16 + r.data - 1
+			}
+			db = append(db, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	db = append(db, 7<<5|6)
+	for _, field := range [][2][]byte{
+		{mmdbString("node_count"), {6<<5 | 4, 0, 0, byte(len(nodes) >> 8), byte(len(nodes))}},
+		{mmdbString("record_size"), {5<<5 | 2, 0, 24}},
+		{mmdbString("ip_version"), {5<<5 | 2, 0, 4}},
+		{mmdbString("database_type"), mmdbString("Test-Country")},
+		{mmdbString("binary_format_major_version"), {5<<5 | 2, 0, 2}},
+		{mmdbString("binary_format_minor_version"), {5<<5 | 2, 0, 0}},
+	} {
+		db = append(db, field[0]...)
+		db = append(db, field[1]...)
+	}
+
+	path := filepath.Join(t.TempDir(), "countries.mmdb")
+	if err := os.WriteFile(path, db, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mmdbString encodes a string shorter than 29 bytes.
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func writeAccessRules(t *testing.T, rules string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "access.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAccessGroupLongestPrefix(t *testing.T) {
+	a, err := loadAccess(writeAccessRules(t, `
+groups:
+  - name: api
+    paths: [/v1/]
+  - name: admin
+    paths: [/v1/admin/, /metrics]
+  - name: public
+    paths: [/]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"/v1/admin/usage": "admin",
+		"/v1/admin":       "api",
+		"/v1/quotes":      "api",
+		"/metrics":        "admin",
+		"/portal/":        "public",
+	} {
+		if g := a.group(path); g == nil || g.Name != want {
+			t.Errorf("group(%s) = %v, want %s", path, g, want)
+		}
+	}
+
+	a, err = loadAccess(writeAccessRules(t, "groups:\n  - name: admin\n    paths: [/v1/admin/]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := a.group("/v1/quotes"); g != nil {
+		t.Errorf("group(/v1/quotes) = %s, want none", g.Name)
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	geo := writeGeoIP(t, map[string]string{
+		"198.51.100.0/24":  "DE",
+		"203.0.113.0/25":   "US",
+		"203.0.113.128/25": "KP",
+	})
+	a, err := loadAccess(writeAccessRules(t, `
+geoip_db: `+geo+`
+groups:
+  - name: admin
+    paths: [/v1/admin/]
+    allow: [10.0.0.0/8, 198.51.100.7]
+  - name: quotes
+    paths: [/v1/quotes]
+    deny: [198.51.100.66]
+    allow_countries: [de, us]
+  - name: public
+    paths: [/]
+    deny_countries: [kp]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := (&realIP{}).wrap(a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	tests := []struct {
+		path, ip string
+		want     int
+	}{
+		{"/v1/admin/keys", "10.1.2.3", http.StatusOK},
+		{"/v1/admin/keys", "198.51.100.7", http.StatusOK},
+		{"/v1/admin/keys", "198.51.100.8", http.StatusForbidden},
+		{"/v1/quotes", "198.51.100.8", http.StatusOK},
+		{"/v1/quotes", "203.0.113.1", http.StatusOK},
+		{"/v1/quotes", "198.51.100.66", http.StatusForbidden}, // denied even in an allowed country
+		{"/v1/quotes", "203.0.113.200", http.StatusUnavailableForLegalReasons},
+		{"/v1/quotes", "192.0.2.1", http.StatusUnavailableForLegalReasons}, // unknown country
+		{"/", "192.0.2.1", http.StatusOK},
+		{"/", "203.0.113.200", http.StatusUnavailableForLegalReasons},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.RemoteAddr = tt.ip + ":1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("GET %s from %s = %d, want %d", tt.path, tt.ip, w.Code, tt.want)
+		}
+		if w.Code == http.StatusUnavailableForLegalReasons && !strings.Contains(w.Body.String(), "region") {
+			t.Errorf("GET %s from %s = %s, want a regional refusal", tt.path, tt.ip, w.Body)
+		}
+	}
+}
+
+func TestLoadAccessErrors(t *testing.T) {
+	for name, rules := range map[string]string{
+		"unknown field":          "groups:\n  - name: a\n    paths: [/]\n    alow: [10.0.0.1]\n",
+		"no paths":               "groups:\n  - name: a\n",
+		"bad range":              "groups:\n  - name: a\n    paths: [/]\n    deny: [10.0.0.0/40]\n",
+		"countries without a db": "groups:\n  - name: a\n    paths: [/]\n    deny_countries: [KP]\n",
+		"missing db":             "geoip_db: /nonexistent.mmdb\ngroups: []\n",
+	} {
+		if _, err := loadAccess(writeAccessRules(t, rules)); err == nil {
+			t.Errorf("loadAccess() accepted rules with %s", name)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// plan is a tier of access to the public API. A quota of zero means
+// unlimited. Developers can switch to the default plan themselves and buy
+// plans with Checkout set; otherwise plans are set by the billing system
+// or by an admin.
+type plan struct {
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	DailyQuota   int64  `json:"daily_quota"`
+	MonthlyQuota int64  `json:"monthly_quota"`
+	Checkout     bool   `json:"checkout"`
+}
+
+var plans = []plan{
+	{Name: "free", Description: "For trying things out and hobby projects.", DailyQuota: 1_000, MonthlyQuota: 20_000},
+	{Name: "pro", Description: "For apps in production.", DailyQuota: 50_000, MonthlyQuota: 1_000_000, Checkout: true},
+	{Name: "enterprise", Description: "No quotas. Talk to us about terms.", DailyQuota: 0, MonthlyQuota: 0},
+}
+
+const defaultPlan = "free"
+
+func planByName(name string) (plan, bool) {
+	for _, p := range plans {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return plan{}, false
+}
+
+const (
+	apiKeyHeader    = "X-API-Key"
+	apiKeyPrefix    = "qk_"
+	maxKeysPerOwner = 10
+	// rotationGrace is how long a rotated key's old secret keeps working,
+	// so deployments can switch over without downtime.
+	rotationGrace = 24 * time.Hour
+	// lastUsedInterval is how often a key's last use is written back, so a
+	// busy key does not cost a write on every request.
+	lastUsedInterval = time.Minute
+)
+
+var (
+	errKeyNotFound = errors.New("API key not found")
+	errTooManyKeys = errors.New("key limit reached; revoke an unused key first")
+)
+
+// apiKey identifies a developer's app on the public API. The secret is
+// shown once at creation or rotation; only its hash is kept.
+type apiKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	CreatedAt time.Time  `json:"created_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+
+	owner string
+}
+
+// storedKey is a key as kept in shared state.
+type storedKey struct {
+	apiKey
+	Owner      string    `json:"owner"`
+	Hash       string    `json:"hash"`
+	OldHash    string    `json:"old_hash,omitempty"` // previous secret during the rotation grace period
+	OldExpires time.Time `json:"old_expires"`
+}
+
+// secretKeys returns the state keys that map the key's secrets to it.
+func (key *storedKey) secretKeys() []string {
+	keys := []string{apiKeySecretKey(key.Hash)}
+	if key.OldHash != "" {
+		keys = append(keys, apiKeySecretKey(key.OldHash))
+	}
+	return keys
+}
+
+// apiKeys issues and checks API keys and records each developer's plan.
+// Everything is kept in shared state, so every replica sees a new, rotated
+// or revoked key at once:
+//
+//	apikey:<id>            the key, as JSON
+//	apikey:secret:<hash>   the ID of the key with that secret; old secrets expire
+//	apikeys:<owner>        hash of the owner's key IDs
+//	apikeys:used:<id>      when the key was last used
+//	apikeys:plan:<owner>   the owner's plan, if not the default
+type apiKeys struct {
+	state stateStore
+
+	mu      sync.Mutex
+	touched map[string]time.Time // last use written back, by key ID
+}
+
+func newAPIKeys(state stateStore) *apiKeys {
+	return &apiKeys{state: state, touched: make(map[string]time.Time)}
+}
+
+func apiKeyKey(id string) string         { return "apikey:" + id }
+func apiKeySecretKey(hash string) string { return "apikey:secret:" + hash }
+func ownerKeysKey(owner string) string   { return "apikeys:" + owner }
+func apiKeyUsedKey(id string) string     { return "apikeys:used:" + id }
+func planKey(owner string) string        { return "apikeys:plan:" + owner }
+
+// newSecret returns a fresh key secret and the prefix shown in listings.
+func newSecret() (secret, prefix string) {
+	secret = apiKeyPrefix + randomString(32)
+	return secret, secret[:len(apiKeyPrefix)+8]
+}
+
+// get returns the stored key with the given ID.
+func (k *apiKeys) get(ctx context.Context, id string) (*storedKey, bool, error) {
+	data, ok, err := k.state.get(ctx, apiKeyKey(id))
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	key := new(storedKey)
+	if err := json.Unmarshal([]byte(data), key); err != nil {
+		return nil, false, err
+	}
+	key.owner = key.Owner
+	return key, true, nil
+}
+
+func (k *apiKeys) put(ctx context.Context, key *storedKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return k.state.set(ctx, apiKeyKey(key.ID), string(data), 0)
+}
+
+// owned returns owner's key with the given ID, if it is not revoked.
+func (k *apiKeys) owned(ctx context.Context, owner, id string) (*storedKey, error) {
+	key, ok, err := k.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || key.Owner != owner || key.RevokedAt != nil {
+		return nil, errKeyNotFound
+	}
+	return key, nil
+}
+
+// create issues a key for owner and returns it with its secret. Replicas
+// creating keys for the same owner at the same moment may each pass the
+// limit check; the limit is a guard against clutter, not a quota.
+func (k *apiKeys) create(ctx context.Context, owner, name string) (apiKey, string, error) {
+	keys, err := k.list(ctx, owner)
+	if err != nil {
+		return apiKey{}, "", err
+	}
+	active := 0
+	for _, key := range keys {
+		if key.RevokedAt == nil {
+			active++
+		}
+	}
+	if active >= maxKeysPerOwner {
+		return apiKey{}, "", errTooManyKeys
+	}
+	secret, prefix := newSecret()
+	key := &storedKey{
+		apiKey: apiKey{
+			ID:        "k_" + randomString(12),
+			Name:      name,
+			Prefix:    prefix,
+			CreatedAt: time.Now().UTC(),
+			owner:     owner,
+		},
+		Owner: owner,
+		Hash:  hashToken(secret),
+	}
+	if err := k.put(ctx, key); err != nil {
+		return apiKey{}, "", err
+	}
+	if err := k.state.set(ctx, apiKeySecretKey(key.Hash), key.ID, 0); err != nil {
+		return apiKey{}, "", err
+	}
+	if err := k.state.hset(ctx, ownerKeysKey(owner), key.ID, ""); err != nil {
+		return apiKey{}, "", err
+	}
+	return key.apiKey, secret, nil
+}
+
+// rotate gives a key a new secret. The old secret keeps working for
+// rotationGrace.
+func (k *apiKeys) rotate(ctx context.Context, owner, id string) (apiKey, string, error) {
+	key, err := k.owned(ctx, owner, id)
+	if err != nil {
+		return apiKey{}, "", err
+	}
+	if key.OldHash != "" {
+		if err := k.state.del(ctx, apiKeySecretKey(key.OldHash)); err != nil {
+			return apiKey{}, "", err
+		}
+	}
+	secret, prefix := newSecret()
+	now := time.Now().UTC()
+	key.OldHash, key.OldExpires = key.Hash, now.Add(rotationGrace)
+	key.Hash, key.Prefix, key.RotatedAt = hashToken(secret), prefix, &now
+	if err := k.put(ctx, key); err != nil {
+		return apiKey{}, "", err
+	}
+	if err := k.state.set(ctx, apiKeySecretKey(key.Hash), key.ID, 0); err != nil {
+		return apiKey{}, "", err
+	}
+	if err := k.state.set(ctx, apiKeySecretKey(key.OldHash), key.ID, rotationGrace); err != nil {
+		return apiKey{}, "", err
+	}
+	return key.apiKey, secret, nil
+}
+
+// revoke disables a key immediately, including any old secret.
+func (k *apiKeys) revoke(ctx context.Context, owner, id string) error {
+	key, err := k.owned(ctx, owner, id)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	key.RevokedAt = &now
+	// Drop the secrets first, so a failure part way leaves the key unusable.
+	if err := k.state.del(ctx, key.secretKeys()...); err != nil {
+		return err
+	}
+	return k.put(ctx, key)
+}
+
+// list returns owner's keys, newest first, including revoked ones.
+func (k *apiKeys) list(ctx context.Context, owner string) ([]apiKey, error) {
+	ids, err := k.state.hgetAll(ctx, ownerKeysKey(owner))
+	if err != nil {
+		return nil, err
+	}
+	out := []apiKey{}
+	for id := range ids {
+		key, ok, err := k.get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if used, ok, err := k.state.get(ctx, apiKeyUsedKey(id)); err != nil {
+			return nil, err
+		} else if t, perr := time.Parse(time.RFC3339, used); ok && perr == nil {
+			key.LastUsed = &t
+		}
+		out = append(out, key.apiKey)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// lookup returns the live key with the given secret and marks it used.
+func (k *apiKeys) lookup(ctx context.Context, secret string) (apiKey, bool, error) {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return apiKey{}, false, nil
+	}
+	h := hashToken(secret)
+	id, ok, err := k.state.get(ctx, apiKeySecretKey(h))
+	if err != nil || !ok {
+		return apiKey{}, false, err
+	}
+	key, ok, err := k.get(ctx, id)
+	if err != nil || !ok || key.RevokedAt != nil {
+		return apiKey{}, false, err
+	}
+	now := time.Now().UTC()
+	if h != key.Hash && (h != key.OldHash || now.After(key.OldExpires)) {
+		return apiKey{}, false, nil
+	}
+
+	k.mu.Lock()
+	stale := now.Sub(k.touched[id]) >= lastUsedInterval
+	if stale {
+		k.touched[id] = now
+	}
+	k.mu.Unlock()
+	if stale {
+		if err := k.state.set(ctx, apiKeyUsedKey(id), now.Format(time.RFC3339), 0); err != nil {
+			return apiKey{}, false, err
+		}
+	}
+	key.LastUsed = &now
+	return key.apiKey, true, nil
+}
+
+// planOf returns the plan of owner.
+func (k *apiKeys) planOf(ctx context.Context, owner string) (plan, error) {
+	name, _, err := k.state.get(ctx, planKey(owner))
+	if err != nil {
+		return plan{}, err
+	}
+	p, ok := planByName(name)
+	if !ok {
+		p, _ = planByName(defaultPlan)
+	}
+	return p, nil
+}
+
+func (k *apiKeys) setPlan(ctx context.Context, owner string, p plan) error {
+	return k.state.set(ctx, planKey(owner), p.Name, 0)
+}
+
+// middleware checks the API key on requests that carry one, meters them
+// under route patterns from mux and enforces the owner's plan quotas.
+// Keyed responses carry the owner's quota, so shared caches must not store
+// them. Requests to the public API without a key are counted against
+// anonymousPlan by client address; they stay cacheable, so they do not
+// report their standing.
+func (k *apiKeys) middleware(mux *http.ServeMux, m *meter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		now := time.Now()
+		secret := r.Header.Get(apiKeyHeader)
+		if secret == "" {
+			if !meteredRoute(pattern) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			q, window, ok, err := m.take(r.Context(), anonymousOwner(clientIP(r)), "", pattern, anonymousPlan, now)
+			if err != nil {
+				stateError(w, err)
+				return
+			}
+			if !ok {
+				quotaExceeded(w, q, window, now, "requests without an API key are limited; get a free key at /portal/")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, ok, err := k.lookup(r.Context(), secret)
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "invalid or revoked API key")
+			return
+		}
+		w = &privateWriter{ResponseWriter: w}
+		p, err := k.planOf(r.Context(), key.owner)
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		q, window, ok, err := m.take(r.Context(), key.owner, key.ID, pattern, p, now)
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		q.setHeaders(w, now)
+		if !ok {
+			quotaExceeded(w, q, window, now, "the "+p.Name+" plan's "+window+"ly quota is used up; upgrade at /portal/")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// meteredRoute reports whether a route pattern is part of the public quote
+// API, which anonymous requests are metered on. Accounts, the portal and
+// the admin API are not.
+func meteredRoute(pattern string) bool {
+	_, path, _ := strings.Cut(pattern, " ")
+	if path == "" {
+		path = pattern
+	}
+	return path == "/" || strings.HasPrefix(path, "/v1/quotes") || strings.HasPrefix(path, "/v1/export/")
+}
+
+// quotaExceeded rejects a request whose quota window ran out.
+func quotaExceeded(w http.ResponseWriter, q quota, window string, now time.Time, msg string) {
+	reset := q.dayReset
+	if window == "month" {
+		reset = q.monthReset
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+	writeError(w, http.StatusTooManyRequests, msg)
+}
+
+// privateWriter turns whatever caching a handler allowed into no-store
+// when the response starts.
+type privateWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *privateWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		h.Set("Cache-Control", "private, no-store")
+		h.Del("Surrogate-Key")
+		h.Del("Cache-Tag")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *privateWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *privateWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *privateWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (k *apiKeys) exportUser(userID string) (any, error) {
+	ctx := context.Background()
+	keys, err := k.list(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	_, chosen, err := k.state.get(ctx, planKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 && !chosen {
+		return nil, nil
+	}
+	p, err := k.planOf(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"plan": p.Name, "keys": keys}, nil
+}
+
+// eraseUser deletes the user's keys, revoked or not, and their plan.
+func (k *apiKeys) eraseUser(userID string) error {
+	ctx := context.Background()
+	ids, err := k.state.hgetAll(ctx, ownerKeysKey(userID))
+	if err != nil {
+		return err
+	}
+	for id := range ids {
+		key, ok, err := k.get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := k.state.del(ctx, key.secretKeys()...); err != nil {
+				return err
+			}
+		}
+		if err := k.state.del(ctx, apiKeyKey(id), apiKeyUsedKey(id)); err != nil {
+			return err
+		}
+	}
+	return k.state.del(ctx, ownerKeysKey(userID), planKey(userID))
+}
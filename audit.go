@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry records who did what to whom.
+type auditEntry struct {
+	Time    time.Time      `json:"time"`
+	Actor   string         `json:"actor"`
+	Action  string         `json:"action"`
+	Subject string         `json:"subject"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// maxRecentAudit is how many entries are kept in memory for the admin API.
+const maxRecentAudit = 1000
+
+// auditLog appends entries as JSON lines to a file, when one is configured,
+// and keeps the most recent ones in memory.
+type auditLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	recent []auditEntry
+}
+
+// newAuditLog opens path for appending. An empty path keeps entries in
+// memory only.
+func newAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a.file = f
+	return a, nil
+}
+
+func (a *auditLog) record(actor, action, subject string, details map[string]any) {
+	e := auditEntry{Time: time.Now().UTC(), Actor: actor, Action: action, Subject: subject, Details: details}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.recent = append(a.recent, e)
+	if len(a.recent) > maxRecentAudit {
+		a.recent = a.recent[len(a.recent)-maxRecentAudit:]
+	}
+	if a.file == nil {
+		return
+	}
+	line, _ := json.Marshal(e)
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("audit: writing entry: %v", err)
+	}
+}
+
+// listHandler returns recent entries, newest first, optionally only those
+// about ?subject=.
+func (a *auditLog) listHandler(w http.ResponseWriter, r *http.Request, _ role) {
+	subject := r.URL.Query().Get("subject")
+	a.mu.Lock()
+	entries := []auditEntry{}
+	for i := len(a.recent) - 1; i >= 0; i-- {
+		if subject == "" || a.recent[i].Subject == subject {
+			entries = append(entries, a.recent[i])
+		}
+	}
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	minPasswordLen = 10
+	maxPasswordLen = 256
+)
+
+// routes registers the account endpoints. Registering and asking for a
+// password reset send email, and resetting hashes a password, so they all
+// need a solved challenge.
+func (a *accounts) routes(mux *http.ServeMux, ch *challenges) {
+	mux.HandleFunc("POST /v1/auth/register", ch.require("register", a.registerHandler))
+	mux.HandleFunc("GET /v1/auth/verify", a.verifyHandler)
+	mux.HandleFunc("POST /v1/auth/verify", a.verifyHandler)
+	mux.HandleFunc("POST /v1/auth/login", a.loginHandler)
+	mux.HandleFunc("POST /v1/auth/logout", a.requireUser(a.logoutHandler))
+	mux.HandleFunc("POST /v1/auth/password/forgot", ch.require("password-forgot", a.forgotHandler))
+	mux.HandleFunc("POST /v1/auth/password/reset", ch.require("password-reset", a.resetHandler))
+	mux.HandleFunc("GET /v1/auth/me", a.requireUser(a.meHandler))
+	mux.HandleFunc("GET /v1/auth/sessions", a.requireUser(a.sessionsHandler))
+	mux.HandleFunc("DELETE /v1/auth/sessions", a.requireUser(a.revokeOthersHandler))
+	mux.HandleFunc("DELETE /v1/auth/sessions/{id}", a.requireUser(a.revokeHandler))
+}
+
+// requireUser only lets requests through that carry a live session cookie.
+func (a *accounts) requireUser(next func(http.ResponseWriter, *http.Request, user, session)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, s, ok, err := a.current(r)
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "sign in first")
+			return
+		}
+		next(w, r, u, s)
+	}
+}
+
+// normalizeEmail validates a bare address and lowercases it so lookups
+// are case-insensitive.
+func normalizeEmail(s string) (string, bool) {
+	addr, err := netmail.ParseAddress(strings.TrimSpace(s))
+	if err != nil || addr.Name != "" || !strings.Contains(addr.Address, "@") {
+		return "", false
+	}
+	return strings.ToLower(addr.Address), true
+}
+
+func checkPasswordPolicy(w http.ResponseWriter, password string) bool {
+	n := utf8.RuneCountInString(password)
+	if n < minPasswordLen || n > maxPasswordLen {
+		writeError(w, http.StatusBadRequest, "password must be between 10 and 256 characters")
+		return false
+	}
+	return true
+}
+
+type credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// decodeCredentials reads and validates an email/password body.
+func decodeCredentials(w http.ResponseWriter, r *http.Request) (credentials, bool) {
+	var c credentials
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON with email and password")
+		return c, false
+	}
+	email, ok := normalizeEmail(c.Email)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid email address")
+		return c, false
+	}
+	c.Email = email
+	return c, true
+}
+
+func (a *accounts) registerHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := decodeCredentials(w, r)
+	if !ok || !checkPasswordPolicy(w, c.Password) {
+		return
+	}
+	if err := a.register(r.Context(), c.Email, c.Password); err != nil {
+		if errors.Is(err, errMailFailed) {
+			writeError(w, http.StatusBadGateway, "could not send the verification email")
+		} else {
+			stateError(w, err)
+		}
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "check your email to verify the account"})
+}
+
+var verifyPage = template.Must(template.New("verify").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Confirm your email address</title>
+<style nonce="{{.Nonce}}">
+body { font-family: system-ui, sans-serif; max-width: 32rem; margin: 3rem auto; padding: 0 1rem; }
+button { padding: .4rem .9rem; }
+</style>
+</head>
+<body>
+{{if .Email}}<h1>Email address confirmed</h1>
+<p>{{.Email}} is verified. You can <a href="/portal/">sign in</a> now.</p>
+{{else if .Error}}<h1>Could not confirm the address</h1>
+<p>{{.Error}}.</p>
+{{else}}<h1>Confirm your email address</h1>
+<form method="post" action="/v1/auth/verify">
+<input type="hidden" name="token" value="{{.Token}}">
+<button>Confirm</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+type verifyPageData struct {
+	Nonce, Token, Email, Error string
+}
+
+// verifyHandler shows a confirmation form on GET and verifies the address
+// on POST. Only POST uses up the token, so mail scanners that follow the
+// link do not spend it. A form submission gets a page back; API clients
+// posting JSON get the user.
+func (a *accounts) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	page := verifyPageData{Nonce: cspNonce(r)}
+	if r.Method == http.MethodGet {
+		page.Token = r.URL.Query().Get("token")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		verifyPage.Execute(w, page)
+		return
+	}
+
+	form := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+	token := r.URL.Query().Get("token")
+	if token == "" && form {
+		r.Body = http.MaxBytesReader(w, r.Body, 4096)
+		token = r.PostFormValue("token")
+	} else if token == "" {
+		var req struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req)
+		token = req.Token
+	}
+	u, err := a.verify(r.Context(), token)
+	if err != nil && !errors.Is(err, errInvalidToken) {
+		stateError(w, err)
+		return
+	}
+	if !form {
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, u)
+		return
+	}
+	status := http.StatusOK
+	if err != nil {
+		status, page.Error = http.StatusBadRequest, err.Error()
+	} else {
+		page.Email = u.Email
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	verifyPage.Execute(w, page)
+}
+
+func (a *accounts) loginHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := decodeCredentials(w, r)
+	if !ok {
+		return
+	}
+	u, token, err := a.login(r.Context(), c.Email, c.Password, r)
+	switch {
+	case errors.Is(err, errBadLogin):
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	case errors.Is(err, errLocked):
+		w.Header().Set("Retry-After", "900")
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return
+	case errors.Is(err, errUnverified):
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	case errors.Is(err, errBadHash):
+		writeError(w, http.StatusInternalServerError, "login failed")
+		return
+	case err != nil:
+		stateError(w, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(sessionLifetime),
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (a *accounts) logoutHandler(w http.ResponseWriter, r *http.Request, u user, s session) {
+	if _, err := a.revokeSession(r.Context(), u.ID, s.ID); err != nil {
+		stateError(w, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forgotHandler always answers 202 so it cannot be used to find accounts.
+func (a *accounts) forgotHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON with an email")
+		return
+	}
+	if email, ok := normalizeEmail(req.Email); ok {
+		a.forgotPassword(r.Context(), email)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "if the address has an account, a reset email is on its way"})
+}
+
+func (a *accounts) resetHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON with token and password")
+		return
+	}
+	if !checkPasswordPolicy(w, req.Password) {
+		return
+	}
+	if err := a.resetPassword(r.Context(), req.Token, req.Password); errors.Is(err, errInvalidToken) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		stateError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *accounts) meHandler(w http.ResponseWriter, _ *http.Request, u user, _ session) {
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (a *accounts) sessionsHandler(w http.ResponseWriter, r *http.Request, u user, current session) {
+	type entry struct {
+		session
+		Current bool `json:"current"`
+	}
+	sessions, err := a.sessionsOf(r.Context(), u.ID)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	list := []entry{}
+	for _, s := range sessions {
+		list = append(list, entry{s, s.ID == current.ID})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"sessions": list})
+}
+
+func (a *accounts) revokeHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	ok, err := a.revokeSession(r.Context(), u.ID, r.PathValue("id"))
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeOthersHandler signs the user out everywhere except this session.
+func (a *accounts) revokeOthersHandler(w http.ResponseWriter, r *http.Request, u user, s session) {
+	if err := a.revokeSessions(r.Context(), u.ID, s.ID); err != nil {
+		stateError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
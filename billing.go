@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	billingSignatureHeader = "X-Billing-Signature"
+	// billingTolerance is how far a callback's timestamp may be from now.
+	billingTolerance = 5 * time.Minute
+)
+
+// billing changes developers' plans. Developers can switch to the free
+// plan themselves and start buying a paid one at the billing system's
+// checkout; paid plans are set by the billing system once payment is
+// arranged, through a signed callback. Admins can set any plan.
+type billing struct {
+	keys     *apiKeys
+	accounts *accounts
+	staff    *staffAuth
+	audit    *auditLog
+	state    stateStore
+	secret   []byte // nil without BILLING_WEBHOOK_SECRET
+	checkout string // "" without BILLING_CHECKOUT_URL
+}
+
+// billingFromEnv reads the callback secret from BILLING_WEBHOOK_SECRET and
+// the checkout page from BILLING_CHECKOUT_URL. The checkout is only offered
+// when the callback is served, since that is how a purchase takes effect.
+func billingFromEnv(keys *apiKeys, accounts *accounts, staff *staffAuth, audit *auditLog, state stateStore) *billing {
+	b := &billing{keys: keys, accounts: accounts, staff: staff, audit: audit, state: state}
+	if v := os.Getenv("BILLING_WEBHOOK_SECRET"); v != "" {
+		b.secret = []byte(v)
+	}
+	if v := os.Getenv("BILLING_CHECKOUT_URL"); v != "" {
+		if b.secret == nil {
+			log.Println("BILLING_CHECKOUT_URL is set without BILLING_WEBHOOK_SECRET; paid plans cannot be bought in the portal")
+		} else {
+			b.checkout = v
+		}
+	}
+	return b
+}
+
+func (b *billing) routes(mux *http.ServeMux) {
+	mux.HandleFunc("PUT /v1/admin/users/{id}/plan", b.staff.require(roleAdmin, b.adminPlanHandler))
+	mux.HandleFunc("PUT /v1/portal/plan", b.accounts.requireUser(b.portalPlanHandler))
+	if b.secret != nil {
+		mux.HandleFunc("POST /v1/billing/plan", b.callbackHandler)
+	}
+}
+
+type planChange struct {
+	UserID string `json:"user_id"`
+	Plan   string `json:"plan"`
+}
+
+// plan returns the plan a change names, writing an error response and
+// returning false if the user or plan does not exist.
+func (b *billing) plan(w http.ResponseWriter, r *http.Request, c planChange) (plan, bool) {
+	_, ok, err := b.accounts.userByID(r.Context(), c.UserID)
+	if err != nil {
+		stateError(w, err)
+		return plan{}, false
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return plan{}, false
+	}
+	pl, ok := planByName(c.Plan)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "unknown plan")
+		return plan{}, false
+	}
+	return pl, true
+}
+
+// setPlan applies a checked change on behalf of actor.
+func (b *billing) setPlan(w http.ResponseWriter, r *http.Request, actor, userID string, pl plan) {
+	if err := b.keys.setPlan(r.Context(), userID, pl); err != nil {
+		stateError(w, err)
+		return
+	}
+	b.audit.record(actor, "plan.set", userID, map[string]any{"plan": pl.Name})
+	writeJSON(w, http.StatusOK, pl)
+}
+
+// adminPlanHandler serves PUT /v1/admin/users/{id}/plan.
+func (b *billing) adminPlanHandler(w http.ResponseWriter, r *http.Request, rl role) {
+	var req struct {
+		Plan string `json:"plan"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON with a plan")
+		return
+	}
+	id := r.PathValue("id")
+	if pl, ok := b.plan(w, r, planChange{UserID: id, Plan: req.Plan}); ok {
+		b.setPlan(w, r, "staff:"+rl.String(), id, pl)
+	}
+}
+
+// portalPlanHandler serves PUT /v1/portal/plan. Switching to the free plan
+// takes effect at once. A paid plan is answered with 202 and the checkout
+// URL to send the developer to; the plan changes when the billing system
+// calls back.
+func (b *billing) portalPlanHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	var req struct {
+		Plan string `json:"plan"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON with a plan")
+		return
+	}
+	pl, ok := planByName(req.Plan)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "unknown plan")
+		return
+	}
+	switch {
+	case pl.Name == defaultPlan:
+		b.setPlan(w, r, "user:"+u.ID, u.ID, pl)
+	case pl.Checkout && b.checkout != "":
+		checkout, err := url.Parse(b.checkout)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "invalid checkout URL")
+			return
+		}
+		q := checkout.Query()
+		q.Set("user_id", u.ID)
+		q.Set("plan", pl.Name)
+		q.Set("return_url", baseURL()+"/portal/")
+		checkout.RawQuery = q.Encode()
+		writeJSON(w, http.StatusAccepted, map[string]string{"checkout_url": checkout.String()})
+	default:
+		writeError(w, http.StatusForbidden, "the "+pl.Name+" plan is arranged with us directly; contact us to switch")
+	}
+}
+
+// callbackHandler serves POST /v1/billing/plan, which the billing system
+// calls when a subscription starts, changes or ends. The body is signed
+// with the shared secret: the X-Billing-Signature header is
+// "t=<unix time>,v1=<hex HMAC-SHA256 of t.body>". Each signature is
+// accepted once.
+func (b *billing) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "body too large")
+		return
+	}
+	sig, ok := b.verify(r.Header.Get(billingSignatureHeader), body, time.Now())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid or expired billing signature")
+		return
+	}
+	var c planChange
+	if err := json.Unmarshal(body, &c); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON with a user_id and plan")
+		return
+	}
+	pl, ok := b.plan(w, r, c)
+	if !ok {
+		return
+	}
+	fresh, err := b.state.setNX(r.Context(), "billing:seen:"+sig, "1", 2*billingTolerance)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !fresh {
+		writeError(w, http.StatusConflict, "callback already applied")
+		return
+	}
+	b.setPlan(w, r, "billing", c.UserID, pl)
+}
+
+// verify checks a signature header against body and returns its MAC.
+func (b *billing) verify(header string, body []byte, now time.Time) (string, bool) {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > billingTolerance || d < -billingTolerance {
+		return "", false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, b.secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return "", false
+	}
+	return sig, true
+}
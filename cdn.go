@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxQuoteKeys caps the per-quote keys on one response. Larger responses are
+// tagged with the listing key only, which every change purges anyway.
+const maxQuoteKeys = 64
+
+// listingKey tags every response that depends on more than one quote.
+const listingKey = "quotes"
+
+// surrogateKeys returns the cache keys for a quote: its ID, author and tags.
+func surrogateKeys(q Quote) []string {
+	keys := []string{"quote-" + strconv.Itoa(q.ID), "author-" + slug(q.Author)}
+	for _, t := range q.Tags {
+		keys = append(keys, "tag-"+slug(t))
+	}
+	return keys
+}
+
+func slug(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// cdn tags cacheable responses and purges the affected keys when content
+// changes.
+type cdn struct {
+	maxAge time.Duration
+	purger purger // nil disables purging
+
+	purges *counterVec
+	poke   chan struct{}
+}
+
+func newCDN(maxAge time.Duration, p purger) *cdn {
+	return &cdn{
+		maxAge: maxAge,
+		purger: p,
+		purges: newCounterVec("quote_cdn_purges_total", "CDN purge requests by result.", "result"),
+		poke:   make(chan struct{}, 1),
+	}
+}
+
+// cacheable marks a response as cacheable by shared caches and tags it with
+// the keys of the quotes it was built from. list is set for responses that
+// would change if any quote were added or removed. The response varies on
+// the tenant, whose plugins may transform it, and on the API key, so keyed
+// requests always reach the origin to be metered.
+func (c *cdn) cacheable(w http.ResponseWriter, list bool, quotes ...Quote) {
+	var keys []string
+	if list {
+		keys = append(keys, listingKey)
+	}
+	if len(quotes) <= maxQuoteKeys {
+		seen := make(map[string]bool)
+		for _, q := range quotes {
+			for _, k := range surrogateKeys(q) {
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+		}
+	}
+	h := w.Header()
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(c.maxAge.Seconds())))
+	h.Set("Surrogate-Key", strings.Join(keys, " "))
+	h.Set("Cache-Tag", strings.Join(keys, ","))
+	h.Add("Vary", "X-Tenant-ID, "+apiKeyHeader)
+}
+
+// uncacheable keeps shared caches from storing a response, e.g. a random pick.
+func (c *cdn) uncacheable(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// notify asks the watcher to look for changes now rather than at its next tick.
+func (c *cdn) notify() {
+	select {
+	case c.poke <- struct{}{}:
+	default:
+	}
+}
+
+// watch compares the store's visible quotes against the previous view every
+// interval, or sooner when notified, and purges the keys of whatever was
+// added, changed or removed. Polling also catches scheduled quotes going live.
+// The view only moves on once a purge succeeds, so a failed purge is retried
+// at the next tick, together with anything that changed in between.
+func (c *cdn) watch(ctx context.Context, store Store, interval time.Duration) {
+	if c.purger == nil {
+		return
+	}
+	prev := indexQuotes(store.Quotes())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.poke:
+		}
+		cur := indexQuotes(store.Quotes())
+		keys := changedKeys(prev, cur)
+		if len(keys) == 0 {
+			continue
+		}
+		if err := c.purger.Purge(ctx, keys); err != nil {
+			c.purges.inc("error")
+			log.Printf("cdn: purging %d keys: %v", len(keys), err)
+			continue
+		}
+		c.purges.inc("success")
+		prev = cur
+	}
+}
+
+func indexQuotes(quotes []Quote) map[int]Quote {
+	m := make(map[int]Quote, len(quotes))
+	for _, q := range quotes {
+		m[q.ID] = q
+	}
+	return m
+}
+
+// changedKeys returns the keys of every quote that differs between two views,
+// covering both the old and new author and tags, plus the listing key.
+func changedKeys(prev, cur map[int]Quote) []string {
+	set := make(map[string]bool)
+	for id, old := range prev {
+		if q, ok := cur[id]; !ok || !reflect.DeepEqual(q, old) {
+			for _, k := range surrogateKeys(old) {
+				set[k] = true
+			}
+		}
+	}
+	for id, q := range cur {
+		if old, ok := prev[id]; !ok || !reflect.DeepEqual(q, old) {
+			for _, k := range surrogateKeys(q) {
+				set[k] = true
+			}
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	set[listingKey] = true
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// purger invalidates cached responses by surrogate key.
+type purger interface {
+	Purge(ctx context.Context, keys []string) error
+}
+
+// newPurgerFromEnv builds the purger named by CDN_PURGER, or returns nil if
+// it is unset.
+func newPurgerFromEnv() (purger, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch kind := os.Getenv("CDN_PURGER"); kind {
+	case "":
+		return nil, nil
+	case "http":
+		url := os.Getenv("CDN_PURGE_URL")
+		if url == "" {
+			return nil, fmt.Errorf("CDN_PURGE_URL is required for CDN_PURGER=http")
+		}
+		return &httpPurger{url: url, client: client}, nil
+	case "fastly":
+		service, token := os.Getenv("FASTLY_SERVICE_ID"), os.Getenv("FASTLY_API_TOKEN")
+		if service == "" || token == "" {
+			return nil, fmt.Errorf("FASTLY_SERVICE_ID and FASTLY_API_TOKEN are required for CDN_PURGER=fastly")
+		}
+		return &fastlyPurger{baseURL: "https://api.fastly.com", serviceID: service, token: token, client: client}, nil
+	case "record":
+		return &recordingPurger{}, nil
+	case "cloudflare":
+		zone, token := os.Getenv("CLOUDFLARE_ZONE_ID"), os.Getenv("CLOUDFLARE_API_TOKEN")
+		if zone == "" || token == "" {
+			return nil, fmt.Errorf("CLOUDFLARE_ZONE_ID and CLOUDFLARE_API_TOKEN are required for CDN_PURGER=cloudflare")
+		}
+		return &cloudflarePurger{baseURL: "https://api.cloudflare.com/client/v4", zoneID: zone, token: token, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown CDN_PURGER %q", kind)
+	}
+}
+
+// httpPurger sends a PURGE request carrying the keys in a Surrogate-Key
+// header, the convention used by Varnish (xkey) and many reverse proxies.
+type httpPurger struct {
+	url    string
+	client *http.Client
+}
+
+func (p *httpPurger) Purge(ctx context.Context, keys []string) error {
+	req, err := http.NewRequestWithContext(ctx, "PURGE", p.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Surrogate-Key", strings.Join(keys, " "))
+	return doPurge(p.client, req)
+}
+
+// fastlyPurger uses Fastly's batch surrogate key purge.
+type fastlyPurger struct {
+	baseURL, serviceID, token string
+	client                    *http.Client
+}
+
+func (p *fastlyPurger) Purge(ctx context.Context, keys []string) error {
+	return inBatches(keys, 256, func(batch []string) error {
+		req, err := jsonRequest(ctx, p.baseURL+"/service/"+p.serviceID+"/purge", map[string]any{"surrogate_keys": batch})
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Fastly-Key", p.token)
+		return doPurge(p.client, req)
+	})
+}
+
+// cloudflarePurger purges Cloudflare's cache by Cache-Tag.
+type cloudflarePurger struct {
+	baseURL, zoneID, token string
+	client                 *http.Client
+}
+
+func (p *cloudflarePurger) Purge(ctx context.Context, keys []string) error {
+	return inBatches(keys, 30, func(batch []string) error {
+		req, err := jsonRequest(ctx, p.baseURL+"/zones/"+p.zoneID+"/purge_cache", map[string]any{"tags": batch})
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+p.token)
+		return doPurge(p.client, req)
+	})
+}
+
+// recordingPurger remembers and logs every purge instead of sending it, for
+// tests and local development.
+type recordingPurger struct {
+	mu     sync.Mutex
+	purges [][]string
+}
+
+func (p *recordingPurger) Purge(_ context.Context, keys []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.purges = append(p.purges, append([]string(nil), keys...))
+	log.Printf("cdn: purge %s", strings.Join(keys, " "))
+	return nil
+}
+
+// Purges returns the key sets purged so far, oldest first.
+func (p *recordingPurger) Purges() [][]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]string(nil), p.purges...)
+}
+
+func inBatches(keys []string, size int, fn func([]string) error) error {
+	for len(keys) > 0 {
+		n := min(size, len(keys))
+		if err := fn(keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func jsonRequest(ctx context.Context, url string, body any) (*http.Request, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func doPurge(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stepPurger hands each purge to the test, which decides how it ends.
+type stepPurger struct {
+	calls   chan []string
+	results chan error
+}
+
+func (p *stepPurger) Purge(_ context.Context, keys []string) error {
+	p.calls <- keys
+	return <-p.results
+}
+
+func (p *stepPurger) next(t *testing.T) []string {
+	t.Helper()
+	select {
+	case keys := <-p.calls:
+		return keys
+	case <-time.After(5 * time.Second):
+		t.Fatal("no purge")
+		return nil
+	}
+}
+
+// watchedStore tells the test when the watcher has taken its first view.
+type watchedStore struct {
+	*memoryStore
+	viewed chan struct{}
+}
+
+func (s *watchedStore) Quotes() []Quote {
+	defer func() {
+		select {
+		case s.viewed <- struct{}{}:
+		default:
+		}
+	}()
+	return s.memoryStore.Quotes()
+}
+
+func TestCDNWatchRetriesFailedPurges(t *testing.T) {
+	store := &watchedStore{newMemoryStore(quizQuotes), make(chan struct{}, 1)}
+	p := &stepPurger{calls: make(chan []string), results: make(chan error)}
+	c := newCDN(time.Minute, p)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.watch(ctx, store, time.Hour)
+	<-store.viewed
+
+	store.Update(1, func(q *Quote) error { q.Author = "Steven Jobs"; return nil })
+	c.notify()
+	want := []string{"author-steve-jobs", "author-steven-jobs", "quote-1", "quotes", "tag-life"}
+	if keys := p.next(t); !slices.Equal(keys, want) {
+		t.Fatalf("purged %v, want %v", keys, want)
+	}
+	p.results <- errors.New("cdn down")
+
+	// The failed keys are purged again, with what changed since.
+	store.Update(3, func(q *Quote) error { q.Tags = []string{"code"}; return nil })
+	c.notify()
+	want = []string{"author-linus-torvalds", "author-steve-jobs", "author-steven-jobs", "quote-1", "quote-3", "quotes", "tag-code", "tag-life", "tag-software"}
+	if keys := p.next(t); !slices.Equal(keys, want) {
+		t.Fatalf("retry purged %v, want %v", keys, want)
+	}
+	p.results <- nil
+
+	// Once purged, keys are not purged again.
+	c.notify()
+	store.Create(Quote{Text: "Less is more.", Author: "Mies van der Rohe"})
+	c.notify()
+	want = []string{"author-mies-van-der-rohe", "quote-6", "quotes"}
+	if keys := p.next(t); !slices.Equal(keys, want) {
+		t.Fatalf("purged %v after a success, want only the new quote %v", keys, want)
+	}
+	p.results <- nil
+}
+
+func TestCDNCacheable(t *testing.T) {
+	c := newCDN(5*time.Minute, nil)
+	w := httptest.NewRecorder()
+	c.cacheable(w, true, quizQuotes[1], quizQuotes[2])
+	h := w.Header()
+	if got := h.Get("Cache-Control"); got != "public, max-age=300" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	if got, want := h.Get("Surrogate-Key"), "quotes quote-2 author-edsger-dijkstra tag-software quote-3 author-linus-torvalds"; got != want {
+		t.Errorf("Surrogate-Key = %q, want %q", got, want)
+	}
+	if got := h.Get("Cache-Tag"); got != strings.ReplaceAll(h.Get("Surrogate-Key"), " ", ",") {
+		t.Errorf("Cache-Tag = %q, want the surrogate keys", got)
+	}
+	if got := h.Get("Vary"); !strings.Contains(got, "X-Tenant-ID") || !strings.Contains(got, apiKeyHeader) {
+		t.Errorf("Vary = %q, want the tenant and API key", got)
+	}
+
+	// Too many quotes are tagged with the listing key only.
+	many := make([]Quote, maxQuoteKeys+1)
+	for i := range many {
+		many[i] = Quote{ID: i + 1, Author: "A"}
+	}
+	w = httptest.NewRecorder()
+	c.cacheable(w, true, many...)
+	if got := w.Header().Get("Surrogate-Key"); got != listingKey {
+		t.Errorf("Surrogate-Key for %d quotes = %q, want %q", len(many), got, listingKey)
+	}
+}
+
+func TestCDNPurgersBatch(t *testing.T) {
+	var bodies []map[string][]string
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string][]string
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		auth = append(auth, r.Header.Get("Fastly-Key")+r.Header.Get("Authorization"))
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	keys := make([]string, 70)
+	for i := range keys {
+		keys[i] = "k" + string(rune('A'+i%26))
+	}
+
+	cf := &cloudflarePurger{baseURL: srv.URL, zoneID: "z", token: "cf-token", client: srv.Client()}
+	if err := cf.Purge(context.Background(), keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 3 || len(bodies[0]["tags"]) != 30 || len(bodies[2]["tags"]) != 10 || auth[0] != "Bearer cf-token" {
+		t.Errorf("cloudflare sent %d requests, auth %q", len(bodies), auth)
+	}
+
+	bodies, auth = nil, nil
+	fastly := &fastlyPurger{baseURL: srv.URL, serviceID: "s", token: "fastly-token", client: srv.Client()}
+	if err := fastly.Purge(context.Background(), keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 1 || len(bodies[0]["surrogate_keys"]) != 70 || auth[0] != "fastly-token" {
+		t.Errorf("fastly sent %d requests, auth %q", len(bodies), auth)
+	}
+
+	h := &httpPurger{url: srv.URL + "/?fail=1", client: srv.Client()}
+	if err := h.Purge(context.Background(), keys); err == nil {
+		t.Error("Purge() against a failing endpoint = nil, want an error")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	challengeTTL          = 5 * time.Minute
+	challengeWindow       = 10 * time.Minute
+	challengeFreeRequests = 10 // per client per window before difficulty rises
+	maxExtraDifficulty    = 8
+	maxChallengePenalty   = 4
+	challengeHeader       = "X-Proof-Of-Work"
+)
+
+// Actions that need a solved challenge when made anonymously.
+var challengeActions = []string{"register", "password-forgot", "password-reset", "quiz-answer"}
+
+var challengeResults = newCounterVec("quote_challenges_total", "Proof-of-work challenges issued and checked, by action and result.", "action", "result")
+
+// challenges hands out hashcash-style proof-of-work puzzles that anonymous
+// write endpoints require. A challenge is a signed token, so any replica
+// can check a solution, and spent challenges are kept in shared state, so
+// each can be used once across all replicas. Recent activity per client is
+// kept in memory.
+type challenges struct {
+	secret []byte
+	base   int // leading zero bits asked of a well-behaved client
+	state  stateStore
+
+	mu sync.Mutex
+	// clients tracks how hard each address is currently pushing, which
+	// raises the difficulty it is given.
+	clients map[netip.Addr]*challengeActivity
+}
+
+type challengeActivity struct {
+	since    time.Time
+	requests int
+	penalty  int // extra bits from failed or replayed solutions
+}
+
+// challenge is the payload carried inside a challenge token.
+type challenge struct {
+	Action     string `json:"a"`
+	Difficulty int    `json:"d"`
+	Client     string `json:"ip"`
+	Expires    int64  `json:"exp"`
+	Nonce      string `json:"n"`
+}
+
+// challengesFromEnv reads the base difficulty in bits from POW_DIFFICULTY
+// (default 16) and the signing key from POW_SECRET. A difficulty of 0 turns
+// challenges off and returns nil.
+func challengesFromEnv(state stateStore) (*challenges, error) {
+	base := 16
+	if v := os.Getenv("POW_DIFFICULTY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 32 {
+			return nil, fmt.Errorf("invalid POW_DIFFICULTY %q: want 0 to 32 bits", v)
+		}
+		base = n
+	}
+	if base == 0 {
+		return nil, nil
+	}
+	secret := []byte(os.Getenv("POW_SECRET"))
+	if len(secret) == 0 {
+		log.Println("POW_SECRET not set; using a random key, challenges will not work across replicas")
+		secret = []byte(randomString(32))
+	}
+	return &challenges{
+		secret:  secret,
+		base:    base,
+		state:   state,
+		clients: make(map[netip.Addr]*challengeActivity),
+	}, nil
+}
+
+func (c *challenges) routes(mux *http.ServeMux) {
+	if c != nil {
+		mux.HandleFunc("POST /v1/challenges", c.issueHandler)
+	}
+}
+
+// activity returns the record for addr, starting a new window when the old
+// one has run out. The caller must hold c.mu.
+func (c *challenges) activity(addr netip.Addr, now time.Time) *challengeActivity {
+	act, ok := c.clients[addr]
+	if !ok || now.Sub(act.since) > challengeWindow {
+		act = &challengeActivity{since: now}
+		c.clients[addr] = act
+	}
+	return act
+}
+
+// run forgets clients whose window has run out, every interval until ctx
+// is done.
+func (c *challenges) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			c.mu.Lock()
+			for addr, act := range c.clients {
+				if now.Sub(act.since) > challengeWindow {
+					delete(c.clients, addr)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// difficulty is the base plus a bit for each doubling of the client's
+// requests beyond the free allowance, plus any penalty.
+func (c *challenges) difficulty(act *challengeActivity) int {
+	extra := 0
+	if act.requests > challengeFreeRequests {
+		extra = bits.Len(uint(act.requests / challengeFreeRequests))
+	}
+	return min(c.base+min(extra+act.penalty, maxExtraDifficulty), 32)
+}
+
+// penalize raises the difficulty given to addr for the rest of the window.
+func (c *challenges) penalize(addr netip.Addr) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	act := c.activity(addr, time.Now())
+	act.penalty = min(act.penalty+1, maxChallengePenalty)
+}
+
+func (c *challenges) issue(r *http.Request, action string) (map[string]any, error) {
+	addr, now := clientIP(r), time.Now()
+	c.mu.Lock()
+	act := c.activity(addr, now)
+	act.requests++
+	d := c.difficulty(act)
+	c.mu.Unlock()
+
+	expires := now.Add(challengeTTL)
+	token, err := signToken(c.secret, challenge{
+		Action:     action,
+		Difficulty: d,
+		Client:     addr.String(),
+		Expires:    expires.Unix(),
+		Nonce:      randomString(12),
+	})
+	if err != nil {
+		return nil, err
+	}
+	challengeResults.inc(action, "issued")
+	return map[string]any{
+		"challenge":  token,
+		"algorithm":  "sha256",
+		"difficulty": d,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// issueHandler hands out a challenge for the action named in the body.
+func (c *challenges) issueHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Action string `json:"action"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON with an action")
+		return
+	}
+	if !validAction(req.Action) {
+		writeError(w, http.StatusBadRequest, "action must be one of "+strings.Join(challengeActions, ", "))
+		return
+	}
+	ch, err := c.issue(r, req.Action)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "could not create challenge")
+		return
+	}
+	writeJSON(w, http.StatusCreated, ch)
+}
+
+func validAction(action string) bool {
+	for _, a := range challengeActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// leadingZeroBits counts the zero bits at the start of sum.
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// check verifies a "<challenge>:<solution>" proof for action, and marks the
+// challenge spent. It returns the reason a proof is refused, or "".
+func (c *challenges) check(r *http.Request, action, proof string) (string, error) {
+	token, solution, ok := strings.Cut(proof, ":")
+	if !ok || len(solution) > 64 {
+		return "invalid", nil
+	}
+	var ch challenge
+	if err := verifyToken(c.secret, token, &ch); err != nil {
+		return "invalid", nil
+	}
+	now := time.Now()
+	if ch.Action != action || ch.Client != clientIP(r).String() || now.Unix() > ch.Expires {
+		return "invalid", nil
+	}
+	sum := sha256.Sum256([]byte(proof))
+	if leadingZeroBits(sum[:]) < ch.Difficulty {
+		return "invalid", nil
+	}
+	// The mark only has to outlive the challenge.
+	fresh, err := c.state.setNX(r.Context(), "challenge:spent:"+ch.Nonce, "1", time.Unix(ch.Expires, 0).Sub(now)+time.Minute)
+	if err != nil {
+		return "", err
+	}
+	if !fresh {
+		return "replayed", nil
+	}
+	return "", nil
+}
+
+// require only lets requests through that carry a solved challenge for
+// action in the X-Proof-Of-Work header. Others get 428 with a fresh
+// challenge to solve. Bad and replayed proofs count against the client.
+// With challenges off, next is returned as is.
+func (c *challenges) require(action string, next http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		proof := r.Header.Get(challengeHeader)
+		result := "missing"
+		if proof != "" {
+			var err error
+			if result, err = c.check(r, action, proof); err != nil {
+				stateError(w, err)
+				return
+			}
+			if result == "" {
+				challengeResults.inc(action, "solved")
+				next(w, r)
+				return
+			}
+			c.penalize(clientIP(r))
+		}
+		challengeResults.inc(action, result)
+		ch, err := c.issue(r, action)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "could not create challenge")
+			return
+		}
+		msg := "solve the challenge and send it in " + challengeHeader
+		if result != "missing" {
+			msg = "proof of work is " + result
+		}
+		writeJSON(w, http.StatusPreconditionRequired, map[string]any{"error": msg, "challenge": ch})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestChallenges returns challenges that share state and a secret with
+// any others made from the same state, like replicas.
+func newTestChallenges(state stateStore, base int) *challenges {
+	return &challenges{secret: []byte("pow secret"), base: base, state: state, clients: make(map[netip.Addr]*challengeActivity)}
+}
+
+func challengeRequest(addr string, proof string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/v1/auth/register", nil)
+	if proof != "" {
+		r.Header.Set(challengeHeader, proof)
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, netip.MustParseAddr(addr)))
+}
+
+// solve finds a proof for token with at least difficulty leading zero bits.
+func solve(t *testing.T, token string, difficulty int) string {
+	t.Helper()
+	for i := 0; i < 1<<24; i++ {
+		proof := token + ":" + strconv.Itoa(i)
+		sum := sha256.Sum256([]byte(proof))
+		if leadingZeroBits(sum[:]) >= difficulty {
+			return proof
+		}
+	}
+	t.Fatalf("no solution for difficulty %d", difficulty)
+	return ""
+}
+
+func issueFor(t *testing.T, c *challenges, addr, action string) (string, int) {
+	t.Helper()
+	ch, err := c.issue(challengeRequest(addr, ""), action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch["challenge"].(string), ch["difficulty"].(int)
+}
+
+func TestChallengeDifficultyEscalates(t *testing.T) {
+	c := newTestChallenges(newMemoryState(), 8)
+	var got []int
+	for i := 0; i < 8*challengeFreeRequests; i++ {
+		_, d := issueFor(t, c, "192.0.2.1", "register")
+		got = append(got, d)
+	}
+	for i, want := range map[int]int{0: 8, challengeFreeRequests - 1: 8, challengeFreeRequests: 9, 2*challengeFreeRequests - 1: 10, 4*challengeFreeRequests - 1: 11, 8*challengeFreeRequests - 1: 12} {
+		if got[i] != want {
+			t.Errorf("difficulty of request %d = %d, want %d", i+1, got[i], want)
+		}
+	}
+	// Other clients are not affected.
+	if _, d := issueFor(t, c, "192.0.2.2", "register"); d != 8 {
+		t.Errorf("difficulty for another client = %d, want 8", d)
+	}
+
+	// Bad proofs add a penalty, up to a cap, and the total is capped too.
+	for i := 0; i < maxChallengePenalty+2; i++ {
+		c.penalize(netip.MustParseAddr("192.0.2.3"))
+	}
+	if _, d := issueFor(t, c, "192.0.2.3", "register"); d != 8+maxChallengePenalty {
+		t.Errorf("difficulty after penalties = %d, want %d", d, 8+maxChallengePenalty)
+	}
+	for i := 0; i < 1000; i++ {
+		issueFor(t, c, "192.0.2.3", "register")
+	}
+	if _, d := issueFor(t, c, "192.0.2.3", "register"); d != 8+maxExtraDifficulty {
+		t.Errorf("difficulty for a flooding client = %d, want the cap %d", d, 8+maxExtraDifficulty)
+	}
+}
+
+func TestChallengeRequire(t *testing.T) {
+	state := newMemoryState()
+	a, b := newTestChallenges(state, 8), newTestChallenges(state, 8)
+	calls := 0
+	handler := func(c *challenges) http.HandlerFunc {
+		return c.require("register", func(w http.ResponseWriter, _ *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	do := func(c *challenges, addr, proof string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		handler(c)(w, challengeRequest(addr, proof))
+		var body map[string]any
+		json.NewDecoder(w.Body).Decode(&body)
+		return w.Code, body
+	}
+
+	status, body := do(a, "192.0.2.1", "")
+	if status != http.StatusPreconditionRequired || body["challenge"] == nil {
+		t.Fatalf("request without a proof = %d %v, want 428 with a challenge", status, body)
+	}
+	token, d := issueFor(t, a, "192.0.2.1", "register")
+	proof := solve(t, token, d)
+
+	// A challenge issued by one replica is accepted by another, once.
+	if status, _ := do(b, "192.0.2.1", proof); status != http.StatusNoContent {
+		t.Fatalf("solved challenge = %d, want 204", status)
+	}
+	if status, body := do(a, "192.0.2.1", proof); status != http.StatusPreconditionRequired || body["error"] != "proof of work is replayed" {
+		t.Errorf("replayed proof = %d %v, want 428 replayed", status, body)
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+
+	token, d = issueFor(t, a, "192.0.2.1", "register")
+	proof = solve(t, token, d)
+	wrongAction, _ := issueFor(t, a, "192.0.2.1", "quiz-answer")
+	for name, tt := range map[string]struct{ addr, proof string }{
+		"another client": {"192.0.2.9", proof},
+		"another action": {"192.0.2.1", solve(t, wrongAction, d)},
+		"unsolved":       {"192.0.2.1", token + ":x"},
+		"forged token":   {"192.0.2.1", "e30." + proof},
+		"no separator":   {"192.0.2.1", token},
+	} {
+		if status, body := do(a, tt.addr, tt.proof); status != http.StatusPreconditionRequired || body["error"] != "proof of work is invalid" {
+			t.Errorf("%s: %d %v, want 428 invalid", name, status, body)
+		}
+	}
+	// The untouched proof still works after all that.
+	if status, _ := do(a, "192.0.2.1", proof); status != http.StatusNoContent {
+		t.Errorf("solved challenge after failures = %d, want 204", status)
+	}
+}
+
+func TestChallengeExpiry(t *testing.T) {
+	c := newTestChallenges(newMemoryState(), 4)
+	issue := func(expires time.Time) string {
+		token, err := signToken(c.secret, challenge{Action: "register", Difficulty: 4, Client: "192.0.2.1", Expires: expires.Unix(), Nonce: randomString(12)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return solve(t, token, 4)
+	}
+	if result, err := c.check(challengeRequest("192.0.2.1", ""), "register", issue(time.Now().Add(-time.Second))); result != "invalid" || err != nil {
+		t.Errorf("check() of an expired challenge = %q, %v, want invalid", result, err)
+	}
+	if result, err := c.check(challengeRequest("192.0.2.1", ""), "register", issue(time.Now().Add(time.Minute))); result != "" || err != nil {
+		t.Errorf("check() of a live challenge = %q, %v, want it accepted", result, err)
+	}
+
+	// A proof signed with another key is refused.
+	other := newTestChallenges(newMemoryState(), 4)
+	other.secret = []byte("another secret")
+	token, d := issueFor(t, other, "192.0.2.1", "register")
+	if result, _ := c.check(challengeRequest("192.0.2.1", ""), "register", solve(t, token, d)); result != "invalid" {
+		t.Errorf("check() of a challenge signed with another key = %q, want invalid", result)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// realIP works out the address of the client behind any trusted reverse
+// proxies and makes it available to the rest of the chain via clientIP.
+type realIP struct {
+	trusted []netip.Prefix
+}
+
+// realIPFromEnv reads TRUSTED_PROXIES, a comma-separated list of addresses
+// and CIDR ranges whose X-Forwarded-For headers are believed.
+func realIPFromEnv() (*realIP, error) {
+	ri := &realIP{}
+	for _, s := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		ri.trusted = append(ri.trusted, p)
+	}
+	return ri, nil
+}
+
+// parsePrefix accepts a CIDR range or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()), nil
+}
+
+func containsAddr(prefixes []netip.Prefix, a netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the client address for r. X-Forwarded-For is read from
+// the right, skipping trusted proxies, so a client cannot spoof its address
+// by sending the header itself.
+func (ri *realIP) resolve(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+	if !containsAddr(ri.trusted, addr) {
+		return addr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !containsAddr(ri.trusted, addr) {
+			break
+		}
+	}
+	return addr
+}
+
+type clientIPKey struct{}
+
+// clientGroup is how anonymous clients are told apart: by address, or by
+// /64 for IPv6, where one host often has many addresses.
+func clientGroup(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if addr.Is6() {
+		p, _ := addr.Prefix(64)
+		return p.String()
+	}
+	return addr.String()
+}
+
+// clientIP returns the address resolved by realIP, or the zero Addr if it
+// is unknown.
+func clientIP(r *http.Request) netip.Addr {
+	a, _ := r.Context().Value(clientIPKey{}).(netip.Addr)
+	return a
+}
+
+func (ri *realIP) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ri.resolve(r))))
+	})
+}
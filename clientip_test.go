@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRealIPResolve(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1 ,2001:db8::/32")
+	ri, err := realIPFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"untrusted peer", "203.0.113.9:1234", []string{"198.51.100.1"}, "203.0.113.9"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"one proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed hops on the left", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "192.0.2.1:1234", []string{"198.51.100.1, 10.1.1.1, 10.2.2.2"}, "198.51.100.1"},
+		{"several header lines", "10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.1,10.3.3.3"}, "198.51.100.1"},
+		{"every hop trusted", "10.0.0.1:1234", []string{"10.9.9.9, 10.8.8.8"}, "10.9.9.9"},
+		{"malformed hop", "10.0.0.1:1234", []string{"198.51.100.1, unknown"}, "10.0.0.1"},
+		{"IPv6 proxy", "[2001:db8::1]:1234", []string{"2001:db9::7"}, "2001:db9::7"},
+		{"IPv4-mapped peer", "[::ffff:10.0.0.1]:1234", []string{"::ffff:198.51.100.1"}, "198.51.100.1"},
+		{"no port", "203.0.113.9", nil, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := ri.resolve(r); got != netip.MustParseAddr(tt.want) {
+			t.Errorf("%s: resolve() = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "@"
+	if got := ri.resolve(r); got.IsValid() {
+		t.Errorf("resolve() of an unparseable peer = %v, want the zero Addr", got)
+	}
+}
+
+func TestRealIPFromEnvRejectsBadRanges(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,10.0.0.0/33")
+	if _, err := realIPFromEnv(); err == nil {
+		t.Error("realIPFromEnv() accepted an invalid range")
+	}
+}
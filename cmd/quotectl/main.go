@@ -0,0 +1,124 @@
+// Command quotectl runs administrative tasks against a quote API server
+// through its admin API.
+//
+// Usage:
+//
+//	quotectl [-url URL] [-token TOKEN] <command> [arguments]
+//
+// Commands:
+//
+//	find-user <email>        print the account with this email address
+//	export-user <id> [file]  write everything held about a user as JSON
+//	erase-user <id>          erase a user from every subsystem
+//	audit [subject]          print recent audit log entries
+//
+// The token must grant the admin staff role. It defaults to the
+// QUOTECTL_TOKEN environment variable.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8080", "base URL of the quote API")
+	token := flag.String("token", os.Getenv("QUOTECTL_TOKEN"), "admin staff token")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: quotectl [-url URL] [-token TOKEN] find-user <email> | export-user <id> [file] | erase-user <id> | audit [subject]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 || *token == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c := client{base: strings.TrimSuffix(*baseURL, "/"), token: *token}
+
+	var err error
+	switch {
+	case args[0] == "find-user" && len(args) == 2:
+		err = c.print("GET", "/v1/admin/users?email="+url.QueryEscape(args[1]))
+	case args[0] == "export-user" && (len(args) == 2 || len(args) == 3):
+		var body []byte
+		if body, err = c.do("GET", "/v1/admin/users/"+url.PathEscape(args[1])+"/export"); err == nil {
+			if len(args) == 3 {
+				err = os.WriteFile(args[2], body, 0o600)
+			} else {
+				_, err = os.Stdout.Write(body)
+			}
+		}
+	case args[0] == "erase-user" && len(args) == 2:
+		if _, err = c.do("DELETE", "/v1/admin/users/"+url.PathEscape(args[1])); err == nil {
+			fmt.Println("erased", args[1])
+		}
+	case args[0] == "audit" && len(args) <= 2:
+		path := "/v1/admin/audit"
+		if len(args) == 2 {
+			path += "?subject=" + url.QueryEscape(args[1])
+		}
+		err = c.print("GET", path)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type client struct {
+	base, token string
+}
+
+// do sends an authenticated request and returns the body of a successful
+// response.
+func (c client) do(method, path string) ([]byte, error) {
+	req, err := http.NewRequest(method, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("%s %s: %s", method, path, e.Error)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return body, nil
+}
+
+// print sends a request and prints the JSON response indented.
+func (c client) print(method, path string) error {
+	body, err := c.do(method, path)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		return err
+	}
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
@@ -0,0 +1,80 @@
+// Command verify-daily checks that a daily quote was selected fairly.
+//
+// Fetch the inputs from a running server and verify them:
+//
+//	verify-daily -url https://quotes.example.com -date 2026-01-01
+//
+// or verify files saved earlier, without network access:
+//
+//	verify-daily -snapshot snapshot.json -proof proof.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sudlo/quote-api/daily"
+)
+
+func main() {
+	baseURL := flag.String("url", "", "base URL of the quote API to fetch the proof and snapshot from")
+	date := flag.String("date", time.Now().UTC().Format(time.DateOnly), "date to verify when using -url")
+	snapshotFile := flag.String("snapshot", "", "canonical corpus snapshot file")
+	proofFile := flag.String("proof", "", "proof file")
+	flag.Parse()
+
+	var snapshot, proofJSON []byte
+	var err error
+	switch {
+	case *baseURL != "":
+		q := "?date=" + url.QueryEscape(*date)
+		if snapshot, err = fetch(*baseURL + "/v1/quotes/daily/snapshot" + q); err == nil {
+			proofJSON, err = fetch(*baseURL + "/v1/quotes/daily/proof" + q)
+		}
+	case *snapshotFile != "" && *proofFile != "":
+		if snapshot, err = os.ReadFile(*snapshotFile); err == nil {
+			proofJSON, err = os.ReadFile(*proofFile)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var proof daily.Proof
+	if err := json.Unmarshal(proofJSON, &proof); err != nil {
+		fmt.Fprintf(os.Stderr, "decoding proof: %v\n", err)
+		os.Exit(1)
+	}
+	if err := daily.Verify(snapshot, proof); err != nil {
+		fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("OK: quote %d of %d for %s (%q - %s)\ncorpus sha256 %s\ncommitment    %s\n",
+		proof.Index, proof.Count, proof.Date, proof.Quote.Text, proof.Quote.Author, proof.CorpusSHA256, proof.Commitment)
+}
+
+func fetch(u string) ([]byte, error) {
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s: %s", u, resp.Status, body)
+	}
+	return body, nil
+}
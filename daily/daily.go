@@ -0,0 +1,131 @@
+// Package daily derives the quote of the day from public inputs so anyone
+// can check that it follows from a snapshot committed in advance.
+//
+// The inputs are the date and a canonical snapshot of the corpus: a JSON
+// array of {"id", "text", "author"} objects sorted by id, as produced by
+// Canonical. The selection is
+//
+//	corpus_sha256 = SHA-256(snapshot)
+//	commitment    = SHA-256("quote-api/daily/v1\n" + hex(corpus_sha256) + "\n" + date)
+//	index         = commitment, read as a big-endian integer, mod len(snapshot)
+//
+// where date is formatted as YYYY-MM-DD. The server commits to a date's
+// snapshot, publishing its corpus_sha256, before the date begins, and a
+// proof records when in committed_at; a proof whose snapshot was committed
+// after its date began does not verify.
+//
+// The date is the only source of randomness, so the scheme is predictable,
+// not random: once a snapshot is committed anyone can compute the quote of
+// the date ahead of time, and the server, which controls the corpus, could
+// try corpus edits before committing until a date selects the quote it
+// wants. A proof shows only that the selection follows from a snapshot
+// fixed before the date began.
+package daily
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// Version names the selection scheme described in the package comment.
+const Version = "v1"
+
+const domain = "quote-api/daily/" + Version + "\n"
+
+// Entry is a quote as recorded in the snapshot.
+type Entry struct {
+	ID     int    `json:"id"`
+	Text   string `json:"text"`
+	Author string `json:"author"`
+}
+
+// Proof is everything needed to recompute a day's selection, apart from the
+// snapshot itself.
+type Proof struct {
+	Version      string `json:"version"`
+	Date         string `json:"date"`
+	CorpusSHA256 string `json:"corpus_sha256"`
+	Commitment   string `json:"commitment"`
+	Count        int    `json:"count"`
+	Index        int    `json:"index"`
+	Quote        Entry  `json:"quote"`
+	// CommittedAt is when the snapshot was committed, in RFC 3339 format.
+	// Select leaves it empty; the server fills it in.
+	CommittedAt string `json:"committed_at,omitempty"`
+}
+
+// Canonical serialises entries in the canonical snapshot form.
+func Canonical(entries []Entry) []byte {
+	sorted := append([]Entry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	data, _ := json.Marshal(sorted) // Entry always marshals
+	return data
+}
+
+// Select computes the proof for date from a canonical snapshot.
+func Select(snapshot []byte, date string) (Proof, error) {
+	var entries []Entry
+	if err := json.Unmarshal(snapshot, &entries); err != nil {
+		return Proof{}, fmt.Errorf("daily: decoding snapshot: %w", err)
+	}
+	if !bytes.Equal(Canonical(entries), snapshot) {
+		return Proof{}, errors.New("daily: snapshot is not in canonical form")
+	}
+	if len(entries) == 0 {
+		return Proof{}, errors.New("daily: snapshot is empty")
+	}
+
+	corpus := sha256.Sum256(snapshot)
+	commitment := sha256.Sum256([]byte(domain + hex.EncodeToString(corpus[:]) + "\n" + date))
+	index := new(big.Int).Mod(new(big.Int).SetBytes(commitment[:]), big.NewInt(int64(len(entries))))
+
+	return Proof{
+		Version:      Version,
+		Date:         date,
+		CorpusSHA256: hex.EncodeToString(corpus[:]),
+		Commitment:   hex.EncodeToString(commitment[:]),
+		Count:        len(entries),
+		Index:        int(index.Int64()),
+		Quote:        entries[index.Int64()],
+	}, nil
+}
+
+// Verify recomputes the selection from snapshot and checks that it matches
+// every field of p.
+func Verify(snapshot []byte, p Proof) error {
+	if p.Version != Version {
+		return fmt.Errorf("daily: unsupported proof version %q", p.Version)
+	}
+	want, err := Select(snapshot, p.Date)
+	if err != nil {
+		return err
+	}
+	if p.CommittedAt == "" {
+		return errors.New("daily: proof does not say when the snapshot was committed")
+	}
+	committed, err := time.Parse(time.RFC3339, p.CommittedAt)
+	if err != nil {
+		return fmt.Errorf("daily: malformed committed_at: %w", err)
+	}
+	if begins, _ := time.Parse(time.DateOnly, p.Date); !committed.Before(begins) {
+		return fmt.Errorf("daily: snapshot was committed at %s, after %s began", p.CommittedAt, p.Date)
+	}
+	switch {
+	case want.CorpusSHA256 != p.CorpusSHA256:
+		return fmt.Errorf("daily: snapshot hash is %s, proof claims %s", want.CorpusSHA256, p.CorpusSHA256)
+	case want.Commitment != p.Commitment:
+		return fmt.Errorf("daily: commitment is %s, proof claims %s", want.Commitment, p.Commitment)
+	case want.Count != p.Count || want.Index != p.Index:
+		return fmt.Errorf("daily: selection is %d of %d, proof claims %d of %d", want.Index, want.Count, p.Index, p.Count)
+	case want.Quote != p.Quote:
+		return fmt.Errorf("daily: selected quote is %d, proof claims %d", want.Quote.ID, p.Quote.ID)
+	}
+	return nil
+}
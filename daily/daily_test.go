@@ -0,0 +1,119 @@
+package daily
+
+import (
+	"strings"
+	"testing"
+)
+
+var entries = []Entry{
+	{ID: 3, Text: "Simplicity is prerequisite for reliability.", Author: "Edsger W. Dijkstra"},
+	{ID: 1, Text: "Stay hungry, stay foolish.", Author: "Steve Jobs"},
+	{ID: 2, Text: "Talk is cheap. Show me the code.", Author: "Linus Torvalds"},
+}
+
+// The expected values were computed independently of this package, from
+// the scheme in the package comment.
+const (
+	snapshot     = `[{"id":1,"text":"Stay hungry, stay foolish.","author":"Steve Jobs"},{"id":2,"text":"Talk is cheap. Show me the code.","author":"Linus Torvalds"},{"id":3,"text":"Simplicity is prerequisite for reliability.","author":"Edsger W. Dijkstra"}]`
+	corpusSHA256 = "baf4c2e76f606a3ca6870815549927555a1751d893d0381fd2c02069f5a53dd3"
+)
+
+func TestCanonical(t *testing.T) {
+	if got := string(Canonical(entries)); got != snapshot {
+		t.Errorf("Canonical() = %s, want %s", got, snapshot)
+	}
+}
+
+func TestSelectKnownAnswers(t *testing.T) {
+	tests := []struct {
+		date       string
+		commitment string
+		id         int
+	}{
+		{"2026-01-01", "90e5036678d9e55ae4edcb6cda1fb8f2e87d97953e92524612bd796beb45575d", 1},
+		{"2026-01-02", "264ea9a44e84694bb00edef2195bb93cadcc0b3de5a65f13b2dcb0e7776128b0", 3},
+		{"2026-01-03", "2c5e164b75f30979fdeab76474e28857bc92867bc625e8724b0576b05317bc43", 2},
+	}
+	for _, tt := range tests {
+		p, err := Select([]byte(snapshot), tt.date)
+		if err != nil {
+			t.Fatalf("Select(%s): %v", tt.date, err)
+		}
+		want := Proof{
+			Version:      Version,
+			Date:         tt.date,
+			CorpusSHA256: corpusSHA256,
+			Commitment:   tt.commitment,
+			Count:        3,
+			Index:        tt.id - 1,
+		}
+		for _, e := range entries {
+			if e.ID == tt.id {
+				want.Quote = e
+			}
+		}
+		if p != want {
+			t.Errorf("Select(%s) = %+v, want %+v", tt.date, p, want)
+		}
+	}
+}
+
+func TestSelectRejectsNonCanonicalSnapshots(t *testing.T) {
+	for name, snap := range map[string]string{
+		"unsorted":         `[{"id":2,"text":"b","author":"B"},{"id":1,"text":"a","author":"A"}]`,
+		"whitespace":       `[{"id": 1, "text": "a", "author": "A"}]`,
+		"key order":        `[{"text":"a","id":1,"author":"A"}]`,
+		"extra field":      `[{"id":1,"text":"a","author":"A","tags":[]}]`,
+		"trailing newline": snapshot + "\n",
+		"empty":            `[]`,
+		"not JSON":         `[{"id":1`,
+	} {
+		if _, err := Select([]byte(snap), "2026-01-01"); err == nil {
+			t.Errorf("Select() accepted a snapshot with %s", name)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	proof := func() Proof {
+		p, err := Select([]byte(snapshot), "2026-01-02")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.CommittedAt = "2026-01-01T23:00:00Z"
+		return p
+	}
+	if err := Verify([]byte(snapshot), proof()); err != nil {
+		t.Fatalf("Verify() of a valid proof: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Proof)
+		want   string
+	}{
+		{"version", func(p *Proof) { p.Version = "v0" }, "unsupported proof version"},
+		{"no commit time", func(p *Proof) { p.CommittedAt = "" }, "does not say when"},
+		{"malformed commit time", func(p *Proof) { p.CommittedAt = "yesterday" }, "malformed committed_at"},
+		{"committed at midnight", func(p *Proof) { p.CommittedAt = "2026-01-02T00:00:00Z" }, "after 2026-01-02 began"},
+		{"committed during the date", func(p *Proof) { p.CommittedAt = "2026-01-02T09:00:00+01:00" }, "after 2026-01-02 began"},
+		{"corpus hash", func(p *Proof) { p.CorpusSHA256 = strings.Repeat("0", 64) }, "snapshot hash"},
+		{"commitment", func(p *Proof) { p.Commitment = strings.Repeat("0", 64) }, "commitment is"},
+		{"index", func(p *Proof) { p.Index = 0 }, "selection is 2 of 3"},
+		{"quote", func(p *Proof) { p.Quote.Text = "Stay hungry." }, "selected quote"},
+		{"date", func(p *Proof) { p.Date = "2026-01-03" }, "commitment is"},
+	}
+	for _, tt := range tests {
+		p := proof()
+		tt.change(&p)
+		if err := Verify([]byte(snapshot), p); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Verify() with a changed %s = %v, want an error mentioning %q", tt.name, err, tt.want)
+		}
+	}
+
+	// A different snapshot does not verify against the proof.
+	other := Canonical(append(entries[:2:2], Entry{ID: 4, Text: "d", Author: "D"}))
+	if err := Verify(other, proof()); err == nil {
+		t.Error("Verify() accepted a proof against another snapshot")
+	}
+}
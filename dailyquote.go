@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sudlo/quote-api/daily"
+)
+
+const (
+	// dailyRetention is how many days commitments are kept after their date.
+	dailyRetention = 30
+	// dailyCommitLead is how long before a date begins its snapshot is
+	// committed. Quotes published after that count from the next date.
+	dailyCommitLead = time.Hour
+)
+
+var errNoDailyQuotes = errors.New("no quotes available")
+
+// dailyCommitment is a date's corpus snapshot, recorded in shared state
+// before the date begins so every replica serves the same selection and
+// the record survives restarts. Once written it never changes.
+type dailyCommitment struct {
+	Date         string    `json:"date"`
+	CorpusSHA256 string    `json:"corpus_sha256"`
+	Count        int       `json:"count"`
+	CommittedAt  time.Time `json:"committed_at"`
+	Snapshot     []byte    `json:"snapshot"`
+}
+
+// dailyQuotes serves the verifiable quote of the day. Each date's snapshot
+// is committed ahead of time by run, so edits made during the day do not
+// change its selection and nobody can choose it after the fact.
+type dailyQuotes struct {
+	store Store
+	state stateStore
+
+	mu          sync.Mutex
+	commitments map[string]*dailyCommitment // by date, read from state
+}
+
+func newDailyQuotes(store Store, state stateStore) *dailyQuotes {
+	return &dailyQuotes{store: store, state: state, commitments: make(map[string]*dailyCommitment)}
+}
+
+func dailyKey(date string) string { return "daily:" + date }
+
+// run commits each date's snapshot dailyCommitLead before the date begins,
+// checking every interval until ctx is done. A missing commitment for the
+// current date, after an outage or on first deployment, is made at once;
+// its proof then shows it was committed late.
+func (d *dailyQuotes) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		now := time.Now().UTC()
+		dates := []string{now.Format(time.DateOnly)}
+		if next := now.Add(dailyCommitLead); next.Day() != now.Day() {
+			dates = append(dates, next.Format(time.DateOnly))
+		}
+		for _, date := range dates {
+			if _, err := d.commit(ctx, date, now); err != nil {
+				log.Printf("daily: committing %s: %v", date, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// commit records the store's current snapshot for date unless a replica
+// already has, and returns the commitment that stands.
+func (d *dailyQuotes) commit(ctx context.Context, date string, now time.Time) (*dailyCommitment, error) {
+	if c, ok, err := d.load(ctx, date); ok || err != nil {
+		return c, err
+	}
+	var entries []daily.Entry
+	rangeQuotes(d.store, func(q Quote) bool {
+		entries = append(entries, daily.Entry{ID: q.ID, Text: q.Text, Author: q.Author})
+		return true
+	})
+	if len(entries) == 0 {
+		return nil, errNoDailyQuotes
+	}
+	snap := daily.Canonical(entries)
+	sum := sha256.Sum256(snap)
+	c := &dailyCommitment{Date: date, CorpusSHA256: hex.EncodeToString(sum[:]), Count: len(entries), CommittedAt: now, Snapshot: snap}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	day, _ := time.Parse(time.DateOnly, date)
+	ttl := time.Until(day.AddDate(0, 0, dailyRetention+1))
+	set, err := d.state.setNX(ctx, dailyKey(date), string(data), ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !set {
+		c, _, err := d.load(ctx, date)
+		return c, err
+	}
+	log.Printf("daily: committed %d quotes for %s, corpus %s", c.Count, date, c.CorpusSHA256)
+	return c, nil
+}
+
+// load returns the commitment for date, if there is one.
+func (d *dailyQuotes) load(ctx context.Context, date string) (*dailyCommitment, bool, error) {
+	d.mu.Lock()
+	c, ok := d.commitments[date]
+	d.mu.Unlock()
+	if ok {
+		return c, true, nil
+	}
+
+	data, ok, err := d.state.get(ctx, dailyKey(date))
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	c = new(dailyCommitment)
+	if err := json.Unmarshal([]byte(data), c); err != nil {
+		return nil, false, err
+	}
+	if sum := sha256.Sum256(c.Snapshot); hex.EncodeToString(sum[:]) != c.CorpusSHA256 {
+		return nil, false, errors.New("daily: stored snapshot for " + date + " does not match its commitment")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.commitments[date] = c
+	cutoff := time.Now().UTC().AddDate(0, 0, -dailyRetention).Format(time.DateOnly)
+	for day := range d.commitments {
+		if day < cutoff {
+			delete(d.commitments, day)
+		}
+	}
+	return c, true, nil
+}
+
+// requestDate returns the request's ?date=, today by default, writing an
+// error response and returning false if it is invalid or later than latest.
+func requestDate(w http.ResponseWriter, r *http.Request, latest time.Time) (string, bool) {
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = time.Now().UTC().Format(time.DateOnly)
+	}
+	if _, err := time.Parse(time.DateOnly, date); err != nil {
+		writeError(w, http.StatusBadRequest, "date must be formatted as YYYY-MM-DD")
+		return "", false
+	}
+	if date > latest.Format(time.DateOnly) {
+		writeError(w, http.StatusBadRequest, "the quote for a future date has not been chosen yet")
+		return "", false
+	}
+	return date, true
+}
+
+// snapshot returns the commitment for the request's date, writing an error
+// response and returning false if there is none.
+func (d *dailyQuotes) snapshot(w http.ResponseWriter, r *http.Request) (*dailyCommitment, bool) {
+	now := time.Now().UTC()
+	date, ok := requestDate(w, r, now)
+	if !ok {
+		return nil, false
+	}
+	var c *dailyCommitment
+	var err error
+	if date == now.Format(time.DateOnly) {
+		c, err = d.commit(r.Context(), date, now)
+	} else {
+		c, ok, err = d.load(r.Context(), date)
+		if err == nil && !ok {
+			writeError(w, http.StatusNotFound, "no snapshot was recorded for "+date)
+			return nil, false
+		}
+	}
+	switch {
+	case errors.Is(err, errNoDailyQuotes):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return nil, false
+	case err != nil:
+		stateError(w, err)
+		return nil, false
+	}
+	return c, true
+}
+
+// proof writes the proof for the request's date, or an error response. The
+// selection is recomputed from the stored snapshot and checked against the
+// published commitment.
+func (d *dailyQuotes) proof(w http.ResponseWriter, r *http.Request) (daily.Proof, bool) {
+	c, ok := d.snapshot(w, r)
+	if !ok {
+		return daily.Proof{}, false
+	}
+	p, err := daily.Select(c.Snapshot, c.Date)
+	if err == nil && p.CorpusSHA256 != c.CorpusSHA256 {
+		err = errors.New("selection does not match the commitment")
+	}
+	if err != nil {
+		log.Printf("daily: %s: %v", c.Date, err)
+		writeError(w, http.StatusInternalServerError, "could not select the daily quote")
+		return daily.Proof{}, false
+	}
+	p.CommittedAt = c.CommittedAt.Format(time.RFC3339)
+	return p, true
+}
+
+// quoteHandler serves GET /v1/quotes/daily.
+func (d *dailyQuotes) quoteHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := d.proof(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"date":  p.Date,
+		"quote": p.Quote,
+		"proof": "/v1/quotes/daily/proof?date=" + p.Date,
+	})
+}
+
+// proofHandler serves GET /v1/quotes/daily/proof.
+func (d *dailyQuotes) proofHandler(w http.ResponseWriter, r *http.Request) {
+	if p, ok := d.proof(w, r); ok {
+		writeJSON(w, http.StatusOK, p)
+	}
+}
+
+// commitmentHandler serves GET /v1/quotes/daily/commitment, which publishes
+// a date's corpus hash as soon as it is committed, before the date begins.
+func (d *dailyQuotes) commitmentHandler(w http.ResponseWriter, r *http.Request) {
+	date, ok := requestDate(w, r, time.Now().UTC().Add(dailyCommitLead))
+	if !ok {
+		return
+	}
+	c, ok, err := d.load(r.Context(), date)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "nothing has been committed for "+date+" yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"version":       daily.Version,
+		"date":          c.Date,
+		"corpus_sha256": c.CorpusSHA256,
+		"count":         c.Count,
+		"committed_at":  c.CommittedAt.Format(time.RFC3339),
+	})
+}
+
+// snapshotHandler serves GET /v1/quotes/daily/snapshot, the exact bytes the
+// selection was computed from.
+func (d *dailyQuotes) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := d.snapshot(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="snapshot-`+c.Date+`.json"`)
+	w.Write(c.Snapshot)
+}
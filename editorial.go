@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Editorial states a quote moves through. Only published quotes, and
+// scheduled ones whose publish_at has passed, are visible to readers.
+const (
+	statusDraft     = "draft"
+	statusInReview  = "in_review"
+	statusScheduled = "scheduled"
+	statusPublished = "published"
+	statusArchived  = "archived"
+)
+
+func validStatus(s string) bool {
+	switch s {
+	case statusDraft, statusInReview, statusScheduled, statusPublished, statusArchived:
+		return true
+	}
+	return false
+}
+
+// transitions lists the allowed moves between states and the least role
+// that may make each one.
+var transitions = map[string]map[string]role{
+	statusDraft: {
+		statusInReview: roleContributor,
+	},
+	statusInReview: {
+		statusDraft:     roleContributor,
+		statusScheduled: roleEditor,
+		statusPublished: roleEditor,
+	},
+	statusScheduled: {
+		statusDraft:     roleEditor,
+		statusPublished: roleEditor,
+	},
+	statusPublished: {
+		statusArchived: roleEditor,
+	},
+	statusArchived: {
+		statusDraft: roleAdmin,
+	},
+}
+
+// editorial serves the staff-only API for drafting, reviewing and
+// scheduling quotes.
+type editorial struct {
+	store editableStore // nil when the store is read-only
+	staff *staffAuth
+}
+
+func (e *editorial) routes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /v1/editorial/quotes", e.staff.require(roleContributor, e.listHandler))
+	mux.HandleFunc("POST /v1/editorial/quotes", e.staff.require(roleContributor, e.createHandler))
+	mux.HandleFunc("GET /v1/editorial/quotes/{id}", e.staff.require(roleContributor, e.getHandler))
+	mux.HandleFunc("PATCH /v1/editorial/quotes/{id}", e.staff.require(roleContributor, e.editHandler))
+	mux.HandleFunc("POST /v1/editorial/quotes/{id}/transitions", e.staff.require(roleContributor, e.transitionHandler))
+	mux.HandleFunc("GET /v1/editorial/scheduled", e.staff.require(roleContributor, e.scheduledHandler))
+}
+
+// editable writes a 501 and returns false when the store cannot be edited.
+func (e *editorial) editable(w http.ResponseWriter) bool {
+	if e.store == nil {
+		writeError(w, http.StatusNotImplemented, "the quote store is read-only; edit quotes at their source")
+		return false
+	}
+	return true
+}
+
+func (e *editorial) listHandler(w http.ResponseWriter, r *http.Request, _ role) {
+	if !e.editable(w) {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && !validStatus(status) {
+		writeError(w, http.StatusBadRequest, "unknown status "+strconv.Quote(status))
+		return
+	}
+	quotes := []Quote{}
+	for _, q := range e.store.AllQuotes() {
+		if status == "" || q.Status == status {
+			quotes = append(quotes, q)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"quotes": quotes})
+}
+
+func (e *editorial) getHandler(w http.ResponseWriter, r *http.Request, _ role) {
+	if !e.editable(w) {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errQuoteNotFound.Error())
+		return
+	}
+	for _, q := range e.store.AllQuotes() {
+		if q.ID == id {
+			writeJSON(w, http.StatusOK, q)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, errQuoteNotFound.Error())
+}
+
+type quoteDraft struct {
+	Text   *string   `json:"text"`
+	Author *string   `json:"author"`
+	Tags   *[]string `json:"tags"`
+}
+
+// apply copies the fields set in d onto q.
+func (d quoteDraft) apply(q *Quote) error {
+	if d.Text != nil {
+		q.Text = strings.TrimSpace(*d.Text)
+	}
+	if d.Author != nil {
+		q.Author = strings.TrimSpace(*d.Author)
+	}
+	if d.Tags != nil {
+		q.Tags = *d.Tags
+	}
+	if q.Text == "" || q.Author == "" {
+		return errors.New("text and author are required")
+	}
+	return nil
+}
+
+func (e *editorial) createHandler(w http.ResponseWriter, r *http.Request, _ role) {
+	if !e.editable(w) {
+		return
+	}
+	var d quoteDraft
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	q := Quote{Status: statusDraft}
+	if err := d.apply(&q); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q, err := e.store.Create(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "could not create quote")
+		return
+	}
+	writeJSON(w, http.StatusCreated, q)
+}
+
+// editHandler changes a quote's content. Contributors may only edit drafts;
+// editors may also correct quotes further along.
+func (e *editorial) editHandler(w http.ResponseWriter, r *http.Request, rl role) {
+	if !e.editable(w) {
+		return
+	}
+	var d quoteDraft
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	e.update(w, r, func(q *Quote) error {
+		if q.Status != statusDraft && rl < roleEditor {
+			return errForbidden("only editors may change a quote once it has left draft")
+		}
+		return d.apply(q)
+	})
+}
+
+type transitionRequest struct {
+	To        string     `json:"to"`
+	PublishAt *time.Time `json:"publish_at"`
+}
+
+func (e *editorial) transitionHandler(w http.ResponseWriter, r *http.Request, rl role) {
+	if !e.editable(w) {
+		return
+	}
+	var req transitionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	now := time.Now()
+	e.update(w, r, func(q *Quote) error {
+		need, ok := transitions[q.Status][req.To]
+		if !ok {
+			return errConflict("cannot move a quote from " + q.Status + " to " + strconv.Quote(req.To))
+		}
+		if rl < need {
+			return errForbidden("moving a quote from " + q.Status + " to " + req.To + " requires the " + need.String() + " role")
+		}
+		switch req.To {
+		case statusScheduled:
+			if req.PublishAt == nil || !req.PublishAt.After(now) {
+				return errors.New("scheduling needs a publish_at in the future")
+			}
+			at := req.PublishAt.UTC()
+			q.PublishAt = &at
+		case statusPublished:
+			at := now.UTC().Truncate(time.Second)
+			q.PublishAt = &at
+		case statusDraft:
+			q.PublishAt = nil
+		}
+		q.Status = req.To
+		return nil
+	})
+}
+
+// scheduledHandler lists quotes waiting to go live, soonest first.
+func (e *editorial) scheduledHandler(w http.ResponseWriter, r *http.Request, _ role) {
+	if !e.editable(w) {
+		return
+	}
+	now := time.Now()
+	upcoming := []Quote{}
+	for _, q := range e.store.AllQuotes() {
+		if q.Status == statusScheduled && q.PublishAt != nil && q.PublishAt.After(now) {
+			upcoming = append(upcoming, q)
+		}
+	}
+	sort.Slice(upcoming, func(i, j int) bool { return upcoming[i].PublishAt.Before(*upcoming[j].PublishAt) })
+	writeJSON(w, http.StatusOK, map[string]any{"scheduled": upcoming})
+}
+
+// statusError carries the HTTP status an update failure should produce.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+func errForbidden(msg string) error { return &statusError{http.StatusForbidden, msg} }
+func errConflict(msg string) error  { return &statusError{http.StatusConflict, msg} }
+
+// update applies fn to the quote named in the path and writes the result.
+func (e *editorial) update(w http.ResponseWriter, r *http.Request, fn func(*Quote) error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errQuoteNotFound.Error())
+		return
+	}
+	q, err := e.store.Update(id, fn)
+	var se *statusError
+	switch {
+	case errors.Is(err, errQuoteNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.As(err, &se):
+		writeError(w, se.status, se.msg)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, q)
+	}
+}
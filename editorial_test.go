@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaffFromEnv(t *testing.T) {
+	t.Setenv("STAFF_TOKENS", " c1:contributor, e1:editor,a1:admin ")
+	a, err := staffFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for header, want := range map[string]role{
+		"Bearer c1": roleContributor,
+		"Bearer e1": roleEditor,
+		"Bearer a1": roleAdmin,
+		"Bearer a":  roleNone,
+		"Bearer ":   roleNone,
+		"a1":        roleNone,
+		"Basic a1":  roleNone,
+		"":          roleNone,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", header)
+		if got := a.role(r); got != want {
+			t.Errorf("role(%q) = %s, want %s", header, got, want)
+		}
+	}
+
+	for _, v := range []string{"c1", "c1:owner", ":editor", "c1:Editor"} {
+		t.Setenv("STAFF_TOKENS", v)
+		if _, err := staffFromEnv(); err == nil {
+			t.Errorf("staffFromEnv() accepted STAFF_TOKENS=%q", v)
+		}
+	}
+}
+
+// editorialServer serves the editorial API over a store holding the given
+// quotes, with a token per role named after it.
+func editorialServer(quotes []Quote) (*memoryStore, func(token, method, path, body string) (int, map[string]any)) {
+	store := newMemoryStore(quotes)
+	e := &editorial{store: store, staff: &staffAuth{tokens: map[string]role{
+		"contributor": roleContributor,
+		"editor":      roleEditor,
+		"admin":       roleAdmin,
+	}}}
+	mux := http.NewServeMux()
+	e.routes(mux)
+	return store, func(token, method, path, body string) (int, map[string]any) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		var resp map[string]any
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+}
+
+func TestEditorialRoles(t *testing.T) {
+	_, do := editorialServer([]Quote{{ID: 1, Text: "Under review.", Author: "Ann", Status: statusInReview}})
+
+	if status, _ := do("", http.MethodGet, "/v1/editorial/quotes", ""); status != http.StatusUnauthorized {
+		t.Errorf("listing without a token = %d, want 401", status)
+	}
+	if status, _ := do("reader", http.MethodGet, "/v1/editorial/quotes", ""); status != http.StatusUnauthorized {
+		t.Errorf("listing with an unknown token = %d, want 401", status)
+	}
+
+	// Contributors draft, but only editors change quotes past draft.
+	status, created := do("contributor", http.MethodPost, "/v1/editorial/quotes", `{"text": " New. ", "author": "Bo"}`)
+	if status != http.StatusCreated || created["status"] != statusDraft || created["text"] != "New." {
+		t.Fatalf("creating a quote = %d %v, want a trimmed draft", status, created)
+	}
+	if status, _ := do("contributor", http.MethodPatch, "/v1/editorial/quotes/2", `{"author": "Cy"}`); status != http.StatusOK {
+		t.Errorf("contributor editing a draft = %d, want 200", status)
+	}
+	if status, _ := do("contributor", http.MethodPatch, "/v1/editorial/quotes/1", `{"author": "Cy"}`); status != http.StatusForbidden {
+		t.Errorf("contributor editing a quote in review = %d, want 403", status)
+	}
+	if status, resp := do("editor", http.MethodPatch, "/v1/editorial/quotes/1", `{"author": "Cy"}`); status != http.StatusOK || resp["author"] != "Cy" {
+		t.Errorf("editor editing a quote in review = %d %v, want 200", status, resp)
+	}
+	if status, _ := do("editor", http.MethodPatch, "/v1/editorial/quotes/1", `{"text": " "}`); status != http.StatusBadRequest {
+		t.Errorf("blanking a quote's text = %d, want 400", status)
+	}
+
+	if status, resp := do("contributor", http.MethodPost, "/v1/editorial/quotes/1/transitions", `{"to": "published"}`); status != http.StatusForbidden || !strings.Contains(resp["error"].(string), "editor") {
+		t.Errorf("contributor publishing = %d %v, want 403 naming the editor role", status, resp)
+	}
+	if status, _ := do("editor", http.MethodPost, "/v1/editorial/quotes/1/transitions", `{"to": "published"}`); status != http.StatusOK {
+		t.Errorf("editor publishing = %d, want 200", status)
+	}
+	do("editor", http.MethodPost, "/v1/editorial/quotes/1/transitions", `{"to": "archived"}`)
+	if status, _ := do("editor", http.MethodPost, "/v1/editorial/quotes/1/transitions", `{"to": "draft"}`); status != http.StatusForbidden {
+		t.Errorf("editor restoring an archived quote = %d, want 403", status)
+	}
+	if status, resp := do("admin", http.MethodPost, "/v1/editorial/quotes/1/transitions", `{"to": "draft"}`); status != http.StatusOK || resp["publish_at"] != nil {
+		t.Errorf("admin restoring an archived quote = %d %v, want a draft without publish_at", status, resp)
+	}
+}
+
+func TestEditorialTransitions(t *testing.T) {
+	statuses := []string{statusDraft, statusInReview, statusScheduled, statusPublished, statusArchived}
+	allowed := map[[2]string]bool{
+		{statusDraft, statusInReview}:      true,
+		{statusInReview, statusDraft}:      true,
+		{statusInReview, statusScheduled}:  true,
+		{statusInReview, statusPublished}:  true,
+		{statusScheduled, statusDraft}:     true,
+		{statusScheduled, statusPublished}: true,
+		{statusPublished, statusArchived}:  true,
+		{statusArchived, statusDraft}:      true,
+	}
+	later := time.Now().Add(time.Hour)
+	body := `{"to": "%s", "publish_at": "` + later.Format(time.RFC3339) + `"}`
+	for _, from := range statuses {
+		for _, to := range append(statuses, "deleted") {
+			q := Quote{ID: 1, Text: "x", Author: "y", Status: from}
+			if from == statusScheduled || from == statusPublished {
+				q.PublishAt = &later
+			}
+			_, do := editorialServer([]Quote{q})
+			status, resp := do("admin", http.MethodPost, "/v1/editorial/quotes/1/transitions", strings.Replace(body, "%s", to, 1))
+			switch {
+			case allowed[[2]string{from, to}] && (status != http.StatusOK || resp["status"] != to):
+				t.Errorf("%s -> %s = %d %v, want it allowed", from, to, status, resp)
+			case !allowed[[2]string{from, to}] && status != http.StatusConflict:
+				t.Errorf("%s -> %s = %d, want 409", from, to, status)
+			}
+		}
+	}
+
+	_, do := editorialServer([]Quote{{ID: 1, Text: "x", Author: "y", Status: statusInReview}})
+	if status, _ := do("editor", http.MethodPost, "/v1/editorial/quotes/1/transitions", `{"to": "scheduled"}`); status != http.StatusBadRequest {
+		t.Errorf("scheduling without publish_at = %d, want 400", status)
+	}
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if status, _ := do("editor", http.MethodPost, "/v1/editorial/quotes/1/transitions", `{"to": "scheduled", "publish_at": "`+past+`"}`); status != http.StatusBadRequest {
+		t.Errorf("scheduling in the past = %d, want 400", status)
+	}
+	if status, _ := do("editor", http.MethodPost, "/v1/editorial/quotes/9/transitions", `{"to": "draft"}`); status != http.StatusNotFound {
+		t.Errorf("moving a missing quote = %d, want 404", status)
+	}
+}
+
+func TestPublishAtVisibility(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	tests := []struct {
+		q    Quote
+		want bool
+	}{
+		{Quote{}, true},
+		{Quote{Status: statusPublished}, true},
+		{Quote{Status: statusPublished, PublishAt: &past}, true},
+		{Quote{Status: statusPublished, PublishAt: &future}, false},
+		{Quote{Status: statusScheduled, PublishAt: &past}, true},
+		{Quote{Status: statusScheduled, PublishAt: &now}, true},
+		{Quote{Status: statusScheduled, PublishAt: &future}, false},
+		{Quote{Status: statusScheduled}, false},
+		{Quote{Status: statusDraft}, false},
+		{Quote{Status: statusInReview, PublishAt: &past}, false},
+		{Quote{Status: statusArchived, PublishAt: &past}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.q.visible(now); got != tt.want {
+			t.Errorf("visible() of a %q quote with publish_at %v = %v, want %v", tt.q.Status, tt.q.PublishAt, got, tt.want)
+		}
+	}
+}
+
+func TestEditorialScheduling(t *testing.T) {
+	store, do := editorialServer([]Quote{
+		{ID: 1, Text: "Live.", Author: "Ann"},
+		{ID: 2, Text: "Soon.", Author: "Bo", Status: statusInReview},
+		{ID: 3, Text: "Sooner.", Author: "Cy", Status: statusInReview},
+	})
+	soon, sooner := time.Now().Add(time.Hour), time.Now().Add(time.Minute)
+	for id, at := range map[string]time.Time{"2": soon, "3": sooner} {
+		if status, resp := do("editor", http.MethodPost, "/v1/editorial/quotes/"+id+"/transitions", `{"to": "scheduled", "publish_at": "`+at.Format(time.RFC3339Nano)+`"}`); status != http.StatusOK {
+			t.Fatalf("scheduling quote %s = %d %v", id, status, resp)
+		}
+	}
+
+	// Scheduled quotes are listed soonest first, and readers do not see them.
+	_, resp := do("contributor", http.MethodGet, "/v1/editorial/scheduled", "")
+	if got := quoteIDsOf(resp["scheduled"]); len(got) != 2 || got[0] != 3 || got[1] != 2 {
+		t.Errorf("scheduled quotes = %v, want 3 then 2", got)
+	}
+	if got := quoteIDs(store.Quotes()); len(got) != 1 || got[0] != 1 {
+		t.Errorf("readers see %v, want only the live quote", got)
+	}
+	_, resp = do("contributor", http.MethodGet, "/v1/editorial/quotes?status=scheduled", "")
+	if got := quoteIDsOf(resp["quotes"]); len(got) != 2 {
+		t.Errorf("staff listing of scheduled quotes = %v, want both", got)
+	}
+
+	// Once publish_at passes, the quote goes live without another change.
+	store.Update(3, func(q *Quote) error {
+		at := time.Now().Add(-time.Second)
+		q.PublishAt = &at
+		return nil
+	})
+	if got := quoteIDs(store.Quotes()); len(got) != 2 || got[1] != 3 {
+		t.Errorf("readers see %v after publish_at passed, want 1 and 3", got)
+	}
+	_, resp = do("contributor", http.MethodGet, "/v1/editorial/scheduled", "")
+	if got := quoteIDsOf(resp["scheduled"]); len(got) != 1 || got[0] != 2 {
+		t.Errorf("scheduled quotes = %v after one went live, want 2", got)
+	}
+
+	// Publishing now makes a quote visible at once.
+	if status, resp := do("editor", http.MethodPost, "/v1/editorial/quotes/2/transitions", `{"to": "published"}`); status != http.StatusOK || resp["publish_at"] == nil {
+		t.Errorf("publishing = %d %v, want publish_at set to now", status, resp)
+	}
+	if got := quoteIDs(store.Quotes()); len(got) != 3 {
+		t.Errorf("readers see %v after publishing, want all three", got)
+	}
+}
+
+func TestEditorialReadOnlyStore(t *testing.T) {
+	e := &editorial{staff: &staffAuth{tokens: map[string]role{"admin": roleAdmin}}}
+	mux := http.NewServeMux()
+	e.routes(mux)
+	r := httptest.NewRequest(http.MethodGet, "/v1/editorial/quotes", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("editorial listing of a read-only store = %d, want 501", w.Code)
+	}
+}
+
+// quoteIDsOf returns the IDs of a decoded JSON array of quotes.
+func quoteIDsOf(v any) []int {
+	var ids []int
+	list, _ := v.([]any)
+	for _, item := range list {
+		q, _ := item.(map[string]any)
+		id, _ := q["id"].(float64)
+		ids = append(ids, int(id))
+	}
+	return ids
+}
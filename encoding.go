@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Quote resources can be served as Protocol Buffers, MessagePack or CBOR
+// as well as JSON. Handlers keep writing JSON, and plugins keep seeing it;
+// the response is then re-encoded following the schema below, which is
+// also published as a .proto file so every format carries the same fields.
+
+type wireKind int
+
+const (
+	kindString wireKind = iota
+	kindInt
+	kindDouble
+	kindBool
+	kindMessage
+)
+
+var protoTypes = map[wireKind]string{kindString: "string", kindInt: "int64", kindDouble: "double", kindBool: "bool"}
+
+type wireField struct {
+	name     string // as in the JSON representation
+	number   int    // Protocol Buffers field number; never reuse one
+	kind     wireKind
+	repeated bool
+	message  *wireMessage // for kindMessage fields
+}
+
+type wireMessage struct {
+	name   string
+	fields []wireField
+}
+
+var (
+	quoteMessage = &wireMessage{"Quote", []wireField{
+		{name: "id", number: 1, kind: kindInt},
+		{name: "text", number: 2, kind: kindString},
+		{name: "author", number: 3, kind: kindString},
+		{name: "tags", number: 4, kind: kindString, repeated: true},
+		{name: "status", number: 5, kind: kindString},
+		{name: "publish_at", number: 6, kind: kindString},
+	}}
+	randomQuoteMessage = &wireMessage{"RandomQuote", []wireField{
+		{name: "quote", number: 1, kind: kindString},
+		{name: "quotes", number: 2, kind: kindString, repeated: true},
+	}}
+	quoteListMessage = &wireMessage{"QuoteList", []wireField{
+		{name: "quotes", number: 1, kind: kindMessage, repeated: true, message: quoteMessage},
+		{name: "total", number: 2, kind: kindInt},
+		{name: "limit", number: 3, kind: kindInt},
+		{name: "offset", number: 4, kind: kindInt},
+	}}
+	semanticResultMessage = &wireMessage{"SemanticResult", []wireField{
+		{name: "quote", number: 1, kind: kindMessage, message: quoteMessage},
+		{name: "score", number: 2, kind: kindDouble},
+	}}
+	semanticResultsMessage = &wireMessage{"SemanticResults", []wireField{
+		{name: "results", number: 1, kind: kindMessage, repeated: true, message: semanticResultMessage},
+		{name: "embedder", number: 2, kind: kindString},
+	}}
+	generatedQuoteMessage = &wireMessage{"GeneratedQuote", []wireField{
+		{name: "generated", number: 1, kind: kindBool},
+		{name: "text", number: 2, kind: kindString},
+		{name: "seed", number: 3, kind: kindInt},
+		{name: "order", number: 4, kind: kindInt},
+		{name: "author_style", number: 5, kind: kindString},
+	}}
+	dailyQuoteMessage = &wireMessage{"DailyQuote", []wireField{
+		{name: "date", number: 1, kind: kindString},
+		{name: "quote", number: 2, kind: kindMessage, message: quoteMessage},
+		{name: "proof", number: 3, kind: kindString},
+	}}
+
+	// wireMessages is every message, dependencies first, for the .proto file.
+	wireMessages = []*wireMessage{
+		quoteMessage, randomQuoteMessage, quoteListMessage, semanticResultMessage,
+		semanticResultsMessage, generatedQuoteMessage, dailyQuoteMessage,
+	}
+
+	// wireRoutes gives the message each quote route responds with.
+	wireRoutes = map[string]*wireMessage{
+		"/":                    randomQuoteMessage,
+		"/v1/quotes":           quoteListMessage,
+		"/v1/quotes/{id}":      quoteMessage,
+		"/v1/quotes/semantic":  semanticResultsMessage,
+		"/v1/quotes/generated": generatedQuoteMessage,
+		"/v1/quotes/daily":     dailyQuoteMessage,
+	}
+)
+
+// wireEncoding is one binary representation of the schema.
+type wireEncoding struct {
+	contentType string
+	encode      func(buf *bytes.Buffer, msg *wireMessage, obj map[string]any) error
+}
+
+var wireEncodings = []wireEncoding{
+	{"application/x-protobuf", encodeProtobuf},
+	{"application/msgpack", encodeMsgpack},
+	{"application/cbor", encodeCBOR},
+}
+
+// Other names clients use for the same formats.
+var wireAliases = map[string]string{
+	"application/protobuf":    "application/x-protobuf",
+	"application/x-msgpack":   "application/msgpack",
+	"application/vnd.msgpack": "application/msgpack",
+}
+
+// negotiateEncoding picks the binary encoding the Accept header prefers,
+// or nil for JSON. Unknown or unacceptable types fall back to JSON rather
+// than 406, as clients that ignore content negotiation always got JSON.
+func negotiateEncoding(accept string) *wireEncoding {
+	var best *wireEncoding
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if alias, ok := wireAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		var enc *wireEncoding
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+		default:
+			for i := range wireEncodings {
+				if wireEncodings[i].contentType == mediaType {
+					enc = &wireEncodings[i]
+				}
+			}
+			if enc == nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// encodeRoute serves route's successful JSON responses in the encoding the
+// client asks for.
+func encodeRoute(route string, next http.HandlerFunc) http.HandlerFunc {
+	msg, ok := wireRoutes[route]
+	if !ok {
+		panic("no wire schema for route " + route)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		enc := negotiateEncoding(r.Header.Get("Accept"))
+		if enc == nil {
+			next(w, r)
+			return
+		}
+
+		rec := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		next(rec, r)
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		if rec.status != http.StatusOK || !strings.HasPrefix(rec.header.Get("Content-Type"), "application/json") {
+			w.WriteHeader(rec.status)
+			w.Write(rec.body.Bytes())
+			return
+		}
+
+		var obj map[string]any
+		dec := json.NewDecoder(&rec.body)
+		dec.UseNumber()
+		var out bytes.Buffer
+		err := dec.Decode(&obj)
+		if err == nil {
+			err = enc.encode(&out, msg, obj)
+		}
+		if err != nil {
+			log.Printf("encoding %s as %s: %v", route, enc.contentType, err)
+			w.Header().Del("Content-Length")
+			writeError(w, http.StatusInternalServerError, "could not encode the response as "+enc.contentType)
+			return
+		}
+		w.Header().Set("Content-Type", enc.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+		w.WriteHeader(rec.status)
+		w.Write(out.Bytes())
+	}
+}
+
+// schemaHandler serves the schema as a .proto file for generating clients.
+func schemaHandler(w http.ResponseWriter, _ *http.Request) {
+	var b strings.Builder
+	b.WriteString("// Generated from the Quote API wire schema. Quote routes return these\n")
+	b.WriteString("// messages with Accept: application/x-protobuf.\nsyntax = \"proto3\";\n\npackage quoteapi.v1;\n")
+	for _, m := range wireMessages {
+		fmt.Fprintf(&b, "\nmessage %s {\n", m.name)
+		for _, f := range m.fields {
+			typ := protoTypes[f.kind]
+			if f.kind == kindMessage {
+				typ = f.message.name
+			}
+			if f.repeated {
+				typ = "repeated " + typ
+			}
+			fmt.Fprintf(&b, "  %s %s = %d;\n", typ, f.name, f.number)
+		}
+		b.WriteString("}\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// fieldValues returns the values of f in obj: none when it is absent or
+// null, each element for a repeated field, and the value itself otherwise.
+func fieldValues(f wireField, obj map[string]any) ([]any, error) {
+	v, ok := obj[f.name]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	if !f.repeated {
+		return []any{v}, nil
+	}
+	list, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("field %s: want a list, got %T", f.name, v)
+	}
+	return list, nil
+}
+
+// scalar checks a JSON value against a field's kind and converts numbers.
+func scalar(f wireField, v any) (any, error) {
+	var ok bool
+	switch f.kind {
+	case kindString:
+		_, ok = v.(string)
+	case kindBool:
+		_, ok = v.(bool)
+	case kindInt:
+		if n, isNum := v.(json.Number); isNum {
+			i, err := n.Int64()
+			return i, err
+		}
+	case kindDouble:
+		if n, isNum := v.(json.Number); isNum {
+			return n.Float64()
+		}
+	case kindMessage:
+		_, ok = v.(map[string]any)
+	}
+	if !ok {
+		return nil, fmt.Errorf("field %s: unexpected %T", f.name, v)
+	}
+	return v, nil
+}
+
+func boolByte(b bool, f, t byte) byte {
+	if b {
+		return t
+	}
+	return f
+}
+
+// presentFields returns the number of fields of msg set in obj.
+func presentFields(msg *wireMessage, obj map[string]any) int {
+	n := 0
+	for _, f := range msg.fields {
+		if v, ok := obj[f.name]; ok && v != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func encodeProtobuf(buf *bytes.Buffer, msg *wireMessage, obj map[string]any) error {
+	for _, f := range msg.fields {
+		values, err := fieldValues(f, obj)
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			if v, err = scalar(f, v); err != nil {
+				return err
+			}
+			switch f.kind {
+			case kindInt:
+				protoTag(buf, f.number, 0)
+				protoVarint(buf, uint64(v.(int64)))
+			case kindBool:
+				protoTag(buf, f.number, 0)
+				buf.WriteByte(boolByte(v.(bool), 0, 1))
+			case kindDouble:
+				protoTag(buf, f.number, 1)
+				binary.Write(buf, binary.LittleEndian, math.Float64bits(v.(float64)))
+			case kindString:
+				protoTag(buf, f.number, 2)
+				protoVarint(buf, uint64(len(v.(string))))
+				buf.WriteString(v.(string))
+			case kindMessage:
+				var nested bytes.Buffer
+				if err := encodeProtobuf(&nested, f.message, v.(map[string]any)); err != nil {
+					return err
+				}
+				protoTag(buf, f.number, 2)
+				protoVarint(buf, uint64(nested.Len()))
+				buf.Write(nested.Bytes())
+			}
+		}
+	}
+	return nil
+}
+
+func protoTag(buf *bytes.Buffer, number, wireType int) {
+	protoVarint(buf, uint64(number<<3|wireType))
+}
+
+func protoVarint(buf *bytes.Buffer, v uint64) {
+	buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func encodeMsgpack(buf *bytes.Buffer, msg *wireMessage, obj map[string]any) error {
+	msgpackHeader(buf, 0x80, 0xde, presentFields(msg, obj))
+	for _, f := range msg.fields {
+		v, ok := obj[f.name]
+		if !ok || v == nil {
+			continue
+		}
+		msgpackString(buf, f.name)
+		values, err := fieldValues(f, obj)
+		if err != nil {
+			return err
+		}
+		if f.repeated {
+			msgpackHeader(buf, 0x90, 0xdc, len(values))
+		}
+		for _, v := range values {
+			if v, err = scalar(f, v); err != nil {
+				return err
+			}
+			switch f.kind {
+			case kindInt:
+				msgpackInt(buf, v.(int64))
+			case kindBool:
+				buf.WriteByte(boolByte(v.(bool), 0xc2, 0xc3))
+			case kindDouble:
+				buf.WriteByte(0xcb)
+				binary.Write(buf, binary.BigEndian, v.(float64))
+			case kindString:
+				msgpackString(buf, v.(string))
+			case kindMessage:
+				if err := encodeMsgpack(buf, f.message, v.(map[string]any)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// msgpackHeader writes a map or array header: fix is the fixmap or
+// fixarray prefix and wide the 16-bit form, followed by the 32-bit one.
+func msgpackHeader(buf *bytes.Buffer, fix, wide byte, n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(wide)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(wide + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// msgpackInt writes i in the shortest form: a fixint, or a signed integer
+// of 8 to 64 bits.
+func msgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= -32 && i <= math.MaxInt8:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.Write([]byte{0xd0, byte(i)})
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func msgpackString(buf *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+// CBOR major types.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+)
+
+func encodeCBOR(buf *bytes.Buffer, msg *wireMessage, obj map[string]any) error {
+	cborHead(buf, cborMap, uint64(presentFields(msg, obj)))
+	for _, f := range msg.fields {
+		v, ok := obj[f.name]
+		if !ok || v == nil {
+			continue
+		}
+		cborString(buf, f.name)
+		values, err := fieldValues(f, obj)
+		if err != nil {
+			return err
+		}
+		if f.repeated {
+			cborHead(buf, cborArray, uint64(len(values)))
+		}
+		for _, v := range values {
+			if v, err = scalar(f, v); err != nil {
+				return err
+			}
+			switch f.kind {
+			case kindInt:
+				if i := v.(int64); i >= 0 {
+					cborHead(buf, cborUint, uint64(i))
+				} else {
+					cborHead(buf, cborNegInt, uint64(-1-i))
+				}
+			case kindBool:
+				buf.WriteByte(boolByte(v.(bool), 0xf4, 0xf5))
+			case kindDouble:
+				buf.WriteByte(0xfb)
+				binary.Write(buf, binary.BigEndian, v.(float64))
+			case kindString:
+				cborString(buf, v.(string))
+			case kindMessage:
+				if err := encodeCBOR(buf, f.message, v.(map[string]any)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// cborHead writes the initial byte of a data item and its argument in the
+// shortest form.
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	m := major << 5
+	switch {
+	case n < 24:
+		buf.WriteByte(m | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{m | 24, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(m | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(m | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(m | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func cborString(buf *bytes.Buffer, s string) {
+	cborHead(buf, cborText, uint64(len(s)))
+	buf.WriteString(s)
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The decoders below are written from the format specifications, without
+// the schema for MessagePack and CBOR, so the round trips check the
+// encoders against the formats rather than against themselves.
+
+type wireReader struct {
+	b []byte
+}
+
+func (r *wireReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.b) {
+		return nil, fmt.Errorf("want %d bytes, have %d", n, len(r.b))
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p, nil
+}
+
+func (r *wireReader) uint(n int) (uint64, error) {
+	p, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range p {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func decodeMsgpack(r *wireReader) (any, error) {
+	p, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := p[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f, c == 0xde, c == 0xdf:
+		n := int(c - 0x80)
+		if c >= 0xde {
+			if n, err = r.uintN(c - 0xde); err != nil {
+				return nil, err
+			}
+		}
+		m := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			k, err := decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key %v is not a string", k)
+			}
+			if m[key], err = decodeMsgpack(r); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case c >= 0x90 && c <= 0x9f, c == 0xdc, c == 0xdd:
+		n := int(c - 0x90)
+		if c >= 0xdc {
+			if n, err = r.uintN(c - 0xdc); err != nil {
+				return nil, err
+			}
+		}
+		list := make([]any, n)
+		for i := range list {
+			if list[i], err = decodeMsgpack(r); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case c >= 0xa0 && c <= 0xbf, c == 0xd9, c == 0xda, c == 0xdb:
+		n := int(c - 0xa0)
+		if c >= 0xd9 {
+			v, err := r.uint(1 << (c - 0xd9))
+			if err != nil {
+				return nil, err
+			}
+			n = int(v)
+		}
+		s, err := r.next(n)
+		return string(s), err
+	case c == 0xc0:
+		return nil, nil
+	case c == 0xc2, c == 0xc3:
+		return c == 0xc3, nil
+	case c >= 0xcc && c <= 0xcf:
+		v, err := r.uint(1 << (c - 0xcc))
+		return int64(v), err
+	case c >= 0xd0 && c <= 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := r.uint(size)
+		shift := 64 - 8*size
+		return int64(v<<shift) >> shift, err
+	case c == 0xca:
+		v, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case c == 0xcb:
+		v, err := r.uint(8)
+		return math.Float64frombits(v), err
+	}
+	return nil, fmt.Errorf("unsupported MessagePack type 0x%02x", c)
+}
+
+// uintN reads the 16-bit (wide 0) or 32-bit (wide 1) length of a map or
+// array.
+func (r *wireReader) uintN(wide byte) (int, error) {
+	v, err := r.uint(2 << wide)
+	return int(v), err
+}
+
+func decodeCBOR(r *wireReader) (any, error) {
+	p, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := p[0]>>5, p[0]&0x1f
+	if major == 7 {
+		switch info {
+		case 20, 21:
+			return info == 21, nil
+		case 22:
+			return nil, nil
+		case 26:
+			v, err := r.uint(4)
+			return float64(math.Float32frombits(uint32(v))), err
+		case 27:
+			v, err := r.uint(8)
+			return math.Float64frombits(v), err
+		}
+		return nil, fmt.Errorf("unsupported CBOR simple value %d", info)
+	}
+	arg := uint64(info)
+	switch {
+	case info >= 24 && info <= 27:
+		if arg, err = r.uint(1 << (info - 24)); err != nil {
+			return nil, err
+		}
+	case info > 27:
+		return nil, fmt.Errorf("unsupported CBOR argument %d", info)
+	}
+	switch major {
+	case 0:
+		return int64(arg), nil
+	case 1:
+		return -1 - int64(arg), nil
+	case 3:
+		s, err := r.next(int(arg))
+		return string(s), err
+	case 4:
+		list := make([]any, arg)
+		for i := range list {
+			if list[i], err = decodeCBOR(r); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case 5:
+		m := make(map[string]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := decodeCBOR(r)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key %v is not a string", k)
+			}
+			if m[key], err = decodeCBOR(r); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported CBOR major type %d", major)
+}
+
+// decodeProtobuf reads a message of type msg. Protocol Buffers carry no
+// names or types, so it needs the schema, but only to name and type what
+// the wire says.
+func decodeProtobuf(b []byte, msg *wireMessage) (map[string]any, error) {
+	out := make(map[string]any)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("bad tag")
+		}
+		b = b[n:]
+		number, wireType := int(tag>>3), int(tag&7)
+		var f *wireField
+		for i := range msg.fields {
+			if msg.fields[i].number == number {
+				f = &msg.fields[i]
+			}
+		}
+		if f == nil {
+			return nil, fmt.Errorf("%s has no field %d", msg.name, number)
+		}
+		want := map[wireKind]int{kindInt: 0, kindBool: 0, kindDouble: 1, kindString: 2, kindMessage: 2}[f.kind]
+		if wireType != want {
+			return nil, fmt.Errorf("field %s: wire type %d, want %d", f.name, wireType, want)
+		}
+		var v any
+		switch wireType {
+		case 0:
+			u, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("field %s: bad varint", f.name)
+			}
+			b = b[n:]
+			if f.kind == kindBool {
+				v = u != 0
+			} else {
+				v = int64(u)
+			}
+		case 1:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("field %s: short double", f.name)
+			}
+			v = math.Float64frombits(binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return nil, fmt.Errorf("field %s: bad length", f.name)
+			}
+			data := b[n : n+int(size)]
+			b = b[n+int(size):]
+			if f.kind == kindMessage {
+				m, err := decodeProtobuf(data, f.message)
+				if err != nil {
+					return nil, err
+				}
+				v = m
+			} else {
+				v = string(data)
+			}
+		}
+		if f.repeated {
+			list, _ := out[f.name].([]any)
+			out[f.name] = append(list, v)
+		} else {
+			out[f.name] = v
+		}
+	}
+	return out, nil
+}
+
+// expected returns the JSON document as the schema carries it: only known,
+// non-null fields, with integers as int64 and doubles as float64. Protocol
+// Buffers cannot tell an empty list from a missing one, so with dropEmpty
+// empty lists are left out.
+func expected(t *testing.T, msg *wireMessage, obj map[string]any, dropEmpty bool) map[string]any {
+	t.Helper()
+	out := make(map[string]any)
+	for _, f := range msg.fields {
+		values, err := fieldValues(f, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if values == nil || dropEmpty && f.repeated && len(values) == 0 {
+			continue
+		}
+		converted := make([]any, len(values))
+		for i, v := range values {
+			if v, err = scalar(f, v); err != nil {
+				t.Fatal(err)
+			}
+			if f.kind == kindMessage {
+				v = expected(t, f.message, v.(map[string]any), dropEmpty)
+			}
+			converted[i] = v
+		}
+		if f.repeated {
+			out[f.name] = converted
+		} else {
+			out[f.name] = converted[0]
+		}
+	}
+	return out
+}
+
+func decodeJSON(t *testing.T, doc string) map[string]any {
+	t.Helper()
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func manyTags(n int) string {
+	tags := make([]string, n)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("%q", fmt.Sprint("t", i))
+	}
+	return "[" + strings.Join(tags, ",") + "]"
+}
+
+// wireSamples are JSON documents as the handlers write them, chosen to hit
+// every length and integer width the encoders switch on.
+var wireSamples = []struct {
+	name string
+	msg  *wireMessage
+	doc  string
+}{
+	{"quote", quoteMessage, `{"id": 1, "text": "The only way to do great work is to love what you do.", "author": "Steve Jobs", "tags": ["work", "love"]}`},
+	{"quote with status", quoteMessage, `{"id": 42, "text": "x", "author": "y", "tags": [], "status": "scheduled", "publish_at": "2026-01-01T00:00:00Z"}`},
+	{"unicode", quoteMessage, `{"id": 7, "text": "Ce qui ne me tue pas me rend plus fort. 生きる 🌱", "author": "Friedrich Nietzsche", "tags": null}`},
+	{"unknown fields", quoteMessage, `{"id": 1, "text": "a", "author": "b", "extra": {"ignored": true}}`},
+	{"string lengths", quoteMessage, `{"id": 1, "text": "` + strings.Repeat("a", 31) + `", "author": "` + strings.Repeat("b", 32) + `", "status": "` + strings.Repeat("c", 256) + `", "publish_at": "` + strings.Repeat("d", 70000) + `"}`},
+	{"tag counts", quoteMessage, `{"id": 1, "text": "a", "author": "b", "tags": ` + manyTags(16) + `}`},
+	{"many tags", quoteMessage, `{"id": 1, "text": "a", "author": "b", "tags": ` + manyTags(70000) + `}`},
+	{"random", randomQuoteMessage, `{"quote": "Stay hungry, stay foolish."}`},
+	{"random several", randomQuoteMessage, `{"quotes": ["a", "b", "c"]}`},
+	{"list", quoteListMessage, `{"quotes": [{"id": 1, "text": "a", "author": "b", "tags": ["x"]}, {"id": 2, "text": "c", "author": "d"}], "total": 2, "limit": 20, "offset": 0}`},
+	{"empty list", quoteListMessage, `{"quotes": [], "total": 0, "limit": 20, "offset": 0}`},
+	{"semantic", semanticResultsMessage, `{"results": [{"quote": {"id": 3, "text": "a", "author": "b"}, "score": 0.8731}, {"quote": {"id": 4, "text": "c", "author": "d"}, "score": -1e-7}], "embedder": "hash"}`},
+	{"generated", generatedQuoteMessage, `{"generated": true, "text": "The only way to love is to do.", "seed": 9007199254740993, "order": 2, "author_style": "Steve Jobs"}`},
+	{"not generated", generatedQuoteMessage, `{"generated": false, "text": "", "seed": 0, "order": 1}`},
+	{"daily", dailyQuoteMessage, `{"date": "2026-01-01", "quote": {"id": 12, "text": "a", "author": "b"}, "proof": "/v1/quotes/daily/proof?date=2026-01-01"}`},
+}
+
+// Integers at every boundary the encoders switch on.
+var wireInts = []int64{
+	0, 1, 23, 24, 31, 32, 127, 128, 255, 256, 32767, 32768, 65535, 65536,
+	math.MaxInt32, math.MaxInt32 + 1, math.MaxUint32, math.MaxUint32 + 1, math.MaxInt64,
+	-1, -24, -25, -32, -33, -128, -129, -256, -257, -32768, -32769, -65536, -65537,
+	math.MinInt32, math.MinInt32 - 1, math.MinInt64,
+}
+
+func TestWireEncodingsRoundTrip(t *testing.T) {
+	samples := wireSamples
+	for _, i := range wireInts {
+		samples = append(samples, struct {
+			name string
+			msg  *wireMessage
+			doc  string
+		}{fmt.Sprint("int ", i), quoteListMessage, fmt.Sprintf(`{"quotes": [{"id": %d}], "total": %d}`, i, i)})
+	}
+	for _, s := range samples {
+		obj := decodeJSON(t, s.doc)
+		t.Run(s.name, func(t *testing.T) {
+			for _, enc := range wireEncodings {
+				var buf bytes.Buffer
+				if err := enc.encode(&buf, s.msg, obj); err != nil {
+					t.Fatalf("%s: %v", enc.contentType, err)
+				}
+				var got any
+				var err error
+				switch enc.contentType {
+				case "application/x-protobuf":
+					got, err = decodeProtobuf(buf.Bytes(), s.msg)
+				case "application/msgpack":
+					r := &wireReader{buf.Bytes()}
+					if got, err = decodeMsgpack(r); err == nil && len(r.b) > 0 {
+						err = fmt.Errorf("%d bytes left over", len(r.b))
+					}
+				case "application/cbor":
+					r := &wireReader{buf.Bytes()}
+					if got, err = decodeCBOR(r); err == nil && len(r.b) > 0 {
+						err = fmt.Errorf("%d bytes left over", len(r.b))
+					}
+				default:
+					t.Fatalf("no decoder for %s", enc.contentType)
+				}
+				if err != nil {
+					t.Fatalf("%s: decoding: %v", enc.contentType, err)
+				}
+				want := expected(t, s.msg, obj, enc.contentType == "application/x-protobuf")
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s round trip:\n got %.300v\nwant %.300v", enc.contentType, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestWireEncodingsGolden pins the exact bytes of a small message, taken
+// from the format specifications, so the encoders and the decoders above
+// cannot agree on the same mistake.
+func TestWireEncodingsGolden(t *testing.T) {
+	obj := decodeJSON(t, `{"id": 300, "text": "hi", "tags": ["a"]}`)
+	want := map[string]string{
+		// field 1 varint 300, field 2 "hi", field 4 "a"
+		"application/x-protobuf": "08ac02" + "12026869" + "220161",
+		// fixmap 3, "id" int16 300, "text" "hi", "tags" [ "a" ]
+		"application/msgpack": "83" + "a26964" + "d1012c" + "a474657874" + "a26869" + "a474616773" + "91a161",
+		// map 3, "id" 300, "text" "hi", "tags" [ "a" ]
+		"application/cbor": "a3" + "626964" + "19012c" + "6474657874" + "626869" + "6474616773" + "816161",
+	}
+	for _, enc := range wireEncodings {
+		var buf bytes.Buffer
+		if err := enc.encode(&buf, quoteMessage, obj); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprintf("%x", buf.Bytes()); got != want[enc.contentType] {
+			t.Errorf("%s = %s, want %s", enc.contentType, got, want[enc.contentType])
+		}
+	}
+}
+
+func TestWireEncodingsRejectMistypedFields(t *testing.T) {
+	for _, doc := range []string{
+		`{"id": "1"}`,
+		`{"id": 1.5}`,
+		`{"text": 3}`,
+		`{"tags": "work"}`,
+		`{"tags": [1]}`,
+	} {
+		obj := decodeJSON(t, doc)
+		for _, enc := range wireEncodings {
+			if err := enc.encode(&bytes.Buffer{}, quoteMessage, obj); err == nil {
+				t.Errorf("%s accepted %s", enc.contentType, doc)
+			}
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"application/json", ""},
+		{"*/*", ""},
+		{"application/x-protobuf", "application/x-protobuf"},
+		{"application/protobuf", "application/x-protobuf"},
+		{"application/vnd.msgpack", "application/msgpack"},
+		{"application/cbor", "application/cbor"},
+		{"application/json;q=0.5, application/cbor", "application/cbor"},
+		{"application/cbor;q=0.5, application/json", ""},
+		{"text/html", ""},
+		{"application/msgpack;q=bad", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if enc := negotiateEncoding(tt.accept); enc != nil {
+			got = enc.contentType
+		}
+		if got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeRoute(t *testing.T) {
+	status, doc := http.StatusOK, `{"id": 5, "text": "a", "author": "b", "tags": ["x"]}`
+	h := encodeRoute("/v1/quotes/{id}", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, status, json.RawMessage(doc))
+	})
+	serve := func(accept string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/v1/quotes/5", nil)
+		r.Header.Set("Accept", accept)
+		h(rec, r)
+		return rec
+	}
+
+	rec := serve("application/cbor")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/cbor" {
+		t.Fatalf("Content-Type = %q, want application/cbor", ct)
+	}
+	got, err := decodeCBOR(&wireReader{rec.Body.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := expected(t, quoteMessage, decodeJSON(t, doc), false); !reflect.DeepEqual(got, want) {
+		t.Errorf("body = %v, want %v", got, want)
+	}
+	if vary := rec.Header().Get("Vary"); !strings.Contains(vary, "Accept") {
+		t.Errorf("Vary = %q, want Accept", vary)
+	}
+
+	// Errors stay JSON.
+	status, doc = http.StatusNotFound, `{"error": "quote not found"}`
+	rec = serve("application/x-protobuf")
+	if rec.Code != http.StatusNotFound || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("error response = %d %q, want 404 as JSON", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+)
+
+// renderEPUB builds an EPUB 3 book with one chapter per author; the
+// navigation document doubles as a table of contents by author. The same
+// quotes always give the same bytes, so exports can be cached.
+func renderEPUB(title string, quotes []Quote) ([]byte, error) {
+	// The book was last modified when its newest quote was published.
+	modified := time.Unix(0, 0)
+	byAuthor := make(map[string][]Quote)
+	for _, q := range quotes {
+		byAuthor[q.Author] = append(byAuthor[q.Author], q)
+		if q.PublishAt != nil && q.PublishAt.After(modified) {
+			modified = *q.PublishAt
+		}
+	}
+	authors := make([]string, 0, len(byAuthor))
+	for a := range byAuthor {
+		authors = append(authors, a)
+	}
+	sort.Strings(authors)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	// The mimetype entry must come first and be stored uncompressed.
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	w.Write([]byte("application/epub+zip"))
+
+	files := map[string]string{
+		"META-INF/container.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`,
+	}
+
+	var manifest, spine, toc strings.Builder
+	for i, author := range authors {
+		name := fmt.Sprintf("author-%d.xhtml", i+1)
+		fmt.Fprintf(&manifest, "    <item id=\"c%d\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", i+1, name)
+		fmt.Fprintf(&spine, "    <itemref idref=\"c%d\"/>\n", i+1)
+		fmt.Fprintf(&toc, "      <li><a href=\"%s\">%s</a></li>\n", name, html.EscapeString(author))
+
+		var body strings.Builder
+		for _, q := range byAuthor[author] {
+			fmt.Fprintf(&body, "    <blockquote><p>%s</p><footer>— %s</footer></blockquote>\n", html.EscapeString(q.Text), html.EscapeString(q.Author))
+		}
+		files["OEBPS/"+name] = xhtmlPage(author, "    <h1>"+html.EscapeString(author)+"</h1>\n"+body.String())
+	}
+
+	files["OEBPS/nav.xhtml"] = strings.Replace(xhtmlPage(title, `    <nav epub:type="toc" id="toc">
+      <h1>Authors</h1>
+      <ol>
+`+toc.String()+`      </ol>
+    </nav>
+`), "<html ", `<html xmlns:epub="http://www.idpf.org/2007/ops" `, 1)
+
+	// Derive the identifier from the content so identical exports match.
+	sum := sha256.Sum256([]byte(title + manifest.String() + fmt.Sprint(quotes)))
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+	files["OEBPS/content.opf"] = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="bookid">urn:uuid:%s</dc:identifier>
+    <dc:title>%s</dc:title>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+%s  </manifest>
+  <spine>
+    <itemref idref="nav"/>
+%s  </spine>
+</package>
+`, uuid, html.EscapeString(title), modified.UTC().Format("2006-01-02T15:04:05Z"), manifest.String(), spine.String())
+
+	names := make([]string, 0, len(files))
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		w, err := zw.Create(n)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(files[n])); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func xhtmlPage(title, body string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+  <head>
+    <meta charset="UTF-8"/>
+    <title>` + html.EscapeString(title) + `</title>
+  </head>
+  <body>
+` + body + `  </body>
+</html>
+`
+}
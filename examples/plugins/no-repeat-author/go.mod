@@ -0,0 +1,3 @@
+module github.com/sudlo/quote-api/examples/plugins/no-repeat-author
+
+go 1.24
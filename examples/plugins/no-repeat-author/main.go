@@ -0,0 +1,74 @@
+// Command no-repeat-author is an example selection strategy plugin. It picks
+// random quotes but avoids authors served recently on the same route and
+// tenant, falling back to any quote when every author was seen.
+//
+// Build it with:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o no-repeat-author.wasm .
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"unsafe"
+)
+
+type quote struct {
+	ID     int    `json:"id"`
+	Author string `json:"author"`
+}
+
+type input struct {
+	Count      int     `json:"count"`
+	Candidates []quote `json:"candidates"`
+	Recent     []int   `json:"recent"`
+	Seed       int64   `json:"seed"`
+}
+
+// buffers keeps allocations reachable so the garbage collector does not
+// reclaim memory the host is still using.
+var buffers [][]byte
+
+//go:wasmexport alloc
+func alloc(size uint32) uint32 {
+	buf := make([]byte, size)
+	buffers = append(buffers, buf)
+	return uint32(uintptr(unsafe.Pointer(unsafe.SliceData(buf))))
+}
+
+//go:wasmexport select
+func selectQuotes(ptr, size uint32) uint64 {
+	var in input
+	if err := json.Unmarshal(unsafe.Slice((*byte)(unsafe.Pointer(uintptr(ptr))), size), &in); err != nil {
+		return 0
+	}
+	rng := rand.New(rand.NewSource(in.Seed))
+
+	// Authors of recently served quotes, most recent last.
+	authorOf := make(map[int]string)
+	for _, q := range in.Candidates {
+		authorOf[q.ID] = q.Author
+	}
+	recent := make(map[string]bool)
+	if n := len(in.Recent); n > 0 {
+		recent[authorOf[in.Recent[n-1]]] = true
+	}
+
+	var fresh, stale []int
+	for i, q := range in.Candidates {
+		if recent[q.Author] {
+			stale = append(stale, i)
+		} else {
+			fresh = append(fresh, i)
+		}
+	}
+	rng.Shuffle(len(fresh), func(i, j int) { fresh[i], fresh[j] = fresh[j], fresh[i] })
+	rng.Shuffle(len(stale), func(i, j int) { stale[i], stale[j] = stale[j], stale[i] })
+	indices := append(fresh, stale...)[:in.Count]
+
+	out, _ := json.Marshal(map[string][]int{"indices": indices})
+	buffers = append(buffers, out)
+	return uint64(uintptr(unsafe.Pointer(unsafe.SliceData(out))))<<32 | uint64(len(out))
+}
+
+func main() {}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxCollectionSize caps the quotes named in one ?ids= collection.
+const maxCollectionSize = 500
+
+// exportHandler serves GET /v1/export/{format}, rendering the selected
+// quotes as a PDF booklet or an EPUB book, or streaming them as NDJSON.
+// ?ids= exports a hand-picked collection, in the order given, instead of
+// a selection. Without an API key, a selection is cut to its first
+// anonymousStreamLimit quotes, whatever the format.
+func (s *server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("ids") {
+		collection, err := s.collection(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.writeExport(w, r, collection, true)
+		return
+	}
+	if r.PathValue("format") == "ndjson" {
+		s.streamQuotes(w, r, 0, 0, "quotes.ndjson")
+		return
+	}
+	selected, err := s.selectQuotes(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Rendering is costlier than streaming, so anonymous books are capped
+	// like anonymous streams.
+	if limit := streamLimit(r); limit > 0 {
+		selected = selected[:min(len(selected), limit)]
+	}
+	s.writeExport(w, r, selected, true)
+}
+
+// collection returns the quotes named by ?ids=, a comma-separated list of
+// quote IDs.
+func (s *server) collection(r *http.Request) ([]Quote, error) {
+	query := r.URL.Query()
+	for _, selector := range []string{"author", "tag", "q", "filter"} {
+		if query.Has(selector) {
+			return nil, errors.New("ids cannot be combined with " + selector)
+		}
+	}
+	fields := strings.Split(query.Get("ids"), ",")
+	if len(fields) > maxCollectionSize {
+		return nil, fmt.Errorf("a collection holds at most %d quotes", maxCollectionSize)
+	}
+	byID := indexQuotes(s.store.Quotes())
+	quotes := make([]Quote, 0, len(fields))
+	for _, f := range fields {
+		id, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, errors.New("ids must be a comma-separated list of quote IDs")
+		}
+		q, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("quote %d not found", id)
+		}
+		quotes = append(quotes, q)
+	}
+	return quotes, nil
+}
+
+// writeExport renders quotes in the format named by the path, titled by
+// ?title=. Public exports may be cached by the CDN; personal ones may not.
+func (s *server) writeExport(w http.ResponseWriter, r *http.Request, quotes []Quote, public bool) {
+	format := r.PathValue("format")
+	if format != "pdf" && format != "epub" && format != "ndjson" {
+		writeError(w, http.StatusNotFound, "unknown export format, use pdf, epub or ndjson")
+		return
+	}
+	if len(quotes) == 0 {
+		writeError(w, http.StatusNotFound, "no quotes match the selection")
+		return
+	}
+	// Only successful responses may be cached.
+	cache := func() {
+		if public {
+			s.cdn.cacheable(w, true, quotes...)
+		} else {
+			s.cdn.uncacheable(w)
+		}
+	}
+	if format == "ndjson" {
+		out, ok := newNDJSONWriter(w, r, "quotes.ndjson")
+		if !ok {
+			return
+		}
+		cache()
+		for _, q := range quotes {
+			if out.write(q) != nil {
+				return
+			}
+		}
+		out.flush()
+		return
+	}
+
+	title := r.URL.Query().Get("title")
+	if title == "" {
+		title = "Quotes"
+	}
+	var (
+		body        []byte
+		contentType string
+		err         error
+	)
+	if format == "pdf" {
+		body, err = renderPDF(title, quotes)
+		contentType = "application/pdf"
+	} else {
+		body, err = renderEPUB(title, quotes)
+		contentType = "application/epub+zip"
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "could not render export")
+		return
+	}
+	cache()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="quotes.`+format+`"`)
+	w.Write(body)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportServer(quotes []Quote) http.Handler {
+	s := &server{store: newMemoryStore(quotes), cdn: newCDN(time.Minute, nil)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/export/{format}", s.exportHandler)
+	return mux
+}
+
+func export(h http.Handler, path, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if key != "" {
+		r.Header.Set(apiKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+var (
+	pdfStream   = regexp.MustCompile(`(?s)<< (/Length1 \d+ )?/Filter /FlateDecode /Length \d+ >>\nstream\n(.*?)\nendstream`)
+	pdfShowText = regexp.MustCompile(`/F\d ([\d.]+) Tf [\d.]+ ([\d.]+) Td`)
+)
+
+// pdfLine is a line of text on a page of a rendered PDF.
+type pdfLine struct {
+	size, y float64
+}
+
+// pdfPages returns the lines of text on each page of a PDF from writePDF.
+func pdfPages(t *testing.T, data []byte) [][]pdfLine {
+	t.Helper()
+	var pages [][]pdfLine
+	for _, m := range pdfStream.FindAllSubmatch(data, -1) {
+		if len(m[1]) > 0 {
+			continue // an embedded font
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(m[2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page []pdfLine
+		for _, l := range pdfShowText.FindAllSubmatch(content, -1) {
+			size, _ := strconv.ParseFloat(string(l[1]), 64)
+			y, _ := strconv.ParseFloat(string(l[2]), 64)
+			page = append(page, pdfLine{size, y})
+		}
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+func TestExportCollection(t *testing.T) {
+	h := exportServer(quizQuotes)
+	w := export(h, "/v1/export/pdf?ids=4,%202,4", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/pdf" {
+		t.Fatalf("exporting a collection = %d %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Surrogate-Key"); !strings.Contains(got, "quote-4") || !strings.Contains(got, "quote-2") || strings.Contains(got, "quote-1 ") {
+		t.Errorf("Surrogate-Key = %q, want the collection's quotes", got)
+	}
+
+	for path, want := range map[string]string{
+		"/v1/export/pdf?ids=1,99":         "quote 99 not found",
+		"/v1/export/pdf?ids=1,x":          "ids must be a comma-separated list of quote IDs",
+		"/v1/export/epub?ids=1&author=Ed": "ids cannot be combined with author",
+		"/v1/export/epub?ids=" + strings.Repeat("1,", maxCollectionSize) + "1": "a collection holds at most 500 quotes",
+	} {
+		if w := export(h, path, ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s = %d %s, want 400 %q", path, w.Code, w.Body, want)
+		}
+	}
+	if w := export(h, "/v1/export/docx?ids=1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown format = %d, want 404", w.Code)
+	}
+	if w := export(h, "/v1/export/pdf?author=Nobody", ""); w.Code != http.StatusNotFound || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("empty selection = %d with Cache-Control %q, want an uncached 404", w.Code, w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestExportAnonymousCap(t *testing.T) {
+	quotes := make([]Quote, anonymousStreamLimit+200)
+	for i := range quotes {
+		quotes[i] = Quote{ID: i + 1, Text: "Quote " + strconv.Itoa(i+1), Author: "Author"}
+	}
+	h := exportServer(quotes)
+	attributions := func(w *httptest.ResponseRecorder) int {
+		n := 0
+		for _, page := range pdfPages(t, w.Body.Bytes()) {
+			for _, l := range page {
+				if l.size == 11 {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	if n := attributions(export(h, "/v1/export/pdf", "")); n != anonymousStreamLimit {
+		t.Errorf("anonymous export has %d quotes, want %d", n, anonymousStreamLimit)
+	}
+	if n := attributions(export(h, "/v1/export/pdf", "qk_metered")); n != len(quotes) {
+		t.Errorf("keyed export has %d quotes, want all %d", n, len(quotes))
+	}
+}
+
+func TestRenderPDFPaginatesTitle(t *testing.T) {
+	data, err := renderPDF(strings.Repeat("A very long title ", 400), quizQuotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := pdfPages(t, data)
+	if len(pages) < 3 {
+		t.Fatalf("%d pages, want the title to run over several", len(pages))
+	}
+	for i, page := range pages {
+		for _, l := range page {
+			if l.size != 9 && l.y < pdfMargin+24 {
+				t.Errorf("page %d has a line at y=%g, below the bottom margin", i+1, l.y)
+			}
+		}
+	}
+	if !bytes.Contains(data, []byte("/Count "+strconv.Itoa(len(pages)))) {
+		t.Errorf("page tree does not count %d pages", len(pages))
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// favorites records the quotes each user has saved. Each user's favorites
+// are a hash in shared state, at favorites:<user>, from quote ID to the
+// time it was saved.
+type favorites struct {
+	store Store
+	state stateStore
+}
+
+func newFavorites(store Store, state stateStore) *favorites {
+	return &favorites{store: store, state: state}
+}
+
+func favoritesKey(userID string) string { return "favorites:" + userID }
+
+// routes registers the favorites API. export renders a list of quotes in
+// the format named by the request path.
+func (f *favorites) routes(mux *http.ServeMux, o *oauthServer, export func(http.ResponseWriter, *http.Request, []Quote, bool)) {
+	mux.HandleFunc("GET /v1/me/favorites", o.requireScope(scopeQuotesRead, f.listHandler))
+	mux.HandleFunc("GET /v1/me/favorites/export/{format}", o.requireScope(scopeQuotesRead, func(w http.ResponseWriter, r *http.Request, u user) {
+		list, err := f.list(r.Context(), u.ID)
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		quotes := make([]Quote, len(list))
+		for i, fav := range list {
+			quotes[i] = fav.Quote
+		}
+		export(w, r, quotes, false)
+	}))
+	mux.HandleFunc("PUT /v1/me/favorites/{id}", o.requireScope(scopeFavoritesWrite, f.addHandler))
+	mux.HandleFunc("DELETE /v1/me/favorites/{id}", o.requireScope(scopeFavoritesWrite, f.removeHandler))
+}
+
+type favorite struct {
+	Quote
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// saved returns the IDs of the user's favorites and when they were saved.
+func (f *favorites) saved(ctx context.Context, userID string) (map[int]time.Time, error) {
+	fields, err := f.state.hgetAll(ctx, favoritesKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	saved := make(map[int]time.Time, len(fields))
+	for k, v := range fields {
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		at, _ := time.Parse(time.RFC3339Nano, v)
+		saved[id] = at
+	}
+	return saved, nil
+}
+
+// list returns the user's favorites, most recently saved first. Quotes
+// that are no longer visible are left out.
+func (f *favorites) list(ctx context.Context, userID string) ([]favorite, error) {
+	saved, err := f.saved(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	list := []favorite{}
+	for id, at := range saved {
+		if q, ok := quoteByID(f.store, id); ok {
+			list = append(list, favorite{q, at})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].SavedAt.After(list[j].SavedAt) })
+	return list, nil
+}
+
+func (f *favorites) listHandler(w http.ResponseWriter, r *http.Request, u user) {
+	list, err := f.list(r.Context(), u.ID)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"favorites": list})
+}
+
+func (f *favorites) addHandler(w http.ResponseWriter, r *http.Request, u user) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errQuoteNotFound.Error())
+		return
+	}
+	if _, ok := quoteByID(f.store, id); !ok {
+		writeError(w, http.StatusNotFound, errQuoteNotFound.Error())
+		return
+	}
+	// Saving a favorite again keeps the time it was first saved.
+	saved, err := f.saved(r.Context(), u.ID)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if _, ok := saved[id]; !ok {
+		if err := f.state.hset(r.Context(), favoritesKey(u.ID), strconv.Itoa(id), time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+			stateError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *favorites) removeHandler(w http.ResponseWriter, r *http.Request, u user) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errQuoteNotFound.Error())
+		return
+	}
+	if err := f.state.hdel(r.Context(), favoritesKey(u.ID), strconv.Itoa(id)); err != nil {
+		stateError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *favorites) exportUser(userID string) (any, error) {
+	saved, err := f.saved(context.Background(), userID)
+	if err != nil || len(saved) == 0 {
+		return nil, err
+	}
+	type savedQuote struct {
+		QuoteID int       `json:"quote_id"`
+		SavedAt time.Time `json:"saved_at"`
+	}
+	list := []savedQuote{}
+	for id, at := range saved {
+		list = append(list, savedQuote{id, at})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].SavedAt.Before(list[j].SavedAt) })
+	return list, nil
+}
+
+func (f *favorites) eraseUser(userID string) error {
+	return f.state.del(context.Background(), favoritesKey(userID))
+}
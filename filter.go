@@ -0,0 +1,727 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The filter language lets clients select quotes with expressions such as
+//
+//	(author == "Winston Churchill" or author contains "Roosevelt") and len(text) < 120 and not ("politics" in tags)
+//
+// Expressions are parsed into an AST, type-checked against the Quote fields
+// and then either evaluated in memory or compiled to a SQL WHERE clause.
+
+const (
+	maxFilterLength = 1024
+	maxFilterDepth  = 32
+)
+
+type filterType int
+
+const (
+	typeString filterType = iota
+	typeNumber
+	typeBool
+	typeList // list of strings or numbers
+)
+
+func (t filterType) String() string {
+	return [...]string{"string", "number", "bool", "list"}[t]
+}
+
+// filterFields maps the filterable Quote fields to their types.
+var filterFields = map[string]filterType{
+	"id":     typeNumber,
+	"text":   typeString,
+	"author": typeString,
+	"tags":   typeList,
+}
+
+// filterExpr is a parsed and type-checked filter.
+type filterExpr struct {
+	root node
+	src  string
+}
+
+func (f *filterExpr) String() string { return f.src }
+
+// match reports whether q satisfies the filter.
+func (f *filterExpr) match(q Quote) bool {
+	return f.root.eval(q).(bool)
+}
+
+// node is an element of the filter AST. Types are resolved at parse time,
+// so eval never sees mismatched operands.
+type node interface {
+	typ() filterType
+	eval(q Quote) any
+}
+
+type fieldNode struct{ name string }
+
+type literalNode struct {
+	t filterType
+	v any // string, float64, bool or []any
+}
+
+type callNode struct {
+	fn  string
+	arg node
+}
+
+type notNode struct{ x node }
+
+type binaryNode struct {
+	op   string
+	l, r node
+}
+
+func (n *fieldNode) typ() filterType   { return filterFields[n.name] }
+func (n *literalNode) typ() filterType { return n.t }
+func (n *notNode) typ() filterType     { return typeBool }
+func (n *binaryNode) typ() filterType  { return typeBool }
+
+func (n *callNode) typ() filterType {
+	if n.fn == "len" {
+		return typeNumber
+	}
+	return typeString
+}
+
+func (n *fieldNode) eval(q Quote) any {
+	switch n.name {
+	case "id":
+		return float64(q.ID)
+	case "text":
+		return q.Text
+	case "author":
+		return q.Author
+	default:
+		tags := make([]any, len(q.Tags))
+		for i, t := range q.Tags {
+			tags[i] = t
+		}
+		return tags
+	}
+}
+
+func (n *literalNode) eval(Quote) any { return n.v }
+
+func (n *callNode) eval(q Quote) any {
+	v := n.arg.eval(q)
+	switch n.fn {
+	case "len":
+		if s, ok := v.(string); ok {
+			return float64(len([]rune(s)))
+		}
+		return float64(len(v.([]any)))
+	default: // lower
+		return strings.ToLower(v.(string))
+	}
+}
+
+func (n *notNode) eval(q Quote) any { return !n.x.eval(q).(bool) }
+
+func (n *binaryNode) eval(q Quote) any {
+	switch n.op {
+	case "and":
+		return n.l.eval(q).(bool) && n.r.eval(q).(bool)
+	case "or":
+		return n.l.eval(q).(bool) || n.r.eval(q).(bool)
+	}
+
+	l, r := n.l.eval(q), n.r.eval(q)
+	switch n.op {
+	case "==":
+		return l == r
+	case "!=":
+		return l != r
+	case "in":
+		return listContains(r.([]any), l)
+	case "contains":
+		if list, ok := l.([]any); ok {
+			return listContains(list, r)
+		}
+		return strings.Contains(l.(string), r.(string))
+	}
+
+	// Ordering comparisons work on numbers or on strings.
+	var cmp int
+	if ls, ok := l.(string); ok {
+		cmp = strings.Compare(ls, r.(string))
+	} else {
+		lf, rf := l.(float64), r.(float64)
+		switch {
+		case lf < rf:
+			cmp = -1
+		case lf > rf:
+			cmp = 1
+		}
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func listContains(list []any, v any) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// filterError reports a problem in a filter along with the byte offset at
+// which it was found.
+type filterError struct {
+	pos int
+	msg string
+}
+
+func (e *filterError) Error() string {
+	return fmt.Sprintf("filter: %s at position %d", e.msg, e.pos)
+}
+
+// parseFilter parses and type-checks src. The result always evaluates to a bool.
+func parseFilter(src string) (*filterExpr, error) {
+	if len(src) > maxFilterLength {
+		return nil, fmt.Errorf("filter: longer than %d characters", maxFilterLength)
+	}
+	toks, err := lexFilter(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &filterError{t.pos, fmt.Sprintf("unexpected %q", t.text)}
+	}
+	if root.typ() != typeBool {
+		return nil, &filterError{0, "expression must be a condition, not a " + root.typ().String()}
+	}
+	return &filterExpr{root: root, src: src}, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp // comparison operators and punctuation
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lexFilter(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentByte(src[i]) && !isDigit(src[i]):
+			start := i
+			for i < len(src) && isIdentByte(src[i]) {
+				i++
+			}
+			toks = append(toks, token{tokIdent, src[start:i], start})
+		case isDigit(src[i]):
+			start := i
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			toks = append(toks, token{tokNumber, src[start:i], start})
+		case c == '"' || c == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(src) {
+					return nil, &filterError{start, "unterminated string"}
+				}
+				if src[i] == c {
+					i++
+					break
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			toks = append(toks, token{tokString, sb.String(), start})
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, &filterError{i, fmt.Sprintf("unexpected character %q", c)}
+			}
+			toks = append(toks, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{tokEOF, "end of filter", len(src)}), nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentByte(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+type filterParser struct {
+	toks  []token
+	pos   int
+	depth int
+}
+
+func (p *filterParser) peek() token { return p.toks[p.pos] }
+
+func (p *filterParser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is one of the given words or
+// operators; keywords are matched case-insensitively.
+func (p *filterParser) accept(words ...string) (token, bool) {
+	t := p.peek()
+	if t.kind != tokIdent && t.kind != tokOp {
+		return t, false
+	}
+	for _, w := range words {
+		if strings.EqualFold(t.text, w) {
+			return p.next(), true
+		}
+	}
+	return t, false
+}
+
+func (p *filterParser) expect(op string) error {
+	if t, ok := p.accept(op); !ok {
+		return &filterError{t.pos, fmt.Sprintf("expected %q, found %q", op, t.text)}
+	}
+	return nil
+}
+
+func (p *filterParser) enter() error {
+	p.depth++
+	if p.depth > maxFilterDepth {
+		return &filterError{p.peek().pos, "expression nested too deeply"}
+	}
+	return nil
+}
+
+// or := and ("or" and)*
+func (p *filterParser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.accept("or", "||")
+		if !ok {
+			return l, nil
+		}
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if l, err = logical(t, "or", l, r); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// and := not ("and" not)*
+func (p *filterParser) parseAnd() (node, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.accept("and", "&&")
+		if !ok {
+			return l, nil
+		}
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if l, err = logical(t, "and", l, r); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func logical(t token, op string, l, r node) (node, error) {
+	if l.typ() != typeBool || r.typ() != typeBool {
+		return nil, &filterError{t.pos, fmt.Sprintf("%q needs conditions on both sides", t.text)}
+	}
+	return &binaryNode{op: op, l: l, r: r}, nil
+}
+
+// not := ("not" | "!") not | comparison
+func (p *filterParser) parseNot() (node, error) {
+	if t, ok := p.accept("not", "!"); ok {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseNot()
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		if x.typ() != typeBool {
+			return nil, &filterError{t.pos, "not needs a condition"}
+		}
+		return &notNode{x}, nil
+	}
+	return p.parseComparison()
+}
+
+// comparison := operand (op operand)?
+func (p *filterParser) parseComparison() (node, error) {
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	// "x not in y" and "x not contains y" negate the membership tests.
+	negate := false
+	if t := p.peek(); t.kind == tokIdent && strings.EqualFold(t.text, "not") {
+		if n := p.toks[p.pos+1]; n.kind == tokIdent && (strings.EqualFold(n.text, "in") || strings.EqualFold(n.text, "contains")) {
+			p.next()
+			negate = true
+		}
+	}
+	t, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "in", "contains")
+	if !ok {
+		return l, nil
+	}
+	r, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := strings.ToLower(t.text)
+	lt, rt := l.typ(), r.typ()
+
+	valid := false
+	switch op {
+	case "==", "!=":
+		valid = lt == rt && lt != typeList
+	case "<", "<=", ">", ">=":
+		valid = lt == rt && (lt == typeString || lt == typeNumber)
+	case "in":
+		valid = rt == typeList && (lt == typeString || lt == typeNumber) && holds(r, lt)
+	case "contains":
+		valid = lt == typeString && rt == typeString ||
+			lt == typeList && (rt == typeString || rt == typeNumber) && holds(l, rt)
+	}
+	if !valid {
+		return nil, &filterError{t.pos, fmt.Sprintf("cannot apply %q to %s and %s", t.text, describeType(l), describeType(r))}
+	}
+	if negate {
+		return &notNode{&binaryNode{op: op, l: l, r: r}}, nil
+	}
+	return &binaryNode{op: op, l: l, r: r}, nil
+}
+
+// holds reports whether the list operand n can hold items of type t. An
+// empty literal list holds anything.
+func holds(n node, t filterType) bool {
+	item, ok := listItemType(n)
+	return !ok || item == t
+}
+
+// listItemType returns the type of the items of the list operand n, and
+// false for an empty literal list.
+func listItemType(n node) (filterType, bool) {
+	lit, ok := n.(*literalNode)
+	if !ok {
+		return typeString, true // tags
+	}
+	items := lit.v.([]any)
+	if len(items) == 0 {
+		return 0, false
+	}
+	if _, ok := items[0].(string); ok {
+		return typeString, true
+	}
+	return typeNumber, true
+}
+
+// describeType names the type of n for error messages, including the item
+// type of lists.
+func describeType(n node) string {
+	if n.typ() != typeList {
+		return n.typ().String()
+	}
+	if item, ok := listItemType(n); ok {
+		return "list of " + item.String() + "s"
+	}
+	return "empty list"
+}
+
+// operand := "(" or ")" | list | call | field | literal
+func (p *filterParser) parseOperand() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return &literalNode{typeString, t.text}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &filterError{t.pos, fmt.Sprintf("invalid number %q", t.text)}
+		}
+		return &literalNode{typeNumber, f}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			x, err := p.parseOr()
+			p.depth--
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			x, err := p.parseList(t)
+			p.depth--
+			return x, err
+		}
+	case tokIdent:
+		name := strings.ToLower(t.text)
+		switch name {
+		case "true", "false":
+			return &literalNode{typeBool, name == "true"}, nil
+		case "len", "lower":
+			return p.parseCall(t, name)
+		}
+		if _, ok := filterFields[name]; ok {
+			return &fieldNode{name}, nil
+		}
+		return nil, &filterError{t.pos, fmt.Sprintf("unknown field %q", t.text)}
+	}
+	return nil, &filterError{t.pos, fmt.Sprintf("unexpected %q", t.text)}
+}
+
+func (p *filterParser) parseCall(t token, fn string) (node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	arg, err := p.parseOperand()
+	p.depth--
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	at := arg.typ()
+	if (fn == "len" && at != typeString && at != typeList) || (fn == "lower" && at != typeString) {
+		return nil, &filterError{t.pos, fmt.Sprintf("%s() does not accept a %s", fn, at)}
+	}
+	return &callNode{fn: fn, arg: arg}, nil
+}
+
+// parseList parses a literal list such as ["a", "b"]. Items must be string
+// or number literals of a single type.
+func (p *filterParser) parseList(open token) (node, error) {
+	var items []any
+	var itemType filterType
+	for {
+		if _, ok := p.accept("]"); ok && len(items) == 0 {
+			break
+		}
+		item, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		lit, ok := item.(*literalNode)
+		if !ok || (lit.t != typeString && lit.t != typeNumber) {
+			return nil, &filterError{open.pos, "lists may only contain string or number literals"}
+		}
+		if len(items) > 0 && lit.t != itemType {
+			return nil, &filterError{open.pos, "list items must all have the same type"}
+		}
+		itemType = lit.t
+		items = append(items, lit.v)
+		if _, ok := p.accept("]"); ok {
+			break
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+	return &literalNode{typeList, items}, nil
+}
+
+// filterStore is implemented by stores that can evaluate a filter natively,
+// such as database stores pushing it down with filterExpr.sql. Other stores
+// are filtered in memory.
+type filterStore interface {
+	FilterQuotes(f *filterExpr) ([]Quote, error)
+}
+
+// applyFilter returns the visible quotes in store that match f, or all of
+// them if f is nil.
+func applyFilter(store Store, f *filterExpr) ([]Quote, error) {
+	if f == nil {
+		return store.Quotes(), nil
+	}
+	if fs, ok := store.(filterStore); ok {
+		return fs.FilterQuotes(f)
+	}
+	var matched []Quote
+	for _, q := range store.Quotes() {
+		if f.match(q) {
+			matched = append(matched, q)
+		}
+	}
+	return matched, nil
+}
+
+// errSQLUnsupported is returned by sql when part of a filter has no SQL
+// translation; stores should then fall back to filtering in memory.
+var errSQLUnsupported = errors.New("filter: expression cannot be translated to SQL")
+
+// sql compiles the filter to a WHERE clause with ? placeholders. It assumes
+// a quotes table with id, text and author columns and tags stored one per
+// row in quote_tags(quote_id, tag). Comparisons match the in-memory ones
+// only under a binary collation.
+func (f *filterExpr) sql() (string, []any, error) {
+	var args []any
+	where, err := toSQL(f.root, &args)
+	if err != nil {
+		return "", nil, err
+	}
+	return where, args, nil
+}
+
+const tagsSubquery = "SELECT tag FROM quote_tags WHERE quote_tags.quote_id = quotes.id"
+
+func toSQL(n node, args *[]any) (string, error) {
+	switch n := n.(type) {
+	case *fieldNode:
+		if n.name == "tags" {
+			return "", errSQLUnsupported
+		}
+		return "quotes." + n.name, nil
+	case *literalNode:
+		switch v := n.v.(type) {
+		case bool:
+			if v {
+				return "(1 = 1)", nil
+			}
+			return "(1 = 0)", nil
+		case []any:
+			marks := make([]string, len(v))
+			for i := range v {
+				marks[i] = "?"
+			}
+			*args = append(*args, v...)
+			return "(" + strings.Join(marks, ", ") + ")", nil
+		default:
+			*args = append(*args, v)
+			return "?", nil
+		}
+	case *callNode:
+		if n.fn == "len" {
+			if f, ok := n.arg.(*fieldNode); ok && f.name == "tags" {
+				return "(SELECT COUNT(*) FROM quote_tags WHERE quote_tags.quote_id = quotes.id)", nil
+			}
+			if _, ok := n.arg.(*literalNode); ok && n.arg.typ() == typeList {
+				return "", errSQLUnsupported
+			}
+			arg, err := toSQL(n.arg, args)
+			return "CHAR_LENGTH(" + arg + ")", err
+		}
+		arg, err := toSQL(n.arg, args)
+		return "LOWER(" + arg + ")", err
+	case *notNode:
+		x, err := toSQL(n.x, args)
+		return "(NOT " + x + ")", err
+	case *binaryNode:
+		return binaryToSQL(n, args)
+	}
+	return "", errSQLUnsupported
+}
+
+func binaryToSQL(n *binaryNode, args *[]any) (string, error) {
+	// Membership in a list is written "x in list" or "list contains x".
+	if n.op == "contains" && n.l.typ() == typeList {
+		n = &binaryNode{op: "in", l: n.r, r: n.l}
+	}
+	if f, ok := n.r.(*fieldNode); ok && n.op == "in" && f.name == "tags" {
+		l, err := toSQL(n.l, args)
+		return "(" + l + " IN (" + tagsSubquery + "))", err
+	}
+	if lit, ok := n.r.(*literalNode); ok && n.op == "in" && len(lit.v.([]any)) == 0 {
+		return "(1 = 0)", nil
+	}
+	if n.op == "contains" {
+		// Substring search needs a literal we can escape for LIKE.
+		lit, ok := n.r.(*literalNode)
+		if !ok {
+			return "", errSQLUnsupported
+		}
+		l, err := toSQL(n.l, args)
+		if err != nil {
+			return "", err
+		}
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(lit.v.(string))
+		*args = append(*args, "%"+escaped+"%")
+		return "(" + l + ` LIKE ? ESCAPE '\')`, nil
+	}
+
+	l, err := toSQL(n.l, args)
+	if err != nil {
+		return "", err
+	}
+	r, err := toSQL(n.r, args)
+	if err != nil {
+		return "", err
+	}
+	op := map[string]string{"and": "AND", "or": "OR", "==": "=", "!=": "<>", "in": "IN"}[n.op]
+	if op == "" {
+		op = n.op
+	}
+	return "(" + l + " " + op + " " + r + ")", nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []int // IDs of quizQuotes that match
+	}{
+		{`author == "Steve Jobs"`, []int{1}},
+		{`author != "Steve Jobs" and "software" in tags`, []int{2, 3, 4}},
+		{`tags contains "life" || id >= 4`, []int{1, 4, 5}},
+		{`not (id < 3) && len(text) < 40`, []int{3, 5}},
+		{`lower(author) contains "knuth"`, []int{4}},
+		{`id in [2, 5, 9]`, []int{2, 5}},
+		{`[2, 5] contains id`, []int{2, 5}},
+		{`"software" not in tags`, []int{1, 5}},
+		{`author not contains "e"`, []int{3, 4}},
+		{`id in []`, nil},
+		{`len(tags) == 1 AND author > "M"`, []int{1, 5}},
+		{`text contains 'code.'`, []int{3}},
+		{`true`, []int{1, 2, 3, 4, 5}},
+	}
+	for _, tt := range tests {
+		f, err := parseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("parseFilter(%s): %v", tt.filter, err)
+			continue
+		}
+		var got []int
+		for _, q := range quizQuotes {
+			if f.match(q) {
+				got = append(got, q.ID)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s matched %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for filter, want := range map[string]string{
+		`author == `:                        "unexpected \"end of filter\" at position 10",
+		`author = "x"`:                      "unexpected character '=' at position 7",
+		`writer == "x"`:                     "unknown field \"writer\" at position 0",
+		`id == "1"`:                         "cannot apply \"==\" to number and string at position 3",
+		`id in ["1"]`:                       "cannot apply \"in\" to number and list of strings at position 3",
+		`tags contains 1`:                   "cannot apply \"contains\" to list of strings and number at position 5",
+		`[1, "a"] contains id`:              "list items must all have the same type at position 0",
+		`id in [text]`:                      "lists may only contain string or number literals at position 6",
+		`len(id) > 1`:                       "len() does not accept a number at position 0",
+		`author`:                            "expression must be a condition, not a string at position 0",
+		`id > 1 and author`:                 "\"and\" needs conditions on both sides at position 7",
+		`(id > 1`:                           "expected \")\", found \"end of filter\" at position 7",
+		`author == "x`:                      "unterminated string at position 10",
+		`id > 1 id`:                         "unexpected \"id\" at position 7",
+		`id == 1.2.3`:                       "invalid number \"1.2.3\" at position 6",
+		strings.Repeat("(", 40) + "id":      "expression nested too deeply at position 33",
+		strings.Repeat("not ", 40) + "true": "expression nested too deeply at position 132",
+		"id in " + strings.Repeat("[", 40):  "expression nested too deeply at position 39",
+		strings.Repeat("len(", 40) + "text": "expression nested too deeply at position 132",
+	} {
+		_, err := parseFilter(filter)
+		if err == nil || err.Error() != "filter: "+want {
+			t.Errorf("parseFilter(%s) = %v, want %q", filter, err, want)
+		}
+	}
+	if _, err := parseFilter(strings.Repeat(" ", maxFilterLength+1)); err == nil {
+		t.Error("parseFilter() of an over-long filter = nil, want an error")
+	}
+}
+
+func TestFilterSQL(t *testing.T) {
+	tests := []struct {
+		filter string
+		where  string
+		args   []any
+	}{
+		{
+			`author == "Ann" and len(text) < 40`,
+			"((quotes.author = ?) AND (CHAR_LENGTH(quotes.text) < ?))",
+			[]any{"Ann", 40.0},
+		},
+		{
+			`"x" in tags or not (tags contains "y")`,
+			"((? IN (" + tagsSubquery + ")) OR (NOT (? IN (" + tagsSubquery + "))))",
+			[]any{"x", "y"},
+		},
+		{`id in [1, 2]`, "(quotes.id IN (?, ?))", []any{1.0, 2.0}},
+		{`[1, 2] contains id`, "(quotes.id IN (?, ?))", []any{1.0, 2.0}},
+		{`id not in []`, "(NOT (1 = 0))", nil},
+		{`lower(author) contains "50%_\\"`, `(LOWER(quotes.author) LIKE ? ESCAPE '\')`, []any{`%50\%\_\\%`}},
+		{`len(tags) > 2`, "((SELECT COUNT(*) FROM quote_tags WHERE quote_tags.quote_id = quotes.id) > ?)", []any{2.0}},
+	}
+	for _, tt := range tests {
+		f, err := parseFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("parseFilter(%s): %v", tt.filter, err)
+		}
+		where, args, err := f.sql()
+		if err != nil || where != tt.where || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("sql(%s) = %q %v %v, want %q %v", tt.filter, where, args, err, tt.where, tt.args)
+		}
+	}
+	// Matching a string against a column has no portable LIKE form.
+	for _, filter := range []string{`"Ann Smith" contains author`, `len(["a"]) == 1`} {
+		f, err := parseFilter(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := f.sql(); err != errSQLUnsupported {
+			t.Errorf("sql(%s) = %v, want errSQLUnsupported", filter, err)
+		}
+	}
+}
+
+// pushdownStore records the filters it is asked to evaluate.
+type pushdownStore struct {
+	*memoryStore
+	filters []string
+}
+
+func (s *pushdownStore) FilterQuotes(f *filterExpr) ([]Quote, error) {
+	s.filters = append(s.filters, f.String())
+	return s.memoryStore.Quotes()[:2], nil
+}
+
+func TestSelectQuotesPushesFilterDown(t *testing.T) {
+	store := &pushdownStore{memoryStore: newMemoryStore(quizQuotes)}
+	s := &server{store: store}
+	r := httptest.NewRequest("GET", "/v1/quotes?author=Edsger+Dijkstra&filter="+url.QueryEscape(`id > 0`), nil)
+	got, err := s.selectQuotes(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.filters) != 1 || store.filters[0] != "id > 0" {
+		t.Errorf("store was asked for %q, want the filter", store.filters)
+	}
+	// The other selectors still apply to what the store returns.
+	if len(got) != 1 || got[0].ID != 2 {
+		t.Errorf("selectQuotes() = %+v, want quote 2", got)
+	}
+}
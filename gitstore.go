@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// revisioner is implemented by stores whose content is versioned; the
+// revision is reported on every response.
+type revisioner interface {
+	Revision() string
+}
+
+// gitStore serves quotes from YAML and JSON files committed to a local git
+// checkout and keeps pulling it. Content is always read from a commit, never
+// the working tree, and a commit that fails validation is rejected while the
+// last good snapshot keeps being served.
+type gitStore struct {
+	dir  string // root of the checkout
+	path string // directory inside the repository holding quote files
+
+	snap      atomic.Pointer[gitSnapshot]
+	mu        sync.Mutex // serialises reloads
+	lastSeen  string     // last commit examined, good or bad
+	listeners []func()
+}
+
+type gitSnapshot struct {
+	revision string
+	quotes   []Quote
+	loadedAt time.Time
+}
+
+var (
+	contentReloads = newCounterVec("quote_content_reloads_total", "Git content reload attempts by result.", "result")
+
+	// servedContent is the store the content gauges report on: the last
+	// one created, which is the only one outside tests.
+	servedContent atomic.Pointer[gitStore]
+	contentGauges sync.Once
+)
+
+// newGitStore loads the current HEAD of the checkout at dir. The initial
+// load must succeed since there is no earlier snapshot to fall back on.
+func newGitStore(dir, path string) (*gitStore, error) {
+	s := &gitStore{dir: dir, path: strings.Trim(path, "/")}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	servedContent.Store(s)
+	contentGauges.Do(registerContentGauges)
+	return s, nil
+}
+
+func registerContentGauges() {
+	newGaugeFunc("quote_content_info", "Commit the served quote content was loaded from.", []string{"revision"}, func() []gaugeSample {
+		return []gaugeSample{{labelValues: []string{servedContent.Load().Revision()}, value: 1}}
+	})
+	newGaugeFunc("quote_content_quotes", "Number of quotes in the served snapshot that are visible now.", nil, func() []gaugeSample {
+		return []gaugeSample{{value: float64(len(servedContent.Load().Quotes()))}}
+	})
+	newGaugeFunc("quote_content_loaded_timestamp_seconds", "Unix time the served snapshot was loaded.", nil, func() []gaugeSample {
+		return []gaugeSample{{value: float64(servedContent.Load().snap.Load().loadedAt.Unix())}}
+	})
+}
+
+// Quotes returns the snapshot's quotes that are visible now, so a scheduled
+// quote committed ahead of time goes live at its publish_at.
+func (s *gitStore) Quotes() []Quote {
+	all := s.snap.Load().quotes
+	now := time.Now()
+	visible := make([]Quote, 0, len(all))
+	for _, q := range all {
+		if q.visible(now) {
+			visible = append(visible, q)
+		}
+	}
+	return visible
+}
+
+// RangeQuotes walks the current snapshot, which is never modified, so it
+// needs no copy.
+func (s *gitStore) RangeQuotes(fn func(Quote) bool) {
+	now := time.Now()
+	for _, q := range s.snap.Load().quotes {
+		if q.visible(now) && !fn(q) {
+			return
+		}
+	}
+}
+
+func (s *gitStore) Revision() string {
+	return s.snap.Load().revision
+}
+
+// run pulls and reloads the checkout every interval until ctx is done.
+func (s *gitStore) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.pull(ctx); err != nil {
+			log.Printf("git store: %v", err)
+		}
+	}
+}
+
+// pull fast-forwards the checkout from its upstream and reloads it.
+func (s *gitStore) pull(ctx context.Context) error {
+	if _, err := s.git(ctx, nil, "pull", "--ff-only", "--quiet"); err != nil {
+		contentReloads.inc("pull_error")
+		return fmt.Errorf("pull failed: %w", err)
+	}
+	if err := s.reload(); err != nil {
+		return fmt.Errorf("keeping revision %s: %w", s.Revision(), err)
+	}
+	return nil
+}
+
+// reload reads the quote files at HEAD and swaps them in if they validate.
+// A commit that has already been examined is skipped.
+func (s *gitStore) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	out, err := s.git(ctx, nil, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	rev := strings.TrimSpace(string(out))
+	if rev == s.lastSeen {
+		return nil
+	}
+	s.lastSeen = rev
+
+	quotes, err := s.load(ctx, rev)
+	if err != nil {
+		contentReloads.inc("rejected")
+		return fmt.Errorf("rejected commit %s: %w", rev, err)
+	}
+	s.snap.Store(&gitSnapshot{revision: rev, quotes: quotes, loadedAt: time.Now()})
+	contentReloads.inc("success")
+	log.Printf("git store: loaded %d quotes from %s", len(quotes), rev)
+	for _, fn := range s.listeners {
+		fn()
+	}
+	return nil
+}
+
+// Subscribe registers fn to be called after each successful reload.
+func (s *gitStore) Subscribe(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// load reads and validates every quote file under s.path at rev.
+func (s *gitStore) load(ctx context.Context, rev string) ([]Quote, error) {
+	// -z keeps git from quoting names with unusual characters.
+	args := []string{"ls-tree", "-r", "-z", "--name-only", rev}
+	if s.path != "" {
+		args = append(args, "--", s.path)
+	}
+	out, err := s.git(ctx, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		switch path.Ext(f) {
+		case ".json", ".yaml", ".yml":
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no quote files found")
+	}
+
+	// Fetch every blob in one round trip.
+	var req bytes.Buffer
+	for _, f := range files {
+		fmt.Fprintf(&req, "%s:%s\n", rev, f)
+	}
+	out, err = s.git(ctx, &req, "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	blobs := bufio.NewReader(bytes.NewReader(out))
+
+	var quotes []Quote
+	seen := make(map[int]string)
+	for _, f := range files {
+		data, err := readBatchBlob(blobs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		var fileQuotes []Quote
+		if path.Ext(f) == ".json" {
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.DisallowUnknownFields()
+			err = dec.Decode(&fileQuotes)
+		} else {
+			dec := yaml.NewDecoder(bytes.NewReader(data))
+			dec.KnownFields(true)
+			err = dec.Decode(&fileQuotes)
+		}
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		for _, q := range fileQuotes {
+			if err := validateQuote(q); err != nil {
+				return nil, fmt.Errorf("%s: %w", f, err)
+			}
+			if other, dup := seen[q.ID]; dup {
+				return nil, fmt.Errorf("%s: quote id %d already defined in %s", f, q.ID, other)
+			}
+			seen[q.ID] = f
+			quotes = append(quotes, q)
+		}
+	}
+	if len(quotes) == 0 {
+		return nil, errors.New("no quotes found")
+	}
+	return quotes, nil
+}
+
+// readBatchBlob reads one "<oid> <type> <size>\n<content>\n" record from the
+// output of git cat-file --batch.
+func readBatchBlob(r *bufio.Reader) ([]byte, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 || fields[1] != "blob" {
+		return nil, fmt.Errorf("unexpected object %q", strings.TrimSpace(header))
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size+1) // content plus trailing newline
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data[:size], nil
+}
+
+func validateQuote(q Quote) error {
+	switch {
+	case q.ID <= 0:
+		return fmt.Errorf("quote %q: id must be positive", q.Text)
+	case strings.TrimSpace(q.Text) == "":
+		return fmt.Errorf("quote %d: text is empty", q.ID)
+	case strings.TrimSpace(q.Author) == "":
+		return fmt.Errorf("quote %d: author is empty", q.ID)
+	case q.Status != "" && !validStatus(q.Status):
+		return fmt.Errorf("quote %d: unknown status %q", q.ID, q.Status)
+	case q.Status == statusScheduled && q.PublishAt == nil:
+		return fmt.Errorf("quote %d: scheduled without publish_at", q.ID)
+	}
+	return nil
+}
+
+func (s *gitStore) git(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", s.dir}, args...)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
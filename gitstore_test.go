@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitFixture is a bare repository standing in for the remote, a working
+// clone that commits and pushes to it, and the checkout the store reads.
+type gitFixture struct {
+	t        *testing.T
+	bare     string
+	work     string
+	checkout string
+}
+
+func newGitFixture(t *testing.T) *gitFixture {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	f := &gitFixture{
+		t:        t,
+		bare:     filepath.Join(root, "quotes.git"),
+		work:     filepath.Join(root, "work"),
+		checkout: filepath.Join(root, "checkout"),
+	}
+	f.run(root, "init", "--quiet", "--bare", "--initial-branch=main", f.bare)
+	f.run(root, "clone", "--quiet", f.bare, f.work)
+	f.run(f.work, "checkout", "--quiet", "-b", "main")
+	return f
+}
+
+func (f *gitFixture) run(dir string, args ...string) string {
+	f.t.Helper()
+	args = append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com", "-C", dir}, args...)
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		f.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes files into the working clone, pushes them and returns the
+// new commit.
+func (f *gitFixture) commit(msg string, files map[string]string) string {
+	f.t.Helper()
+	for name, content := range files {
+		p := filepath.Join(f.work, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			f.t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	f.run(f.work, "add", "-A")
+	f.run(f.work, "commit", "--quiet", "-m", msg)
+	f.run(f.work, "push", "--quiet", "origin", "main")
+	return f.run(f.work, "rev-parse", "HEAD")
+}
+
+// clone makes the checkout the store reads from.
+func (f *gitFixture) clone() {
+	f.t.Helper()
+	f.run(filepath.Dir(f.checkout), "clone", "--quiet", "--branch", "main", f.bare, f.checkout)
+}
+
+const (
+	goodYAML = `- id: 1
+  text: The only way to do great work is to love what you do.
+  author: Steve Jobs
+  tags: [work]
+- id: 2
+  text: Life is what happens when you're busy making other plans.
+  author: John Lennon
+`
+	goodJSON = `[{"id": 3, "text": "Stay hungry, stay foolish.", "author": "Steve Jobs"}]`
+)
+
+func quoteIDs(quotes []Quote) []int {
+	ids := make([]int, len(quotes))
+	for i, q := range quotes {
+		ids[i] = q.ID
+	}
+	return ids
+}
+
+func TestGitStoreLoadsHEAD(t *testing.T) {
+	f := newGitFixture(t)
+	rev := f.commit("initial", map[string]string{"quotes/a.yaml": goodYAML, "quotes/b.json": goodJSON, "README.md": "not quotes"})
+	f.clone()
+
+	s, err := newGitStore(f.checkout, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Revision(); got != rev {
+		t.Errorf("Revision() = %s, want %s", got, rev)
+	}
+	if got := quoteIDs(s.Quotes()); len(got) != 3 {
+		t.Errorf("loaded quotes %v, want 1, 2 and 3", got)
+	}
+}
+
+func TestGitStorePath(t *testing.T) {
+	f := newGitFixture(t)
+	f.commit("initial", map[string]string{"quotes/a.yaml": goodYAML, "drafts/b.json": goodJSON})
+	f.clone()
+
+	s, err := newGitStore(f.checkout, "/quotes/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := quoteIDs(s.Quotes()); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("loaded quotes %v, want only those under quotes/", got)
+	}
+}
+
+func TestGitStoreUnusualFileNames(t *testing.T) {
+	f := newGitFixture(t)
+	// git quotes names like these in its line-based output.
+	f.commit("initial", map[string]string{"quotes/café.yaml": goodYAML, "quotes/\"b\".json": goodJSON})
+	f.clone()
+
+	s, err := newGitStore(f.checkout, "quotes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := quoteIDs(s.Quotes()); len(got) != 3 {
+		t.Errorf("loaded quotes %v, want 1, 2 and 3", got)
+	}
+}
+
+func TestGitStorePullsNewCommits(t *testing.T) {
+	f := newGitFixture(t)
+	f.commit("initial", map[string]string{"a.yaml": goodYAML})
+	f.clone()
+	s, err := newGitStore(f.checkout, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := 0
+	s.Subscribe(func() { notified++ })
+
+	rev := f.commit("add a quote", map[string]string{"b.json": goodJSON})
+	if err := s.pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Revision(); got != rev {
+		t.Errorf("Revision() = %s after pull, want %s", got, rev)
+	}
+	if got := len(s.Quotes()); got != 3 {
+		t.Errorf("got %d quotes after pull, want 3", got)
+	}
+	if notified != 1 {
+		t.Errorf("listeners called %d times, want 1", notified)
+	}
+
+	// Pulling again with nothing new reloads nothing.
+	if err := s.pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if notified != 1 {
+		t.Errorf("listeners called %d times after an empty pull, want 1", notified)
+	}
+}
+
+func TestGitStoreRejectsInvalidCommits(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"malformed YAML", map[string]string{"a.yaml": "- id: [1\n"}, "a.yaml"},
+		{"unknown field", map[string]string{"b.json": `[{"id": 3, "text": "x", "author": "y", "autor": "z"}]`}, "unknown field"},
+		{"missing author", map[string]string{"b.json": `[{"id": 3, "text": "Stay hungry."}]`}, "author is empty"},
+		{"duplicate id", map[string]string{"b.json": `[{"id": 2, "text": "Stay hungry.", "author": "Steve Jobs"}]`}, "already defined"},
+		{"unknown status", map[string]string{"b.json": `[{"id": 3, "text": "x", "author": "y", "status": "gone"}]`}, "unknown status"},
+		{"scheduled without time", map[string]string{"b.json": `[{"id": 3, "text": "x", "author": "y", "status": "scheduled"}]`}, "publish_at"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newGitFixture(t)
+			good := f.commit("initial", map[string]string{"a.yaml": goodYAML})
+			f.clone()
+			s, err := newGitStore(f.checkout, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f.commit("break it", tt.files)
+			err = s.pull(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("pull() error = %v, want one mentioning %q", err, tt.want)
+			}
+			if got := s.Revision(); got != good {
+				t.Errorf("Revision() = %s after a bad commit, want last good %s", got, good)
+			}
+			if got := quoteIDs(s.Quotes()); len(got) != 2 {
+				t.Errorf("serving quotes %v after a bad commit, want the last good snapshot", got)
+			}
+
+			// A later good commit is picked up again.
+			fixed := f.commit("fix it", map[string]string{"a.yaml": goodYAML, "b.json": goodJSON})
+			if err := s.pull(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Revision(); got != fixed {
+				t.Errorf("Revision() = %s after the fix, want %s", got, fixed)
+			}
+		})
+	}
+}
+
+func TestGitStoreInitialLoadMustSucceed(t *testing.T) {
+	f := newGitFixture(t)
+	f.commit("initial", map[string]string{"a.yaml": "- id: 0\n  text: x\n  author: y\n"})
+	f.clone()
+	if _, err := newGitStore(f.checkout, ""); err == nil {
+		t.Fatal("newGitStore() accepted an invalid first commit")
+	}
+}
+
+func TestGitStoreReportsRevision(t *testing.T) {
+	f := newGitFixture(t)
+	rev := f.commit("initial", map[string]string{"a.yaml": goodYAML})
+	f.clone()
+	s, err := newGitStore(f.checkout, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := revisionHeader(s, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/quotes", nil))
+	if got := rec.Header().Get("X-Content-Revision"); got != rev {
+		t.Errorf("X-Content-Revision = %q, want %q", got, rev)
+	}
+
+	rec = httptest.NewRecorder()
+	metricsRegistry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `quote_content_info{revision="` + rev + `"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics do not report %s", want)
+	}
+	// Stores created by earlier tests do not register the metrics again.
+	for _, name := range []string{"quote_content_reloads_total", "quote_content_info", "quote_content_quotes"} {
+		if n := strings.Count(rec.Body.String(), "# TYPE "+name+" "); n != 1 {
+			t.Errorf("metrics describe %s %d times, want once", name, n)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// hnswIndex is an in-process approximate nearest neighbour index using
+// Hierarchical Navigable Small World graphs (Malkov & Yashunin, 2016).
+// Vectors are L2-normalised on insert so similarity is a dot product.
+// Inserts are not safe for concurrent use, but once the index is built any
+// number of searches may run at once.
+type hnswIndex struct {
+	m              int // links per node on upper layers
+	mMax0          int // links per node on layer 0
+	efConstruction int
+	levelMult      float64
+	rng            *rand.Rand
+
+	nodes    []hnswNode
+	entry    int // -1 while empty
+	maxLevel int
+}
+
+type hnswNode struct {
+	id    int
+	vec   []float32
+	links [][]int // per layer, indexes into nodes
+}
+
+type hnswResult struct {
+	id    int
+	score float64 // cosine similarity
+}
+
+func newHNSWIndex(m, efConstruction int) *hnswIndex {
+	return &hnswIndex{
+		m:              m,
+		mMax0:          2 * m,
+		efConstruction: efConstruction,
+		levelMult:      1 / math.Log(float64(m)),
+		rng:            rand.New(rand.NewSource(1)), // deterministic graph for a given corpus
+		entry:          -1,
+	}
+}
+
+func (h *hnswIndex) len() int { return len(h.nodes) }
+
+func (h *hnswIndex) insert(id int, vec []float32) {
+	vec = normalize(vec)
+	level := int(math.Floor(-math.Log(1-h.rng.Float64()) * h.levelMult))
+	n := len(h.nodes)
+	h.nodes = append(h.nodes, hnswNode{id: id, vec: vec, links: make([][]int, level+1)})
+	if h.entry < 0 {
+		h.entry, h.maxLevel = n, level
+		return
+	}
+
+	ep := h.entry
+	for l := h.maxLevel; l > level; l-- {
+		ep = h.searchLayer(vec, []int{ep}, 1, l)[0].node
+	}
+	for l := min(level, h.maxLevel); l >= 0; l-- {
+		found := h.searchLayer(vec, []int{ep}, h.efConstruction, l)
+		limit := h.m
+		if l == 0 {
+			limit = h.mMax0
+		}
+		for i := 0; i < len(found) && i < h.m; i++ {
+			nb := found[i].node
+			h.nodes[n].links[l] = append(h.nodes[n].links[l], nb)
+			h.nodes[nb].links[l] = append(h.nodes[nb].links[l], n)
+			if len(h.nodes[nb].links[l]) > limit {
+				h.prune(nb, l, limit)
+			}
+		}
+		ep = found[0].node
+	}
+	if level > h.maxLevel {
+		h.entry, h.maxLevel = n, level
+	}
+}
+
+// prune keeps only the limit closest links of node on layer l.
+func (h *hnswIndex) prune(node, l, limit int) {
+	links := h.nodes[node].links[l]
+	sort.Slice(links, func(i, j int) bool {
+		return dot(h.nodes[node].vec, h.nodes[links[i]].vec) > dot(h.nodes[node].vec, h.nodes[links[j]].vec)
+	})
+	h.nodes[node].links[l] = links[:limit]
+}
+
+// search returns up to k nearest neighbours of q, best first. ef trades
+// recall for speed and is raised to k if smaller.
+func (h *hnswIndex) search(q []float32, k, ef int) []hnswResult {
+	if h.entry < 0 {
+		return nil
+	}
+	q = normalize(q)
+	ep := h.entry
+	for l := h.maxLevel; l > 0; l-- {
+		ep = h.searchLayer(q, []int{ep}, 1, l)[0].node
+	}
+	found := h.searchLayer(q, []int{ep}, max(ef, k), 0)
+	if len(found) > k {
+		found = found[:k]
+	}
+	results := make([]hnswResult, len(found))
+	for i, c := range found {
+		results[i] = hnswResult{id: h.nodes[c.node].id, score: c.sim}
+	}
+	return results
+}
+
+// searchLayer is the greedy beam search of the HNSW paper. It returns up
+// to ef nodes ordered by decreasing similarity to q.
+func (h *hnswIndex) searchLayer(q []float32, entries []int, ef, l int) []hnswCandidate {
+	visited := make(map[int]bool)
+	candidates := &candidateHeap{best: true}
+	results := &candidateHeap{}
+	for _, e := range entries {
+		c := hnswCandidate{e, dot(q, h.nodes[e].vec)}
+		visited[e] = true
+		heap.Push(candidates, c)
+		heap.Push(results, c)
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && c.sim < results.items[0].sim {
+			break
+		}
+		for _, nb := range h.nodes[c.node].links[l] {
+			if visited[nb] {
+				continue
+			}
+			visited[nb] = true
+			sim := dot(q, h.nodes[nb].vec)
+			if results.Len() < ef || sim > results.items[0].sim {
+				heap.Push(candidates, hnswCandidate{nb, sim})
+				heap.Push(results, hnswCandidate{nb, sim})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	out := results.items
+	sort.Slice(out, func(i, j int) bool { return out[i].sim > out[j].sim })
+	return out
+}
+
+type hnswCandidate struct {
+	node int
+	sim  float64
+}
+
+// candidateHeap pops the most similar candidate first when best is set and
+// the least similar otherwise.
+type candidateHeap struct {
+	items []hnswCandidate
+	best  bool
+}
+
+func (c *candidateHeap) Len() int { return len(c.items) }
+func (c *candidateHeap) Less(i, j int) bool {
+	if c.best {
+		return c.items[i].sim > c.items[j].sim
+	}
+	return c.items[i].sim < c.items[j].sim
+}
+func (c *candidateHeap) Swap(i, j int) { c.items[i], c.items[j] = c.items[j], c.items[i] }
+func (c *candidateHeap) Push(x any)    { c.items = append(c.items, x.(hnswCandidate)) }
+func (c *candidateHeap) Pop() any {
+	last := c.items[len(c.items)-1]
+	c.items = c.items[:len(c.items)-1]
+	return last
+}
+
+func dot(a, b []float32) float64 {
+	var s float64
+	for i := range a {
+		s += float64(a[i]) * float64(b[i])
+	}
+	return s
+}
+
+func normalize(v []float32) []float32 {
+	norm := math.Sqrt(dot(v, v))
+	out := make([]float32, len(v))
+	if norm == 0 {
+		return out
+	}
+	for i, x := range v {
+		out[i] = float32(float64(x) / norm)
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func randomVectors(rng *rand.Rand, n, dim int) [][]float32 {
+	vecs := make([][]float32, n)
+	for i := range vecs {
+		vecs[i] = make([]float32, dim)
+		for j := range vecs[i] {
+			vecs[i][j] = float32(rng.NormFloat64())
+		}
+	}
+	return vecs
+}
+
+// TestHNSWRecall checks the index against an exhaustive search.
+func TestHNSWRecall(t *testing.T) {
+	const n, dim, k = 2000, 32, 10
+	rng := rand.New(rand.NewSource(7))
+	vecs := randomVectors(rng, n, dim)
+	index := newHNSWIndex(16, 200)
+	for i, v := range vecs {
+		index.insert(i, v)
+	}
+	if index.len() != n {
+		t.Fatalf("len() = %d, want %d", index.len(), n)
+	}
+
+	normed := make([][]float32, n)
+	for i, v := range vecs {
+		normed[i] = normalize(v)
+	}
+	found, total := 0, 0
+	for _, q := range randomVectors(rng, 100, dim) {
+		nq := normalize(q)
+		exact, scores := make([]int, n), make([]float64, n)
+		for i := range exact {
+			exact[i], scores[i] = i, dot(nq, normed[i])
+		}
+		sort.Slice(exact, func(a, b int) bool { return scores[exact[a]] > scores[exact[b]] })
+		want := make(map[int]bool, k)
+		for _, id := range exact[:k] {
+			want[id] = true
+		}
+
+		results := index.search(q, k, 64)
+		if len(results) != k {
+			t.Fatalf("search() returned %d results, want %d", len(results), k)
+		}
+		for i, r := range results {
+			if i > 0 && r.score > results[i-1].score {
+				t.Fatalf("results are not ordered by score: %v", results)
+			}
+			if want[r.id] {
+				found++
+			}
+		}
+		total += k
+	}
+	if recall := float64(found) / float64(total); recall < 0.95 {
+		t.Errorf("recall@%d = %.3f, want at least 0.95", k, recall)
+	}
+}
+
+func TestHNSWSmallIndexes(t *testing.T) {
+	index := newHNSWIndex(16, 200)
+	if got := index.search([]float32{1, 0}, 3, 64); got != nil {
+		t.Errorf("search() of an empty index = %v, want nothing", got)
+	}
+	index.insert(1, []float32{1, 0})
+	index.insert(2, []float32{0, 3})
+	index.insert(3, []float32{1, 1})
+	got := index.search([]float32{2, 0.1}, 5, 1)
+	if len(got) != 3 || got[0].id != 1 || got[1].id != 3 || got[2].id != 2 {
+		t.Errorf("search() = %v, want all three by similarity", got)
+	}
+	if got[0].score < 0.99 || got[0].score > 1.0001 {
+		t.Errorf("score of the nearest vector = %f, want its cosine similarity", got[0].score)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// tlsServers serves the API over HTTPS and, optionally, over HTTP/3 on the
+// same port, alongside the plain HTTP listener that sits behind the load
+// balancer. Both share the handler chain.
+type tlsServers struct {
+	https *http.Server
+	h3    *http3.Server // nil unless HTTP3 is set
+}
+
+// tlsFromEnv reads the certificate and key from TLS_CERT and TLS_KEY and
+// the address from TLS_ADDR (default :8443). HTTP3=1 adds a QUIC listener
+// on the same port, advertised to HTTPS clients with Alt-Svc. It returns nil
+// when no certificate is configured.
+func tlsFromEnv(handler http.Handler) (*tlsServers, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		if os.Getenv("HTTP3") != "" {
+			return nil, errors.New("HTTP3 needs TLS_CERT and TLS_KEY")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	addr := os.Getenv("TLS_ADDR")
+	if addr == "" {
+		addr = ":8443"
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	t := &tlsServers{https: &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}}
+	if os.Getenv("HTTP3") != "" {
+		t.h3 = &http3.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+		t.https.Handler = t.altSvc(handler)
+	}
+	return t, nil
+}
+
+// altSvc tells HTTPS clients that they can switch to HTTP/3.
+func (t *tlsServers) altSvc(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listen opens the TCP and UDP sockets and serves on them until shutdown.
+// The TCP listener accepts PROXY protocol like the plain one. The UDP
+// socket takes the port the TCP one got, so a port of 0 picks one free
+// port for both.
+func (t *tlsServers) listen() error {
+	ln, err := net.Listen("tcp", t.https.Addr)
+	if err != nil {
+		return err
+	}
+	t.https.Addr = ln.Addr().String()
+	if ln, err = proxyListenerFromEnv(ln); err != nil {
+		return err
+	}
+	go func() {
+		if err := t.https.ServeTLS(ln, "", ""); err != http.ErrServerClosed {
+			log.Fatalf("HTTPS server: %v", err)
+		}
+	}()
+	if t.h3 == nil {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", t.https.Addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer conn.Close()
+		if err := t.h3.Serve(conn); err != http.ErrServerClosed {
+			log.Fatalf("HTTP/3 server: %v", err)
+		}
+	}()
+	return nil
+}
+
+// shutdown stops both servers, letting requests in flight finish until ctx
+// is done.
+func (t *tlsServers) shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	var wg sync.WaitGroup
+	var h3Err error
+	if t.h3 != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h3Err = t.h3.Shutdown(ctx)
+		}()
+	}
+	err := t.https.Shutdown(ctx)
+	wg.Wait()
+	return errors.Join(err, h3Err)
+}
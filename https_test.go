@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// testCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key to PEM files, and returns their paths and a pool that trusts it.
+func testCertificate(t *testing.T) (certFile, keyFile string, roots *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "quote-api test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, roots
+}
+
+// startTLS serves handler over HTTPS, and HTTP/3 if h3 is set, on a free
+// loopback port, and shuts the servers down when the test ends.
+func startTLS(t *testing.T, handler http.Handler, h3 bool) (*tlsServers, *x509.CertPool) {
+	t.Helper()
+	certFile, keyFile, roots := testCertificate(t)
+	t.Setenv("TLS_CERT", certFile)
+	t.Setenv("TLS_KEY", keyFile)
+	t.Setenv("TLS_ADDR", "127.0.0.1:0")
+	t.Setenv("PROXY_PROTOCOL_FROM", "")
+	if h3 {
+		t.Setenv("HTTP3", "1")
+	} else {
+		t.Setenv("HTTP3", "")
+	}
+	srv, err := tlsFromEnv(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.listen(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.shutdown(ctx)
+	})
+	return srv, roots
+}
+
+var helloHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "hello over "+r.Proto)
+})
+
+func getBody(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestHTTPSServesHTTP2(t *testing.T) {
+	srv, roots := startTLS(t, helloHandler, false)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+
+	resp, body := getBody(t, client, "https://"+srv.https.Addr+"/")
+	if resp.StatusCode != http.StatusOK || body != "hello over HTTP/2.0" {
+		t.Errorf("got %d %q, want 200 over HTTP/2", resp.StatusCode, body)
+	}
+	if alt := resp.Header.Get("Alt-Svc"); alt != "" {
+		t.Errorf("Alt-Svc = %q without HTTP3, want none", alt)
+	}
+
+	// Plain HTTP on the TLS port is refused.
+	plain, err := http.Get("http://" + srv.https.Addr + "/")
+	if err == nil {
+		defer plain.Body.Close()
+		if plain.StatusCode == http.StatusOK {
+			t.Error("plain HTTP was served on the TLS port")
+		}
+	}
+}
+
+func TestHTTP3(t *testing.T) {
+	srv, roots := startTLS(t, helloHandler, true)
+	_, port, _ := net.SplitHostPort(srv.https.Addr)
+
+	h3 := &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	defer h3.Close()
+	resp, body := getBody(t, &http.Client{Transport: h3, Timeout: 5 * time.Second}, "https://"+srv.https.Addr+"/")
+	if resp.StatusCode != http.StatusOK || body != "hello over HTTP/3.0" {
+		t.Errorf("got %d %q, want 200 over HTTP/3", resp.StatusCode, body)
+	}
+
+	// HTTPS responses advertise HTTP/3 on the same port.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	defer client.CloseIdleConnections()
+	resp, _ = getBody(t, client, "https://"+srv.https.Addr+"/")
+	if alt := resp.Header.Get("Alt-Svc"); !strings.Contains(alt, `h3=":`+port+`"`) {
+		t.Errorf("Alt-Svc = %q, want h3 on port %s", alt, port)
+	}
+}
+
+func TestTLSShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	srv, roots := startTLS(t, slow, true)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	defer client.CloseIdleConnections()
+
+	// A request in flight is allowed to finish.
+	done := make(chan string)
+	go func() {
+		resp, err := client.Get("https://" + srv.https.Addr + "/")
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		done <- string(body)
+	}()
+	<-started
+	stopped := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- srv.shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if body := <-done; body != "done" {
+		t.Errorf("request in flight got %q, want it to finish", body)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("shutdown() = %v", err)
+	}
+
+	// New connections are refused afterwards.
+	if _, err := net.DialTimeout("tcp", srv.https.Addr, time.Second); err == nil {
+		t.Error("the HTTPS port still accepts connections after shutdown")
+	}
+}
+
+func TestTLSFromEnv(t *testing.T) {
+	t.Setenv("TLS_CERT", "")
+	t.Setenv("TLS_KEY", "")
+	t.Setenv("HTTP3", "")
+	if srv, err := tlsFromEnv(helloHandler); srv != nil || err != nil {
+		t.Errorf("tlsFromEnv() without a certificate = %v, %v, want nil, nil", srv, err)
+	}
+	t.Setenv("HTTP3", "1")
+	if _, err := tlsFromEnv(helloHandler); err == nil {
+		t.Error("tlsFromEnv() accepted HTTP3 without a certificate")
+	}
+	t.Setenv("TLS_CERT", filepath.Join(t.TempDir(), "missing.pem"))
+	t.Setenv("TLS_KEY", filepath.Join(t.TempDir(), "missing.pem"))
+	if _, err := tlsFromEnv(helloHandler); err == nil {
+		t.Error("tlsFromEnv() accepted a missing certificate")
+	}
+}
@@ -0,0 +1,204 @@
+package httpsig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Canonicalize returns the canonical form of a single JSON value following
+// the JSON Canonicalization Scheme (RFC 8785): object members sorted by
+// key, no insignificant whitespace, numbers in their shortest form and
+// strings with only the escapes JSON requires. Two values that decode to
+// the same data have the same canonical form however they were written.
+func Canonicalize(value []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("httpsig: more than one JSON value")
+	}
+	var b bytes.Buffer
+	if err := writeCanonical(&b, v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func writeCanonical(b *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil || math.IsInf(f, 0) {
+			return fmt.Errorf("httpsig: number %s out of range", v)
+		}
+		b.WriteString(formatNumber(f))
+	case string:
+		writeString(b, v)
+	case []any:
+		b.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := writeCanonical(b, e); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		// RFC 8785 orders keys by their UTF-16 code units.
+		sort.Slice(keys, func(i, j int) bool { return lessUTF16(keys[i], keys[j]) })
+		b.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeString(b, k)
+			b.WriteByte(':')
+			if err := writeCanonical(b, v[k]); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+	default:
+		return fmt.Errorf("httpsig: unexpected JSON value %T", v)
+	}
+	return nil
+}
+
+// formatNumber formats f as ECMAScript's Number.prototype.toString does.
+func formatNumber(f float64) string {
+	if f == 0 {
+		return "0" // also for -0
+	}
+	if abs := math.Abs(f); abs >= 1e-6 && abs < 1e21 {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	s := strconv.FormatFloat(f, 'e', -1, 64)
+	mantissa, exp, _ := strings.Cut(s, "e")
+	sign, digits := exp[:1], strings.TrimLeft(exp[1:], "0")
+	return mantissa + "e" + sign + digits
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+func lessUTF16(a, b string) bool {
+	for a != "" && b != "" {
+		ra, na := utf8.DecodeRuneInString(a)
+		rb, nb := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			return utf16Key(ra) < utf16Key(rb)
+		}
+		a, b = a[na:], b[nb:]
+	}
+	return a == "" && b != ""
+}
+
+// utf16Key orders runes by their first UTF-16 code unit, so characters
+// outside the Basic Multilingual Plane sort as their surrogates do.
+func utf16Key(r rune) rune {
+	if r >= 0x10000 {
+		return 0xd800 + (r-0x10000)>>10
+	}
+	return r
+}
+
+// Digester computes a Quote-Digest incrementally, one JSON value at a
+// time, so a streamed response can be signed once it has been sent.
+type Digester struct {
+	h hash.Hash
+}
+
+// NewDigester returns a Digester that has seen no values.
+func NewDigester() *Digester {
+	return &Digester{h: sha256.New()}
+}
+
+// Add adds one JSON value, such as a whole document or one line of an
+// NDJSON stream. Blank values are ignored.
+func (d *Digester) Add(value []byte) error {
+	if len(bytes.TrimSpace(value)) == 0 {
+		return nil
+	}
+	c, err := Canonicalize(value)
+	if err != nil {
+		return err
+	}
+	d.h.Write(c)
+	d.h.Write([]byte{'\n'})
+	return nil
+}
+
+// Sum returns the Quote-Digest header value for the values added so far.
+func (d *Digester) Sum() string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(d.h.Sum(nil)) + ":"
+}
+
+// DigestJSON returns the Quote-Digest of a body holding a JSON document or
+// an NDJSON stream.
+func DigestJSON(body []byte) (string, error) {
+	d := NewDigester()
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var v json.RawMessage
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			return d.Sum(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := d.Add(v); err != nil {
+			return "", err
+		}
+	}
+}
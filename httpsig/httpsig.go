@@ -0,0 +1,326 @@
+// Package httpsig signs and verifies quote API responses with Ed25519 using
+// HTTP Message Signatures (RFC 9421).
+//
+// A signed response carries three fields:
+//
+//	Quote-Digest:    sha-256=:<base64 SHA-256 of the canonical JSON>:
+//	Signature-Input: sig1=("@status" "quote-digest");created=<unix>;keyid="<kid>";alg="ed25519"
+//	Signature:       sig1=:<base64 Ed25519 signature>:
+//
+// The digest covers the canonical form (see Canonicalize) of each JSON
+// value in the body, each followed by a newline, so it does not depend on
+// formatting or on the wire encoding: a response served as Protocol
+// Buffers, MessagePack or CBOR verifies once decoded into its JSON form.
+// Streamed NDJSON responses send the three fields as trailers, and the
+// signature covers "quote-digest";tr instead. Public keys are published as
+// a JSON Web Key Set; use FetchJWKS and VerifyResponse to check a response.
+package httpsig
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Label is the signature label used in Signature-Input and Signature.
+const Label = "sig1"
+
+// Algorithm is the RFC 9421 algorithm name for Ed25519.
+const Algorithm = "ed25519"
+
+// DigestField carries the digest of the canonical body.
+const DigestField = "Quote-Digest"
+
+// TrailerFields lists the fields a streamed response sends as trailers.
+var TrailerFields = []string{DigestField, "Signature-Input", "Signature"}
+
+// covered lists the components included in every signature, in order, for
+// responses signed in their headers and in their trailers.
+var (
+	covered        = []string{`"@status"`, `"quote-digest"`}
+	coveredTrailer = []string{`"@status"`, `"quote-digest";tr`}
+)
+
+var (
+	// ErrNoSignature is returned when a response carries no signature.
+	ErrNoSignature = errors.New("httpsig: response is not signed")
+	// ErrDigestMismatch is returned when the body does not match Quote-Digest.
+	ErrDigestMismatch = errors.New("httpsig: body does not match Quote-Digest")
+	// ErrAmbiguous is returned when a signature field is sent both as a
+	// header and as a trailer, so it is unclear which one was signed.
+	ErrAmbiguous = errors.New("httpsig: signature field sent as both header and trailer")
+	// ErrBadSignature is returned when the signature does not verify.
+	ErrBadSignature = errors.New("httpsig: signature verification failed")
+)
+
+// Key is a named Ed25519 key pair. Private is nil for verification-only keys.
+type Key struct {
+	ID      string
+	Private ed25519.PrivateKey
+	Public  ed25519.PublicKey
+}
+
+// SignResponse signs a response whose body has the given digest, as
+// returned by DigestJSON or a Digester, with key. It sets Quote-Digest,
+// Signature-Input and Signature on fields, which are the response's
+// headers, or its trailers if trailer is set.
+func SignResponse(fields http.Header, status int, digest string, trailer bool, key Key, created time.Time) error {
+	if key.Private == nil {
+		return fmt.Errorf("httpsig: key %q has no private half", key.ID)
+	}
+	fields.Set(DigestField, digest)
+
+	components := covered
+	if trailer {
+		components = coveredTrailer
+	}
+	params := fmt.Sprintf("(%s);created=%d;keyid=%s;alg=%q", strings.Join(components, " "), created.Unix(), strconv.Quote(key.ID), Algorithm)
+
+	base, err := signatureBase(fields, fields, status, components, params)
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(key.Private, []byte(base))
+	fields.Set("Signature-Input", Label+"="+params)
+	fields.Set("Signature", Label+"=:"+base64.StdEncoding.EncodeToString(sig)+":")
+	return nil
+}
+
+// KeyFunc looks up the public key for a key ID.
+type KeyFunc func(keyID string) (ed25519.PublicKey, error)
+
+// VerifyOptions tunes VerifyResponse. The zero value accepts signatures of
+// any age.
+type VerifyOptions struct {
+	// MaxAge rejects signatures created longer ago than this.
+	MaxAge time.Duration
+	// Now overrides the clock, for tests.
+	Now func() time.Time
+}
+
+// VerifyResponse checks the signature labelled Label on a response whose
+// body has already been read into body, which must be in its JSON form: a
+// JSON document or an NDJSON stream. Reading the body to the end also
+// fills in resp.Trailer for streamed responses. The body is checked
+// against the Quote-Digest the signature covers, from the headers or the
+// trailers, and responses that send a field in both are rejected.
+func VerifyResponse(resp *http.Response, body []byte, keys KeyFunc, opts VerifyOptions) error {
+	for _, name := range TrailerFields {
+		if len(resp.Header.Values(name)) > 0 && len(resp.Trailer.Values(name)) > 0 {
+			return ErrAmbiguous
+		}
+	}
+	field := func(name string) string {
+		if v := resp.Header.Get(name); v != "" {
+			return v
+		}
+		return resp.Trailer.Get(name)
+	}
+	input, ok := dictMember(field("Signature-Input"), Label)
+	if !ok {
+		return ErrNoSignature
+	}
+	sigValue, ok := dictMember(field("Signature"), Label)
+	if !ok || len(sigValue) < 2 || sigValue[0] != ':' || sigValue[len(sigValue)-1] != ':' {
+		return ErrNoSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigValue[1 : len(sigValue)-1])
+	if err != nil {
+		return fmt.Errorf("httpsig: malformed Signature: %w", err)
+	}
+
+	components, params, err := parseSignatureInput(input)
+	if err != nil {
+		return err
+	}
+	for i, need := range covered {
+		if !contains(components, need) && !contains(components, coveredTrailer[i]) {
+			return fmt.Errorf("httpsig: signature does not cover %s", need)
+		}
+	}
+	// The body is checked against the digest that was signed, never a
+	// copy sent alongside it.
+	digestFields := resp.Header
+	if contains(components, coveredTrailer[1]) {
+		if contains(components, covered[1]) {
+			return fmt.Errorf("httpsig: signature covers %s twice", DigestField)
+		}
+		digestFields = resp.Trailer
+	}
+	if alg, ok := params["alg"]; ok && alg != Algorithm {
+		return fmt.Errorf("httpsig: unsupported algorithm %q", alg)
+	}
+	if opts.MaxAge > 0 {
+		created, err := strconv.ParseInt(params["created"], 10, 64)
+		if err != nil {
+			return errors.New("httpsig: signature has no created time")
+		}
+		now := time.Now
+		if opts.Now != nil {
+			now = opts.Now
+		}
+		if now().Sub(time.Unix(created, 0)) > opts.MaxAge {
+			return errors.New("httpsig: signature has expired")
+		}
+	}
+
+	digest, err := DigestJSON(body)
+	if err != nil {
+		return fmt.Errorf("httpsig: body is not JSON: %w", err)
+	}
+	if signed, ok := fieldValue(digestFields, DigestField); !ok || signed != digest {
+		return ErrDigestMismatch
+	}
+	pub, err := keys(params["keyid"])
+	if err != nil {
+		return err
+	}
+	base, err := signatureBase(resp.Header, resp.Trailer, resp.StatusCode, components, input)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(base), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// signatureBase builds the RFC 9421 signature base for a response.
+// Components are serialized component identifiers such as "content-type"
+// or "quote-digest";tr, the latter taken from the trailers.
+func signatureBase(header, trailer http.Header, status int, components []string, params string) (string, error) {
+	var b strings.Builder
+	for _, c := range components {
+		quoted, param, _ := strings.Cut(c, ";")
+		name, err := strconv.Unquote(quoted)
+		if err != nil {
+			return "", fmt.Errorf("httpsig: malformed component %s", c)
+		}
+		fields := header
+		switch param {
+		case "":
+		case "tr":
+			fields = trailer
+		default:
+			return "", fmt.Errorf("httpsig: unsupported component parameter %s", c)
+		}
+		var v string
+		switch {
+		case name == "@status" && param == "":
+			v = strconv.Itoa(status)
+		case strings.HasPrefix(name, "@"):
+			return "", fmt.Errorf("httpsig: unsupported component %s", c)
+		default:
+			var ok bool
+			if v, ok = fieldValue(fields, name); !ok {
+				return "", fmt.Errorf("httpsig: covered field %s is missing", c)
+			}
+		}
+		fmt.Fprintf(&b, "%s: %s\n", c, v)
+	}
+	fmt.Fprintf(&b, "%q: %s", "@signature-params", params)
+	return b.String(), nil
+}
+
+// fieldValue returns a field's values as the signature base holds them:
+// trimmed and joined with ", ".
+func fieldValue(fields http.Header, name string) (string, bool) {
+	values := fields.Values(name)
+	if len(values) == 0 {
+		return "", false
+	}
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(trimmed, ", "), true
+}
+
+// dictMember returns the raw value of a member of a structured-field
+// dictionary such as `sig1=(...);created=1, sig2=...`.
+func dictMember(header, name string) (string, bool) {
+	for _, member := range splitTopLevel(header) {
+		key, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if ok && key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// splitTopLevel splits s at commas that are not inside quotes, parentheses
+// or byte sequences.
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	inString, inBytes := false, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == ':':
+			inBytes = !inBytes
+		case inBytes:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseSignatureInput parses `("a" "b";tr);k=v;k2="v2"` into its
+// serialized component identifiers and parameters.
+func parseSignatureInput(s string) ([]string, map[string]string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		return nil, nil, errors.New("httpsig: malformed Signature-Input")
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, nil, errors.New("httpsig: malformed Signature-Input")
+	}
+	components := strings.Fields(s[1:end])
+	for _, c := range components {
+		quoted, _, _ := strings.Cut(c, ";")
+		if _, err := strconv.Unquote(quoted); err != nil {
+			return nil, nil, fmt.Errorf("httpsig: malformed component %s", c)
+		}
+	}
+	params := make(map[string]string)
+	for _, p := range strings.Split(s[end+1:], ";") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(p, "=")
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		}
+		params[k] = v
+	}
+	return components, params, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,280 @@
+package httpsig
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testKey(t *testing.T, id string) Key {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Key{ID: id, Private: priv, Public: pub}
+}
+
+func keyFunc(keys ...Key) KeyFunc {
+	return func(id string) (ed25519.PublicKey, error) {
+		for _, k := range keys {
+			if k.ID == id {
+				return k.Public, nil
+			}
+		}
+		return nil, errors.New("unknown key")
+	}
+}
+
+// signed returns a response for body signed with key in its headers, or
+// its trailers if trailer is set.
+func signed(t *testing.T, key Key, body string, trailer bool) *http.Response {
+	t.Helper()
+	digest, err := DigestJSON([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Trailer: make(http.Header)}
+	fields := resp.Header
+	if trailer {
+		fields = resp.Trailer
+	}
+	if err := SignResponse(fields, resp.StatusCode, digest, trailer, key, testTime); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestVerifyResponse(t *testing.T) {
+	key := testKey(t, "k1")
+	body := `{"id": 1, "text": "Stay hungry."}`
+	for _, trailer := range []bool{false, true} {
+		if err := VerifyResponse(signed(t, key, body, trailer), []byte(body), keyFunc(key), VerifyOptions{}); err != nil {
+			t.Errorf("trailer=%v: VerifyResponse() = %v", trailer, err)
+		}
+		// Formatting and the order of members are not signed.
+		reformatted := "{\n  \"text\": \"Stay hungry.\",\n  \"id\": 1.0\n}\n"
+		if err := VerifyResponse(signed(t, key, body, trailer), []byte(reformatted), keyFunc(key), VerifyOptions{}); err != nil {
+			t.Errorf("trailer=%v: VerifyResponse(reformatted) = %v", trailer, err)
+		}
+	}
+}
+
+func TestVerifyResponseRejects(t *testing.T) {
+	key, other := testKey(t, "k1"), testKey(t, "k2")
+	body := `{"id": 1, "text": "Stay hungry."}`
+	forged := `{"id": 1, "text": "Stay foolish."}`
+	forgedDigest, _ := DigestJSON([]byte(forged))
+
+	tests := []struct {
+		name   string
+		resp   func() *http.Response
+		body   string
+		keys   KeyFunc
+		opts   VerifyOptions
+		wantIs error
+	}{
+		{"unsigned", func() *http.Response {
+			return &http.Response{StatusCode: 200, Header: make(http.Header), Trailer: make(http.Header)}
+		}, body, keyFunc(key), VerifyOptions{}, ErrNoSignature},
+		{"changed body", func() *http.Response { return signed(t, key, body, false) }, forged, keyFunc(key), VerifyOptions{}, ErrDigestMismatch},
+		{"changed body and digest", func() *http.Response {
+			resp := signed(t, key, body, false)
+			resp.Header.Set(DigestField, forgedDigest)
+			return resp
+		}, forged, keyFunc(key), VerifyOptions{}, ErrBadSignature},
+		{"changed status", func() *http.Response {
+			resp := signed(t, key, body, false)
+			resp.StatusCode = http.StatusNotFound
+			return resp
+		}, body, keyFunc(key), VerifyOptions{}, ErrBadSignature},
+		{"wrong key", func() *http.Response { return signed(t, key, body, false) }, body, func(string) (ed25519.PublicKey, error) {
+			return other.Public, nil
+		}, VerifyOptions{}, ErrBadSignature},
+		{"header digest beside a signed trailer", func() *http.Response {
+			resp := signed(t, key, body, true)
+			resp.Header.Set(DigestField, forgedDigest)
+			return resp
+		}, forged, keyFunc(key), VerifyOptions{}, ErrAmbiguous},
+		{"signature in both", func() *http.Response {
+			resp := signed(t, key, body, true)
+			resp.Header.Set("Signature", resp.Trailer.Get("Signature"))
+			return resp
+		}, body, keyFunc(key), VerifyOptions{}, ErrAmbiguous},
+		{"expired", func() *http.Response { return signed(t, key, body, false) }, body, keyFunc(key), VerifyOptions{
+			MaxAge: time.Minute,
+			Now:    func() time.Time { return testTime.Add(2 * time.Minute) },
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyResponse(tt.resp(), []byte(tt.body), tt.keys, tt.opts)
+			if err == nil {
+				t.Fatal("VerifyResponse() = nil, want an error")
+			}
+			if tt.wantIs != nil && !errors.Is(err, tt.wantIs) {
+				t.Errorf("VerifyResponse() = %v, want %v", err, tt.wantIs)
+			}
+		})
+	}
+}
+
+// TestVerifyResponseTrailerForgery replays a signed stream with a changed
+// body and a matching Quote-Digest header: the trailer that was signed
+// still holds the original digest, so verification must fail.
+func TestVerifyResponseTrailerForgery(t *testing.T) {
+	key := testKey(t, "k1")
+	body := "{\"id\":1}\n{\"id\":2}\n"
+	forged := "{\"id\":1}\n{\"id\":3}\n"
+	forgedDigest, _ := DigestJSON([]byte(forged))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", strings.Join(TrailerFields, ", "))
+		if r.URL.Query().Has("forge") {
+			w.Header().Set(DigestField, forgedDigest)
+			io.WriteString(w, forged)
+		} else {
+			io.WriteString(w, body)
+		}
+		digest, _ := DigestJSON([]byte(body))
+		SignResponse(w.Header(), http.StatusOK, digest, true, key, testTime)
+	}))
+	defer srv.Close()
+
+	get := func(url string) error {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		got, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return VerifyResponse(resp, got, keyFunc(key), VerifyOptions{})
+	}
+	if err := get(srv.URL); err != nil {
+		t.Errorf("genuine stream: VerifyResponse() = %v", err)
+	}
+	if err := get(srv.URL + "?forge"); err == nil {
+		t.Error("forged stream with a Quote-Digest header verified")
+	}
+}
+
+func TestSignResponseNeedsPrivateKey(t *testing.T) {
+	key := testKey(t, "k1")
+	key.Private = nil
+	if err := SignResponse(make(http.Header), 200, "sha-256=:x:", false, key, testTime); err == nil {
+		t.Error("SignResponse() with a public key only = nil, want an error")
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`{"b": 2, "a": 1}`, `{"a":1,"b":2}`},
+		{`[1.0, 1e2, -0, 0.000001, 1e-7, 1e21, 123456789012345680000]`, `[1,100,0,0.000001,1e-7,1e+21,123456789012345680000]`},
+		{`"é\n\u001f\/"`, "\"é\\n\\u001f/\""},
+		{`{"דּ": 3, "😀": 2, "€": 1}`, "{\"€\":1,\"\U0001f600\":2,\"דּ\":3}"},
+		{`{"a": [true, false, null, {"z": {}, "y": []}]}`, `{"a":[true,false,null,{"y":[],"z":{}}]}`},
+	}
+	for _, tt := range tests {
+		got, err := Canonicalize([]byte(tt.in))
+		if err != nil {
+			t.Errorf("Canonicalize(%s) = %v", tt.in, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("Canonicalize(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+	for _, in := range []string{`{"a":1} {"b":2}`, `1e400`, `{"a":`} {
+		if _, err := Canonicalize([]byte(in)); err == nil {
+			t.Errorf("Canonicalize(%s) = nil error, want one", in)
+		}
+	}
+}
+
+func TestDigesterMatchesDigestJSON(t *testing.T) {
+	lines := []string{`{"id":1}`, ``, `{"id": 2, "tags": ["a"]}`}
+	d := NewDigester()
+	for _, l := range lines {
+		if err := d.Add([]byte(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := DigestJSON([]byte(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Sum(); got != want {
+		t.Errorf("Digester.Sum() = %s, want %s", got, want)
+	}
+}
+
+func writeKey(t *testing.T, dir string, key Key) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, key.ID+".pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	dir := t.TempDir()
+	old, next := testKey(t, "2026-01"), testKey(t, "2026-02")
+	writeKey(t, dir, old)
+	ring, err := LoadKeyring(dir, old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ring.Active().ID; got != old.ID {
+		t.Fatalf("Active() = %s, want %s", got, old.ID)
+	}
+
+	writeKey(t, dir, next)
+	if err := os.WriteFile(filepath.Join(dir, ActiveFile), []byte(next.ID+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ring.Active().ID; got != next.ID {
+		t.Errorf("Active() after rotation = %s, want %s", got, next.ID)
+	}
+	set := ring.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS() has %d keys, want both", len(set.Keys))
+	}
+	for _, k := range []Key{old, next} {
+		pub, err := set.PublicKey(k.ID)
+		if err != nil || !pub.Equal(k.Public) {
+			t.Errorf("JWKS().PublicKey(%s) = %v, %v", k.ID, pub, err)
+		}
+	}
+
+	// A broken directory keeps the previous keys.
+	os.WriteFile(filepath.Join(dir, ActiveFile), []byte("missing"), 0o600)
+	if err := ring.Reload(); err == nil {
+		t.Error("Reload() with an unknown active key = nil, want an error")
+	}
+	if got := ring.Active().ID; got != next.ID {
+		t.Errorf("Active() after a failed reload = %s, want %s", got, next.ID)
+	}
+}
@@ -0,0 +1,192 @@
+package httpsig
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ActiveFile names the file in a key directory that holds the active key
+// ID. It overrides the ID passed to LoadKeyring, so the active key can be
+// switched without a restart.
+const ActiveFile = "active"
+
+// Keyring holds the signing keys loaded from a directory of PEM files. Every
+// key is published for verification; only the active one signs. Rotate by
+// adding a new key file, waiting for clients to pick up the new key set,
+// writing the new key ID to the ActiveFile, and finally removing the old
+// key file.
+type Keyring struct {
+	dir           string
+	defaultActive string
+
+	mu     sync.RWMutex
+	active string
+	keys   map[string]Key
+}
+
+// LoadKeyring reads every <key-id>.pem file in dir, each holding a PKCS #8
+// Ed25519 private key, as produced by `openssl genpkey -algorithm ed25519`.
+// The ActiveFile in dir names the key used for signing; without it, active
+// does.
+func LoadKeyring(dir, active string) (*Keyring, error) {
+	k := &Keyring{dir: dir, defaultActive: active}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload rereads the key directory. On error the previous keys are kept.
+func (k *Keyring) Reload() error {
+	active := k.defaultActive
+	data, err := os.ReadFile(filepath.Join(k.dir, ActiveFile))
+	switch {
+	case err == nil:
+		active = strings.TrimSpace(string(data))
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(k.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]Key)
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("httpsig: %s: no PEM block", p)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("httpsig: %s: %w", p, err)
+		}
+		priv, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return fmt.Errorf("httpsig: %s: not an Ed25519 key", p)
+		}
+		id := strings.TrimSuffix(filepath.Base(p), ".pem")
+		keys[id] = Key{ID: id, Private: priv, Public: priv.Public().(ed25519.PublicKey)}
+	}
+	if _, ok := keys[active]; !ok {
+		return fmt.Errorf("httpsig: active key %q not found in %s", active, k.dir)
+	}
+	k.mu.Lock()
+	k.keys, k.active = keys, active
+	k.mu.Unlock()
+	return nil
+}
+
+// Active returns the key used for signing.
+func (k *Keyring) Active() Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[k.active]
+}
+
+// PublicKey implements KeyFunc over the keyring.
+func (k *Keyring) PublicKey(id string) (ed25519.PublicKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("httpsig: unknown key %q", id)
+	}
+	return key.Public, nil
+}
+
+// JWKS returns the public half of every key as a JSON Web Key Set.
+func (k *Keyring) JWKS() JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		set.Keys = append(set.Keys, NewJWK(key.ID, key.Public))
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+	return set
+}
+
+// JWK is an Ed25519 public key in JSON Web Key form (RFC 8037).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// NewJWK encodes an Ed25519 public key.
+func NewJWK(id string, pub ed25519.PublicKey) JWK {
+	return JWK{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(pub),
+		KeyID:     id,
+		Algorithm: "EdDSA",
+		Use:       "sig",
+	}
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKey implements KeyFunc over the key set.
+func (s JWKS) PublicKey(id string) (ed25519.PublicKey, error) {
+	for _, k := range s.Keys {
+		if k.KeyID != id {
+			continue
+		}
+		if k.KeyType != "OKP" || k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("httpsig: key %q is not an Ed25519 key", id)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("httpsig: key %q is malformed", id)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("httpsig: unknown key %q", id)
+}
+
+// FetchJWKS downloads a key set, typically from the API's
+// /.well-known/jwks.json.
+func FetchJWKS(ctx context.Context, client *http.Client, url string) (JWKS, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return JWKS{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return JWKS{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return JWKS{}, fmt.Errorf("httpsig: fetching %s: %s", url, resp.Status)
+	}
+	var set JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return JWKS{}, err
+	}
+	return set, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// mail is an outgoing plain-text email.
+type mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// mailer delivers email.
+type mailer interface {
+	Send(ctx context.Context, m mail) error
+}
+
+// newMailerFromEnv returns an SMTP mailer when SMTP_ADDR is set and a
+// logging mailer otherwise. The logging mailer leaves out message bodies,
+// which carry verification and reset links, unless MAIL_LOG_BODIES is set.
+func newMailerFromEnv() mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return logMailer{bodies: os.Getenv("MAIL_LOG_BODIES") != ""}
+	}
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "quotes@localhost"
+	}
+	return &smtpMailer{
+		addr:     addr,
+		from:     from,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+	}
+}
+
+// logMailer writes messages to the log instead of sending them, for local
+// development. Bodies hold one-time tokens, so they are only logged when
+// asked for.
+type logMailer struct {
+	bodies bool
+}
+
+func (l logMailer) Send(_ context.Context, m mail) error {
+	if !l.bodies {
+		log.Printf("mail to %s: %s (not sent; set SMTP_ADDR, or MAIL_LOG_BODIES to log the body)", m.To, m.Subject)
+		return nil
+	}
+	log.Printf("mail to %s: %s\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// smtpMailer sends through an SMTP relay, upgrading to TLS when offered.
+type smtpMailer struct {
+	addr, from         string
+	username, password string
+}
+
+func (s *smtpMailer) Send(_ context.Context, m mail) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, _ := net.SplitHostPort(s.addr)
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		s.from, m.To, m.Subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return smtp.SendMail(s.addr, auth, s.from, []string{m.To}, []byte(msg))
+}
@@ -1,33 +1,333 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/sudlo/quote-api/httpsig"
 )
 
-func quoteHandler(w http.ResponseWriter, r *http.Request) {
-	quotes := []string{
-		"The only way to do great work is to love what you do. - Steve Jobs",
-		"The future belongs to those who believe in the beauty of their dreams. - Eleanor Roosevelt",
-		"It does not matter how slowly you go as long as you do not stop. - Confucius",
-		"Success is not final, failure is not fatal: it is the courage to continue that counts. - Winston Churchill",
-		"Believe you can and you're halfway there. - Theodore Roosevelt",
+// server holds the dependencies shared by the HTTP handlers.
+type server struct {
+	store      Store
+	quiz       *quiz
+	markov     *markovChains
+	semantic   *semanticSearch
+	daily      *dailyQuotes
+	staff      *staffAuth
+	editor     *editorial
+	accounts   *accounts
+	oauth      *oauthServer
+	favorites  *favorites
+	keys       *apiKeys
+	billing    *billing
+	meter      *meter
+	privacy    *privacy
+	security   *securityConfig
+	realIP     *realIP
+	access     *access        // nil without ACCESS_RULES
+	challenges *challenges    // nil when proof of work is off
+	abuse      *abuseDetector // nil when abuse detection is off
+	cdn        *cdn
+	signer     *signer     // nil when responses are not signed
+	plugins    *pluginHost // nil when plugins are disabled
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	// Quote resources pass through plugin transformers, get signed, then
+	// are encoded as the client asked.
+	quoteRoute := func(pattern, route string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, encodeRoute(route, s.signer.wrap(s.plugins.transform(route, h))))
+	}
+	quoteRoute("/", "/", s.quoteHandler)
+	quoteRoute("GET /v1/quotes", "/v1/quotes", s.listHandler)
+	quoteRoute("GET /v1/quotes/{id}", "/v1/quotes/{id}", s.getHandler)
+	quoteRoute("GET /v1/quotes/semantic", "/v1/quotes/semantic", s.semanticHandler)
+	quoteRoute("GET /v1/quotes/generated", "/v1/quotes/generated", s.generatedHandler)
+	quoteRoute("GET /v1/quotes/daily", "/v1/quotes/daily", s.daily.quoteHandler)
+	mux.HandleFunc("GET /v1/schema.proto", schemaHandler)
+	mux.HandleFunc("GET /v1/quotes/daily/proof", s.signer.wrap(s.daily.proofHandler))
+	mux.HandleFunc("GET /v1/quotes/daily/snapshot", s.daily.snapshotHandler)
+	mux.HandleFunc("GET /v1/quotes/daily/commitment", s.daily.commitmentHandler)
+	if s.signer != nil {
+		mux.HandleFunc("GET /.well-known/jwks.json", s.signer.jwksHandler)
 	}
+	mux.HandleFunc("GET /v1/export/{format}", s.exportHandler)
+	mux.HandleFunc("POST /v1/quiz/rounds", s.quiz.newRoundHandler)
+	mux.HandleFunc("POST /v1/quiz/answers", s.challenges.require("quiz-answer", s.quiz.answerHandler))
+	mux.HandleFunc("GET /v1/quiz/leaderboard", s.quiz.leaderboardHandler)
+	mux.Handle("GET /metrics", metricsRegistry)
+	s.editor.routes(mux)
+	s.challenges.routes(mux)
+	s.accounts.routes(mux, s.challenges)
+	s.oauth.routes(mux)
+	s.favorites.routes(mux, s.oauth, s.writeExport)
+	(&portal{accounts: s.accounts, keys: s.keys, meter: s.meter}).routes(mux)
+	s.billing.routes(mux)
+	mux.HandleFunc("GET /v1/admin/usage", s.staff.require(roleAdmin, s.meter.exportHandler(s.accounts)))
+	s.privacy.routes(mux, s.staff)
+	s.abuse.routes(mux, s.staff)
 
-	// Seed the random number generator
-	rand.Seed(time.Now().UnixNano())
-	// Get a random quote
-	randomQuote := quotes[rand.Intn(len(quotes))]
+	h := s.keys.middleware(mux, s.meter, mux)
+	if rs, ok := s.store.(revisioner); ok {
+		h = revisionHeader(rs, h)
+	}
+	return s.realIP.wrap(s.security.wrap(s.access.wrap(s.abuse.wrap(h))))
+}
 
-	// Set the content type header and write the response
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"quote": "%s"}`, randomQuote)
+// revisionHeader reports the content revision being served on every response.
+func revisionHeader(rs revisioner, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Revision", rs.Revision())
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) quoteHandler(w http.ResponseWriter, r *http.Request) {
+	quotes, err := s.selectQuotes(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(quotes) == 0 {
+		writeError(w, http.StatusNotFound, "no quotes match the request")
+		return
+	}
+
+	count := 1
+	countParam := r.URL.Query().Get("count")
+	if countParam != "" {
+		count, err = strconv.Atoi(countParam)
+		if err != nil || count < 1 {
+			writeError(w, http.StatusBadRequest, "count must be a positive integer")
+			return
+		}
+	}
+	if count > len(quotes) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("count %d exceeds the %d quotes matching the request", count, len(quotes)))
+		return
+	}
+
+	s.cdn.uncacheable(w)
+
+	// Draw distinct quotes so a single request never repeats itself
+	picked := s.plugins.pick(r, "/", quotes, count, func() []Quote {
+		picked := make([]Quote, 0, count)
+		for _, i := range sampleIndices(len(quotes), count) {
+			picked = append(picked, quotes[i])
+		}
+		return picked
+	})
+
+	// Without a count we keep the original single-quote response shape.
+	if countParam == "" {
+		writeJSON(w, http.StatusOK, map[string]string{"quote": picked[0].String()})
+		return
+	}
+	texts := make([]string, len(picked))
+	for i, q := range picked {
+		texts[i] = q.String()
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"quotes": texts})
+}
+
+// sampleIndices returns k distinct indices from [0, n) in random order using
+// a partial Fisher–Yates shuffle. The caller must ensure k <= n.
+func sampleIndices(n, k int) []int {
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	for i := 0; i < k; i++ {
+		j := i + rand.Intn(n-i)
+		idx[i], idx[j] = idx[j], idx[i]
+	}
+	return idx[:k]
 }
 
 func main() {
-	http.HandleFunc("/", quoteHandler)
+	// SIGTERM, as sent by Kubernetes, drains in-flight requests and saves
+	// state before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var store Store = newMemoryStore(seedQuotes)
+	if dir := os.Getenv("QUOTES_GIT_DIR"); dir != "" {
+		gs, err := newGitStore(dir, os.Getenv("QUOTES_GIT_PATH"))
+		if err != nil {
+			log.Fatalf("loading quotes from git: %v", err)
+		}
+		interval := time.Minute
+		if v := os.Getenv("QUOTES_GIT_INTERVAL"); v != "" {
+			if interval, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("invalid QUOTES_GIT_INTERVAL: %v", err)
+			}
+		}
+		go gs.run(ctx, interval)
+		store = gs
+	}
+
+	emb, err := newEmbedder()
+	if err != nil {
+		log.Fatalf("configuring embedder: %v", err)
+	}
+	staff, err := staffFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	state, err := stateFromEnv()
+	if err != nil {
+		log.Fatalf("connecting to shared state: %v", err)
+	}
+	if ms, ok := state.(*memoryState); ok {
+		go ms.run(ctx, time.Minute)
+	}
+	editable, _ := store.(editableStore)
+	srv := &server{
+		store:    store,
+		quiz:     newQuiz(store, quizSecret(), state),
+		markov:   newMarkovChains(store),
+		semantic: newSemanticSearch(store, emb),
+		daily:    newDailyQuotes(store, state),
+		staff:    staff,
+		security: securityFromEnv(),
+		editor:   &editorial{store: editable, staff: staff},
+		accounts: newAccounts(state, newMailerFromEnv(), baseURL(), os.Getenv("COOKIE_INSECURE") == ""),
+	}
+	go srv.daily.run(ctx, time.Minute)
+	if srv.realIP, err = realIPFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if srv.challenges, err = challengesFromEnv(state); err != nil {
+		log.Fatal(err)
+	}
+	if srv.challenges != nil {
+		go srv.challenges.run(ctx, time.Minute)
+	}
+	if path := os.Getenv("ACCESS_RULES"); path != "" {
+		if srv.access, err = loadAccess(path); err != nil {
+			log.Fatalf("loading access rules: %v", err)
+		}
+		go srv.access.geo.watch(ctx, time.Minute)
+	}
+	srv.oauth = newOAuthServer(srv.accounts, state)
+	srv.favorites = newFavorites(store, state)
+	srv.keys = newAPIKeys(state)
+	srv.meter = newMeter(state)
+	audit, err := newAuditLog(os.Getenv("AUDIT_LOG"))
+	if err != nil {
+		log.Fatalf("opening audit log: %v", err)
+	}
+	srv.billing = billingFromEnv(srv.keys, srv.accounts, staff, audit, state)
+	if srv.abuse, err = abuseFromEnv(staff, srv.keys, audit, state); err != nil {
+		log.Fatal(err)
+	}
+	if srv.abuse != nil {
+		srv.abuse.onDetection = srv.challenges.penalize
+		go srv.abuse.run(ctx, time.Hour)
+	}
+	srv.privacy = newPrivacy(srv.accounts, audit, srv.personalData())
+
+	purger, err := newPurgerFromEnv()
+	if err != nil {
+		log.Fatalf("configuring CDN purging: %v", err)
+	}
+	maxAge := time.Minute
+	if v := os.Getenv("CDN_MAX_AGE"); v != "" {
+		if maxAge, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid CDN_MAX_AGE: %v", err)
+		}
+	}
+	srv.cdn = newCDN(maxAge, purger)
+
+	if dir := os.Getenv("SIGNING_KEYS_DIR"); dir != "" {
+		keys, err := httpsig.LoadKeyring(dir, os.Getenv("SIGNING_KEY_ID"))
+		if err != nil {
+			log.Fatalf("loading signing keys: %v", err)
+		}
+		srv.signer = &signer{keys: keys}
+		go srv.signer.reload(ctx, time.Minute)
+	}
+	if n, ok := store.(changeNotifier); ok {
+		n.Subscribe(srv.cdn.notify)
+	}
+	go srv.cdn.watch(ctx, store, 15*time.Second)
+	if dir := os.Getenv("PLUGINS_DIR"); dir != "" {
+		memoryMB, timeout := 64, 100*time.Millisecond
+		if v := os.Getenv("PLUGIN_MEMORY_MB"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				log.Fatalf("invalid PLUGIN_MEMORY_MB %q", v)
+			}
+			memoryMB = n
+		}
+		if v := os.Getenv("PLUGIN_TIMEOUT"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				log.Fatalf("invalid PLUGIN_TIMEOUT: %v", err)
+			}
+			timeout = d
+		}
+		plugins, err := loadPlugins(dir, memoryMB, timeout)
+		if err != nil {
+			log.Fatalf("loading plugins: %v", err)
+		}
+		srv.plugins = plugins
+	}
+
+	handler := srv.routes()
+	httpServer := &http.Server{Addr: ":8080", Handler: handler}
+	tlsSrv, err := tlsFromEnv(handler)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Serve returns as soon as shutdown starts, so wait here for requests
+	// in flight on every listener before exiting.
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		log.Println("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tlsSrv.shutdown(shutdownCtx); err != nil {
+				log.Printf("shutting down TLS listeners: %v", err)
+			}
+		}()
+		httpServer.Shutdown(shutdownCtx)
+		wg.Wait()
+		close(stopped)
+	}()
+	if tlsSrv != nil {
+		if err := tlsSrv.listen(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Serving HTTPS on %s\n", tlsSrv.https.Addr)
+	}
+	ln, err := net.Listen("tcp", httpServer.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ln, err = proxyListenerFromEnv(ln); err != nil {
+		log.Fatal(err)
+	}
 	fmt.Println("Starting Quote API server on port 8080...")
-	http.ListenAndServe(":8080", nil)
+	if err := httpServer.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	markovMaxWords = 40
+	markovAttempts = 50
+	// markovMaxSimilarity is the highest word-bigram overlap with any real
+	// quote that a generated sentence may have before it is rejected.
+	markovMaxSimilarity = 0.6
+)
+
+// markovModel is a word-level n-gram Markov chain. Each state is the previous
+// order words joined by a space; an empty word marks the start and end.
+type markovModel struct {
+	order int
+	next  map[string][]string
+}
+
+func trainMarkov(texts []string, order int) *markovModel {
+	m := &markovModel{order: order, next: make(map[string][]string)}
+	for _, t := range texts {
+		words := strings.Fields(t)
+		if len(words) == 0 {
+			continue
+		}
+		state := make([]string, order)
+		for _, w := range append(words, "") {
+			key := strings.Join(state, " ")
+			m.next[key] = append(m.next[key], w)
+			state = append(state[1:], w)
+		}
+	}
+	return m
+}
+
+// generate walks the chain from the start state until it reaches an end
+// marker or markovMaxWords.
+func (m *markovModel) generate(rng *rand.Rand) string {
+	state := make([]string, m.order)
+	var out []string
+	for len(out) < markovMaxWords {
+		choices := m.next[strings.Join(state, " ")]
+		if len(choices) == 0 {
+			break
+		}
+		w := choices[rng.Intn(len(choices))]
+		if w == "" {
+			break
+		}
+		out = append(out, w)
+		state = append(state[1:], w)
+	}
+	return strings.Join(out, " ")
+}
+
+// similarity returns the Jaccard overlap of the word bigrams of a and b.
+func similarity(a, b string) float64 {
+	ga, gb := bigrams(a), bigrams(b)
+	if len(ga) == 0 || len(gb) == 0 {
+		return 0
+	}
+	shared := 0
+	for g := range ga {
+		if gb[g] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(ga)+len(gb)-shared)
+}
+
+func bigrams(s string) map[string]bool {
+	words := markovWords(s)
+	grams := make(map[string]bool)
+	for i := 0; i+1 < len(words); i++ {
+		grams[words[i]+" "+words[i+1]] = true
+	}
+	return grams
+}
+
+// markovWords splits s into lower-case words stripped of punctuation.
+func markovWords(s string) []string {
+	words := strings.Fields(strings.ToLower(s))
+	for i, w := range words {
+		words[i] = strings.Trim(w, ".,;:!?\"'")
+	}
+	return words
+}
+
+// normalizeText joins the words of s with single spaces and pads it with
+// one on each side, so containment checks only match whole words.
+func normalizeText(s string) string {
+	return " " + strings.Join(markovWords(s), " ") + " "
+}
+
+// tooClose reports whether text copies a real quote: it is a run of words
+// from one, such as its opening, or contains one whole, or shares too many
+// word bigrams with one. sources are normalized with normalizeText.
+func tooClose(text string, sources []string) bool {
+	norm := normalizeText(text)
+	for _, s := range sources {
+		if strings.Contains(s, norm) || strings.Contains(norm, s) || similarity(text, s) > markovMaxSimilarity {
+			return true
+		}
+	}
+	return false
+}
+
+// markovChains keeps trained chains, by order and author, until the corpus
+// changes, so requests do not retrain on every call.
+type markovChains struct {
+	store   Store
+	content *contentTracker
+
+	mu      sync.Mutex
+	version string
+	texts   []string // every quote, normalized, to reject output too close to one
+	quotes  []Quote
+	chains  map[markovChainKey]*markovChain
+}
+
+type markovChainKey struct {
+	order  int
+	author string // lower case, or empty for the whole corpus
+}
+
+type markovChain struct {
+	model  *markovModel
+	author string // as spelled in the corpus
+}
+
+func newMarkovChains(store Store) *markovChains {
+	return &markovChains{store: store, content: newContentTracker(store)}
+}
+
+// chain returns the chain of the given order trained on author's quotes, or
+// on every quote when author is empty, along with the normalized texts of
+// all quotes. It reports false if author has no quotes.
+func (c *markovChains) chain(order int, author string) (*markovChain, []string, bool) {
+	version := c.content.current()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != c.version || c.chains == nil {
+		c.version, c.quotes, c.texts = version, c.store.Quotes(), nil
+		c.chains = make(map[markovChainKey]*markovChain)
+		for _, q := range c.quotes {
+			c.texts = append(c.texts, normalizeText(q.Text))
+		}
+	}
+
+	key := markovChainKey{order, strings.ToLower(author)}
+	if ch, ok := c.chains[key]; ok {
+		return ch, c.texts, true
+	}
+	// Conditioning on an author trains the chain on their quotes only.
+	var corpus []string
+	for _, q := range c.quotes {
+		if author == "" || strings.EqualFold(q.Author, author) {
+			corpus = append(corpus, q.Text)
+			if author != "" {
+				author = q.Author
+			}
+		}
+	}
+	if len(corpus) == 0 {
+		return nil, nil, false
+	}
+	ch := &markovChain{model: trainMarkov(corpus, order), author: author}
+	c.chains[key] = ch
+	return ch, c.texts, true
+}
+
+// generatedHandler serves GET /v1/quotes/generated. Output is reproducible
+// for a given seed, order and author against the same corpus.
+func (s *server) generatedHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	order := 1
+	if v := query.Get("order"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 3 {
+			writeError(w, http.StatusBadRequest, "order must be between 1 and 3")
+			return
+		}
+		order = n
+	}
+
+	// Only seeded output is repeatable, and only a quote is cacheable.
+	s.cdn.uncacheable(w)
+	seed, seeded := rand.Int63(), false
+	if v := query.Get("seed"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "seed must be an integer")
+			return
+		}
+		seed, seeded = n, true
+	}
+
+	chain, all, ok := s.markov.chain(order, query.Get("author"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no quotes to learn from")
+		return
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	for i := 0; i < markovAttempts; i++ {
+		text := chain.model.generate(rng)
+		if text == "" || tooClose(text, all) {
+			continue
+		}
+		resp := map[string]any{
+			"generated": true,
+			"text":      text,
+			"seed":      seed,
+			"order":     order,
+		}
+		if chain.author != "" {
+			resp["author_style"] = chain.author
+		}
+		if seeded {
+			s.cdn.cacheable(w, true)
+		}
+		w.Header().Set("X-Generated-Content", "true")
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	writeError(w, http.StatusUnprocessableEntity, "could not generate a quote distinct enough from the corpus; try another seed or a lower order")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTooClose(t *testing.T) {
+	sources := []string{
+		normalizeText("Stay hungry, stay foolish."),
+		normalizeText("The best way out is always through."),
+	}
+	for text, want := range map[string]bool{
+		"Stay hungry, stay foolish.":               true,  // verbatim
+		"stay hungry":                              true,  // a prefix
+		"way out is always":                        true,  // a run from the middle
+		"Stay hungry, stay foolish, and be brave.": true,  // contains a quote
+		"The best way out is always foolish.":      true,  // mostly the same bigrams
+		"Stay foolish, the best way is hungry.":    false, // recombined
+		"stay hung":                                false, // not a whole word
+	} {
+		if got := tooClose(text, sources); got != want {
+			t.Errorf("tooClose(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+func generate(s *server, query string) (*httptest.ResponseRecorder, map[string]any) {
+	w := httptest.NewRecorder()
+	s.generatedHandler(w, httptest.NewRequest(http.MethodGet, "/v1/quotes/generated?"+query, nil))
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w, resp
+}
+
+func markovServer(quotes []Quote) *server {
+	store := newMemoryStore(quotes)
+	return &server{store: store, markov: newMarkovChains(store), cdn: newCDN(time.Minute, nil)}
+}
+
+func TestGeneratedQuotes(t *testing.T) {
+	s := markovServer([]Quote{
+		{ID: 1, Text: "The mind is a garden and the garden needs light.", Author: "Ann"},
+		{ID: 2, Text: "A garden is a mind at rest in the light of day.", Author: "Ann"},
+		{ID: 3, Text: "The light of the mind is the day that needs rest.", Author: "Ann"},
+		{ID: 4, Text: "Rest is the garden where the day grows quiet.", Author: "Bo"},
+	})
+	var texts []string
+	for _, seed := range []string{"1", "2", "3", "4", "5"} {
+		w, resp := generate(s, "seed="+seed)
+		if w.Code != http.StatusOK {
+			continue
+		}
+		if resp["generated"] != true || w.Header().Get("X-Generated-Content") != "true" {
+			t.Errorf("response %v does not say it is generated", resp)
+		}
+		if !strings.HasPrefix(w.Header().Get("Cache-Control"), "public") {
+			t.Errorf("seeded quote has Cache-Control %q, want public", w.Header().Get("Cache-Control"))
+		}
+		// The same seed gives the same quote.
+		if _, again := generate(s, "seed="+seed); again["text"] != resp["text"] {
+			t.Errorf("seed %s gave %q, then %q", seed, resp["text"], again["text"])
+		}
+		texts = append(texts, resp["text"].(string))
+	}
+	if len(texts) == 0 {
+		t.Fatal("no seed generated a quote")
+	}
+	for _, text := range texts {
+		if tooClose(text, s.markov.texts) {
+			t.Errorf("generated %q, which copies the corpus", text)
+		}
+	}
+
+	if w, _ := generate(s, ""); w.Code == http.StatusOK && w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("unseeded quote has Cache-Control %q, want no-store", w.Header().Get("Cache-Control"))
+	}
+	if w, resp := generate(s, "author=ann&seed=1"); w.Code != http.StatusOK || resp["author_style"] != "Ann" {
+		t.Errorf("generating for ann = %d, author_style %v, want Ann as spelled in the corpus", w.Code, resp["author_style"])
+	}
+	for query, want := range map[string]int{
+		"order=4":       http.StatusBadRequest,
+		"seed=x":        http.StatusBadRequest,
+		"author=Nobody": http.StatusNotFound,
+	} {
+		if w, _ := generate(s, query); w.Code != want {
+			t.Errorf("%s = %d, want %d", query, w.Code, want)
+		}
+	}
+}
+
+func TestGeneratedFailureIsNotCached(t *testing.T) {
+	// A single quote can only be reproduced, never recombined.
+	s := markovServer([]Quote{{ID: 1, Text: "Talk is cheap. Show me the code.", Author: "Linus Torvalds"}})
+	w, _ := generate(s, "seed=7")
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("generating from one quote = %d %s, want 422", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" || w.Header().Get("Surrogate-Key") != "" {
+		t.Errorf("failed seeded request has Cache-Control %q, want no-store and no cache keys", got)
+	}
+}
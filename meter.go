@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usageKey is one metering bucket: requests by one API key to one route on
+// one UTC day, under the plan the owner had at the time.
+type usageKey struct {
+	Owner string `json:"owner"`
+	Key   string `json:"key"`
+	Plan  string `json:"plan"`
+	Route string `json:"route"`
+	Day   string `json:"day"` // YYYY-MM-DD
+}
+
+// field returns the bucket's field in its day's usage hash.
+func (k usageKey) field() string {
+	return strings.Join([]string{k.Owner, k.Key, k.Plan, k.Route}, "\t")
+}
+
+func parseUsageField(day, field string) (usageKey, bool) {
+	parts := strings.Split(field, "\t")
+	if len(parts) != 4 {
+		return usageKey{}, false
+	}
+	return usageKey{Owner: parts[0], Key: parts[1], Plan: parts[2], Route: parts[3], Day: day}, true
+}
+
+// usageRetention is how long buckets are kept, long enough to bill the
+// previous year.
+const usageRetention = 400 * 24 * time.Hour
+
+// anonymousPlan limits requests to the public API made without a key. It
+// applies to each client address and is not offered in the portal.
+var anonymousPlan = plan{Name: "anonymous", Description: "Requests without an API key, per client address.", DailyQuota: 200, MonthlyQuota: 2_000}
+
+// meter counts API requests and enforces plan quotas. Quotas apply to the
+// developer account, across all of its keys, or to the client address for
+// requests without a key. Counters are kept in shared state, so every
+// replica enforces the same quota and restarts lose nothing.
+type meter struct {
+	state      stateStore
+	rejections *counterVec
+}
+
+func newMeter(state stateStore) *meter {
+	return &meter{
+		state:      state,
+		rejections: newCounterVec("quote_quota_rejections_total", "Requests rejected for exceeding a plan quota, by plan and window.", "plan", "window"),
+	}
+}
+
+// The day and month totals of an account or address expire once their
+// window has passed. Each day's buckets are a hash that expires after
+// usageRetention, and each key's buckets are a hash of day and route that
+// the portal reads.
+func meterTotalKey(owner, window string) string { return "meter:total:" + owner + ":" + window }
+func usageDayKey(day string) string             { return "meter:usage:" + day }
+func keyUsageKey(keyID string) string           { return "meter:key:" + keyID }
+
+// anonymousOwner is whom requests without a key are counted against: the
+// client's address group.
+func anonymousOwner(addr netip.Addr) string {
+	return "addr:" + clientGroup(addr)
+}
+
+// quota is an account's standing against its plan after a request.
+type quota struct {
+	plan                 plan
+	dayUsed, monthUsed   int64
+	dayReset, monthReset time.Time
+}
+
+// take counts a request against owner's plan unless a quota is used up, in
+// which case it reports false and the window that ran out. Requests by a
+// key (keyID is not empty) are also recorded for usage and billing.
+// Replicas race only on the counters, which are incremented first and
+// given back when over the quota.
+func (m *meter) take(ctx context.Context, owner, keyID, route string, p plan, now time.Time) (quota, string, bool, error) {
+	now = now.UTC()
+	day, month := now.Format(time.DateOnly), now.Format("2006-01")
+	q := quota{
+		plan:       p,
+		dayReset:   time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC),
+		monthReset: time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	windows := []struct {
+		name, key string
+		limit     int64
+		ttl       time.Duration
+		used      *int64
+	}{
+		{"day", meterTotalKey(owner, day), p.DailyQuota, q.dayReset.Sub(now) + time.Hour, &q.dayUsed},
+		{"month", meterTotalKey(owner, month), p.MonthlyQuota, q.monthReset.Sub(now) + time.Hour, &q.monthUsed},
+	}
+	for i, win := range windows {
+		n, err := m.state.incr(ctx, win.key, 1, win.ttl)
+		if err != nil {
+			return q, "", false, err
+		}
+		*win.used = n
+		if win.limit > 0 && n > win.limit {
+			for _, taken := range windows[:i+1] {
+				if _, err := m.state.incr(ctx, taken.key, -1, 0); err != nil {
+					return q, "", false, err
+				}
+				*taken.used--
+			}
+			// Windows not counted yet are reported as they stand.
+			for _, rest := range windows[i+1:] {
+				v, _, err := m.state.get(ctx, rest.key)
+				if err != nil {
+					return q, "", false, err
+				}
+				*rest.used, _ = strconv.ParseInt(v, 10, 64)
+			}
+			m.rejections.inc(p.Name, win.name)
+			return q, win.name, false, nil
+		}
+	}
+	if keyID == "" {
+		return q, "", true, nil
+	}
+	k := usageKey{owner, keyID, p.Name, route, day}
+	if _, err := m.state.hincr(ctx, usageDayKey(day), k.field(), 1, usageRetention); err != nil {
+		return q, "", false, err
+	}
+	if _, err := m.state.hincr(ctx, keyUsageKey(keyID), day+"\t"+route, 1, usageRetention); err != nil {
+		return q, "", false, err
+	}
+	return q, "", true, nil
+}
+
+// setHeaders reports the account's remaining quota. A zero limit means the
+// plan has none for that window, and its headers are left out.
+func (q quota) setHeaders(w http.ResponseWriter, now time.Time) {
+	h := w.Header()
+	h.Set("X-Quota-Plan", q.plan.Name)
+	if q.plan.DailyQuota > 0 {
+		h.Set("X-Quota-Limit-Day", strconv.FormatInt(q.plan.DailyQuota, 10))
+		h.Set("X-Quota-Remaining-Day", strconv.FormatInt(max(q.plan.DailyQuota-q.dayUsed, 0), 10))
+		h.Set("X-Quota-Reset-Day", strconv.Itoa(int(q.dayReset.Sub(now).Seconds())))
+	}
+	if q.plan.MonthlyQuota > 0 {
+		h.Set("X-Quota-Limit-Month", strconv.FormatInt(q.plan.MonthlyQuota, 10))
+		h.Set("X-Quota-Remaining-Month", strconv.FormatInt(max(q.plan.MonthlyQuota-q.monthUsed, 0), 10))
+		h.Set("X-Quota-Reset-Month", strconv.Itoa(int(q.monthReset.Sub(now).Seconds())))
+	}
+}
+
+// usage returns keyID's counts for each day from first to last inclusive,
+// in total and by route. Buckets past usageRetention are dropped on the
+// way.
+func (m *meter) usage(ctx context.Context, keyID string, first, last string) (daily map[string]int64, routes map[string]int64, err error) {
+	fields, err := m.state.hgetAll(ctx, keyUsageKey(keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+	daily, routes = make(map[string]int64), make(map[string]int64)
+	oldest := time.Now().UTC().Add(-usageRetention).Format(time.DateOnly)
+	var expired []string
+	for f, v := range fields {
+		day, route, _ := strings.Cut(f, "\t")
+		if day < oldest {
+			expired = append(expired, f)
+			continue
+		}
+		n, _ := strconv.ParseInt(v, 10, 64)
+		if day >= first && day <= last {
+			daily[day] += n
+			routes[route] += n
+		}
+	}
+	if len(expired) > 0 {
+		if err := m.state.hdel(ctx, keyUsageKey(keyID), expired...); err != nil {
+			return nil, nil, err
+		}
+	}
+	return daily, routes, nil
+}
+
+// usageRow is one line of a billing export.
+type usageRow struct {
+	usageKey
+	Email    string `json:"email,omitempty"`
+	Requests int64  `json:"requests"`
+}
+
+// rows returns the buckets from first to last inclusive that match keep,
+// ordered by day, owner, key and route. Only days from the retention
+// period up to today are read, whatever the range asks for, so one call
+// reads at most one hash per retained day.
+func (m *meter) rows(ctx context.Context, first, last string, keep func(usageKey) bool) ([]usageRow, error) {
+	start, _ := time.Parse(time.DateOnly, first)
+	end, _ := time.Parse(time.DateOnly, last)
+	now := time.Now().UTC()
+	if oldest := now.Add(-usageRetention).Truncate(24 * time.Hour); start.Before(oldest) {
+		start = oldest
+	}
+	if today := now.Truncate(24 * time.Hour); end.After(today) {
+		end = today
+	}
+	rows := []usageRow{}
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		day := d.Format(time.DateOnly)
+		fields, err := m.state.hgetAll(ctx, usageDayKey(day))
+		if err != nil {
+			return nil, err
+		}
+		for f, v := range fields {
+			k, ok := parseUsageField(day, f)
+			if !ok || keep != nil && !keep(k) {
+				continue
+			}
+			n, _ := strconv.ParseInt(v, 10, 64)
+			rows = append(rows, usageRow{usageKey: k, Requests: n})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i].usageKey, rows[j].usageKey
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Route < b.Route
+	})
+	return rows, nil
+}
+
+// exportHandler serves usage for billing, as JSON or, with ?format=csv or
+// ?format=ndjson, as CSV or one row per line. The range defaults to the
+// current month; narrow it with ?from= and ?to= dates.
+func (m *meter) exportHandler(a *accounts) func(http.ResponseWriter, *http.Request, role) {
+	return func(w http.ResponseWriter, r *http.Request, _ role) {
+		now := time.Now().UTC()
+		from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Format(time.DateOnly)
+		to := now.Format(time.DateOnly)
+		for name, v := range map[string]*string{"from": &from, "to": &to} {
+			if s := r.URL.Query().Get(name); s != "" {
+				if _, err := time.Parse(time.DateOnly, s); err != nil {
+					writeError(w, http.StatusBadRequest, name+" must be a date in YYYY-MM-DD form")
+					return
+				}
+				*v = s
+			}
+		}
+
+		rows, err := m.rows(r.Context(), from, to, nil)
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		for i := range rows {
+			u, ok, err := a.userByID(r.Context(), rows[i].Owner)
+			if err != nil {
+				stateError(w, err)
+				return
+			}
+			if ok {
+				rows[i].Email = u.Email
+			}
+		}
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			writeJSON(w, http.StatusOK, map[string]any{"from": from, "to": to, "usage": rows})
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=usage-%s-%s.csv", from, to))
+			cw := csv.NewWriter(w)
+			cw.Write([]string{"day", "owner", "email", "plan", "key", "route", "requests"})
+			for _, row := range rows {
+				cw.Write([]string{row.Day, row.Owner, row.Email, row.Plan, row.Key, row.Route, strconv.FormatInt(row.Requests, 10)})
+			}
+			cw.Flush()
+		case "ndjson":
+			out, ok := newNDJSONWriter(w, r, fmt.Sprintf("usage-%s-%s.ndjson", from, to))
+			if !ok {
+				return
+			}
+			for _, row := range rows {
+				if out.write(row) != nil {
+					return
+				}
+			}
+			out.flush()
+		default:
+			writeError(w, http.StatusBadRequest, "format must be json, csv or ndjson")
+		}
+	}
+}
+
+// erasedOwner replaces the owner and key of erased users' usage, which is
+// kept in aggregate for billing records.
+const erasedOwner = "erased"
+
+// userRows returns all of the user's buckets that are still kept.
+func (m *meter) userRows(ctx context.Context, userID string) ([]usageRow, error) {
+	today := time.Now().UTC().Format(time.DateOnly)
+	return m.rows(ctx, "", today, func(k usageKey) bool { return k.Owner == userID })
+}
+
+func (m *meter) exportUser(userID string) (any, error) {
+	rows, err := m.userRows(context.Background(), userID)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// eraseUser anonymizes the user's usage. Counts stay, so totals billed
+// before the erasure still add up, but no longer point to the user.
+func (m *meter) eraseUser(userID string) error {
+	ctx := context.Background()
+	rows, err := m.userRows(ctx, userID)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]bool)
+	for _, row := range rows {
+		erased := row.usageKey
+		erased.Owner, erased.Key = erasedOwner, erasedOwner
+		if _, err := m.state.hincr(ctx, usageDayKey(row.Day), erased.field(), row.Requests, 0); err != nil {
+			return err
+		}
+		if err := m.state.hdel(ctx, usageDayKey(row.Day), row.field()); err != nil {
+			return err
+		}
+		keys[keyUsageKey(row.Key)] = true
+	}
+	now := time.Now().UTC()
+	del := []string{meterTotalKey(userID, now.Format(time.DateOnly)), meterTotalKey(userID, now.Format("2006-01"))}
+	for k := range keys {
+		del = append(del, k)
+	}
+	return m.state.del(ctx, del...)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMeterQuotas(t *testing.T) {
+	m := newMeter(newMemoryState())
+	ctx := context.Background()
+	p := plan{Name: "test", DailyQuota: 3, MonthlyQuota: 5}
+	now := time.Now().UTC()
+	first := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+
+	take := func(at time.Time) (quota, string, bool) {
+		t.Helper()
+		q, window, ok, err := m.take(ctx, "u_1", "k_1", "GET /v1/quotes", p, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q, window, ok
+	}
+	for i := 0; i < 3; i++ {
+		if _, window, ok := take(first); !ok {
+			t.Fatalf("request %d refused for the %s", i+1, window)
+		}
+	}
+	q, window, ok := take(first)
+	if ok || window != "day" {
+		t.Fatalf("request over the daily quota = %v %q, want refused for the day", ok, window)
+	}
+	// The refused request is given back, so it does not count.
+	if q.dayUsed != 3 || q.monthUsed != 3 {
+		t.Errorf("used %d today and %d this month after a refusal, want 3 and 3", q.dayUsed, q.monthUsed)
+	}
+	w := httptest.NewRecorder()
+	q.setHeaders(w, first)
+	if w.Header().Get("X-Quota-Remaining-Day") != "0" || w.Header().Get("X-Quota-Remaining-Month") != "2" || w.Header().Get("X-Quota-Reset-Day") != "86400" {
+		t.Errorf("quota headers = %v", w.Header())
+	}
+
+	// The next day has room, until the month runs out.
+	next := first.AddDate(0, 0, 1)
+	take(next)
+	take(next)
+	if _, window, ok := take(next); ok || window != "month" {
+		t.Errorf("request over the monthly quota = %v %q, want refused for the month", ok, window)
+	}
+	if _, _, ok := take(first.AddDate(0, 1, 0)); !ok {
+		t.Error("request in a new month refused")
+	}
+
+	// Only accepted requests are billed.
+	rows, err := m.rows(ctx, first.Format(time.DateOnly), now.Format(time.DateOnly), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var billed int64
+	for _, row := range rows {
+		billed += row.Requests
+	}
+	if billed != 6 {
+		t.Errorf("billed %d requests, want 6", billed)
+	}
+}
+
+func TestMeterAnonymousQuota(t *testing.T) {
+	m := newMeter(newMemoryState())
+	now := time.Now()
+	// Addresses in one /64 share a quota; another /64 has its own.
+	a, b := netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")
+	for i := int64(0); i < anonymousPlan.DailyQuota; i++ {
+		addr := a
+		if i%2 == 1 {
+			addr = b
+		}
+		if _, _, ok, _ := m.take(context.Background(), anonymousOwner(addr), "", "GET /", anonymousPlan, now); !ok {
+			t.Fatalf("anonymous request %d refused", i+1)
+		}
+	}
+	if _, _, ok, _ := m.take(context.Background(), anonymousOwner(b), "", "GET /", anonymousPlan, now); ok {
+		t.Error("request over the anonymous quota from the same /64 accepted")
+	}
+	if _, _, ok, _ := m.take(context.Background(), anonymousOwner(netip.MustParseAddr("2001:db8:0:1::1")), "", "GET /", anonymousPlan, now); !ok {
+		t.Error("request from another /64 refused")
+	}
+	// Anonymous requests are not billed.
+	if rows, _ := m.rows(context.Background(), "", now.UTC().Format(time.DateOnly), nil); len(rows) != 0 {
+		t.Errorf("anonymous requests left %d usage rows", len(rows))
+	}
+}
+
+// countingState counts the usage hashes read.
+type countingState struct {
+	stateStore
+	reads int
+}
+
+func (s *countingState) hgetAll(ctx context.Context, key string) (map[string]string, error) {
+	s.reads++
+	return s.stateStore.hgetAll(ctx, key)
+}
+
+func TestMeterExportRange(t *testing.T) {
+	state := &countingState{stateStore: newMemoryState()}
+	m := newMeter(state)
+	if _, _, _, err := m.take(context.Background(), "u_1", "k_1", "GET /v1/quotes", plan{Name: "free"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	h := m.exportHandler(newAccounts(newMemoryState(), new(inbox), "", false))
+	export := func(query string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/v1/admin/usage?"+query, nil), roleAdmin)
+		var resp map[string]any
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	// However wide the range, only the retained days up to today are read.
+	status, resp := export("from=0001-01-01&to=9999-12-31")
+	if usage, _ := resp["usage"].([]any); status != http.StatusOK || len(usage) != 1 {
+		t.Fatalf("export of every date = %d %v, want today's row", status, resp)
+	}
+	if max := int(usageRetention/(24*time.Hour)) + 2; state.reads > max {
+		t.Errorf("read %d days of usage, want at most %d", state.reads, max)
+	}
+
+	if status, _ := export("to=2026-13-01"); status != http.StatusBadRequest {
+		t.Errorf("export with an invalid date = %d, want 400", status)
+	}
+	if status, _ := export("format=xml"); status != http.StatusBadRequest {
+		t.Errorf("export as xml = %d, want 400", status)
+	}
+}
@@ -0,0 +1,933 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OAuth scopes third-party apps can ask for.
+const (
+	scopeQuotesRead     = "quotes:read"
+	scopeFavoritesWrite = "favorites:write"
+)
+
+var oauthScopes = map[string]string{
+	scopeQuotesRead:     "Read quotes and your favorites",
+	scopeFavoritesWrite: "Add and remove your favorites",
+}
+
+const (
+	authCodeTTL     = time.Minute
+	accessTokenTTL  = time.Hour
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// oauthClient is a registered third-party app. Public clients (mobile and
+// single-page apps) have no secret and rely on PKCE alone.
+type oauthClient struct {
+	ID           string    `json:"client_id"`
+	Name         string    `json:"client_name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// storedClient is a client as kept in shared state.
+type storedClient struct {
+	oauthClient
+	Owner      string `json:"owner"`
+	SecretHash string `json:"secret_hash,omitempty"`
+}
+
+// authCode is an issued authorization code. Codes are kept after use until
+// they expire so a replayed code can revoke what it was exchanged for.
+type authCode struct {
+	ClientID    string    `json:"client_id"`
+	UserID      string    `json:"user_id"`
+	RedirectURI string    `json:"redirect_uri"`
+	Scope       string    `json:"scope"`
+	Challenge   string    `json:"challenge"`
+	Expires     time.Time `json:"expires"`
+}
+
+// oauthToken is an access or refresh token. Every token descends from one
+// authorization (its grant), and revoking a refresh token revokes the grant.
+type oauthToken struct {
+	Refresh  bool      `json:"refresh,omitempty"`
+	ClientID string    `json:"client_id"`
+	UserID   string    `json:"user_id"`
+	Scope    string    `json:"scope"`
+	Grant    string    `json:"grant"`
+	Issued   time.Time `json:"issued"`
+	Expires  time.Time `json:"expires"`
+	Rotated  bool      `json:"rotated,omitempty"` // refresh tokens only: already exchanged
+}
+
+// oauthServer is an OAuth 2.1 authorization server for the authorization
+// code grant with PKCE, acting for the users in accounts.
+//
+// Clients, codes and tokens are kept in shared state, so any replica can
+// finish a flow another one started:
+//
+//	oauth:client:<id>          the client, as JSON
+//	oauth:clients:<owner>      hash of the IDs of the clients a user registered
+//	oauth:code:<hash>          an authorization code, until it expires
+//	oauth:code:<hash>:grant    the grant a code was exchanged for
+//	oauth:token:<hash>         an access or refresh token, until it expires
+//	oauth:grant:<grant>        hash of the token hashes issued under a grant
+//	oauth:grants:<user>        hash of a user's grants, to their client IDs
+//	oauth:client-grants:<id>   hash of a client's grants, to their user IDs
+//
+// Codes and tokens are keyed by their SHA-256, like sessions.
+type oauthServer struct {
+	accounts *accounts
+	state    stateStore
+}
+
+func newOAuthServer(a *accounts, state stateStore) *oauthServer {
+	return &oauthServer{accounts: a, state: state}
+}
+
+func oauthClientKey(id string) string       { return "oauth:client:" + id }
+func oauthClientsKey(owner string) string   { return "oauth:clients:" + owner }
+func oauthCodeKey(hash string) string       { return "oauth:code:" + hash }
+func oauthTokenKey(hash string) string      { return "oauth:token:" + hash }
+func oauthGrantKey(grant string) string     { return "oauth:grant:" + grant }
+func oauthUserGrantsKey(user string) string { return "oauth:grants:" + user }
+func oauthClientGrantsKey(id string) string { return "oauth:client-grants:" + id }
+
+func (o *oauthServer) routes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /v1/oauth/clients", o.accounts.requireUser(o.registerClientHandler))
+	mux.HandleFunc("GET /v1/oauth/clients", o.accounts.requireUser(o.listClientsHandler))
+	mux.HandleFunc("DELETE /v1/oauth/clients/{id}", o.accounts.requireUser(o.deleteClientHandler))
+	mux.HandleFunc("GET /v1/oauth/authorize", o.authorizeHandler)
+	mux.HandleFunc("POST /v1/oauth/authorize", o.authorizeHandler)
+	mux.HandleFunc("POST /v1/oauth/token", o.tokenHandler)
+	mux.HandleFunc("POST /v1/oauth/revoke", o.revokeHandler)
+	mux.HandleFunc("POST /v1/oauth/introspect", o.introspectHandler)
+}
+
+// oauthError is an error response as defined by RFC 6749 section 5.2.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, desc string) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, oauthError{code, desc})
+}
+
+// validRedirectURI accepts absolute https URIs and http ones on loopback
+// addresses for native apps, without fragments.
+func validRedirectURI(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	return u.Scheme == "http" && (host == "localhost" || ip != nil && ip.IsLoopback())
+}
+
+// parseScope checks a space-separated scope list and returns it sorted.
+// An empty request gets quotes:read.
+func parseScope(s string) (string, bool) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return scopeQuotesRead, true
+	}
+	for _, f := range fields {
+		if _, ok := oauthScopes[f]; !ok {
+			return "", false
+		}
+	}
+	sort.Strings(fields)
+	return strings.Join(slices.Compact(fields), " "), true
+}
+
+func hasScope(scope, want string) bool {
+	return slices.Contains(strings.Fields(scope), want)
+}
+
+func (o *oauthServer) registerClientHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	var req struct {
+		Name         string   `json:"client_name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		writeError(w, http.StatusBadRequest, "client_name is required, up to 100 characters")
+		return
+	}
+	if len(req.RedirectURIs) == 0 || len(req.RedirectURIs) > 10 {
+		writeError(w, http.StatusBadRequest, "between 1 and 10 redirect_uris are required")
+		return
+	}
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri) {
+			writeError(w, http.StatusBadRequest, "redirect URI "+strconv.Quote(uri)+" must be https, or http on a loopback address, without a fragment")
+			return
+		}
+	}
+
+	c := &storedClient{
+		oauthClient: oauthClient{
+			ID:           "c_" + randomString(12),
+			Name:         req.Name,
+			RedirectURIs: req.RedirectURIs,
+			Confidential: req.Confidential,
+			CreatedAt:    time.Now().UTC(),
+		},
+		Owner: u.ID,
+	}
+	resp := map[string]any{"client": c.oauthClient}
+	if c.Confidential {
+		secret := randomString(32)
+		c.SecretHash = hashToken(secret)
+		resp["client_secret"] = secret
+	}
+	ctx := r.Context()
+	if err := setJSON(ctx, o.state, oauthClientKey(c.ID), c, 0); err != nil {
+		stateError(w, err)
+		return
+	}
+	if err := o.state.hset(ctx, oauthClientsKey(u.ID), c.ID, ""); err != nil {
+		stateError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// client returns the client with id.
+func (o *oauthServer) client(ctx context.Context, id string) (*storedClient, bool, error) {
+	c := new(storedClient)
+	ok, err := getJSON(ctx, o.state, oauthClientKey(id), c)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return c, true, nil
+}
+
+// clientsOf returns the clients owner registered, oldest first.
+func (o *oauthServer) clientsOf(ctx context.Context, owner string) ([]*storedClient, error) {
+	ids, err := o.state.hgetAll(ctx, oauthClientsKey(owner))
+	if err != nil {
+		return nil, err
+	}
+	list := []*storedClient{}
+	for id := range ids {
+		c, ok, err := o.client(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			list = append(list, c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+func (o *oauthServer) listClientsHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	stored, err := o.clientsOf(r.Context(), u.ID)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	list := make([]oauthClient, len(stored))
+	for i, c := range stored {
+		list[i] = c.oauthClient
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"clients": list})
+}
+
+// deleteClientHandler removes a client and every token issued to it.
+func (o *oauthServer) deleteClientHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	c, ok, err := o.client(r.Context(), r.PathValue("id"))
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !ok || c.Owner != u.ID {
+		writeError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	if err := o.deleteClient(r.Context(), c); err != nil {
+		stateError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteClient removes c and revokes every grant made to it. The client
+// goes first, so its codes can no longer be exchanged.
+func (o *oauthServer) deleteClient(ctx context.Context, c *storedClient) error {
+	if err := o.state.del(ctx, oauthClientKey(c.ID)); err != nil {
+		return err
+	}
+	if err := o.state.hdel(ctx, oauthClientsKey(c.Owner), c.ID); err != nil {
+		return err
+	}
+	grants, err := o.state.hgetAll(ctx, oauthClientGrantsKey(c.ID))
+	if err != nil {
+		return err
+	}
+	for grant := range grants {
+		if err := o.revokeGrant(ctx, grant); err != nil {
+			return err
+		}
+	}
+	return o.state.del(ctx, oauthClientGrantsKey(c.ID))
+}
+
+// authRequest is a validated authorization request.
+type authRequest struct {
+	Client      oauthClient
+	RedirectURI string
+	Scope       string
+	State       string
+	Challenge   string
+}
+
+// ScopeDescriptions lists what the consent page asks the user to allow.
+func (a authRequest) ScopeDescriptions() []string {
+	var out []string
+	for _, s := range strings.Fields(a.Scope) {
+		out = append(out, oauthScopes[s])
+	}
+	return out
+}
+
+// parseAuthorize validates an authorization request. A nil redirect URL
+// means the client or redirect URI could not be trusted, so the error must
+// be shown to the user rather than sent back to the client.
+func (o *oauthServer) parseAuthorize(ctx context.Context, q url.Values) (authRequest, *url.URL, *oauthError, error) {
+	c, ok, err := o.client(ctx, q.Get("client_id"))
+	if err != nil {
+		return authRequest{}, nil, nil, err
+	}
+	if !ok {
+		return authRequest{}, nil, &oauthError{"invalid_request", "unknown client_id"}, nil
+	}
+	client := c.oauthClient
+	uri := q.Get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, uri) {
+		return authRequest{}, nil, &oauthError{"invalid_request", "redirect_uri is not registered for this client"}, nil
+	}
+	redirect, _ := url.Parse(uri)
+
+	req := authRequest{Client: client, RedirectURI: uri, State: q.Get("state"), Challenge: q.Get("code_challenge")}
+	if q.Get("response_type") != "code" {
+		return req, redirect, &oauthError{"unsupported_response_type", "only response_type=code is supported"}, nil
+	}
+	if q.Get("code_challenge_method") != "S256" || len(req.Challenge) != 43 {
+		return req, redirect, &oauthError{"invalid_request", "a PKCE code_challenge with code_challenge_method=S256 is required"}, nil
+	}
+	scope, ok := parseScope(q.Get("scope"))
+	if !ok {
+		return req, redirect, &oauthError{"invalid_scope", "unknown scope"}, nil
+	}
+	req.Scope = scope
+	return req, redirect, nil, nil
+}
+
+// redirectWith sends the user agent back to the client with params added
+// to the redirect URI's query.
+func redirectWith(w http.ResponseWriter, r *http.Request, redirect *url.URL, state string, params map[string]string) {
+	u := *redirect
+	q := u.Query()
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+var consentPage = template.Must(template.New("consent").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Authorize {{.Client.Name}}</title>
+<style nonce="{{.Nonce}}">
+body { font-family: system-ui, sans-serif; max-width: 32rem; margin: 3rem auto; padding: 0 1rem; }
+button { padding: .4rem .9rem; margin-right: .5rem; }
+</style>
+</head>
+<body>
+<h1>{{.Client.Name}} wants to access your account</h1>
+<p>Signed in as {{.Email}}. The app is asking to:</p>
+<ul>{{range .ScopeDescriptions}}<li>{{.}}</li>{{end}}</ul>
+<form method="post">
+<input type="hidden" name="client_id" value="{{.Client.ID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="response_type" value="code">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="code_challenge" value="{{.Challenge}}">
+<input type="hidden" name="code_challenge_method" value="S256">
+<button name="decision" value="allow">Allow</button>
+<button name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+// authorizeHandler shows the consent page on GET and records the user's
+// decision on POST. The session cookie is SameSite=Lax, so another site
+// cannot submit the form on the user's behalf.
+func (o *oauthServer) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request")
+		return
+	}
+	req, redirect, oerr, err := o.parseAuthorize(r.Context(), r.Form)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if oerr != nil {
+		if redirect == nil {
+			writeError(w, http.StatusBadRequest, oerr.Description)
+			return
+		}
+		redirectWith(w, r, redirect, req.State, map[string]string{"error": oerr.Code, "error_description": oerr.Description})
+		return
+	}
+	u, _, ok, err := o.accounts.current(r)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "sign in first, then retry this authorization request")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY")
+		consentPage.Execute(w, struct {
+			authRequest
+			Email string
+			Nonce string
+		}{req, u.Email, cspNonce(r)})
+		return
+	}
+	if r.PostForm.Get("decision") != "allow" {
+		redirectWith(w, r, redirect, req.State, map[string]string{"error": "access_denied"})
+		return
+	}
+
+	code := randomString(32)
+	c := authCode{
+		ClientID:    req.Client.ID,
+		UserID:      u.ID,
+		RedirectURI: req.RedirectURI,
+		Scope:       req.Scope,
+		Challenge:   req.Challenge,
+		Expires:     time.Now().Add(authCodeTTL),
+	}
+	if err := setJSON(r.Context(), o.state, oauthCodeKey(hashToken(code)), c, authCodeTTL); err != nil {
+		stateError(w, err)
+		return
+	}
+	redirectWith(w, r, redirect, req.State, map[string]string{"code": code})
+}
+
+// authenticateClient identifies the client calling the token, revocation
+// or introspection endpoint. Confidential clients must present their
+// secret, with HTTP Basic or client_secret in the form.
+func (o *oauthServer) authenticateClient(r *http.Request) (oauthClient, bool, error) {
+	id, secret, basic := r.BasicAuth()
+	if !basic {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	c, ok, err := o.client(r.Context(), id)
+	if err != nil || !ok {
+		return oauthClient{}, false, err
+	}
+	if c.Confidential && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretHash)) != 1 {
+		return oauthClient{}, false, nil
+	}
+	return c.oauthClient, true, nil
+}
+
+// issueTokens creates an access and refresh token pair within grant. The
+// grant's index lives as long as its newest refresh token.
+func (o *oauthServer) issueTokens(ctx context.Context, clientID, userID, scope, grant string) (map[string]any, error) {
+	now := time.Now()
+	access, refresh := randomString(32), randomString(32)
+	for _, t := range []struct {
+		token string
+		oauthToken
+	}{
+		{access, oauthToken{ClientID: clientID, UserID: userID, Scope: scope, Grant: grant, Issued: now, Expires: now.Add(accessTokenTTL)}},
+		{refresh, oauthToken{Refresh: true, ClientID: clientID, UserID: userID, Scope: scope, Grant: grant, Issued: now, Expires: now.Add(refreshTokenTTL)}},
+	} {
+		h := hashToken(t.token)
+		if _, err := o.state.hincr(ctx, oauthGrantKey(grant), h, 1, refreshTokenTTL); err != nil {
+			return nil, err
+		}
+		if err := setJSON(ctx, o.state, oauthTokenKey(h), t.oauthToken, t.Expires.Sub(now)); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]any{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(accessTokenTTL.Seconds()),
+		"refresh_token": refresh,
+		"scope":         scope,
+	}, nil
+}
+
+// token returns the live token with hash h.
+func (o *oauthServer) token(ctx context.Context, h string) (*oauthToken, bool, error) {
+	t := new(oauthToken)
+	ok, err := getJSON(ctx, o.state, oauthTokenKey(h), t)
+	if err != nil || !ok || time.Now().After(t.Expires) {
+		return nil, false, err
+	}
+	return t, true, nil
+}
+
+// revokeGrant removes every token issued under grant.
+func (o *oauthServer) revokeGrant(ctx context.Context, grant string) error {
+	hashes, err := o.state.hgetAll(ctx, oauthGrantKey(grant))
+	if err != nil {
+		return err
+	}
+	keys := []string{oauthGrantKey(grant)}
+	for h := range hashes {
+		keys = append(keys, oauthTokenKey(h))
+	}
+	return o.state.del(ctx, keys...)
+}
+
+// grants returns the live grants in the index at key, and drops the ones
+// that were revoked or have expired.
+func (o *oauthServer) grants(ctx context.Context, key string) (map[string]string, error) {
+	index, err := o.state.hgetAll(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for grant := range index {
+		hashes, err := o.state.hgetAll(ctx, oauthGrantKey(grant))
+		if err != nil {
+			return nil, err
+		}
+		if len(hashes) > 0 {
+			continue
+		}
+		delete(index, grant)
+		if err := o.state.hdel(ctx, key, grant); err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+func (o *oauthServer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 16<<10)
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "the body must be application/x-www-form-urlencoded")
+		return
+	}
+	client, ok, err := o.authenticateClient(r)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		o.exchangeCode(w, r, client)
+	case "refresh_token":
+		o.refresh(w, r, client)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "use authorization_code or refresh_token")
+	}
+}
+
+func (o *oauthServer) exchangeCode(w http.ResponseWriter, r *http.Request, client oauthClient) {
+	verifier := r.PostForm.Get("code_verifier")
+	if len(verifier) < 43 || len(verifier) > 128 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "code_verifier must be 43 to 128 characters")
+		return
+	}
+
+	ctx := r.Context()
+	h := hashToken(r.PostForm.Get("code"))
+	var c authCode
+	ok, err := getJSON(ctx, o.state, oauthCodeKey(h), &c)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if ok {
+		// The user may have been erased since the code was issued.
+		_, ok, err = o.accounts.userByID(ctx, c.UserID)
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+	}
+	if !ok || time.Now().After(c.Expires) || c.ClientID != client.ID {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "the code is invalid or expired")
+		return
+	}
+	if o.replayedCode(w, r, h) {
+		return
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if c.RedirectURI != r.PostForm.Get("redirect_uri") || subtle.ConstantTimeCompare([]byte(challenge), []byte(c.Challenge)) != 1 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri or code_verifier does not match the authorization request")
+		return
+	}
+
+	// Of concurrent exchanges on any replicas, only one claims the code.
+	grant := "g_" + randomString(12)
+	fresh, err := o.state.setNX(ctx, oauthCodeKey(h)+":grant", grant, authCodeTTL)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !fresh {
+		o.replayedCode(w, r, h)
+		return
+	}
+	// Record the grant where revoking the client or erasing the user will
+	// find it, and drop the ones that are gone.
+	for _, idx := range []struct{ key, value string }{
+		{oauthUserGrantsKey(c.UserID), client.ID},
+		{oauthClientGrantsKey(client.ID), c.UserID},
+	} {
+		if _, err := o.grants(ctx, idx.key); err != nil {
+			stateError(w, err)
+			return
+		}
+		if err := o.state.hset(ctx, idx.key, grant, idx.value); err != nil {
+			stateError(w, err)
+			return
+		}
+	}
+	tokens, err := o.issueTokens(ctx, client.ID, c.UserID, c.Scope, grant)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// replayedCode reports whether the code with hash h was already exchanged.
+// A replayed code may have been stolen, so what it produced is revoked.
+func (o *oauthServer) replayedCode(w http.ResponseWriter, r *http.Request, h string) bool {
+	grant, used, err := o.state.get(r.Context(), oauthCodeKey(h)+":grant")
+	if err != nil {
+		stateError(w, err)
+		return true
+	}
+	if !used {
+		return false
+	}
+	if err := o.revokeGrant(r.Context(), grant); err != nil {
+		stateError(w, err)
+		return true
+	}
+	writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "the code has already been used")
+	return true
+}
+
+// refresh exchanges a refresh token for a new pair. Refresh tokens rotate:
+// each works once, and presenting a spent one revokes the whole grant.
+func (o *oauthServer) refresh(w http.ResponseWriter, r *http.Request, client oauthClient) {
+	ctx := r.Context()
+	h := hashToken(r.PostForm.Get("refresh_token"))
+	t, ok, err := o.token(ctx, h)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !ok || !t.Refresh || t.ClientID != client.ID {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "the refresh token is invalid or expired")
+		return
+	}
+	scope := t.Scope
+	if s := r.PostForm.Get("scope"); s != "" {
+		narrowed, ok := parseScope(s)
+		if !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "unknown scope")
+			return
+		}
+		for _, f := range strings.Fields(narrowed) {
+			if !hasScope(t.Scope, f) {
+				writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "a refresh cannot add scopes")
+				return
+			}
+		}
+		scope = narrowed
+	}
+
+	// Of concurrent refreshes on any replicas, only one rotates the token.
+	ttl := time.Until(t.Expires)
+	fresh := !t.Rotated
+	if fresh {
+		fresh, err = o.state.setNX(ctx, oauthTokenKey(h)+":rotated", "1", ttl)
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+	}
+	if !fresh {
+		if err := o.revokeGrant(ctx, t.Grant); err != nil {
+			stateError(w, err)
+			return
+		}
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "the refresh token has already been used")
+		return
+	}
+	t.Rotated = true
+	if err := setJSON(ctx, o.state, oauthTokenKey(h), t, ttl); err != nil {
+		stateError(w, err)
+		return
+	}
+	tokens, err := o.issueTokens(ctx, client.ID, t.UserID, scope, t.Grant)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// revokeHandler implements RFC 7009. Revoking a refresh token also revokes
+// the access tokens issued alongside it. Unknown tokens are not an error.
+func (o *oauthServer) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 16<<10)
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "the body must be application/x-www-form-urlencoded")
+		return
+	}
+	client, ok, err := o.authenticateClient(r)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	ctx := r.Context()
+	h := hashToken(r.PostForm.Get("token"))
+	t, ok, err := o.token(ctx, h)
+	if err == nil && ok && t.ClientID == client.ID {
+		if t.Refresh {
+			err = o.revokeGrant(ctx, t.Grant)
+		} else {
+			err = o.state.del(ctx, oauthTokenKey(h))
+		}
+	}
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// introspectHandler implements RFC 7662 for confidential clients, which may
+// inspect tokens issued to themselves.
+func (o *oauthServer) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 16<<10)
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "the body must be application/x-www-form-urlencoded")
+		return
+	}
+	client, ok, err := o.authenticateClient(r)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !ok || !client.Confidential {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "introspection requires a confidential client")
+		return
+	}
+	tok, ok, err := o.token(r.Context(), hashToken(r.PostForm.Get("token")))
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok || tok.ClientID != client.ID || tok.Rotated {
+		writeJSON(w, http.StatusOK, map[string]bool{"active": false})
+		return
+	}
+	tokenType := "access_token"
+	if tok.Refresh {
+		tokenType = "refresh_token"
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"active":     true,
+		"scope":      tok.Scope,
+		"client_id":  tok.ClientID,
+		"sub":        tok.UserID,
+		"token_type": tokenType,
+		"iat":        tok.Issued.Unix(),
+		"exp":        tok.Expires.Unix(),
+	})
+}
+
+// requireScope lets a request through for the signed-in user, or for an app
+// presenting a bearer access token that carries scope.
+func (o *oauthServer) requireScope(scope string, next func(http.ResponseWriter, *http.Request, user)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer {
+			u, _, ok, err := o.accounts.current(r)
+			if err != nil {
+				stateError(w, err)
+				return
+			}
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer scope="`+scope+`"`)
+				writeError(w, http.StatusUnauthorized, "sign in or present an access token")
+				return
+			}
+			next(w, r, u)
+			return
+		}
+
+		tok, ok, err := o.token(r.Context(), hashToken(token))
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		if !ok || tok.Refresh {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "the access token is invalid or expired")
+			return
+		}
+		if !hasScope(tok.Scope, scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			writeError(w, http.StatusForbidden, "the access token lacks the "+scope+" scope")
+			return
+		}
+		u, ok, err := o.accounts.userByID(r.Context(), tok.UserID)
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "the access token is invalid or expired")
+			return
+		}
+		next(w, r, u)
+	}
+}
+
+// exportUser lists the clients the user registered and the apps they have
+// authorized.
+func (o *oauthServer) exportUser(userID string) (any, error) {
+	ctx := context.Background()
+	type authorization struct {
+		ClientID  string    `json:"client_id"`
+		TokenType string    `json:"token_type"`
+		Scope     string    `json:"scope"`
+		IssuedAt  time.Time `json:"issued_at"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	stored, err := o.clientsOf(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	clients, auths := []oauthClient{}, []authorization{}
+	for _, c := range stored {
+		clients = append(clients, c.oauthClient)
+	}
+	grants, err := o.grants(ctx, oauthUserGrantsKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	for grant := range grants {
+		hashes, err := o.state.hgetAll(ctx, oauthGrantKey(grant))
+		if err != nil {
+			return nil, err
+		}
+		for h := range hashes {
+			t, ok, err := o.token(ctx, h)
+			if err != nil {
+				return nil, err
+			}
+			if !ok || t.Rotated {
+				continue
+			}
+			typ := "access_token"
+			if t.Refresh {
+				typ = "refresh_token"
+			}
+			auths = append(auths, authorization{t.ClientID, typ, t.Scope, t.Issued.UTC(), t.Expires.UTC()})
+		}
+	}
+	if len(clients) == 0 && len(auths) == 0 {
+		return nil, nil
+	}
+	sort.Slice(auths, func(i, j int) bool { return auths[i].IssuedAt.Before(auths[j].IssuedAt) })
+	return map[string]any{"clients": clients, "authorizations": auths}, nil
+}
+
+// eraseUser revokes everything issued to or for the user and deletes the
+// clients they registered. Outstanding codes expire within a minute and
+// cannot be exchanged for a deleted client or user.
+func (o *oauthServer) eraseUser(userID string) error {
+	ctx := context.Background()
+	clients, err := o.clientsOf(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, c := range clients {
+		if err := o.deleteClient(ctx, c); err != nil {
+			return err
+		}
+	}
+	grants, err := o.state.hgetAll(ctx, oauthUserGrantsKey(userID))
+	if err != nil {
+		return err
+	}
+	for grant := range grants {
+		if err := o.revokeGrant(ctx, grant); err != nil {
+			return err
+		}
+	}
+	return o.state.del(ctx, oauthUserGrantsKey(userID), oauthClientsKey(userID))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testRedirect = "https://app.example/callback"
+
+// oauthReplica is one pod's OAuth server, with a route that needs the
+// quotes:read scope and one that needs favorites:write.
+type oauthReplica struct {
+	o   *oauthServer
+	mux *http.ServeMux
+}
+
+func newOAuthReplica(a *accounts, state stateStore) oauthReplica {
+	o := newOAuthServer(a, state)
+	mux := http.NewServeMux()
+	o.routes(mux)
+	who := func(w http.ResponseWriter, _ *http.Request, u user) { writeJSON(w, http.StatusOK, u) }
+	mux.HandleFunc("GET /read", o.requireScope(scopeQuotesRead, who))
+	mux.HandleFunc("GET /write", o.requireScope(scopeFavoritesWrite, who))
+	return oauthReplica{o, mux}
+}
+
+func (p oauthReplica) do(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.mux.ServeHTTP(w, r)
+	return w
+}
+
+// oauthFixture is two replicas sharing state, and a signed-in user.
+type oauthFixture struct {
+	a, b    oauthReplica
+	user    user
+	session string
+}
+
+func newOAuthFixture(t *testing.T) *oauthFixture {
+	t.Helper()
+	state, in := newMemoryState(), new(inbox)
+	accA := newAccounts(state, in, "https://quotes.test", true)
+	accB := newAccounts(state, in, "https://quotes.test", true)
+	u := signUp(t, accA, in, "ada@example.com", "correct horse")
+	_, session, err := accA.login(context.Background(), "ada@example.com", "correct horse", loginRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &oauthFixture{newOAuthReplica(accA, state), newOAuthReplica(accB, state), u, session}
+}
+
+// registerClient registers a client with the user's session and returns
+// its ID and secret.
+func (f *oauthFixture) registerClient(t *testing.T, confidential bool) (string, string) {
+	t.Helper()
+	body := `{"client_name":"App","redirect_uris":["` + testRedirect + `"],"confidential":` + map[bool]string{true: "true", false: "false"}[confidential] + `}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/oauth/clients", strings.NewReader(body))
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: f.session})
+	w := f.a.do(r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("registering a client: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Client oauthClient `json:"client"`
+		Secret string      `json:"client_secret"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp.Client.ID, resp.Secret
+}
+
+// authorize approves an authorization request on p and returns the code.
+func (f *oauthFixture) authorize(t *testing.T, p oauthReplica, clientID, scope, verifier string) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(verifier))
+	form := url.Values{
+		"client_id":             {clientID},
+		"redirect_uri":          {testRedirect},
+		"response_type":         {"code"},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+		"decision":              {"allow"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/v1/oauth/authorize", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: f.session})
+	w := p.do(r)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil {
+		t.Fatalf("authorize: %d %s", w.Code, w.Body)
+	}
+	if got := loc.Query().Get("state"); got != "xyz" {
+		t.Errorf("redirect state = %q, want xyz", got)
+	}
+	code := loc.Query().Get("code")
+	if code == "" {
+		t.Fatalf("authorize redirected to %s, want a code", loc)
+	}
+	return code
+}
+
+type tokenResponse struct {
+	Access  string `json:"access_token"`
+	Refresh string `json:"refresh_token"`
+	Scope   string `json:"scope"`
+	Error   string `json:"error"`
+}
+
+// post sends form to path on p, as clientID with secret.
+func post(p oauthReplica, path, clientID, secret string, form url.Values) (int, tokenResponse) {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(clientID, secret)
+	w := p.do(r)
+	var resp tokenResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+func exchange(p oauthReplica, clientID, secret, code, verifier string) (int, tokenResponse) {
+	return post(p, "/v1/oauth/token", clientID, secret, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirect},
+		"code_verifier": {verifier},
+	})
+}
+
+func refresh(p oauthReplica, clientID, secret, token string) (int, tokenResponse) {
+	return post(p, "/v1/oauth/token", clientID, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token}})
+}
+
+// bearer returns the status of GET path on p with an access token.
+func bearer(p oauthReplica, path, token string) int {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return p.do(r).Code
+}
+
+var testVerifier = strings.Repeat("v", 43)
+
+func TestOAuthPKCE(t *testing.T) {
+	f := newOAuthFixture(t)
+	client, _ := f.registerClient(t, false)
+
+	// The code is issued on one replica and exchanged on the other.
+	code := f.authorize(t, f.a, client, "", testVerifier)
+	if status, resp := exchange(f.b, client, "", code, strings.Repeat("w", 43)); status != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Errorf("exchange with the wrong verifier = %d %q, want 400 invalid_grant", status, resp.Error)
+	}
+	if status, resp := exchange(f.b, client, "", code, "short"); status != http.StatusBadRequest || resp.Error != "invalid_request" {
+		t.Errorf("exchange with a short verifier = %d %q, want 400 invalid_request", status, resp.Error)
+	}
+	status, tok := exchange(f.b, client, "", code, testVerifier)
+	if status != http.StatusOK || tok.Access == "" || tok.Scope != scopeQuotesRead {
+		t.Fatalf("exchange = %d %+v", status, tok)
+	}
+	if got := bearer(f.a, "/read", tok.Access); got != http.StatusOK {
+		t.Errorf("access token on the other replica = %d, want 200", got)
+	}
+	if got := bearer(f.a, "/write", tok.Access); got != http.StatusForbidden {
+		t.Errorf("access token without favorites:write = %d, want 403", got)
+	}
+	if got := bearer(f.a, "/read", tok.Refresh); got != http.StatusUnauthorized {
+		t.Errorf("refresh token as a bearer token = %d, want 401", got)
+	}
+
+	// Without a challenge, the authorization request is sent back.
+	r := httptest.NewRequest(http.MethodGet, "/v1/oauth/authorize?response_type=code&client_id="+client+"&redirect_uri="+url.QueryEscape(testRedirect), nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: f.session})
+	w := f.a.do(r)
+	if loc := w.Header().Get("Location"); w.Code != http.StatusFound || !strings.Contains(loc, "error=invalid_request") {
+		t.Errorf("authorize without PKCE = %d %s, want a redirect with invalid_request", w.Code, loc)
+	}
+}
+
+func TestOAuthCodeReplay(t *testing.T) {
+	f := newOAuthFixture(t)
+	client, _ := f.registerClient(t, false)
+	code := f.authorize(t, f.a, client, "", testVerifier)
+	_, tok := exchange(f.a, client, "", code, testVerifier)
+
+	// Replaying the code on another replica revokes what it produced.
+	if status, resp := exchange(f.b, client, "", code, testVerifier); status != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Errorf("replayed exchange = %d %q, want 400 invalid_grant", status, resp.Error)
+	}
+	if got := bearer(f.a, "/read", tok.Access); got != http.StatusUnauthorized {
+		t.Errorf("access token after a replay = %d, want 401", got)
+	}
+	if status, _ := refresh(f.a, client, "", tok.Refresh); status != http.StatusBadRequest {
+		t.Errorf("refresh after a replay = %d, want 400", status)
+	}
+
+	// A code only works for the client it was issued to.
+	other, _ := f.registerClient(t, false)
+	code = f.authorize(t, f.a, client, "", testVerifier)
+	if status, _ := exchange(f.b, other, "", code, testVerifier); status != http.StatusBadRequest {
+		t.Errorf("exchange by another client = %d, want 400", status)
+	}
+}
+
+func TestOAuthRefreshRotation(t *testing.T) {
+	f := newOAuthFixture(t)
+	client, _ := f.registerClient(t, false)
+	code := f.authorize(t, f.a, client, scopeQuotesRead+" "+scopeFavoritesWrite, testVerifier)
+	_, first := exchange(f.a, client, "", code, testVerifier)
+
+	status, second := post(f.b, "/v1/oauth/token", client, "", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {first.Refresh},
+		"scope":         {scopeQuotesRead},
+	})
+	if status != http.StatusOK || second.Scope != scopeQuotesRead {
+		t.Fatalf("narrowing refresh = %d %+v", status, second)
+	}
+	if got := bearer(f.a, "/write", second.Access); got != http.StatusForbidden {
+		t.Errorf("narrowed access token on /write = %d, want 403", got)
+	}
+	if status, resp := post(f.a, "/v1/oauth/token", client, "", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {second.Refresh},
+		"scope":         {scopeQuotesRead + " " + scopeFavoritesWrite},
+	}); status != http.StatusBadRequest || resp.Error != "invalid_scope" {
+		t.Errorf("widening refresh = %d %q, want 400 invalid_scope", status, resp.Error)
+	}
+
+	// Presenting the rotated token again revokes the whole grant.
+	if status, resp := refresh(f.a, client, "", first.Refresh); status != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Errorf("reused refresh token = %d %q, want 400 invalid_grant", status, resp.Error)
+	}
+	for _, tok := range []string{first.Access, second.Access} {
+		if got := bearer(f.b, "/read", tok); got != http.StatusUnauthorized {
+			t.Errorf("access token after reuse = %d, want 401", got)
+		}
+	}
+	if status, _ := refresh(f.b, client, "", second.Refresh); status != http.StatusBadRequest {
+		t.Errorf("latest refresh token after reuse = %d, want 400", status)
+	}
+}
+
+func TestOAuthRevocation(t *testing.T) {
+	f := newOAuthFixture(t)
+	client, secret := f.registerClient(t, true)
+	code := f.authorize(t, f.a, client, "", testVerifier)
+	if status, _ := exchange(f.a, client, "wrong", code, testVerifier); status != http.StatusUnauthorized {
+		t.Errorf("exchange with the wrong secret = %d, want 401", status)
+	}
+	_, tok := exchange(f.a, client, secret, code, testVerifier)
+
+	introspect := func(token string) map[string]any {
+		r := httptest.NewRequest(http.MethodPost, "/v1/oauth/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(client, secret)
+		var resp map[string]any
+		json.NewDecoder(f.b.do(r).Body).Decode(&resp)
+		return resp
+	}
+	if got := introspect(tok.Access); got["active"] != true || got["sub"] != f.user.ID {
+		t.Errorf("introspecting a live token = %v", got)
+	}
+
+	// Revoking the refresh token revokes the access token beside it.
+	if status, _ := post(f.b, "/v1/oauth/revoke", client, secret, url.Values{"token": {tok.Refresh}}); status != http.StatusOK {
+		t.Errorf("revoke = %d, want 200", status)
+	}
+	if got := introspect(tok.Access); got["active"] != false {
+		t.Errorf("introspecting a revoked token = %v", got)
+	}
+	if got := bearer(f.a, "/read", tok.Access); got != http.StatusUnauthorized {
+		t.Errorf("access token after revocation = %d, want 401", got)
+	}
+	if status, _ := post(f.b, "/v1/oauth/revoke", client, secret, url.Values{"token": {"unknown"}}); status != http.StatusOK {
+		t.Errorf("revoking an unknown token = %d, want 200", status)
+	}
+
+	// Deleting the client revokes everything issued to it.
+	code = f.authorize(t, f.b, client, "", testVerifier)
+	_, tok = exchange(f.a, client, secret, code, testVerifier)
+	r := httptest.NewRequest(http.MethodDelete, "/v1/oauth/clients/"+client, nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: f.session})
+	if w := f.b.do(r); w.Code != http.StatusNoContent {
+		t.Fatalf("deleting the client = %d %s", w.Code, w.Body)
+	}
+	if got := bearer(f.a, "/read", tok.Access); got != http.StatusUnauthorized {
+		t.Errorf("access token of a deleted client = %d, want 401", got)
+	}
+}
+
+func TestOAuthEraseUser(t *testing.T) {
+	f := newOAuthFixture(t)
+	client, _ := f.registerClient(t, false)
+	code := f.authorize(t, f.a, client, "", testVerifier)
+	_, tok := exchange(f.a, client, "", code, testVerifier)
+
+	data, err := f.b.o.exportUser(f.user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export, _ := json.Marshal(data)
+	if !strings.Contains(string(export), client) || !strings.Contains(string(export), "refresh_token") {
+		t.Errorf("exportUser() = %s, want the client and its authorization", export)
+	}
+	if err := f.b.o.eraseUser(f.user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := bearer(f.a, "/read", tok.Access); got != http.StatusUnauthorized {
+		t.Errorf("access token after erasure = %d, want 401", got)
+	}
+	if data, err := f.a.o.exportUser(f.user.ID); data != nil || err != nil {
+		t.Errorf("exportUser() after erasure = %v, %v, want nothing", data, err)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// A4 page geometry in PDF points.
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	pdfMargin     = 72
+)
+
+// pdfFont is a TrueType font embedded in the document as a simple font with
+// WinAnsiEncoding, so every character code is a single byte.
+type pdfFont struct {
+	resource string // name used in content streams, e.g. F1
+	baseName string
+	data     []byte
+	widths   [256]int // advance per WinAnsi code, in 1/1000 em
+	ascent   int
+	descent  int
+	capH     int
+	bbox     [4]int
+	italic   bool
+}
+
+func loadPDFFont(resource string, ttf []byte, italic bool) (*pdfFont, error) {
+	f, err := sfnt.Parse(ttf)
+	if err != nil {
+		return nil, err
+	}
+	var buf sfnt.Buffer
+	upem := int(f.UnitsPerEm())
+	ppem := fixed.I(upem)
+	scale := func(v fixed.Int26_6) int { return v.Round() * 1000 / upem }
+
+	pf := &pdfFont{resource: resource, data: ttf, italic: italic}
+	if pf.baseName, err = f.Name(&buf, sfnt.NameIDPostScript); err != nil {
+		return nil, err
+	}
+	for code := 32; code < 256; code++ {
+		r := winAnsiRune(byte(code))
+		idx, err := f.GlyphIndex(&buf, r)
+		if err != nil || idx == 0 {
+			continue
+		}
+		adv, err := f.GlyphAdvance(&buf, idx, ppem, font.HintingNone)
+		if err != nil {
+			continue
+		}
+		pf.widths[code] = scale(adv)
+	}
+
+	m, err := f.Metrics(&buf, ppem, font.HintingNone)
+	if err != nil {
+		return nil, err
+	}
+	pf.ascent, pf.descent, pf.capH = scale(m.Ascent), -scale(m.Descent), scale(m.CapHeight)
+	b, err := f.Bounds(&buf, ppem, font.HintingNone)
+	if err != nil {
+		return nil, err
+	}
+	// sfnt reports bounds with y growing downwards; PDF grows upwards.
+	pf.bbox = [4]int{scale(b.Min.X), -scale(b.Max.Y), scale(b.Max.X), -scale(b.Min.Y)}
+	return pf, nil
+}
+
+// width returns the rendered width of s at the given size in points.
+func (f *pdfFont) width(s string, size float64) float64 {
+	total := 0
+	for _, c := range toWinAnsi(s) {
+		total += f.widths[c]
+	}
+	return float64(total) * size / 1000
+}
+
+// wrap breaks s into lines no wider than max points. Words wider than a
+// line on their own are broken between characters.
+func (f *pdfFont) wrap(s string, size, max float64) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		for _, piece := range f.breakWord(word, size, max) {
+			candidate := piece
+			if line != "" {
+				candidate = line + " " + piece
+			}
+			if line != "" && f.width(candidate, size) > max {
+				lines = append(lines, line)
+				candidate = piece
+			}
+			line = candidate
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// breakWord splits word into pieces no wider than max points, keeping at
+// least one character in each.
+func (f *pdfFont) breakWord(word string, size, max float64) []string {
+	if f.width(word, size) <= max {
+		return []string{word}
+	}
+	var pieces []string
+	piece := ""
+	for _, r := range word {
+		if piece != "" && f.width(piece+string(r), size) > max {
+			pieces = append(pieces, piece)
+			piece = ""
+		}
+		piece += string(r)
+	}
+	return append(pieces, piece)
+}
+
+// winAnsiHigh maps the WinAnsi codes 0x80–0x9F that differ from Latin-1.
+var winAnsiHigh = map[byte]rune{
+	0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+	0x88: 'ˆ', 0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ', 0x8E: 'Ž', 0x91: '‘',
+	0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—', 0x98: '˜',
+	0x99: '™', 0x9A: 'š', 0x9B: '›', 0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+}
+
+func winAnsiRune(c byte) rune {
+	if r, ok := winAnsiHigh[c]; ok {
+		return r
+	}
+	return rune(c)
+}
+
+// toWinAnsi encodes s for a WinAnsiEncoding font, replacing characters the
+// encoding cannot represent with '?'.
+func toWinAnsi(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r >= 0x20 && r < 0x7F, r >= 0xA0 && r <= 0xFF:
+			out = append(out, byte(r))
+		default:
+			c := byte('?')
+			for code, hr := range winAnsiHigh {
+				if hr == r {
+					c = code
+					break
+				}
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// pdfText is a positioned run of text on a page.
+type pdfText struct {
+	font *pdfFont
+	size float64
+	x, y float64
+	text string
+}
+
+// renderPDF lays out quotes on A4 pages, one block of text with a
+// right-aligned attribution per quote, and returns the PDF bytes.
+func renderPDF(title string, quotes []Quote) ([]byte, error) {
+	regular, err := loadPDFFont("F1", goregular.TTF, false)
+	if err != nil {
+		return nil, err
+	}
+	italic, err := loadPDFFont("F2", goitalic.TTF, true)
+	if err != nil {
+		return nil, err
+	}
+
+	const (
+		textSize   = 14.0
+		textLead   = 20.0
+		attrSize   = 11.0
+		attrLead   = 16.0
+		blockGap   = 24.0
+		titleSize  = 22.0
+		titleLead  = 28.0
+		bodyWidth  = pdfPageWidth - 2*pdfMargin
+		bottomEdge = pdfMargin + 24 // keep clear of the footer
+	)
+
+	var pages [][]pdfText
+	var page []pdfText
+	y := float64(pdfPageHeight - pdfMargin)
+	newPage := func() {
+		pages = append(pages, page)
+		page = nil
+		y = pdfPageHeight - pdfMargin
+	}
+
+	for i, l := range regular.wrap(title, titleSize, bodyWidth) {
+		lead := titleLead
+		if i == 0 {
+			lead = titleSize
+		}
+		if y-lead < bottomEdge {
+			newPage()
+			lead = titleSize
+		}
+		y -= lead
+		page = append(page, pdfText{regular, titleSize, pdfMargin, y, l})
+	}
+	y -= 2 * blockGap
+
+	for _, q := range quotes {
+		lines := regular.wrap("“"+q.Text+"”", textSize, bodyWidth)
+		// Keep a quote on one page when it fits on one; longer quotes
+		// start on a fresh page and continue over as many as they need.
+		height := float64(len(lines))*textLead + attrLead
+		if y-height < bottomEdge && len(page) > 0 {
+			newPage()
+		}
+		for _, l := range lines {
+			if y-textLead < bottomEdge {
+				newPage()
+			}
+			y -= textLead
+			page = append(page, pdfText{regular, textSize, pdfMargin, y, l})
+		}
+		for _, l := range italic.wrap("— "+q.Author, attrSize, bodyWidth) {
+			if y-attrLead < bottomEdge {
+				newPage()
+			}
+			y -= attrLead
+			page = append(page, pdfText{italic, attrSize, pdfPageWidth - pdfMargin - italic.width(l, attrSize), y, l})
+		}
+		y -= blockGap
+	}
+	pages = append(pages, page)
+
+	for i := range pages {
+		footer := fmt.Sprintf("%d / %d", i+1, len(pages))
+		pages[i] = append(pages[i], pdfText{regular, 9, (pdfPageWidth - regular.width(footer, 9)) / 2, pdfMargin / 2, footer})
+	}
+	return writePDF(pages, []*pdfFont{regular, italic})
+}
+
+// writePDF serialises pages into a PDF 1.7 document with the given fonts
+// embedded.
+func writePDF(pages [][]pdfText, fonts []*pdfFont) ([]byte, error) {
+	var buf bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	stream := func(dict string, data []byte) error {
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n<< %s/Filter /FlateDecode /Length %d >>\nstream\n", len(offsets), dict, z.Len())
+		buf.Write(z.Bytes())
+		buf.WriteString("\nendstream\nendobj\n")
+		return nil
+	}
+
+	buf.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1 and 2 are the catalog and page tree; fonts take three objects
+	// each, followed by a page and content stream pair per page.
+	fontBase := 3
+	pageBase := fontBase + 3*len(fonts)
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", pageBase+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+
+	var fontRes []string
+	for i, f := range fonts {
+		n := fontBase + 3*i
+		fontRes = append(fontRes, fmt.Sprintf("/%s %d 0 R", f.resource, n))
+		widths := make([]string, 0, 224)
+		for c := 32; c < 256; c++ {
+			widths = append(widths, fmt.Sprint(f.widths[c]))
+		}
+		obj(fmt.Sprintf("<< /Type /Font /Subtype /TrueType /BaseFont /%s /FirstChar 32 /LastChar 255 /Widths [%s] /FontDescriptor %d 0 R /Encoding /WinAnsiEncoding >>",
+			f.baseName, strings.Join(widths, " "), n+1))
+		flags, angle := 32, 0 // nonsymbolic
+		if f.italic {
+			flags, angle = flags|64, -12
+		}
+		obj(fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags %d /FontBBox [%d %d %d %d] /ItalicAngle %d /Ascent %d /Descent %d /CapHeight %d /StemV 80 /FontFile2 %d 0 R >>",
+			f.baseName, flags, f.bbox[0], f.bbox[1], f.bbox[2], f.bbox[3], angle, f.ascent, f.descent, f.capH, n+2))
+		if err := stream(fmt.Sprintf("/Length1 %d ", len(f.data)), f.data); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, texts := range pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, strings.Join(fontRes, " "), pageBase+2*i+1))
+		var content bytes.Buffer
+		for _, t := range texts {
+			fmt.Fprintf(&content, "BT /%s %g Tf %.2f %.2f Td (%s) Tj ET\n", t.font.resource, t.size, t.x, t.y, pdfEscape(toWinAnsi(t.text)))
+		}
+		if err := stream("", content.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes(), nil
+}
+
+// pdfEscape escapes the delimiters of a PDF literal string.
+func pdfEscape(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c == '(' || c == ')' || c == '\\' {
+			out = append(out, '\\')
+		}
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Plugins are WebAssembly modules loaded from a directory and run in the
+// pure-Go wazero runtime. Each call gets a fresh instance, bounded by the
+// host's memory limit and timeout.
+//
+// The ABI is JSON in, JSON out. A module exports its memory and
+//
+//	alloc(size i32) i32        reserve size bytes for the input
+//	select(ptr, len i32) i64   selection strategy
+//	transform(ptr, len i32) i64 response transformer
+//
+// select and transform receive the JSON input at ptr and return the output
+// location packed as ptr<<32 | len. A module may export either or both.
+//
+// Bindings from routes and tenants to plugins are read from plugins.json in
+// the same directory:
+//
+//	{
+//	  "routes":  {"/": {"strategy": "no-repeat-author"}},
+//	  "tenants": {"acme": {"strategy": "round-robin", "transformers": ["uppercase"]}}
+//	}
+//
+// The tenant is taken from the X-Tenant-ID header; a tenant binding takes
+// precedence over the route binding.
+type pluginHost struct {
+	runtime  wazero.Runtime
+	plugins  map[string]*plugin
+	bindings pluginBindings
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	history map[string][]int // recently served quote IDs per route and bound tenant
+
+	calls *counterVec
+}
+
+type plugin struct {
+	name     string
+	compiled wazero.CompiledModule
+}
+
+type pluginBinding struct {
+	Strategy     string   `json:"strategy"`
+	Transformers []string `json:"transformers"`
+}
+
+type pluginBindings struct {
+	Routes  map[string]pluginBinding `json:"routes"`
+	Tenants map[string]pluginBinding `json:"tenants"`
+}
+
+const pluginHistorySize = 20
+
+// loadPlugins compiles every .wasm file in dir and reads its plugins.json.
+func loadPlugins(dir string, memoryMB int, timeout time.Duration) (*pluginHost, error) {
+	ctx := context.Background()
+	cfg := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(memoryMB) * 16). // 64 KiB pages
+		WithCloseOnContextDone(true)
+	rt := wazero.NewRuntimeWithConfig(ctx, cfg)
+	// Modules built with standard toolchains expect WASI; they get no
+	// filesystem, network or environment.
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+
+	h := &pluginHost{
+		runtime: rt,
+		plugins: make(map[string]*plugin),
+		timeout: timeout,
+		history: make(map[string][]int),
+		calls:   newCounterVec("quote_plugin_calls_total", "Plugin invocations by plugin, function and result.", "plugin", "function", "result"),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.wasm"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		bin, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		compiled, err := rt.CompileModule(ctx, bin)
+		if err != nil {
+			return nil, fmt.Errorf("compiling %s: %w", p, err)
+		}
+		exports := compiled.ExportedFunctions()
+		if _, ok := exports["alloc"]; !ok {
+			return nil, fmt.Errorf("%s: missing alloc export", p)
+		}
+		name := strings.TrimSuffix(filepath.Base(p), ".wasm")
+		h.plugins[name] = &plugin{name: name, compiled: compiled}
+		log.Printf("plugins: loaded %s", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "plugins.json"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &h.bindings); err != nil {
+			return nil, fmt.Errorf("plugins.json: %w", err)
+		}
+	}
+	for _, b := range h.allBindings() {
+		if err := h.checkBinding(b); err != nil {
+			return nil, fmt.Errorf("plugins.json: %w", err)
+		}
+	}
+	return h, nil
+}
+
+func (h *pluginHost) allBindings() []pluginBinding {
+	var all []pluginBinding
+	for _, b := range h.bindings.Routes {
+		all = append(all, b)
+	}
+	for _, b := range h.bindings.Tenants {
+		all = append(all, b)
+	}
+	return all
+}
+
+func (h *pluginHost) checkBinding(b pluginBinding) error {
+	check := func(name, fn string) error {
+		p, ok := h.plugins[name]
+		if !ok {
+			return fmt.Errorf("unknown plugin %q", name)
+		}
+		if _, ok := p.compiled.ExportedFunctions()[fn]; !ok {
+			return fmt.Errorf("plugin %q does not export %s", name, fn)
+		}
+		return nil
+	}
+	if b.Strategy != "" {
+		if err := check(b.Strategy, "select"); err != nil {
+			return err
+		}
+	}
+	for _, t := range b.Transformers {
+		if err := check(t, "transform"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// binding resolves the plugins that apply to a request on route.
+func (h *pluginHost) binding(route, tenant string) pluginBinding {
+	b := h.bindings.Routes[route]
+	if tb, ok := h.bindings.Tenants[tenant]; ok && tenant != "" {
+		if tb.Strategy != "" {
+			b.Strategy = tb.Strategy
+		}
+		if tb.Transformers != nil {
+			b.Transformers = tb.Transformers
+		}
+	}
+	return b
+}
+
+// call runs fn in a fresh instance of p with input encoded as JSON and
+// returns the raw JSON output.
+func (h *pluginHost) call(ctx context.Context, p *plugin, fn string, input any) (out []byte, err error) {
+	defer func() {
+		result := "ok"
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			result = "timeout"
+		case err != nil:
+			result = "error"
+		}
+		h.calls.inc(p.name, fn, result)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	in, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := h.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, h.callError(ctx, err)
+	}
+	defer mod.Close(context.Background())
+
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, h.callError(ctx, err)
+	}
+	ptr := uint32(res[0])
+	if !mod.Memory().Write(ptr, in) {
+		return nil, errors.New("alloc returned an out of range pointer")
+	}
+	res, err = mod.ExportedFunction(fn).Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, h.callError(ctx, err)
+	}
+	view, ok := mod.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return nil, errors.New("output is out of range")
+	}
+	// The view aliases module memory, which is released on Close.
+	return bytes.Clone(view), nil
+}
+
+func (h *pluginHost) callError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+type strategyInput struct {
+	Route      string  `json:"route"`
+	Tenant     string  `json:"tenant,omitempty"`
+	Count      int     `json:"count"`
+	Candidates []Quote `json:"candidates"`
+	Recent     []int   `json:"recent"` // served quote IDs, oldest first
+	Seed       int64   `json:"seed"`
+}
+
+type strategyOutput struct {
+	Indices []int `json:"indices"`
+}
+
+// pick chooses count quotes from candidates using the strategy bound to the
+// route or tenant. Without a strategy, or if the plugin fails, fallback
+// decides instead. h may be nil when plugins are disabled.
+func (h *pluginHost) pick(r *http.Request, route string, candidates []Quote, count int, fallback func() []Quote) []Quote {
+	if h == nil {
+		return fallback()
+	}
+	tenant := r.Header.Get("X-Tenant-ID")
+	b := h.binding(route, tenant)
+	if b.Strategy == "" {
+		return fallback()
+	}
+
+	// Tenants without a binding of their own share the route's history, so
+	// made-up tenant IDs cannot grow it: there is one history per route and
+	// bound tenant, each of at most pluginHistorySize IDs.
+	key := route + "\x00"
+	if _, ok := h.bindings.Tenants[tenant]; ok {
+		key += tenant
+	}
+	h.mu.Lock()
+	recent := append([]int(nil), h.history[key]...)
+	h.mu.Unlock()
+
+	picked, err := h.runStrategy(r.Context(), h.plugins[b.Strategy], strategyInput{
+		Route:      route,
+		Tenant:     tenant,
+		Count:      count,
+		Candidates: candidates,
+		Recent:     recent,
+		Seed:       rand.Int63(),
+	})
+	if err != nil {
+		log.Printf("plugins: strategy %s failed, using default selection: %v", b.Strategy, err)
+		picked = fallback()
+	}
+
+	h.mu.Lock()
+	hist := h.history[key]
+	for _, q := range picked {
+		hist = append(hist, q.ID)
+	}
+	if len(hist) > pluginHistorySize {
+		hist = hist[len(hist)-pluginHistorySize:]
+	}
+	h.history[key] = hist
+	h.mu.Unlock()
+	return picked
+}
+
+func (h *pluginHost) runStrategy(ctx context.Context, p *plugin, in strategyInput) ([]Quote, error) {
+	raw, err := h.call(ctx, p, "select", in)
+	if err != nil {
+		return nil, err
+	}
+	var out strategyOutput
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("decoding output: %w", err)
+	}
+	if len(out.Indices) != in.Count {
+		return nil, fmt.Errorf("returned %d indices, want %d", len(out.Indices), in.Count)
+	}
+	seen := make(map[int]bool)
+	picked := make([]Quote, 0, in.Count)
+	for _, i := range out.Indices {
+		if i < 0 || i >= len(in.Candidates) || seen[i] {
+			return nil, fmt.Errorf("invalid or repeated index %d", i)
+		}
+		seen[i] = true
+		picked = append(picked, in.Candidates[i])
+	}
+	return picked, nil
+}
+
+type transformInput struct {
+	Route  string          `json:"route"`
+	Tenant string          `json:"tenant,omitempty"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// transform wraps a JSON handler so its successful responses pass through
+// the transformers bound to route. A failing transformer is skipped.
+// Transformers work on whole documents, so NDJSON streams bypass them.
+func (h *pluginHost) transform(route string, next http.HandlerFunc) http.HandlerFunc {
+	if h == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get("X-Tenant-ID")
+		b := h.binding(route, tenant)
+		if len(b.Transformers) == 0 || wantsNDJSON(r) {
+			next(w, r)
+			return
+		}
+
+		rec := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		next(rec, r)
+
+		body := rec.body.Bytes()
+		if rec.status == http.StatusOK && strings.HasPrefix(rec.header.Get("Content-Type"), "application/json") {
+			for _, name := range b.Transformers {
+				out, err := h.call(r.Context(), h.plugins[name], "transform", transformInput{Route: route, Tenant: tenant, Body: body})
+				if err == nil && !json.Valid(out) {
+					err = errors.New("output is not valid JSON")
+				}
+				if err != nil {
+					log.Printf("plugins: transformer %s failed, skipping: %v", name, err)
+					continue
+				}
+				body = out
+			}
+		}
+
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rec.status)
+		w.Write(body)
+	}
+}
+
+// bufferedResponse captures a handler's response so it can be rewritten.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
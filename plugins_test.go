@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Test plugins are assembled by hand, so the tests need no wasm toolchain.
+// Each exports memory, alloc (which always returns inputAt) and select.
+const (
+	inputAt  = 4096
+	outputAt = 16
+)
+
+// wasmModule assembles a module whose select runs body and then returns
+// output, which is placed in memory at outputAt.
+func wasmModule(body []byte, output string) []byte {
+	section := func(id byte, items ...[]byte) []byte {
+		content := uleb(len(items))
+		for _, it := range items {
+			content = append(content, it...)
+		}
+		return append(append([]byte{id}, uleb(len(content))...), content...)
+	}
+	name := func(s string) []byte { return append(uleb(len(s)), s...) }
+	code := func(instrs ...byte) []byte {
+		fn := append([]byte{0}, append(instrs, 0x0b)...) // no locals
+		return append(uleb(len(fn)), fn...)
+	}
+	const i32, i64 = 0x7f, 0x7e
+	packed := int64(outputAt)<<32 | int64(len(output))
+
+	m := []byte{0, 'a', 's', 'm', 1, 0, 0, 0}
+	m = append(m, section(1, []byte{0x60, 1, i32, 1, i32}, []byte{0x60, 2, i32, i32, 1, i64})...)
+	m = append(m, section(3, []byte{0}, []byte{1})...)
+	m = append(m, section(5, []byte{0, 1})...) // one page, no maximum
+	m = append(m, section(7,
+		append(name("memory"), 2, 0),
+		append(name("alloc"), 0, 0),
+		append(name("select"), 0, 1),
+	)...)
+	m = append(m, section(10,
+		code(append([]byte{0x41}, sleb(inputAt)...)...),
+		code(append(body, append([]byte{0x42}, sleb(packed)...)...)...),
+	)...)
+	data := append([]byte{0, 0x41}, sleb(outputAt)...)
+	data = append(append(data, 0x0b), name(output)...)
+	return append(m, section(11, data)...)
+}
+
+// growBy grows memory by pages and traps if that fails.
+func growBy(pages int) []byte {
+	b := append([]byte{0x41}, sleb(int64(pages))...)
+	return append(b,
+		0x40, 0, // memory.grow
+		0x41, 0x7f, // i32.const -1
+		0x46,             // i32.eq
+		0x04, 0x40, 0x00, // if: unreachable
+		0x0b,
+	)
+}
+
+// spin loops forever.
+var spin = []byte{0x03, 0x40, 0x0c, 0, 0x0b}
+
+func uleb(n int) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func sleb(n int64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 && c&0x40 == 0 || n == -1 && c&0x40 != 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// loadTestPlugins writes modules and bindings to a directory and loads it.
+func loadTestPlugins(t *testing.T, memoryMB int, timeout time.Duration, modules map[string][]byte, bindings pluginBindings) *pluginHost {
+	t.Helper()
+	dir := t.TempDir()
+	for name, bin := range modules {
+		if err := os.WriteFile(filepath.Join(dir, name+".wasm"), bin, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := json.Marshal(bindings)
+	if err := os.WriteFile(filepath.Join(dir, "plugins.json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := loadPlugins(dir, memoryMB, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func pickFor(h *pluginHost, tenant string) []Quote {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if tenant != "" {
+		r.Header.Set("X-Tenant-ID", tenant)
+	}
+	return h.pick(r, "/", quizQuotes, 1, func() []Quote { return quizQuotes[4:] })
+}
+
+func TestPluginMemoryLimit(t *testing.T) {
+	modules := map[string][]byte{"grow": wasmModule(growBy(32), `{"indices":[1]}`)} // 2 MiB
+	bindings := pluginBindings{Routes: map[string]pluginBinding{"/": {Strategy: "grow"}}}
+
+	h := loadTestPlugins(t, 4, time.Second, modules, bindings)
+	if got := pickFor(h, ""); len(got) != 1 || got[0].ID != 2 {
+		t.Fatalf("pick() within the memory limit = %+v, want quote 2", got)
+	}
+
+	h = loadTestPlugins(t, 1, time.Second, modules, bindings)
+	if got := pickFor(h, ""); len(got) != 1 || got[0].ID != 5 {
+		t.Errorf("pick() over the memory limit = %+v, want the fallback", got)
+	}
+	if n := h.calls.values["grow\xffselect\xfferror"]; n != 1 {
+		t.Errorf("failed calls = %v, want 1", n)
+	}
+}
+
+func TestPluginTimeout(t *testing.T) {
+	h := loadTestPlugins(t, 1, 50*time.Millisecond,
+		map[string][]byte{"spin": wasmModule(spin, `{"indices":[0]}`)},
+		pluginBindings{Routes: map[string]pluginBinding{"/": {Strategy: "spin"}}})
+	start := time.Now()
+	if got := pickFor(h, ""); len(got) != 1 || got[0].ID != 5 {
+		t.Errorf("pick() with a strategy that never returns = %+v, want the fallback", got)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("pick() took %v, want it stopped after the timeout", d)
+	}
+	if n := h.calls.values["spin\xffselect\xfftimeout"]; n != 1 {
+		t.Errorf("timed out calls = %v, want 1", n)
+	}
+}
+
+func TestPluginHistory(t *testing.T) {
+	h := loadTestPlugins(t, 1, time.Second,
+		map[string][]byte{"first": wasmModule(nil, `{"indices":[0]}`)},
+		pluginBindings{
+			Routes:  map[string]pluginBinding{"/": {Strategy: "first"}},
+			Tenants: map[string]pluginBinding{"acme": {Strategy: "first"}},
+		})
+
+	// Tenants without a binding share the route's history.
+	for i := 0; i < 100; i++ {
+		pickFor(h, "tenant-"+strconv.Itoa(i))
+	}
+	pickFor(h, "")
+	pickFor(h, "acme")
+	if len(h.history) != 2 {
+		t.Errorf("%d histories, want one for the route and one for acme", len(h.history))
+	}
+	if n := len(h.history["/\x00"]); n != pluginHistorySize {
+		t.Errorf("route history has %d IDs, want it capped at %d", n, pluginHistorySize)
+	}
+	if n := len(h.history["/\x00acme"]); n != 1 {
+		t.Errorf("acme's history has %d IDs, want 1", n)
+	}
+}
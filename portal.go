@@ -0,0 +1,169 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed web/portal
+var portalFiles embed.FS
+
+var portalPage = template.Must(template.ParseFS(portalFiles, "web/portal/index.html"))
+
+// portal is the developer self-service site: a static web UI under /portal/
+// and the JSON API it uses under /v1/portal/.
+type portal struct {
+	accounts *accounts
+	keys     *apiKeys
+	meter    *meter
+}
+
+func (p *portal) routes(mux *http.ServeMux) {
+	static, _ := fs.Sub(portalFiles, "web/portal")
+	assets := http.StripPrefix("/portal/", http.FileServerFS(static))
+	// The page is a template; only its assets are served as they are.
+	mux.HandleFunc("GET /portal/{$}", p.pageHandler)
+	mux.HandleFunc("GET /portal/index.html", p.pageHandler)
+	mux.Handle("GET /portal/app.js", assets)
+	mux.Handle("GET /portal/style.css", assets)
+	mux.HandleFunc("GET /v1/portal/plans", p.plansHandler)
+	mux.HandleFunc("GET /v1/portal/plan", p.accounts.requireUser(p.planHandler))
+	mux.HandleFunc("GET /v1/portal/keys", p.accounts.requireUser(p.listKeysHandler))
+	mux.HandleFunc("POST /v1/portal/keys", p.accounts.requireUser(p.createKeyHandler))
+	mux.HandleFunc("POST /v1/portal/keys/{id}/rotate", p.accounts.requireUser(p.rotateKeyHandler))
+	mux.HandleFunc("DELETE /v1/portal/keys/{id}", p.accounts.requireUser(p.revokeKeyHandler))
+	mux.HandleFunc("GET /v1/portal/usage", p.accounts.requireUser(p.usageHandler))
+}
+
+// pageHandler renders the portal page, whose assets carry the request's
+// CSP nonce.
+func (p *portal) pageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	portalPage.Execute(w, map[string]string{"Nonce": cspNonce(r)})
+}
+
+func (p *portal) plansHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"plans": plans})
+}
+
+func (p *portal) planHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	pl, err := p.keys.planOf(r.Context(), u.ID)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, pl)
+}
+
+func (p *portal) listKeysHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	keys, err := p.keys.list(r.Context(), u.ID)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
+
+func (p *portal) createKeyHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON with a name")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		writeError(w, http.StatusBadRequest, "name is required, up to 100 characters")
+		return
+	}
+	key, secret, err := p.keys.create(r.Context(), u.ID, req.Name)
+	if err != nil {
+		keyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"key": key, "secret": secret})
+}
+
+func (p *portal) rotateKeyHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	key, secret, err := p.keys.rotate(r.Context(), u.ID, r.PathValue("id"))
+	if err != nil {
+		keyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"key": key, "secret": secret})
+}
+
+func (p *portal) revokeKeyHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	if err := p.keys.revoke(r.Context(), u.ID, r.PathValue("id")); err != nil {
+		keyError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keyError writes the response for an error from apiKeys.
+func keyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errTooManyKeys):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		stateError(w, err)
+	}
+}
+
+type keyUsage struct {
+	ID     string           `json:"id"`
+	Name   string           `json:"name"`
+	Total  int64            `json:"total"`
+	Daily  []int64          `json:"daily"`
+	Routes map[string]int64 `json:"routes"`
+}
+
+// usageHandler returns request counts for each of the developer's keys over
+// the last ?days= days (default 30), for the portal charts.
+func (p *portal) usageHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	days, ok := intParam(w, r, "days", 30, 1, 90)
+	if !ok {
+		return
+	}
+	today := time.Now().UTC()
+	dates := make([]string, days)
+	for i := range dates {
+		dates[i] = today.AddDate(0, 0, i-days+1).Format(time.DateOnly)
+	}
+
+	keys, err := p.keys.list(r.Context(), u.ID)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	pl, err := p.keys.planOf(r.Context(), u.ID)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	usage := []keyUsage{}
+	for _, key := range keys {
+		daily, routes, err := p.meter.usage(r.Context(), key.ID, dates[0], dates[len(dates)-1])
+		if err != nil {
+			stateError(w, err)
+			return
+		}
+		ku := keyUsage{ID: key.ID, Name: key.Name, Daily: make([]int64, days), Routes: routes}
+		for i, d := range dates {
+			ku.Daily[i] = daily[d]
+			ku.Total += daily[d]
+		}
+		usage = append(usage, ku)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"plan": pl, "dates": dates, "keys": usage})
+}
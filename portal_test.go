@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// portalFixture serves the portal and billing routes for a signed-in
+// developer.
+type portalFixture struct {
+	mux     *http.ServeMux
+	keys    *apiKeys
+	audit   *auditLog
+	user    user
+	session string
+}
+
+func newPortalFixture(t *testing.T, env map[string]string) *portalFixture {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	state, in := newMemoryState(), new(inbox)
+	accounts := newAccounts(state, in, "https://quotes.test", true)
+	u := signUp(t, accounts, in, "dev@example.com", "correct horse")
+	_, session, err := accounts.login(context.Background(), "dev@example.com", "correct horse", loginRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := newAPIKeys(state)
+	audit, _ := newAuditLog("")
+	mux := http.NewServeMux()
+	(&portal{accounts: accounts, keys: keys, meter: newMeter(state)}).routes(mux)
+	billingFromEnv(keys, accounts, &staffAuth{tokens: map[string]role{"adm": roleAdmin}}, audit, state).routes(mux)
+	return &portalFixture{mux, keys, audit, u, session}
+}
+
+// do sends a request as the signed-in developer, or anonymously if the
+// session is cleared.
+func (f *portalFixture) do(method, path, body string) (int, map[string]any) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if f.session != "" {
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: f.session})
+	}
+	w := httptest.NewRecorder()
+	f.mux.ServeHTTP(w, r)
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+func (f *portalFixture) plan(t *testing.T) string {
+	t.Helper()
+	pl, err := f.keys.planOf(context.Background(), f.user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pl.Name
+}
+
+func signBilling(secret, body string, at time.Time) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, ts+"."+body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestPortalPlanChoice(t *testing.T) {
+	f := newPortalFixture(t, map[string]string{
+		"BILLING_WEBHOOK_SECRET": "billing secret",
+		"BILLING_CHECKOUT_URL":   "https://billing.example/checkout?product=quotes",
+		"BASE_URL":               "https://quotes.test",
+	})
+
+	// A paid plan is bought at checkout and applies once billing calls back.
+	status, resp := f.do(http.MethodPut, "/v1/portal/plan", `{"plan": "pro"}`)
+	if status != http.StatusAccepted {
+		t.Fatalf("choosing pro = %d %v, want 202", status, resp)
+	}
+	checkout, err := url.Parse(resp["checkout_url"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := checkout.Query()
+	if checkout.Host != "billing.example" || q.Get("product") != "quotes" || q.Get("user_id") != f.user.ID || q.Get("plan") != "pro" || q.Get("return_url") != "https://quotes.test/portal/" {
+		t.Errorf("checkout_url = %s", checkout)
+	}
+	if got := f.plan(t); got != "free" {
+		t.Errorf("plan before the callback = %s, want free", got)
+	}
+	body := `{"user_id": "` + f.user.ID + `", "plan": "pro"}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/billing/plan", strings.NewReader(body))
+	r.Header.Set(billingSignatureHeader, signBilling("billing secret", body, time.Now()))
+	w := httptest.NewRecorder()
+	f.mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || f.plan(t) != "pro" {
+		t.Fatalf("billing callback = %d %s, plan %s", w.Code, w.Body, f.plan(t))
+	}
+
+	// Enterprise is arranged directly; unknown plans are refused.
+	if status, _ := f.do(http.MethodPut, "/v1/portal/plan", `{"plan": "enterprise"}`); status != http.StatusForbidden {
+		t.Errorf("choosing enterprise = %d, want 403", status)
+	}
+	if status, _ := f.do(http.MethodPut, "/v1/portal/plan", `{"plan": "platinum"}`); status != http.StatusBadRequest {
+		t.Errorf("choosing an unknown plan = %d, want 400", status)
+	}
+	if got := f.plan(t); got != "pro" {
+		t.Errorf("plan after refused changes = %s, want pro", got)
+	}
+
+	// Going back to free is immediate, and audited.
+	if status, resp := f.do(http.MethodPut, "/v1/portal/plan", `{"plan": "free"}`); status != http.StatusOK || resp["name"] != "free" {
+		t.Errorf("choosing free = %d %v, want 200", status, resp)
+	}
+	if got := f.plan(t); got != "free" {
+		t.Errorf("plan after switching to free = %s", got)
+	}
+	entries := f.audit.recent
+	if last := entries[len(entries)-1]; last.Actor != "user:"+f.user.ID || last.Details["plan"] != "free" {
+		t.Errorf("last audit entry = %+v, want the developer switching to free", last)
+	}
+
+	f.session = ""
+	if status, _ := f.do(http.MethodPut, "/v1/portal/plan", `{"plan": "free"}`); status != http.StatusUnauthorized {
+		t.Errorf("choosing a plan signed out = %d, want 401", status)
+	}
+}
+
+func TestPortalPlanWithoutCheckout(t *testing.T) {
+	// A checkout without the callback secret could take payment that never
+	// applies, so it is not offered.
+	f := newPortalFixture(t, map[string]string{"BILLING_CHECKOUT_URL": "https://billing.example/checkout"})
+	if status, _ := f.do(http.MethodPut, "/v1/portal/plan", `{"plan": "pro"}`); status != http.StatusForbidden {
+		t.Errorf("choosing pro without billing = %d, want 403", status)
+	}
+	if status, _ := f.do(http.MethodPut, "/v1/portal/plan", `{"plan": "free"}`); status != http.StatusOK {
+		t.Errorf("choosing free without billing = %d, want 200", status)
+	}
+	if status, _ := f.do(http.MethodPost, "/v1/billing/plan", `{}`); status != http.StatusNotFound && status != http.StatusMethodNotAllowed {
+		t.Errorf("billing callback without a secret = %d, want it not served", status)
+	}
+}
+
+func TestPortalKeys(t *testing.T) {
+	f := newPortalFixture(t, nil)
+	status, resp := f.do(http.MethodPost, "/v1/portal/keys", `{"name": "prod"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("creating a key = %d %v", status, resp)
+	}
+	id := resp["key"].(map[string]any)["id"].(string)
+	secret := resp["secret"].(string)
+	if key, ok, err := f.keys.lookup(context.Background(), secret); !ok || err != nil || key.ID != id {
+		t.Fatalf("lookup(new secret) = %+v, %v, %v", key, ok, err)
+	}
+
+	status, resp = f.do(http.MethodPost, "/v1/portal/keys/"+id+"/rotate", "")
+	if status != http.StatusOK || resp["secret"] == secret {
+		t.Fatalf("rotating = %d %v", status, resp)
+	}
+	rotated := resp["secret"].(string)
+	for _, s := range []string{secret, rotated} {
+		if _, ok, _ := f.keys.lookup(context.Background(), s); !ok {
+			t.Errorf("lookup() during the rotation grace period failed for one of the secrets")
+		}
+	}
+
+	if status, _ := f.do(http.MethodDelete, "/v1/portal/keys/"+id, ""); status != http.StatusNoContent {
+		t.Errorf("revoking = %d, want 204", status)
+	}
+	for _, s := range []string{secret, rotated} {
+		if _, ok, _ := f.keys.lookup(context.Background(), s); ok {
+			t.Error("lookup() after revocation succeeded")
+		}
+	}
+	if status, _ := f.do(http.MethodPost, "/v1/portal/keys/"+id+"/rotate", ""); status != http.StatusNotFound {
+		t.Errorf("rotating a revoked key = %d, want 404", status)
+	}
+
+	status, resp = f.do(http.MethodGet, "/v1/portal/keys", "")
+	if keys, _ := resp["keys"].([]any); status != http.StatusOK || len(keys) != 1 || keys[0].(map[string]any)["revoked_at"] == nil {
+		t.Errorf("listing keys = %d %v, want the revoked key", status, resp)
+	}
+	if status, _ := f.do(http.MethodPost, "/v1/portal/keys", `{"name": " "}`); status != http.StatusBadRequest {
+		t.Errorf("creating a key without a name = %d, want 400", status)
+	}
+	for i := 0; i < maxKeysPerOwner; i++ {
+		f.do(http.MethodPost, "/v1/portal/keys", `{"name": "k"}`)
+	}
+	if status, _ := f.do(http.MethodPost, "/v1/portal/keys", `{"name": "one too many"}`); status != http.StatusConflict {
+		t.Errorf("creating key %d = %d, want 409", maxKeysPerOwner+1, status)
+	}
+
+	// Without a session, keys cannot be touched.
+	f.session = ""
+	if status, _ := f.do(http.MethodDelete, "/v1/portal/keys/"+id, ""); status != http.StatusUnauthorized {
+		t.Errorf("revoking signed out = %d, want 401", status)
+	}
+}
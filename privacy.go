@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// personalData is implemented by every subsystem that stores data about
+// users, so data subject requests can reach all of it.
+type personalData interface {
+	// exportUser returns everything held about the user, ready to be
+	// encoded as JSON, or nil if there is nothing.
+	exportUser(userID string) (any, error)
+	// eraseUser deletes the user's data, or anonymizes what must be kept.
+	eraseUser(userID string) error
+}
+
+// noPersonalData lists the server's subsystems that hold nothing linked to
+// a user account, and why. Every other subsystem must implement
+// personalData and be returned by server.personalData; a test checks this,
+// so a new subsystem cannot be forgotten.
+var noPersonalData = map[string]string{
+	"store":      "quotes are editorial content",
+	"quiz":       "players are free-text names not linked to accounts",
+	"markov":     "chains trained on quote text",
+	"semantic":   "an index of quote text",
+	"daily":      "corpus snapshots",
+	"staff":      "staff tokens come from configuration",
+	"editor":     "edits quotes in the store",
+	"cdn":        "cache keys name quotes, authors and tags",
+	"signer":     "signing keys",
+	"billing":    "plans are stored, exported and erased with the keys",
+	"plugins":    "history is kept per tenant, not per user",
+	"privacy":    "this registry; its audit log keeps erasures on record",
+	"security":   "header configuration",
+	"realIP":     "trusted proxy configuration",
+	"access":     "address and country rules",
+	"challenges": "per-address request counts, forgotten after ten minutes",
+	"abuse":      "addresses of misbehaving clients, forgotten after a quiet day",
+}
+
+type privacySubsystem struct {
+	name string
+	data personalData
+}
+
+// privacy runs data subject requests across every subsystem.
+type privacy struct {
+	accounts   *accounts
+	audit      *auditLog
+	subsystems []privacySubsystem
+}
+
+// personalData returns the subsystems of s that hold personal data, keyed
+// by field name.
+func (s *server) personalData() map[string]personalData {
+	return map[string]personalData{
+		"accounts":  s.accounts,
+		"oauth":     s.oauth,
+		"favorites": s.favorites,
+		"keys":      s.keys,
+		"meter":     s.meter,
+	}
+}
+
+// newPrivacy runs requests across the given subsystems, keyed by name.
+func newPrivacy(accounts *accounts, audit *auditLog, subsystems map[string]personalData) *privacy {
+	p := &privacy{accounts: accounts, audit: audit}
+	for name, d := range subsystems {
+		p.subsystems = append(p.subsystems, privacySubsystem{name, d})
+	}
+	sort.Slice(p.subsystems, func(i, j int) bool { return p.subsystems[i].name < p.subsystems[j].name })
+	return p
+}
+
+// userArchive is a data export: one entry per subsystem that holds data
+// about the user.
+type userArchive struct {
+	UserID     string                     `json:"user_id"`
+	ExportedAt time.Time                  `json:"exported_at"`
+	Data       map[string]json.RawMessage `json:"data"`
+}
+
+func (p *privacy) export(actor, userID string) (userArchive, error) {
+	archive := userArchive{UserID: userID, ExportedAt: time.Now().UTC(), Data: make(map[string]json.RawMessage)}
+	for _, s := range p.subsystems {
+		v, err := s.data.exportUser(userID)
+		if err != nil {
+			return userArchive{}, fmt.Errorf("%s: %w", s.name, err)
+		}
+		if v == nil {
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return userArchive{}, fmt.Errorf("%s: %w", s.name, err)
+		}
+		archive.Data[s.name] = raw
+	}
+	p.audit.record(actor, "user.export", userID, nil)
+	return archive, nil
+}
+
+// erase removes the user from every subsystem. It carries on past failures
+// so as much as possible is erased, and reports them together.
+func (p *privacy) erase(actor, userID string) error {
+	var errs []error
+	var erased []string
+	for _, s := range p.subsystems {
+		if err := s.data.eraseUser(userID); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+			continue
+		}
+		erased = append(erased, s.name)
+	}
+	err := errors.Join(errs...)
+	details := map[string]any{"subsystems": erased}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+	p.audit.record(actor, "user.erase", userID, details)
+	return err
+}
+
+func (p *privacy) routes(mux *http.ServeMux, staff *staffAuth) {
+	mux.HandleFunc("GET /v1/me/export", p.accounts.requireUser(p.selfExportHandler))
+	mux.HandleFunc("DELETE /v1/me", p.accounts.requireUser(p.selfEraseHandler))
+	mux.HandleFunc("GET /v1/admin/users", staff.require(roleAdmin, p.findUserHandler))
+	mux.HandleFunc("GET /v1/admin/users/{id}/export", staff.require(roleAdmin, p.adminExportHandler))
+	mux.HandleFunc("DELETE /v1/admin/users/{id}", staff.require(roleAdmin, p.adminEraseHandler))
+	mux.HandleFunc("GET /v1/admin/audit", staff.require(roleAdmin, p.audit.listHandler))
+}
+
+func (p *privacy) writeArchive(w http.ResponseWriter, actor, userID string) {
+	archive, err := p.export(actor, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "export failed: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=quote-api-"+userID+".json")
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, archive)
+}
+
+func (p *privacy) selfExportHandler(w http.ResponseWriter, _ *http.Request, u user, _ session) {
+	p.writeArchive(w, "user:"+u.ID, u.ID)
+}
+
+// selfEraseHandler deletes the signed-in user's account. The password is
+// asked for again so an unattended session cannot be used to do it.
+func (p *privacy) selfEraseHandler(w http.ResponseWriter, r *http.Request, u user, _ session) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req)
+	match, err := p.accounts.confirmPassword(r.Context(), u.ID, req.Password)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !match {
+		writeError(w, http.StatusForbidden, "confirm with your current password")
+		return
+	}
+	if err := p.erase("user:"+u.ID, u.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, "erasure incomplete: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findUserHandler looks a user up by ?email=, to find the ID for a request
+// that arrives by email.
+func (p *privacy) findUserHandler(w http.ResponseWriter, r *http.Request, _ role) {
+	email, ok := normalizeEmail(r.URL.Query().Get("email"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "email must be a valid address")
+		return
+	}
+	u, ok, err := p.accounts.userByEmail(r.Context(), email)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no user with that email")
+		return
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (p *privacy) adminExportHandler(w http.ResponseWriter, r *http.Request, rl role) {
+	id := r.PathValue("id")
+	if _, ok, err := p.accounts.userByID(r.Context(), id); err != nil {
+		stateError(w, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	p.writeArchive(w, "staff:"+rl.String(), id)
+}
+
+func (p *privacy) adminEraseHandler(w http.ResponseWriter, r *http.Request, rl role) {
+	id := r.PathValue("id")
+	if _, ok, err := p.accounts.userByID(r.Context(), id); err != nil {
+		stateError(w, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err := p.erase("staff:"+rl.String(), id); err != nil {
+		writeError(w, http.StatusInternalServerError, "erasure incomplete: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestEverySubsystemIsCovered checks that each server field either holds
+// personal data and is reached by data subject requests, or is listed in
+// noPersonalData with a reason.
+func TestEverySubsystemIsCovered(t *testing.T) {
+	iface := reflect.TypeOf((*personalData)(nil)).Elem()
+	registered := (&server{}).personalData()
+	st := reflect.TypeOf(server{})
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		_, isRegistered := registered[f.Name]
+		_, isExempt := noPersonalData[f.Name]
+		switch {
+		case f.Type.Implements(iface) && !isRegistered:
+			t.Errorf("server.%s implements personalData but is not returned by server.personalData", f.Name)
+		case !f.Type.Implements(iface) && !isExempt:
+			t.Errorf("server.%s must implement personalData, or be listed in noPersonalData with a reason", f.Name)
+		case isRegistered && isExempt:
+			t.Errorf("server.%s is both registered and listed in noPersonalData", f.Name)
+		}
+	}
+	for name := range noPersonalData {
+		if _, ok := st.FieldByName(name); !ok {
+			t.Errorf("noPersonalData lists %s, which is not a server field", name)
+		}
+	}
+	for name := range registered {
+		if _, ok := st.FieldByName(name); !ok {
+			t.Errorf("server.personalData returns %s, which is not a server field", name)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt)
+// lets a TCP load balancer pass on the client's address at the start of
+// each connection.
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("proxy protocol: malformed header")
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	proxyV1MaxLength   = 107
+)
+
+var proxyHeaders = newCounterVec("quote_proxy_protocol_headers_total", "PROXY protocol headers received, by result.", "result")
+
+// proxyListener reads PROXY protocol headers on connections from trusted
+// load balancers, so RemoteAddr reports the original client. Connections
+// from anywhere else are passed through untouched, and their headers are
+// not believed.
+type proxyListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+// proxyListenerFromEnv wraps ln when PROXY_PROTOCOL_FROM lists the load
+// balancers' addresses or CIDR ranges, and returns ln unchanged otherwise.
+func proxyListenerFromEnv(ln net.Listener) (net.Listener, error) {
+	v := os.Getenv("PROXY_PROTOCOL_FROM")
+	if v == "" {
+		return ln, nil
+	}
+	pl := &proxyListener{Listener: ln}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("PROXY_PROTOCOL_FROM: %w", err)
+		}
+		pl.trusted = append(pl.trusted, p)
+	}
+	return pl, nil
+}
+
+// Accept does not read the header itself, so a slow or silent peer cannot
+// hold up other connections; the header is read on first use instead.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer, ok := netip.AddrFromSlice(tcpAddrIP(c.RemoteAddr()))
+	if !ok || !containsAddr(l.trusted, peer.Unmap()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+func tcpAddrIP(a net.Addr) net.IP {
+	if ta, ok := a.(*net.TCPAddr); ok {
+		return ta.IP
+	}
+	return nil
+}
+
+// proxyConn is a connection from a load balancer, which must start with a
+// PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+
+	once       sync.Once
+	err        error
+	r          io.Reader // the buffered reader until its buffer drains
+	br         *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.br = bufio.NewReader(c.Conn)
+		c.r = c.br
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		src, dst, version, err := readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			proxyHeaders.inc("error")
+			c.err = err
+			c.Conn.Close()
+			return
+		}
+		proxyHeaders.inc(version)
+		c.remoteAddr, c.localAddr = c.Conn.RemoteAddr(), c.Conn.LocalAddr()
+		if src != nil {
+			c.remoteAddr, c.localAddr = src, dst
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.r == c.br && c.br.Buffered() == 0 {
+		c.r = c.Conn
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address from the header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.localAddr == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.localAddr
+}
+
+// readProxyHeader reads a version 1 or 2 header. The addresses are nil for
+// health checks sent by the load balancer itself (v1 UNKNOWN, v2 LOCAL) and
+// for address families other than TCP over IPv4 and IPv6.
+func readProxyHeader(br *bufio.Reader) (src, dst net.Addr, version string, err error) {
+	sig, err := br.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if bytes.Equal(sig, proxyV1Prefix) {
+		return readProxyV1(br)
+	}
+	if sig, err = br.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(br)
+	}
+	return nil, nil, "", errProxyHeader
+}
+
+// readProxyV1 reads a header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(br *bufio.Reader) (src, dst net.Addr, version string, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, "", err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, "", errProxyHeader
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, "v1", nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, "", errProxyHeader
+	}
+	srcIP, err1 := netip.ParseAddr(fields[2])
+	dstIP, err2 := netip.ParseAddr(fields[3])
+	srcPort, err3 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err4 := strconv.ParseUint(fields[5], 10, 16)
+	tcp4 := fields[1] == "TCP4"
+	if err := errors.Join(err1, err2, err3, err4); err != nil || srcIP.Is4() != tcp4 || dstIP.Is4() != tcp4 {
+		return nil, nil, "", errProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, uint16(srcPort))),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, uint16(dstPort))), "v1", nil
+}
+
+// readProxyV2 reads a binary header: the signature, a version and command
+// byte, an address family byte, a length, then the addresses and any TLVs,
+// which are skipped.
+func readProxyV2(br *bufio.Reader) (src, dst net.Addr, version string, err error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, nil, "", err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, "", errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, "", err
+	}
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil, "v2", nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, "", errProxyHeader
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = 4
+	case 0x21: // TCP over IPv6
+		ipLen = 16
+	default:
+		return nil, nil, "v2", nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, "", errProxyHeader
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:ipLen])
+	dstIP, _ := netip.AddrFromSlice(body[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(body[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(body[2*ipLen+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), "v2", nil
+}
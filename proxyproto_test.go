@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a version 2 header with the given command, family and
+// address block.
+func proxyV2(command, family byte, body []byte) string {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x20|command, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(body)))
+	return string(append(hdr, body...))
+}
+
+func proxyV2Addrs(src, dst string, srcPort, dstPort uint16) []byte {
+	var b []byte
+	b = append(b, netip.MustParseAddr(src).AsSlice()...)
+	b = append(b, netip.MustParseAddr(dst).AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	return binary.BigEndian.AppendUint16(b, dstPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tlv := []byte{0x04, 0x00, 0x03, 'a', 'b', 'c'} // a NOOP TLV
+	tests := []struct {
+		name, header string
+		src, dst     string // empty for no addresses
+		version      string
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", "198.51.100.1:443", "v1"},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:443", "v1"},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", "", "v1"},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN ::1 ::2 1 2\r\n", "", "", "v1"},
+		{"v2 IPv4", proxyV2(0x1, 0x11, proxyV2Addrs("192.0.2.1", "198.51.100.1", 56324, 443)), "192.0.2.1:56324", "198.51.100.1:443", "v2"},
+		{"v2 IPv6 with TLVs", proxyV2(0x1, 0x21, append(proxyV2Addrs("2001:db8::1", "2001:db8::2", 1, 2), tlv...)), "[2001:db8::1]:1", "[2001:db8::2]:2", "v2"},
+		{"v2 LOCAL", proxyV2(0x0, 0x00, nil), "", "", "v2"},
+		{"v2 LOCAL with addresses", proxyV2(0x0, 0x11, proxyV2Addrs("192.0.2.1", "198.51.100.1", 1, 2)), "", "", "v2"},
+		{"v2 UDP", proxyV2(0x1, 0x12, proxyV2Addrs("192.0.2.1", "198.51.100.1", 1, 2)), "", "", "v2"},
+		{"v2 unix socket", proxyV2(0x1, 0x31, make([]byte, 216)), "", "", "v2"},
+	}
+	for _, tt := range tests {
+		br := bufio.NewReader(strings.NewReader(tt.header + "GET / HTTP/1.1\r\n"))
+		src, dst, version, err := readProxyHeader(br)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if addrString(src) != tt.src || addrString(dst) != tt.dst || version != tt.version {
+			t.Errorf("%s: got %s -> %s (%s), want %s -> %s (%s)", tt.name, addrString(src), addrString(dst), version, tt.src, tt.dst, tt.version)
+		}
+		// The header is consumed exactly, leaving the request.
+		if rest, _ := io.ReadAll(br); string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: left %q after the header", tt.name, rest)
+		}
+	}
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func TestReadProxyHeaderRejects(t *testing.T) {
+	v4 := proxyV2Addrs("192.0.2.1", "198.51.100.1", 1, 2)
+	for name, header := range map[string]string{
+		"no header":               "GET / HTTP/1.1\r\n\r\n",
+		"v1 without CRLF":         "PROXY TCP4 192.0.2.1 198.51.100.1 1 2\n",
+		"v1 too long":             "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		"v1 missing port":         "PROXY TCP4 192.0.2.1 198.51.100.1 1\r\n",
+		"v1 extra field":          "PROXY TCP4 192.0.2.1 198.51.100.1 1 2 3\r\n",
+		"v1 unknown protocol":     "PROXY UDP4 192.0.2.1 198.51.100.1 1 2\r\n",
+		"v1 bad address":          "PROXY TCP4 192.0.2.256 198.51.100.1 1 2\r\n",
+		"v1 port out of range":    "PROXY TCP4 192.0.2.1 198.51.100.1 65536 2\r\n",
+		"v1 source family":        "PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n",
+		"v1 destination family":   "PROXY TCP6 2001:db8::1 198.51.100.1 1 2\r\n",
+		"v1 double spaces":        "PROXY TCP4  192.0.2.1 198.51.100.1 1 2\r\n",
+		"v1 truncated":            "PROXY TCP4 192.0.2.1",
+		"v2 wrong version":        strings.Replace(proxyV2(0x1, 0x11, v4), "\x21\x11", "\x11\x11", 1),
+		"v2 unknown command":      proxyV2(0x2, 0x11, v4),
+		"v2 short address block":  proxyV2(0x1, 0x21, v4),
+		"v2 truncated fixed part": proxyV2(0x1, 0x11, v4)[:14],
+		"v2 truncated body":       proxyV2(0x1, 0x11, v4)[:20],
+		"v2 signature only":       string(proxyV2Signature),
+		"empty":                   "",
+	} {
+		if _, _, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("readProxyHeader() accepted a header with %s", name)
+		}
+	}
+}
+
+// proxyDial sends data to l over TCP and returns the accepted connection.
+func proxyDial(t *testing.T, l net.Listener, data string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := io.WriteString(c, data); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func proxyListen(t *testing.T, from string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	t.Setenv("PROXY_PROTOCOL_FROM", from)
+	l, err := proxyListenerFromEnv(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestProxyListener(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+
+	// A trusted load balancer's header sets the client address.
+	conn := proxyDial(t, proxyListen(t, "10.0.0.0/8, 127.0.0.1"), header+"hello")
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr() = %s, want the client from the header", got)
+	}
+	if body, err := io.ReadAll(conn); err != nil || string(body) != "hello" {
+		t.Errorf("read %q, %v after the header, want hello", body, err)
+	}
+
+	// A LOCAL health check keeps the load balancer's own address.
+	conn = proxyDial(t, proxyListen(t, "127.0.0.1"), proxyV2(0x0, 0x00, nil)+"ping")
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("RemoteAddr() of a LOCAL connection = %s, want the peer", got)
+	}
+	if body, _ := io.ReadAll(conn); string(body) != "ping" {
+		t.Errorf("read %q after a LOCAL header, want ping", body)
+	}
+
+	// A trusted peer that sends no header is cut off.
+	conn = proxyDial(t, proxyListen(t, "127.0.0.1"), "GET / HTTP/1.1\r\n\r\n")
+	if _, err := conn.Read(make([]byte, 1)); err != errProxyHeader {
+		t.Errorf("Read() without a header = %v, want errProxyHeader", err)
+	}
+
+	// Anyone else's header is not believed, and reaches the server as is.
+	conn = proxyDial(t, proxyListen(t, "10.0.0.0/8"), header)
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("RemoteAddr() of an untrusted peer = %s, want the peer", got)
+	}
+	if body, _ := io.ReadAll(conn); string(body) != header {
+		t.Errorf("read %q from an untrusted peer, want the header untouched", body)
+	}
+}
+
+func TestProxyListenerFromEnv(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	t.Setenv("PROXY_PROTOCOL_FROM", "")
+	if l, _ := proxyListenerFromEnv(ln); l != ln {
+		t.Error("proxyListenerFromEnv() wrapped the listener without PROXY_PROTOCOL_FROM")
+	}
+	t.Setenv("PROXY_PROTOCOL_FROM", "10.0.0.0/8,lb.internal")
+	if _, err := proxyListenerFromEnv(ln); err == nil {
+		t.Error("proxyListenerFromEnv() accepted a host name")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// selectQuotes returns the quotes chosen by the request's filter, author,
+// tag and q parameters. It is shared by every endpoint that works on a
+// subset of the corpus so they all honour the same selectors. Stores that
+// can evaluate the filter themselves are asked to.
+func (s *server) selectQuotes(r *http.Request) ([]Quote, error) {
+	f, err := requestFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	quotes, err := applyFilter(s.store, f)
+	if err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	author, tag, search := query.Get("author"), query.Get("tag"), query.Get("q")
+	var selected []Quote
+	for _, q := range quotes {
+		if matchQuote(q, author, tag, search) {
+			selected = append(selected, q)
+		}
+	}
+	return selected, nil
+}
+
+// quoteMatcher returns the request's selectors as a predicate, for callers
+// that walk the store one quote at a time instead of using selectQuotes.
+func (s *server) quoteMatcher(r *http.Request) (func(Quote) bool, error) {
+	f, err := requestFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	author, tag, search := query.Get("author"), query.Get("tag"), query.Get("q")
+	return func(q Quote) bool {
+		return (f == nil || f.match(q)) && matchQuote(q, author, tag, search)
+	}, nil
+}
+
+// requestFilter parses the request's ?filter=, or returns nil if it has none.
+func requestFilter(r *http.Request) (*filterExpr, error) {
+	src := r.URL.Query().Get("filter")
+	if src == "" {
+		return nil, nil
+	}
+	return parseFilter(src)
+}
+
+// matchQuote reports whether q satisfies the author, tag and free-text
+// search selectors shared by the listing-style endpoints. Empty selectors
+// match everything.
+func matchQuote(q Quote, author, tag, search string) bool {
+	if author != "" && !strings.EqualFold(q.Author, author) {
+		return false
+	}
+	if tag != "" && !hasTag(q, tag) {
+		return false
+	}
+	if search != "" {
+		needle := strings.ToLower(search)
+		if !strings.Contains(strings.ToLower(q.Text), needle) && !strings.Contains(strings.ToLower(q.Author), needle) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTag(q Quote, tag string) bool {
+	for _, t := range q.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// listHandler serves GET /v1/quotes, a paginated listing of the selected
+// quotes. Clients accepting NDJSON get the selected quotes streamed
+// instead: all of them with an API key unless they set a limit, and up to
+// anonymousStreamLimit without one.
+func (s *server) listHandler(w http.ResponseWriter, r *http.Request) {
+	stream := wantsNDJSON(r)
+	def, lo, hi := 50, 1, 500
+	if stream {
+		def, lo, hi = 0, 0, streamLimit(r)
+		if hi == 0 {
+			hi = 1<<31 - 1
+		}
+	}
+	limit, ok := intParam(w, r, "limit", def, lo, hi)
+	if !ok {
+		return
+	}
+	offset, ok := intParam(w, r, "offset", 0, 0, 1<<31-1)
+	if !ok {
+		return
+	}
+	if stream {
+		s.streamQuotes(w, r, offset, limit, "")
+		return
+	}
+
+	quotes, err := s.selectQuotes(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	total := len(quotes)
+	page := quotes[min(offset, total):min(offset+limit, total)]
+	if page == nil {
+		page = []Quote{}
+	}
+	s.cdn.cacheable(w, true, page...)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"quotes": page,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// getHandler serves GET /v1/quotes/{id}.
+func (s *server) getHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errQuoteNotFound.Error())
+		return
+	}
+	q, ok := quoteByID(s.store, id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errQuoteNotFound.Error())
+		return
+	}
+	s.cdn.cacheable(w, false, q)
+	writeJSON(w, http.StatusOK, q)
+}
+
+// intParam reads an optional integer query parameter, writing a 400 and
+// returning false if it is malformed or outside [lo, hi].
+func intParam(w http.ResponseWriter, r *http.Request, name string, def, lo, hi int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		writeError(w, http.StatusBadRequest, name+" must be an integer between "+strconv.Itoa(lo)+" and "+strconv.Itoa(hi))
+		return 0, false
+	}
+	return n, true
+}
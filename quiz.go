@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	quizChoices  = 4
+	quizRoundTTL = 5 * time.Minute
+)
+
+// quiz runs the "Who said it?" game. Rounds live entirely in sealed tokens
+// so any replica can grade an answer, and players cannot read the answer
+// out of them; spent rounds and scores are kept in shared state.
+type quiz struct {
+	store  Store
+	secret []byte
+	state  stateStore
+}
+
+type quizScore struct {
+	Player   string `json:"player"`
+	Correct  int    `json:"correct"`
+	Answered int    `json:"answered"`
+}
+
+// quizRound is the payload carried inside a round token.
+type quizRound struct {
+	QuoteID int      `json:"q"`
+	Choices []string `json:"c"`
+	Expires int64    `json:"exp"`
+	Nonce   string   `json:"n"`
+}
+
+const (
+	quizSpentPrefix = "quiz:spent:"
+	quizCorrectKey  = "quiz:correct"
+	quizAnsweredKey = "quiz:answered"
+)
+
+func newQuiz(store Store, secret []byte, state stateStore) *quiz {
+	return &quiz{store: store, secret: secret, state: state}
+}
+
+// quizSecret reads the round sealing key from QUIZ_SECRET. Without it a
+// random key is generated, which only works when running a single replica.
+func quizSecret() []byte {
+	if s := os.Getenv("QUIZ_SECRET"); s != "" {
+		return []byte(s)
+	}
+	log.Println("QUIZ_SECRET not set; using a random key, quiz tokens will not work across replicas")
+	return []byte(randomString(32))
+}
+
+func (qz *quiz) newRoundHandler(w http.ResponseWriter, r *http.Request) {
+	quotes := qz.store.Quotes()
+	if len(quotes) == 0 {
+		writeError(w, http.StatusServiceUnavailable, "no quotes available")
+		return
+	}
+	q := quotes[rand.Intn(len(quotes))]
+
+	choices := append(qz.distractors(q, quotes, quizChoices-1), q.Author)
+	if len(choices) < 2 {
+		writeError(w, http.StatusServiceUnavailable, "not enough authors for a quiz round")
+		return
+	}
+	rand.Shuffle(len(choices), func(i, j int) { choices[i], choices[j] = choices[j], choices[i] })
+
+	expires := time.Now().Add(quizRoundTTL)
+	token, err := sealToken(qz.secret, quizRound{
+		QuoteID: q.ID,
+		Choices: choices,
+		Expires: expires.Unix(),
+		Nonce:   randomString(12),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "could not create round")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"token":      token,
+		"quote":      q.Text,
+		"choices":    choices,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// distractors picks up to n authors other than q's. Authors who share a tag
+// with q are preferred so the wrong answers are plausible.
+func (qz *quiz) distractors(q Quote, quotes []Quote, n int) []string {
+	var related, others []string
+	seen := map[string]bool{q.Author: true}
+	for _, c := range quotes {
+		if seen[c.Author] {
+			continue
+		}
+		seen[c.Author] = true
+		if sharesTag(q, c) {
+			related = append(related, c.Author)
+		} else {
+			others = append(others, c.Author)
+		}
+	}
+	rand.Shuffle(len(related), func(i, j int) { related[i], related[j] = related[j], related[i] })
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+
+	picked := append(related, others...)
+	if len(picked) > n {
+		picked = picked[:n]
+	}
+	return picked
+}
+
+func sharesTag(a, b Quote) bool {
+	for _, t := range a.Tags {
+		if slices.Contains(b.Tags, t) {
+			return true
+		}
+	}
+	return false
+}
+
+type quizAnswer struct {
+	Token  string `json:"token"`
+	Player string `json:"player"`
+	Answer string `json:"answer"`
+}
+
+func (qz *quiz) answerHandler(w http.ResponseWriter, r *http.Request) {
+	var req quizAnswer
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	player := strings.TrimSpace(req.Player)
+	if player == "" || len(player) > 32 {
+		writeError(w, http.StatusBadRequest, "player must be between 1 and 32 characters")
+		return
+	}
+
+	var round quizRound
+	if err := openToken(qz.secret, req.Token, &round); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid round token")
+		return
+	}
+	now := time.Now()
+	if now.Unix() > round.Expires {
+		writeError(w, http.StatusGone, "round has expired")
+		return
+	}
+	if !slices.Contains(round.Choices, req.Answer) {
+		writeError(w, http.StatusBadRequest, "answer must be one of the round's choices")
+		return
+	}
+	q, ok := quoteByID(qz.store, round.QuoteID)
+	if !ok {
+		writeError(w, http.StatusGone, "quote is no longer available")
+		return
+	}
+
+	correct := req.Answer == q.Author
+	score, ok, err := qz.record(r.Context(), round, player, correct, now)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusConflict, "round has already been answered")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"correct":  correct,
+		"author":   q.Author,
+		"quote_id": q.ID,
+		"score":    score,
+	})
+}
+
+// record marks the round as spent and updates the player's score. It
+// reports false if the round was already answered, on any replica.
+func (qz *quiz) record(ctx context.Context, round quizRound, player string, correct bool, now time.Time) (quizScore, bool, error) {
+	ttl := time.Unix(round.Expires, 0).Sub(now) + time.Second
+	if ok, err := qz.state.setNX(ctx, quizSpentPrefix+round.Nonce, "1", ttl); err != nil || !ok {
+		return quizScore{}, false, err
+	}
+	answered, err := qz.state.hincr(ctx, quizAnsweredKey, player, 1, 0)
+	if err != nil {
+		return quizScore{}, false, err
+	}
+	var point int64
+	if correct {
+		point = 1
+	}
+	right, err := qz.state.hincr(ctx, quizCorrectKey, player, point, 0)
+	if err != nil {
+		return quizScore{}, false, err
+	}
+	return quizScore{Player: player, Correct: int(right), Answered: int(answered)}, true, nil
+}
+
+func (qz *quiz) leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+
+	answered, err := qz.state.hgetAll(r.Context(), quizAnsweredKey)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	correct, err := qz.state.hgetAll(r.Context(), quizCorrectKey)
+	if err != nil {
+		stateError(w, err)
+		return
+	}
+	board := make([]quizScore, 0, len(answered))
+	for player, n := range answered {
+		s := quizScore{Player: player}
+		s.Answered, _ = strconv.Atoi(n)
+		s.Correct, _ = strconv.Atoi(correct[player])
+		board = append(board, s)
+	}
+
+	// Most correct answers first; fewer attempts break ties.
+	sort.Slice(board, func(i, j int) bool {
+		if board[i].Correct != board[j].Correct {
+			return board[i].Correct > board[j].Correct
+		}
+		if board[i].Answered != board[j].Answered {
+			return board[i].Answered < board[j].Answered
+		}
+		return board[i].Player < board[j].Player
+	})
+	if len(board) > limit {
+		board = board[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"leaderboard": board})
+}
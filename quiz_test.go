@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var quizQuotes = []Quote{
+	{ID: 1, Text: "Stay hungry, stay foolish.", Author: "Steve Jobs", Tags: []string{"life"}},
+	{ID: 2, Text: "Simplicity is prerequisite for reliability.", Author: "Edsger Dijkstra", Tags: []string{"software"}},
+	{ID: 3, Text: "Talk is cheap. Show me the code.", Author: "Linus Torvalds", Tags: []string{"software"}},
+	{ID: 4, Text: "Premature optimization is the root of all evil.", Author: "Donald Knuth", Tags: []string{"software"}},
+	{ID: 5, Text: "The best way out is always through.", Author: "Robert Frost", Tags: []string{"life"}},
+}
+
+// newQuizReplicas returns two quizzes sharing a secret and state, like two
+// pods configured alike.
+func newQuizReplicas() (*quiz, *quiz) {
+	store, state, secret := newMemoryStore(quizQuotes), newMemoryState(), []byte("test secret")
+	return newQuiz(store, secret, state), newQuiz(store, secret, state)
+}
+
+type quizRoundResponse struct {
+	Token   string   `json:"token"`
+	Quote   string   `json:"quote"`
+	Choices []string `json:"choices"`
+}
+
+func startRound(t *testing.T, qz *quiz) quizRoundResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	qz.newRoundHandler(w, httptest.NewRequest(http.MethodPost, "/v1/quiz/rounds", nil))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("new round: %d %s", w.Code, w.Body)
+	}
+	var round quizRoundResponse
+	json.NewDecoder(w.Body).Decode(&round)
+	return round
+}
+
+func answer(qz *quiz, a quizAnswer) (int, map[string]any) {
+	body, _ := json.Marshal(a)
+	w := httptest.NewRecorder()
+	qz.answerHandler(w, httptest.NewRequest(http.MethodPost, "/v1/quiz/answers", strings.NewReader(string(body))))
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+// authorOf returns who said text.
+func authorOf(text string) string {
+	for _, q := range quizQuotes {
+		if q.Text == text {
+			return q.Author
+		}
+	}
+	return ""
+}
+
+func TestQuizRoundTokenIsSealed(t *testing.T) {
+	a, _ := newQuizReplicas()
+	round := startRound(t, a)
+	if len(round.Choices) != quizChoices {
+		t.Errorf("round has %d choices, want %d", len(round.Choices), quizChoices)
+	}
+	author := authorOf(round.Quote)
+	if !strings.Contains(strings.Join(round.Choices, "|"), author) {
+		t.Errorf("choices %q do not include the author %q", round.Choices, author)
+	}
+	// The answer cannot be read out of the token.
+	raw, err := base64.RawURLEncoding.DecodeString(round.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), author) || strings.Contains(string(raw), `"q":`) {
+		t.Errorf("token %s carries its claims in the clear", round.Token)
+	}
+	var claims quizRound
+	if err := openToken([]byte("another secret"), round.Token, &claims); err == nil {
+		t.Error("openToken() with another secret = nil, want an error")
+	}
+
+	// Changing any part of the token breaks it.
+	forged := []byte(round.Token)
+	forged[len(forged)/2] ^= 1
+	if status, _ := answer(a, quizAnswer{Token: string(forged), Player: "ada", Answer: author}); status != http.StatusBadRequest {
+		t.Errorf("answer with a tampered token = %d, want 400", status)
+	}
+}
+
+func TestQuizSpentRounds(t *testing.T) {
+	a, b := newQuizReplicas()
+	round := startRound(t, a)
+	author := authorOf(round.Quote)
+
+	// A round started on one replica is answered on the other, once.
+	status, resp := answer(b, quizAnswer{Token: round.Token, Player: "ada", Answer: author})
+	if status != http.StatusOK || resp["correct"] != true {
+		t.Fatalf("answer = %d %v, want a correct answer", status, resp)
+	}
+	if status, _ := answer(a, quizAnswer{Token: round.Token, Player: "bob", Answer: author}); status != http.StatusConflict {
+		t.Errorf("answering a spent round = %d, want 409", status)
+	}
+
+	round = startRound(t, a)
+	if status, _ := answer(a, quizAnswer{Token: round.Token, Player: "ada", Answer: "Someone Else"}); status != http.StatusBadRequest {
+		t.Errorf("answer that is not a choice = %d, want 400", status)
+	}
+	if status, _ := answer(a, quizAnswer{Token: round.Token, Player: " ", Answer: author}); status != http.StatusBadRequest {
+		t.Errorf("answer without a player = %d, want 400", status)
+	}
+
+	// Expired rounds are refused, whether or not they were answered.
+	expired, err := sealToken(a.secret, quizRound{QuoteID: 1, Choices: []string{"Steve Jobs", "Robert Frost"}, Expires: time.Now().Add(-time.Second).Unix(), Nonce: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := answer(b, quizAnswer{Token: expired, Player: "ada", Answer: "Steve Jobs"}); status != http.StatusGone {
+		t.Errorf("answering an expired round = %d, want 410", status)
+	}
+}
+
+func TestQuizScoring(t *testing.T) {
+	a, b := newQuizReplicas()
+	play := func(qz *quiz, player string, right bool) {
+		t.Helper()
+		round := startRound(t, qz)
+		choice := authorOf(round.Quote)
+		if !right {
+			for _, c := range round.Choices {
+				if c != choice {
+					choice = c
+					break
+				}
+			}
+		}
+		if status, resp := answer(qz, quizAnswer{Token: round.Token, Player: player, Answer: choice}); status != http.StatusOK || resp["correct"] != right {
+			t.Fatalf("answer = %d %v, want correct=%v", status, resp, right)
+		}
+	}
+	// ada: 2 of 2. bob: 2 of 3. cy: 0 of 1. dee: 2 of 2, sorted after ada.
+	play(a, "ada", true)
+	play(b, "ada", true)
+	play(a, "bob", true)
+	play(b, "bob", false)
+	play(a, "bob", true)
+	play(b, "cy", false)
+	play(a, "dee", true)
+	play(b, "dee", true)
+
+	w := httptest.NewRecorder()
+	b.leaderboardHandler(w, httptest.NewRequest(http.MethodGet, "/v1/quiz/leaderboard?limit=3", nil))
+	var resp struct {
+		Leaderboard []quizScore `json:"leaderboard"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	want := []quizScore{{"ada", 2, 2}, {"dee", 2, 2}, {"bob", 2, 3}}
+	if len(resp.Leaderboard) != len(want) {
+		t.Fatalf("leaderboard = %+v, want %+v", resp.Leaderboard, want)
+	}
+	for i := range want {
+		if resp.Leaderboard[i] != want[i] {
+			t.Errorf("leaderboard[%d] = %+v, want %+v", i, resp.Leaderboard[i], want[i])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	b.leaderboardHandler(w, httptest.NewRequest(http.MethodGet, "/v1/quiz/leaderboard?limit=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("leaderboard?limit=0 = %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Quote is a single attributed quote in the corpus.
+type Quote struct {
+	ID        int        `json:"id"`
+	Text      string     `json:"text"`
+	Author    string     `json:"author"`
+	Tags      []string   `json:"tags,omitempty"`
+	Status    string     `json:"status,omitempty"`
+	PublishAt *time.Time `json:"publish_at,omitempty" yaml:"publish_at"`
+}
+
+// visible reports whether q may be served to readers at now: it is
+// published, or scheduled and its publish_at has passed. Quotes without a
+// status predate the editorial workflow and count as published.
+func (q Quote) visible(now time.Time) bool {
+	switch q.Status {
+	case "", statusPublished:
+		return q.PublishAt == nil || !q.PublishAt.After(now)
+	case statusScheduled:
+		return q.PublishAt != nil && !q.PublishAt.After(now)
+	}
+	return false
+}
+
+// String renders the quote in the "text - author" form used by the random endpoint.
+func (q Quote) String() string {
+	return q.Text + " - " + q.Author
+}
+
+// Store is the source of quotes served by the API.
+type Store interface {
+	// Quotes returns the quotes currently visible to readers. Callers must
+	// not modify the slice.
+	Quotes() []Quote
+}
+
+// editableStore is implemented by stores that support the editorial
+// workflow.
+type editableStore interface {
+	Store
+	// AllQuotes returns every quote regardless of status.
+	AllQuotes() []Quote
+	// Create stores q under a new ID and returns it.
+	Create(q Quote) (Quote, error)
+	// Update applies fn to the quote with the given ID. If fn returns an
+	// error the quote is left unchanged.
+	Update(id int, fn func(*Quote) error) (Quote, error)
+}
+
+// quoteRanger is implemented by stores that can hand out their visible
+// quotes one at a time, so streaming the corpus does not copy it.
+type quoteRanger interface {
+	// RangeQuotes calls fn for each visible quote in order until fn
+	// returns false.
+	RangeQuotes(fn func(Quote) bool)
+}
+
+// rangeQuotes calls fn for each of the store's visible quotes until fn
+// returns false.
+func rangeQuotes(store Store, fn func(Quote) bool) {
+	if qr, ok := store.(quoteRanger); ok {
+		qr.RangeQuotes(fn)
+		return
+	}
+	for _, q := range store.Quotes() {
+		if !fn(q) {
+			return
+		}
+	}
+}
+
+// changeNotifier is implemented by stores that announce changes as they
+// happen, so dependants need not wait for their next poll.
+type changeNotifier interface {
+	Subscribe(fn func())
+}
+
+var errQuoteNotFound = errors.New("quote not found")
+
+// memoryStore keeps quotes in memory. Edits are lost on restart.
+type memoryStore struct {
+	mu        sync.RWMutex
+	quotes    []Quote
+	nextID    int
+	listeners []func()
+}
+
+func newMemoryStore(quotes []Quote) *memoryStore {
+	s := &memoryStore{nextID: 1}
+	for _, q := range quotes {
+		if q.Status == "" {
+			q.Status = statusPublished
+		}
+		s.quotes = append(s.quotes, q)
+		s.nextID = max(s.nextID, q.ID+1)
+	}
+	return s
+}
+
+func (s *memoryStore) Quotes() []Quote {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	visible := make([]Quote, 0, len(s.quotes))
+	for _, q := range s.quotes {
+		if q.visible(now) {
+			visible = append(visible, q)
+		}
+	}
+	return visible
+}
+
+// RangeQuotes copies quotes out a chunk at a time, so a slow consumer never
+// holds the lock while it works.
+func (s *memoryStore) RangeQuotes(fn func(Quote) bool) {
+	chunk := make([]Quote, 256)
+	now := time.Now()
+	for i := 0; ; {
+		s.mu.RLock()
+		n := copy(chunk, s.quotes[min(i, len(s.quotes)):])
+		s.mu.RUnlock()
+		if n == 0 {
+			return
+		}
+		i += n
+		for _, q := range chunk[:n] {
+			if q.visible(now) && !fn(q) {
+				return
+			}
+		}
+	}
+}
+
+func (s *memoryStore) AllQuotes() []Quote {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Quote(nil), s.quotes...)
+}
+
+func (s *memoryStore) Create(q Quote) (Quote, error) {
+	s.mu.Lock()
+	q.ID = s.nextID
+	s.nextID++
+	s.quotes = append(s.quotes, q)
+	s.mu.Unlock()
+	s.notify()
+	return q, nil
+}
+
+func (s *memoryStore) Update(id int, fn func(*Quote) error) (Quote, error) {
+	q, err := s.update(id, fn)
+	if err == nil {
+		s.notify()
+	}
+	return q, err
+}
+
+func (s *memoryStore) update(id int, fn func(*Quote) error) (Quote, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.quotes {
+		if s.quotes[i].ID != id {
+			continue
+		}
+		q := s.quotes[i]
+		q.Tags = append([]string(nil), q.Tags...)
+		if err := fn(&q); err != nil {
+			return Quote{}, err
+		}
+		s.quotes[i] = q
+		return q, nil
+	}
+	return Quote{}, errQuoteNotFound
+}
+
+func (s *memoryStore) Subscribe(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+func (s *memoryStore) notify() {
+	s.mu.RLock()
+	listeners := append([]func(){}, s.listeners...)
+	s.mu.RUnlock()
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+// quoteByID looks up a quote by its ID.
+func quoteByID(store Store, id int) (Quote, bool) {
+	for _, q := range store.Quotes() {
+		if q.ID == id {
+			return q, true
+		}
+	}
+	return Quote{}, false
+}
+
+// seedQuotes is the built-in corpus. Add new quotes here.
+var seedQuotes = []Quote{
+	{ID: 1, Text: "The only way to do great work is to love what you do.", Author: "Steve Jobs", Tags: []string{"work", "passion"}},
+	{ID: 2, Text: "The future belongs to those who believe in the beauty of their dreams.", Author: "Eleanor Roosevelt", Tags: []string{"dreams", "future"}},
+	{ID: 3, Text: "It does not matter how slowly you go as long as you do not stop.", Author: "Confucius", Tags: []string{"perseverance"}},
+	{ID: 4, Text: "Success is not final, failure is not fatal: it is the courage to continue that counts.", Author: "Winston Churchill", Tags: []string{"success", "perseverance", "courage"}},
+	{ID: 5, Text: "Believe you can and you're halfway there.", Author: "Theodore Roosevelt", Tags: []string{"belief", "success"}},
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Default header values. HTML pages get a policy that only runs scripts and
+// styles served by us or carrying the request's nonce; everything else is
+// data and may load nothing at all.
+const (
+	defaultHTMLPolicy        = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; img-src 'self' data:; object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+	defaultAPIPolicy         = "default-src 'none'; frame-ancestors 'none'"
+	defaultReferrerPolicy    = "no-referrer"
+	defaultPermissionsPolicy = "camera=(), microphone=(), geolocation=(), payment=(), usb=(), browsing-topics=()"
+	maxURLLength             = 4096
+)
+
+// securityConfig holds the headers added to every response and the hosts
+// requests may be addressed to.
+type securityConfig struct {
+	htmlPolicy        string // {nonce} is replaced with the request's nonce
+	apiPolicy         string
+	hsts              string // empty to leave HSTS off
+	referrerPolicy    string
+	permissionsPolicy string
+	coop, corp        string
+	allowedHosts      []string // empty to accept any host
+}
+
+// securityFromEnv reads the configuration. Each header can be overridden
+// with its own variable, and set to "off" to leave it out.
+func securityFromEnv() *securityConfig {
+	get := func(name, def string) string {
+		v, ok := os.LookupEnv(name)
+		switch {
+		case !ok:
+			return def
+		case v == "off":
+			return ""
+		}
+		return v
+	}
+	c := &securityConfig{
+		htmlPolicy:        get("CSP_HTML", defaultHTMLPolicy),
+		apiPolicy:         get("CSP_API", defaultAPIPolicy),
+		hsts:              get("HSTS", ""),
+		referrerPolicy:    get("REFERRER_POLICY", defaultReferrerPolicy),
+		permissionsPolicy: get("PERMISSIONS_POLICY", defaultPermissionsPolicy),
+		coop:              get("CROSS_ORIGIN_OPENER_POLICY", "same-origin"),
+		corp:              get("CROSS_ORIGIN_RESOURCE_POLICY", "same-origin"),
+	}
+	for _, h := range strings.Split(os.Getenv("ALLOWED_HOSTS"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			c.allowedHosts = append(c.allowedHosts, h)
+		}
+	}
+	return c
+}
+
+type nonceKey struct{}
+
+// cspNonce returns the nonce that inline scripts and styles on an HTML page
+// must carry to run.
+func cspNonce(r *http.Request) string {
+	n, _ := r.Context().Value(nonceKey{}).(string)
+	return n
+}
+
+// hostAllowed reports whether host, without a port, is one of the allowed
+// hosts. An entry of "*.example.com" matches any subdomain.
+func (c *securityConfig) hostAllowed(host string) bool {
+	if len(c.allowedHosts) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1] // an IPv6 literal without a port
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, a := range c.allowedHosts {
+		if a == host || strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequest rejects requests no handler should see. It returns the
+// status and message to send, or 0 if the request is fine.
+func (c *securityConfig) checkRequest(r *http.Request) (int, string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		return http.StatusNotImplemented, "method not supported"
+	}
+	if len(r.RequestURI) > maxURLLength {
+		return http.StatusRequestURITooLong, "URL too long"
+	}
+	// Prometheus scrapes pods by IP, so metrics are exempt from host checks.
+	if r.URL.Path != "/metrics" && !c.hostAllowed(r.Host) {
+		return http.StatusMisdirectedRequest, "unknown host"
+	}
+	path, raw := r.URL.Path, r.URL.EscapedPath()
+	if !strings.HasPrefix(path, "/") || !utf8.ValidString(path) {
+		return http.StatusBadRequest, "malformed path"
+	}
+	for _, ch := range path {
+		if ch < 0x20 || ch == 0x7f || ch == '\\' {
+			return http.StatusBadRequest, "malformed path"
+		}
+	}
+	// Encoded separators and dot segments are how traversal attempts get
+	// past path-based rules, and no route uses them.
+	lower := strings.ToLower(raw)
+	if strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c") || strings.Contains(lower, "%2e") {
+		return http.StatusBadRequest, "encoded separators are not allowed in the path"
+	}
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "." || seg == ".." {
+			return http.StatusBadRequest, "dot segments are not allowed in the path"
+		}
+	}
+	if _, err := url.ParseQuery(r.URL.RawQuery); err != nil {
+		return http.StatusBadRequest, "malformed query string"
+	}
+	return 0, ""
+}
+
+// wrap validates requests and adds the security headers to every response.
+func (c *securityConfig) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := randomString(16)
+		sw := &securityWriter{ResponseWriter: w, config: c, nonce: nonce}
+		if status, msg := c.checkRequest(r); status != 0 {
+			writeError(sw, status, msg)
+			return
+		}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce)))
+	})
+}
+
+// securityWriter adds the headers when the response starts, once the
+// content type is known, so HTML and data get different policies.
+type securityWriter struct {
+	http.ResponseWriter
+	config      *securityConfig
+	nonce       string
+	wroteHeader bool
+}
+
+func (w *securityWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		c, h := w.config, w.Header()
+		policy := c.apiPolicy
+		if strings.HasPrefix(h.Get("Content-Type"), "text/html") {
+			policy = strings.ReplaceAll(c.htmlPolicy, "{nonce}", w.nonce)
+		}
+		for name, v := range map[string]string{
+			"Content-Security-Policy":      policy,
+			"Strict-Transport-Security":    c.hsts,
+			"Referrer-Policy":              c.referrerPolicy,
+			"Permissions-Policy":           c.permissionsPolicy,
+			"Cross-Origin-Opener-Policy":   c.coop,
+			"Cross-Origin-Resource-Policy": c.corp,
+		} {
+			if v != "" && h.Get(name) == "" {
+				h.Set(name, v)
+			}
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *securityWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, for
+// flushing and deadlines.
+func (w *securityWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *securityWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestHostAllowed(t *testing.T) {
+	c := &securityConfig{allowedHosts: []string{"api.example.com", "*.example.org", "::1"}}
+	for host, want := range map[string]bool{
+		"api.example.com":      true,
+		"API.Example.COM.":     true,
+		"api.example.com:8443": true,
+		"x.example.org":        true,
+		"a.b.example.org:80":   true,
+		"[::1]:8080":           true,
+		"[::1]":                true,
+		"example.org":          false,
+		"evilexample.org":      false,
+		"example.com":          false,
+		"api.example.com.evil": false,
+		"":                     false,
+	} {
+		if got := c.hostAllowed(host); got != want {
+			t.Errorf("hostAllowed(%q) = %v, want %v", host, got, want)
+		}
+	}
+	if !(&securityConfig{}).hostAllowed("anything.test") {
+		t.Error("hostAllowed() without ALLOWED_HOSTS refused a host")
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	c := &securityConfig{allowedHosts: []string{"api.example.com"}}
+	tests := []struct {
+		method, target string
+		want           int
+	}{
+		{"GET", "/v1/quotes?tag=life", 0},
+		{"GET", "/caf%C3%A9", 0},
+		{"GET", "/v1/quotes/...", 0},
+		{"TRACE", "/", http.StatusNotImplemented},
+		{"GET", "/" + strings.Repeat("a", maxURLLength), http.StatusRequestURITooLong},
+		{"GET", "/v1/../v1/admin/keys", http.StatusBadRequest},
+		{"GET", "/v1/./quotes", http.StatusBadRequest},
+		{"GET", "/v1/%2e%2e/admin", http.StatusBadRequest},
+		{"GET", "/v1/.%2E/admin", http.StatusBadRequest},
+		{"GET", "/v1/admin%2Fkeys", http.StatusBadRequest},
+		{"GET", "/v1%5cadmin", http.StatusBadRequest},
+		{"GET", "/v1/quotes%00", http.StatusBadRequest},
+		{"GET", "/v1/quotes%0d%0a", http.StatusBadRequest},
+		{"GET", "/v1/quotes%7f", http.StatusBadRequest},
+		{"GET", "/%ff", http.StatusBadRequest},
+		{"GET", "/v1/quotes?q=%zz", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://api.example.com"+tt.target, nil)
+		if got, msg := c.checkRequest(r); got != tt.want {
+			t.Errorf("%s %s = %d %q, want %d", tt.method, tt.target, got, msg, tt.want)
+		}
+	}
+
+	// A backslash cannot be sent unencoded in a URL, but may still reach
+	// the handler through a client that does not escape it.
+	r := httptest.NewRequest("GET", "http://api.example.com/", nil)
+	r.URL.Path = `/v1\admin`
+	if got, _ := c.checkRequest(r); got != http.StatusBadRequest {
+		t.Errorf("path with a backslash = %d, want 400", got)
+	}
+
+	// Metrics are scraped by pod IP, so their host is not checked.
+	for target, want := range map[string]int{"/metrics": 0, "/v1/quotes": http.StatusMisdirectedRequest} {
+		r := httptest.NewRequest("GET", "http://10.0.0.7:8080"+target, nil)
+		if got, _ := c.checkRequest(r); got != want {
+			t.Errorf("GET %s by IP = %d, want %d", target, got, want)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	t.Setenv("HSTS", "max-age=63072000")
+	t.Setenv("REFERRER_POLICY", "off")
+	t.Setenv("ALLOWED_HOSTS", " API.example.com ,")
+	c := securityFromEnv()
+	if len(c.allowedHosts) != 1 || c.allowedHosts[0] != "api.example.com" {
+		t.Errorf("ALLOWED_HOSTS read as %q", c.allowedHosts)
+	}
+
+	var nonces []string
+	h := c.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/portal/":
+			nonces = append(nonces, cspNonce(r))
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(`<script nonce="` + cspNonce(r) + `"></script>`))
+		case "/framed":
+			w.Header().Set("Content-Security-Policy", "frame-ancestors 'self'")
+			w.Write([]byte("{}"))
+		default:
+			w.Write([]byte(`{"ok": true}`))
+		}
+	}))
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com"+target, nil))
+		return w
+	}
+
+	// Each HTML page's policy carries the nonce its handler was given.
+	nonceSource := regexp.MustCompile(`script-src 'self' 'nonce-([^']+)'; style-src 'self' 'nonce-([^']+)'`)
+	for i := 0; i < 2; i++ {
+		w := serve("/portal/")
+		m := nonceSource.FindStringSubmatch(w.Header().Get("Content-Security-Policy"))
+		if m == nil || m[1] != nonces[i] || m[2] != nonces[i] || strings.Contains(w.Header().Get("Content-Security-Policy"), "{nonce}") {
+			t.Fatalf("HTML policy %q does not carry the page's nonce %q", w.Header().Get("Content-Security-Policy"), nonces[i])
+		}
+		if !strings.Contains(w.Body.String(), `nonce="`+nonces[i]+`"`) {
+			t.Errorf("page body %q does not carry the nonce", w.Body)
+		}
+	}
+	if nonces[0] == "" || nonces[0] == nonces[1] {
+		t.Errorf("nonces %q, want a fresh one per request", nonces)
+	}
+
+	w := serve("/v1/quotes")
+	if got := w.Header().Get("Content-Security-Policy"); got != defaultAPIPolicy {
+		t.Errorf("API response policy = %q, want %q", got, defaultAPIPolicy)
+	}
+	if w.Header().Get("Strict-Transport-Security") != "max-age=63072000" || w.Header().Get("Referrer-Policy") != "" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("API response headers = %v", w.Header())
+	}
+	if got := serve("/framed").Header().Get("Content-Security-Policy"); got != "frame-ancestors 'self'" {
+		t.Errorf("handler's own policy replaced with %q", got)
+	}
+
+	// Refused requests get the headers too.
+	w = serve("/v1/%2e%2e/admin")
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Security-Policy") != defaultAPIPolicy {
+		t.Errorf("refused request = %d with headers %v", w.Code, w.Header())
+	}
+}
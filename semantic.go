@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// embedder turns texts into vectors for semantic search.
+type embedder interface {
+	Name() string
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// newEmbedder picks the embedder from EMBEDDER: "hash" (the default) or
+// "http" for an OpenAI-compatible embeddings API at EMBEDDER_URL.
+func newEmbedder() (embedder, error) {
+	switch kind := os.Getenv("EMBEDDER"); kind {
+	case "", "hash":
+		return hashEmbedder{dim: 512}, nil
+	case "http":
+		url := os.Getenv("EMBEDDER_URL")
+		if url == "" {
+			return nil, fmt.Errorf("EMBEDDER_URL is required when EMBEDDER=http")
+		}
+		return &httpEmbedder{
+			url:    url,
+			model:  os.Getenv("EMBEDDER_MODEL"),
+			apiKey: os.Getenv("EMBEDDER_API_KEY"),
+			client: &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown EMBEDDER %q", kind)
+	}
+}
+
+// hashEmbedder is an offline lexical embedder. It hashes words and
+// character trigrams into a fixed number of buckets, so related word forms
+// ("stop", "stopping") land close together. It does not know synonyms.
+type hashEmbedder struct {
+	dim int
+}
+
+func (e hashEmbedder) Name() string { return "hash" }
+
+func (e hashEmbedder) Embed(_ context.Context, texts []string) ([][]float32, error) {
+	out := make([][]float32, len(texts))
+	for i, t := range texts {
+		out[i] = e.embed(t)
+	}
+	return out, nil
+}
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"do": true, "does": true, "for": true, "from": true, "in": true, "is": true, "it": true, "its": true,
+	"of": true, "on": true, "or": true, "that": true, "the": true, "their": true, "this": true, "those": true,
+	"to": true, "was": true, "what": true, "who": true, "with": true, "you": true, "your": true,
+}
+
+func (e hashEmbedder) embed(text string) []float32 {
+	vec := make([]float32, e.dim)
+	add := func(feature string, weight float32) {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+		// One hash picks the bucket and an independent bit its sign, which
+		// keeps collisions from systematically inflating similarity.
+		if sum>>63 == 1 {
+			weight = -weight
+		}
+		vec[sum%uint64(e.dim)] += weight
+	}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '\'' || r > 127)
+	}) {
+		word = strings.Trim(word, "'")
+		if word == "" || stopWords[word] {
+			continue
+		}
+		add("w:"+word, 1)
+		padded := "^" + word + "$"
+		for i := 0; i+3 <= len(padded); i++ {
+			add("t:"+padded[i:i+3], 0.4)
+		}
+	}
+	return vec
+}
+
+// httpEmbedder calls an OpenAI-compatible /embeddings endpoint.
+type httpEmbedder struct {
+	url, model, apiKey string
+	client             *http.Client
+}
+
+func (e *httpEmbedder) Name() string { return "http" }
+
+func (e *httpEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]any{"model": e.model, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embedding service returned %s", resp.Status)
+	}
+	var decoded struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, err
+	}
+	if len(decoded.Data) != len(texts) {
+		return nil, fmt.Errorf("embedding service returned %d vectors for %d texts", len(decoded.Data), len(texts))
+	}
+	out := make([][]float32, len(texts))
+	for i, d := range decoded.Data {
+		out[i] = d.Embedding
+	}
+	return out, nil
+}
+
+// semanticSearch keeps an HNSW index of the store's quotes, rebuilding it
+// when the content changes. Embeddings are cached by text so a rebuild only
+// embeds new or edited quotes.
+type semanticSearch struct {
+	store    Store
+	embedder embedder
+	content  *contentTracker
+
+	// build serialises rebuilds. mu guards the fields below and is never
+	// held while the embedder is called, so searches against the current
+	// index carry on during a rebuild.
+	build   sync.Mutex
+	mu      sync.Mutex
+	version string
+	index   *hnswIndex
+	dim     int
+	quotes  map[int]Quote
+	cache   map[string][]float32
+}
+
+func newSemanticSearch(store Store, e embedder) *semanticSearch {
+	return &semanticSearch{store: store, embedder: e, content: newContentTracker(store), cache: make(map[string][]float32)}
+}
+
+// contentVersion identifies the store's currently visible content: its
+// revision, when it has one, plus the visible quote IDs, since a scheduled
+// quote goes live without a new revision; otherwise a hash of every
+// visible quote.
+func contentVersion(store Store) string {
+	h := fnv.New64a()
+	rs, ok := store.(revisioner)
+	rangeQuotes(store, func(q Quote) bool {
+		if ok {
+			fmt.Fprintf(h, "%d\x00", q.ID)
+		} else {
+			fmt.Fprintf(h, "%d\x00%s\x00%s\x00", q.ID, q.Text, q.Author)
+		}
+		return true
+	})
+	v := strconv.FormatUint(h.Sum64(), 16)
+	if ok {
+		return rs.Revision() + ":" + v
+	}
+	return v
+}
+
+// contentVersionTTL bounds how long a cached content version is trusted.
+// A scheduled quote going live is not announced, so this is how long one
+// can take to reach the index and the chains.
+const contentVersionTTL = time.Second
+
+// contentTracker caches contentVersion so that requests do not each walk
+// the corpus. The version is recomputed after the store announces a
+// change, or once it is contentVersionTTL old.
+type contentTracker struct {
+	store   Store
+	changed atomic.Bool
+
+	mu       sync.Mutex
+	version  string
+	computed time.Time
+}
+
+func newContentTracker(store Store) *contentTracker {
+	t := &contentTracker{store: store}
+	if n, ok := store.(changeNotifier); ok {
+		n.Subscribe(func() { t.changed.Store(true) })
+	}
+	return t
+}
+
+// current returns the store's content version. Concurrent callers wait for
+// a single walk rather than each making their own.
+func (t *contentTracker) current() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.changed.Swap(false) || t.computed.IsZero() || time.Since(t.computed) >= contentVersionTTL {
+		t.version, t.computed = contentVersion(t.store), time.Now()
+	}
+	return t.version
+}
+
+// search returns up to k quotes most similar to query with a score of at
+// least minScore.
+func (s *semanticSearch) search(ctx context.Context, query string, k int, minScore float64) ([]hnswResult, map[int]Quote, error) {
+	index, quotes, dim, err := s.current(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	vecs, err := s.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkVectors(vecs, 1, dim); err != nil {
+		return nil, nil, err
+	}
+	var results []hnswResult
+	for _, r := range index.search(vecs[0], k, 64) {
+		if r.score >= minScore {
+			results = append(results, r)
+		}
+	}
+	return results, quotes, nil
+}
+
+// current returns an index of the store's current content, rebuilding it
+// first if the content has changed. A built index is never modified, so
+// callers may search it without holding a lock.
+func (s *semanticSearch) current(ctx context.Context) (*hnswIndex, map[int]Quote, int, error) {
+	v := s.content.current()
+	fresh := func() (*hnswIndex, map[int]Quote, int, bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.index, s.quotes, s.dim, s.index != nil && s.version == v
+	}
+	if index, quotes, dim, ok := fresh(); ok {
+		return index, quotes, dim, nil
+	}
+
+	s.build.Lock()
+	defer s.build.Unlock()
+	// Another request may have rebuilt the index while this one waited.
+	if index, quotes, dim, ok := fresh(); ok {
+		return index, quotes, dim, nil
+	}
+	if err := s.rebuild(ctx, v); err != nil {
+		return nil, nil, 0, err
+	}
+	index, quotes, dim, _ := fresh()
+	return index, quotes, dim, nil
+}
+
+// rebuild indexes the store's quotes as content version v. The caller must
+// hold s.build.
+func (s *semanticSearch) rebuild(ctx context.Context, v string) error {
+	quotes := s.store.Quotes()
+	s.mu.Lock()
+	cache, dim := s.cache, s.dim
+	s.mu.Unlock()
+
+	var missing []string
+	for _, q := range quotes {
+		if _, ok := cache[q.Text]; !ok {
+			missing = append(missing, q.Text)
+		}
+	}
+	var vecs [][]float32
+	if len(missing) > 0 {
+		var err error
+		if vecs, err = s.embedder.Embed(ctx, missing); err != nil {
+			return fmt.Errorf("embedding quotes: %w", err)
+		}
+		if err := checkVectors(vecs, len(missing), 0); err != nil {
+			return fmt.Errorf("embedding quotes: %w", err)
+		}
+		if dim != 0 && len(vecs[0]) != dim {
+			// The embedding model changed under us. Start afresh next time
+			// rather than mixing vectors from two models.
+			s.mu.Lock()
+			s.cache = make(map[string][]float32)
+			s.mu.Unlock()
+			return fmt.Errorf("embedding quotes: got %d-dimensional vectors, cached ones have %d", len(vecs[0]), dim)
+		}
+		dim = len(vecs[0])
+	}
+
+	index := newHNSWIndex(16, 200)
+	byID := make(map[int]Quote, len(quotes))
+	live := make(map[string][]float32, len(quotes))
+	for i, t := range missing {
+		live[t] = vecs[i]
+	}
+	for _, q := range quotes {
+		vec, ok := live[q.Text]
+		if !ok {
+			vec = cache[q.Text]
+			live[q.Text] = vec
+		}
+		index.insert(q.ID, vec)
+		byID[q.ID] = q
+	}
+
+	s.mu.Lock()
+	s.index, s.quotes, s.cache, s.dim, s.version = index, byID, live, dim, v
+	s.mu.Unlock()
+	log.Printf("semantic: indexed %d quotes with the %s embedder", index.len(), s.embedder.Name())
+	return nil
+}
+
+// checkVectors reports an error unless vecs holds n non-empty vectors of
+// one dimension, which must be dim if that is positive. The index cannot
+// compare vectors of different dimensions.
+func checkVectors(vecs [][]float32, n, dim int) error {
+	if len(vecs) != n {
+		return fmt.Errorf("embedder returned %d vectors for %d texts", len(vecs), n)
+	}
+	if dim <= 0 && n > 0 {
+		dim = len(vecs[0])
+	}
+	for _, v := range vecs {
+		if len(v) == 0 || len(v) != dim {
+			return fmt.Errorf("embedder returned a %d-dimensional vector, want %d", len(v), dim)
+		}
+	}
+	return nil
+}
+
+type semanticResult struct {
+	Quote Quote   `json:"quote"`
+	Score float64 `json:"score"`
+}
+
+// semanticHandler serves GET /v1/quotes/semantic?q=.
+func (s *server) semanticHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	limit, ok := intParam(w, r, "limit", 10, 1, 100)
+	if !ok {
+		return
+	}
+	minScore := 0.1
+	if v := r.URL.Query().Get("min_score"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < -1 || f > 1 {
+			writeError(w, http.StatusBadRequest, "min_score must be a number between -1 and 1")
+			return
+		}
+		minScore = f
+	}
+
+	found, quotes, err := s.semantic.search(r.Context(), query, limit, minScore)
+	if err != nil {
+		log.Printf("semantic search: %v", err)
+		writeError(w, http.StatusServiceUnavailable, "semantic search is unavailable")
+		return
+	}
+	results := make([]semanticResult, 0, len(found))
+	matched := make([]Quote, 0, len(found))
+	for _, f := range found {
+		results = append(results, semanticResult{Quote: quotes[f.id], Score: f.score})
+		matched = append(matched, quotes[f.id])
+	}
+	s.cdn.cacheable(w, true, matched...)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"results":  results,
+		"embedder": s.semantic.embedder.Name(),
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashEmbedder(t *testing.T) {
+	e := hashEmbedder{dim: 512}
+	embed := func(text string) []float32 {
+		vecs, err := e.Embed(context.Background(), []string{text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vecs) != 1 || len(vecs[0]) != e.dim {
+			t.Fatalf("Embed(%q) returned %d vectors", text, len(vecs))
+		}
+		return vecs[0]
+	}
+	sim := func(a, b string) float64 { return dot(normalize(embed(a)), normalize(embed(b))) }
+
+	if !reflect.DeepEqual(embed("Keep going."), embed("keep GOING")) {
+		t.Error("embedding depends on case or punctuation")
+	}
+	if v := embed("the and of to"); !reflect.DeepEqual(v, make([]float32, e.dim)) {
+		t.Error("stop words contribute to the embedding")
+	}
+	// Trigrams bring related forms of a word closer than unrelated words.
+	if related, unrelated := sim("stopping", "stop"), sim("stopping", "banana"); related <= unrelated+0.15 {
+		t.Errorf("similarity of stopping to stop = %.2f, to banana = %.2f", related, unrelated)
+	}
+	if s := sim("courage to continue", "the courage to continue"); s < 0.999 {
+		t.Errorf("similarity with an added stop word = %.3f, want 1", s)
+	}
+}
+
+func TestHTTPEmbedder(t *testing.T) {
+	var got struct {
+		Model string   `json:"model"`
+		Input []string `json:"input"`
+	}
+	var auth string
+	vectors := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+		if got.Model == "broken" {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		data := make([]map[string]any, vectors)
+		for i := range data {
+			data[i] = map[string]any{"embedding": []float32{float32(i), 1}}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+	defer srv.Close()
+
+	t.Setenv("EMBEDDER", "http")
+	t.Setenv("EMBEDDER_URL", srv.URL)
+	t.Setenv("EMBEDDER_MODEL", "small")
+	t.Setenv("EMBEDDER_API_KEY", "sk-test")
+	e, err := newEmbedder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vecs, err := e.Embed(context.Background(), []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vecs, [][]float32{{0, 1}, {1, 1}}) {
+		t.Errorf("Embed() = %v", vecs)
+	}
+	if got.Model != "small" || !reflect.DeepEqual(got.Input, []string{"a", "b"}) || auth != "Bearer sk-test" {
+		t.Errorf("service was sent model %q, input %q and Authorization %q", got.Model, got.Input, auth)
+	}
+
+	vectors = 1
+	if _, err := e.Embed(context.Background(), []string{"a", "b"}); err == nil {
+		t.Error("Embed() accepted too few vectors")
+	}
+	e.(*httpEmbedder).model = "broken"
+	if _, err := e.Embed(context.Background(), []string{"a"}); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Embed() of a failing service = %v, want its status", err)
+	}
+
+	t.Setenv("EMBEDDER_URL", "")
+	if _, err := newEmbedder(); err == nil {
+		t.Error("newEmbedder() accepted EMBEDDER=http without a URL")
+	}
+	t.Setenv("EMBEDDER", "magic")
+	if _, err := newEmbedder(); err == nil {
+		t.Error("newEmbedder() accepted an unknown embedder")
+	}
+}
+
+// countingEmbedder counts the texts it is asked to embed.
+type countingEmbedder struct {
+	hashEmbedder
+	texts int
+}
+
+func (e *countingEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.texts += len(texts)
+	return e.hashEmbedder.Embed(ctx, texts)
+}
+
+func TestSemanticSearch(t *testing.T) {
+	store := newMemoryStore(seedQuotes)
+	e := &countingEmbedder{hashEmbedder: hashEmbedder{dim: 512}}
+	s := newSemanticSearch(store, e)
+
+	results, quotes, err := s.search(context.Background(), "keep going slowly, never stopping", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || quotes[results[0].id].Author != "Confucius" {
+		t.Errorf("search() = %v, want the Confucius quote first", results)
+	}
+	if e.texts != len(seedQuotes)+1 {
+		t.Errorf("embedded %d texts, want every quote and the query", e.texts)
+	}
+
+	// An edit is picked up at once, and only the edited quote is embedded.
+	if _, err := store.Update(5, func(q *Quote) error { q.Text = "Bananas are a fine breakfast."; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	e.texts = 0
+	results, quotes, err = s.search(context.Background(), "banana breakfast", 1, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].id != 5 || !strings.HasPrefix(quotes[5].Text, "Bananas") {
+		t.Errorf("search() after an edit = %v, want the edited quote", results)
+	}
+	if e.texts != 2 {
+		t.Errorf("embedded %d texts after one edit, want the edited quote and the query", e.texts)
+	}
+	if results, _, _ := s.search(context.Background(), "zebra xylophone", 5, 0.5); len(results) != 0 {
+		t.Errorf("search() for unrelated words = %v, want nothing above the minimum score", results)
+	}
+}
+
+// rangeCountingStore counts walks over the corpus.
+type rangeCountingStore struct {
+	*memoryStore
+	walks int
+}
+
+func (s *rangeCountingStore) RangeQuotes(fn func(Quote) bool) {
+	s.walks++
+	s.memoryStore.RangeQuotes(fn)
+}
+
+func TestContentTracker(t *testing.T) {
+	store := &rangeCountingStore{memoryStore: newMemoryStore(seedQuotes)}
+	tr := newContentTracker(store)
+
+	v := tr.current()
+	for i := 0; i < 100; i++ {
+		if tr.current() != v {
+			t.Fatal("version changed without a change to the content")
+		}
+	}
+	if store.walks != 1 {
+		t.Errorf("walked the corpus %d times for 101 lookups, want once", store.walks)
+	}
+
+	// A change the store announces is seen at once.
+	store.Update(1, func(q *Quote) error { q.Author = "Anonymous"; return nil })
+	edited := tr.current()
+	if edited == v {
+		t.Error("version unchanged after an edit")
+	}
+
+	// A scheduled quote going live is not announced, so it is picked up
+	// once the cached version expires.
+	at := time.Now().Add(-time.Minute)
+	store.memoryStore.quotes = append(store.memoryStore.quotes, Quote{ID: 9, Text: "Later.", Author: "Ann", Status: statusScheduled, PublishAt: &at})
+	if tr.current() != edited {
+		t.Error("version recomputed before it expired")
+	}
+	tr.computed = tr.computed.Add(-contentVersionTTL)
+	if tr.current() == edited {
+		t.Error("version unchanged after a scheduled quote went live")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sudlo/quote-api/httpsig"
+)
+
+// signer adds Ed25519 HTTP Message Signatures to quote responses so
+// partners can prove they were not altered. A nil signer leaves responses
+// unsigned.
+type signer struct {
+	keys *httpsig.Keyring
+}
+
+// wrap signs every response produced by next with the active key. It sits
+// inside encodeRoute, so it signs the canonical JSON and the signature
+// holds whichever encoding the client asked for. Whole documents, which
+// are rendered in one go anyway, are signed in the headers; NDJSON streams
+// pass through line by line and are signed in the trailers.
+func (sg *signer) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if sg == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &signingWriter{ResponseWriter: w, key: sg.keys.Active(), digest: httpsig.NewDigester(), status: http.StatusOK}
+		next(sw, r)
+		sw.finish()
+	}
+}
+
+// signingWriter digests a response as it is written and signs it once the
+// handler returns.
+type signingWriter struct {
+	http.ResponseWriter
+	key    httpsig.Key
+	digest *httpsig.Digester
+
+	wroteHeader bool
+	stream      bool
+	status      int
+	body        bytes.Buffer // the document, or a stream's partial last line
+	failed      bool         // the body is not JSON and goes out unsigned
+}
+
+func (w *signingWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader, w.status = true, status
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.stream = mediaType == ndjsonType; w.stream {
+		w.Header().Set("Trailer", strings.Join(httpsig.TrailerFields, ", "))
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *signingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.stream {
+		return w.body.Write(p)
+	}
+	if !w.failed {
+		w.body.Write(p)
+		for i := bytes.IndexByte(w.body.Bytes(), '\n'); i >= 0 && !w.failed; i = bytes.IndexByte(w.body.Bytes(), '\n') {
+			w.add(w.body.Next(i + 1))
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *signingWriter) add(value []byte) {
+	if err := w.digest.Add(value); err != nil {
+		log.Printf("signing response: %v", err)
+		w.failed = true
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *signingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// Flush passes a stream's lines on; a document is only sent once signed.
+func (w *signingWriter) Flush() {
+	if w.stream {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *signingWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.stream {
+		if !w.failed {
+			w.add(w.body.Bytes())
+		}
+		w.sign(true)
+		return
+	}
+	w.add(w.body.Bytes())
+	w.sign(false)
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.body.Bytes())
+}
+
+func (w *signingWriter) sign(trailer bool) {
+	if w.failed {
+		return
+	}
+	if err := httpsig.SignResponse(w.Header(), w.status, w.digest.Sum(), trailer, w.key, time.Now()); err != nil {
+		log.Printf("signing response: %v", err)
+	}
+}
+
+// jwksHandler publishes the public keys at /.well-known/jwks.json.
+func (sg *signer) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, sg.keys.JWKS())
+}
+
+// reload picks up added, removed or rotated key files and a switched
+// active key every interval until ctx is done.
+func (sg *signer) reload(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := sg.keys.Reload(); err != nil {
+				log.Printf("signing keys: keeping previous keys: %v", err)
+			}
+		}
+	}
+}
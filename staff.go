@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// role is a staff member's level of access. Each role can do everything the
+// roles below it can.
+type role int
+
+const (
+	roleNone role = iota
+	roleContributor
+	roleEditor
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"contributor": roleContributor,
+	"editor":      roleEditor,
+	"admin":       roleAdmin,
+}
+
+func (r role) String() string {
+	for name, v := range roleNames {
+		if v == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// staffAuth maps bearer tokens to roles.
+type staffAuth struct {
+	tokens map[string]role
+}
+
+// staffFromEnv reads STAFF_TOKENS, a comma-separated list of token:role
+// pairs such as "s3cret:editor,0ther:admin".
+func staffFromEnv() (*staffAuth, error) {
+	a := &staffAuth{tokens: make(map[string]role)}
+	for _, pair := range strings.Split(os.Getenv("STAFF_TOKENS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		token, name, ok := strings.Cut(pair, ":")
+		r, known := roleNames[name]
+		if !ok || token == "" || !known {
+			return nil, fmt.Errorf("STAFF_TOKENS: invalid entry %q, want token:contributor|editor|admin", pair)
+		}
+		a.tokens[token] = r
+	}
+	return a, nil
+}
+
+// role returns the role granted by the request's bearer token.
+func (a *staffAuth) role(r *http.Request) role {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return roleNone
+	}
+	found := roleNone
+	for t, rl := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = rl
+		}
+	}
+	return found
+}
+
+// require only lets requests through whose token grants at least min.
+func (a *staffAuth) require(min role, next func(http.ResponseWriter, *http.Request, role)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rl := a.role(r)
+		if rl == roleNone {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "a staff token is required")
+			return
+		}
+		if rl < min {
+			writeError(w, http.StatusForbidden, "this action requires the "+min.String()+" role")
+			return
+		}
+		next(w, r, rl)
+	}
+}
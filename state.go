@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errStateUnavailable is reported to clients when shared state cannot be
+// reached, so requests that depend on it fail rather than skip the check.
+var errStateUnavailable = errors.New("service temporarily unavailable")
+
+// stateStore holds the state that every replica must agree on, such as
+// spent tokens, API keys, usage counters and daily quote commitments.
+// Keys are plain strings; a TTL of zero means the key never expires.
+type stateStore interface {
+	get(ctx context.Context, key string) (string, bool, error)
+	set(ctx context.Context, key, value string, ttl time.Duration) error
+	// setNX sets key only if it does not exist yet, and reports whether it
+	// did. It is how one-time things are claimed across replicas.
+	setNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	del(ctx context.Context, keys ...string) error
+	// incr adds by to the counter at key and returns the new value. A
+	// positive ttl (re)sets the key's expiry.
+	incr(ctx context.Context, key string, by int64, ttl time.Duration) (int64, error)
+
+	hgetAll(ctx context.Context, key string) (map[string]string, error)
+	hset(ctx context.Context, key, field, value string) error
+	hdel(ctx context.Context, key string, fields ...string) error
+	hincr(ctx context.Context, key, field string, by int64, ttl time.Duration) (int64, error)
+}
+
+// stateFromEnv connects to the Redis server at REDIS_URL, for example
+// redis://quote-api-redis:6379/0. Without it, state is kept in memory,
+// which only works with a single replica and is lost on restart.
+func stateFromEnv() (stateStore, error) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		log.Println("REDIS_URL not set; keeping shared state in memory, which only works with a single replica")
+		return newMemoryState(), nil
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &redisState{client: redis.NewClient(opts)}, nil
+}
+
+// stateError logs err and reports errStateUnavailable to the client.
+func stateError(w http.ResponseWriter, err error) {
+	log.Printf("shared state: %v", err)
+	writeError(w, http.StatusServiceUnavailable, errStateUnavailable.Error())
+}
+
+type redisState struct {
+	client *redis.Client
+}
+
+func (s *redisState) get(ctx context.Context, key string) (string, bool, error) {
+	v, err := s.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	return v, err == nil, err
+}
+
+func (s *redisState) set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *redisState) setNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (s *redisState) del(ctx context.Context, keys ...string) error {
+	return s.client.Del(ctx, keys...).Err()
+}
+
+func (s *redisState) incr(ctx context.Context, key string, by int64, ttl time.Duration) (int64, error) {
+	pipe := s.client.TxPipeline()
+	n := pipe.IncrBy(ctx, key, by)
+	if ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return n.Val(), err
+}
+
+func (s *redisState) hgetAll(ctx context.Context, key string) (map[string]string, error) {
+	return s.client.HGetAll(ctx, key).Result()
+}
+
+func (s *redisState) hset(ctx context.Context, key, field, value string) error {
+	return s.client.HSet(ctx, key, field, value).Err()
+}
+
+func (s *redisState) hdel(ctx context.Context, key string, fields ...string) error {
+	return s.client.HDel(ctx, key, fields...).Err()
+}
+
+func (s *redisState) hincr(ctx context.Context, key, field string, by int64, ttl time.Duration) (int64, error) {
+	pipe := s.client.TxPipeline()
+	n := pipe.HIncrBy(ctx, key, field, by)
+	if ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return n.Val(), err
+}
+
+// memoryState is the single-replica stand-in for Redis. Expired keys are
+// invisible at once and removed by run.
+type memoryState struct {
+	mu     sync.Mutex
+	values map[string]*memoryValue
+}
+
+type memoryValue struct {
+	s       string
+	hash    map[string]string
+	expires time.Time // zero for never
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{values: make(map[string]*memoryValue)}
+}
+
+// lookup returns the live value at key. The caller must hold s.mu.
+func (s *memoryState) lookup(key string, now time.Time) (*memoryValue, bool) {
+	v, ok := s.values[key]
+	if ok && !v.expires.IsZero() && now.After(v.expires) {
+		delete(s.values, key)
+		return nil, false
+	}
+	return v, ok
+}
+
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+func (s *memoryState) get(_ context.Context, key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.lookup(key, time.Now())
+	if !ok {
+		return "", false, nil
+	}
+	return v.s, true, nil
+}
+
+func (s *memoryState) set(_ context.Context, key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = &memoryValue{s: value, expires: expiry(time.Now(), ttl)}
+	return nil
+}
+
+func (s *memoryState) setNX(_ context.Context, key, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if _, ok := s.lookup(key, now); ok {
+		return false, nil
+	}
+	s.values[key] = &memoryValue{s: value, expires: expiry(now, ttl)}
+	return true, nil
+}
+
+func (s *memoryState) del(_ context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range keys {
+		delete(s.values, k)
+	}
+	return nil
+}
+
+func (s *memoryState) incr(_ context.Context, key string, by int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	v, ok := s.lookup(key, now)
+	if !ok {
+		v = &memoryValue{}
+		s.values[key] = v
+	}
+	n, _ := strconv.ParseInt(v.s, 10, 64)
+	n += by
+	v.s = strconv.FormatInt(n, 10)
+	if ttl > 0 {
+		v.expires = now.Add(ttl)
+	}
+	return n, nil
+}
+
+func (s *memoryState) hgetAll(_ context.Context, key string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string)
+	if v, ok := s.lookup(key, time.Now()); ok {
+		for f, x := range v.hash {
+			out[f] = x
+		}
+	}
+	return out, nil
+}
+
+// hash returns the hash at key, creating it if needed. The caller must hold
+// s.mu.
+func (s *memoryState) hash(key string, now time.Time) *memoryValue {
+	v, ok := s.lookup(key, now)
+	if !ok {
+		v = &memoryValue{}
+		s.values[key] = v
+	}
+	if v.hash == nil {
+		v.hash = make(map[string]string)
+	}
+	return v
+}
+
+func (s *memoryState) hset(_ context.Context, key, field, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hash(key, time.Now()).hash[field] = value
+	return nil
+}
+
+func (s *memoryState) hdel(_ context.Context, key string, fields ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.lookup(key, time.Now()); ok {
+		for _, f := range fields {
+			delete(v.hash, f)
+		}
+	}
+	return nil
+}
+
+func (s *memoryState) hincr(_ context.Context, key, field string, by int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	v := s.hash(key, now)
+	n, _ := strconv.ParseInt(v.hash[field], 10, 64)
+	n += by
+	v.hash[field] = strconv.FormatInt(n, 10)
+	if ttl > 0 {
+		v.expires = now.Add(ttl)
+	}
+	return n, nil
+}
+
+// run removes expired keys every interval until ctx is done.
+func (s *memoryState) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.mu.Lock()
+			for k, v := range s.values {
+				if !v.expires.IsZero() && now.After(v.expires) {
+					delete(s.values, k)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ndjsonType          = "application/x-ndjson"
+	ndjsonFlushInterval = 250 * time.Millisecond
+	// anonymousStreamLimit caps the quotes streamed to a request without an
+	// API key. Streams are cacheable, but each miss walks the store, so an
+	// anonymous client may not ask for the whole corpus in one request.
+	anonymousStreamLimit = 1000
+)
+
+// wantsNDJSON reports whether the Accept header asks for newline-delimited
+// JSON, one value per line, instead of a single document.
+func wantsNDJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != ndjsonType && mediaType != "application/ndjson" {
+			continue
+		}
+		q, err := strconv.ParseFloat(params["q"], 64)
+		return params["q"] == "" || err == nil && q > 0
+	}
+	return false
+}
+
+// ndjsonWriter streams values as newline-delimited JSON. It flushes every
+// ?flush= lines (default 100), and sooner when values arrive slowly, so
+// clients see data as it is produced and the server never holds more than
+// a few lines. Writes fail once the client has gone away.
+type ndjsonWriter struct {
+	w         http.ResponseWriter
+	r         *http.Request
+	rc        *http.ResponseController
+	enc       *json.Encoder
+	every     int
+	pending   int
+	lastFlush time.Time
+	started   bool
+}
+
+// newNDJSONWriter reads ?flush= and sets the response headers, for a
+// download named filename if that is set. It writes a 400 and returns false
+// if the parameter is invalid. The response starts with the first line or
+// flush, so callers can still mark it cacheable once it is known to
+// succeed.
+func newNDJSONWriter(w http.ResponseWriter, r *http.Request, filename string) (*ndjsonWriter, bool) {
+	every, ok := intParam(w, r, "flush", 100, 1, 10000)
+	if !ok {
+		return nil, false
+	}
+	if filename != "" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	}
+	w.Header().Set("Content-Type", ndjsonType)
+	w.Header().Del("Content-Length")
+	return &ndjsonWriter{
+		w: w, r: r, rc: http.NewResponseController(w),
+		enc: json.NewEncoder(w), every: every, lastFlush: time.Now(),
+	}, true
+}
+
+// write sends v as one line. It returns the request's context error when
+// the client has disconnected, so producers can stop early.
+func (s *ndjsonWriter) write(v any) error {
+	if err := s.r.Context().Err(); err != nil {
+		return err
+	}
+	s.start()
+	if err := s.enc.Encode(v); err != nil {
+		return err
+	}
+	s.pending++
+	if s.pending >= s.every || time.Since(s.lastFlush) >= ndjsonFlushInterval {
+		s.flush()
+	}
+	return nil
+}
+
+// flush sends any buffered lines. A signed stream is flushed the same way;
+// its signature follows in the trailers.
+func (s *ndjsonWriter) flush() {
+	s.start()
+	s.rc.Flush()
+	s.pending, s.lastFlush = 0, time.Now()
+}
+
+func (s *ndjsonWriter) start() {
+	if !s.started {
+		s.started = true
+		s.w.WriteHeader(http.StatusOK)
+	}
+}
+
+// streamLimit returns the most quotes r may have streamed, or 0 for no
+// limit: requests with an API key are metered and may stream everything.
+func streamLimit(r *http.Request) int {
+	if r.Header.Get(apiKeyHeader) != "" {
+		return 0
+	}
+	return anonymousStreamLimit
+}
+
+// streamQuotes writes the selected quotes from offset on, up to limit of
+// them when limit is positive and streamLimit otherwise, reading them from
+// the store one at a time. The response is public unless it fails.
+func (s *server) streamQuotes(w http.ResponseWriter, r *http.Request, offset, limit int, filename string) {
+	match, err := s.quoteMatcher(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	out, ok := newNDJSONWriter(w, r, filename)
+	if !ok {
+		return
+	}
+	if limit <= 0 {
+		limit = streamLimit(r)
+	}
+	s.cdn.cacheable(w, true)
+	seen, sent := 0, 0
+	rangeQuotes(s.store, func(q Quote) bool {
+		if !match(q) {
+			return true
+		}
+		if seen++; seen <= offset {
+			return true
+		}
+		if out.write(q) != nil {
+			return false
+		}
+		sent++
+		return limit <= 0 || sent < limit
+	})
+	out.flush()
+}
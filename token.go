@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var errBadToken = errors.New("invalid token")
+
+// signToken serialises claims as JSON and appends an HMAC-SHA256 signature,
+// producing "<payload>.<signature>" with both parts base64url encoded.
+func signToken(secret []byte, claims any) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(secret, body)), nil
+}
+
+// verifyToken checks the signature on a token created by signToken and
+// decodes its claims into dst.
+func verifyToken(secret []byte, token string, dst any) error {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return errBadToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, tokenMAC(secret, body)) {
+		return errBadToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return errBadToken
+	}
+	if err := json.Unmarshal(payload, dst); err != nil {
+		return errBadToken
+	}
+	return nil
+}
+
+// sealToken is like signToken, but also encrypts the claims with
+// AES-256-GCM so holders of the token cannot read them.
+func sealToken(secret []byte, claims any) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	aead := tokenAEAD(secret)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, payload, nil)), nil
+}
+
+// openToken decrypts and checks a token created by sealToken and decodes
+// its claims into dst.
+func openToken(secret []byte, token string, dst any) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	aead := tokenAEAD(secret)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return errBadToken
+	}
+	n := aead.NonceSize()
+	payload, err := aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return errBadToken
+	}
+	if err := json.Unmarshal(payload, dst); err != nil {
+		return errBadToken
+	}
+	return nil
+}
+
+// tokenAEAD derives the encryption key from secret, so the same secret can
+// both sign and seal without the two uses sharing a key.
+func tokenAEAD(secret []byte) cipher.AEAD {
+	block, _ := aes.NewCipher(tokenMAC(secret, "seal"))
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+func tokenMAC(secret []byte, body string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+// randomString returns n random bytes encoded as base64url.
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxFailedLogins = 5
+	lockoutDuration = 15 * time.Minute
+	sessionLifetime = 30 * 24 * time.Hour
+	sessionIdleTime = 7 * 24 * time.Hour
+	verifyTokenTTL  = 24 * time.Hour
+	resetTokenTTL   = time.Hour
+	// sessionTouchInterval is how often a session's last use is written
+	// back, so a busy session does not cost a write on every request.
+	sessionTouchInterval = time.Minute
+
+	sessionCookie = "quote_session"
+)
+
+var (
+	errEmailTaken   = errors.New("email already registered")
+	errBadLogin     = errors.New("invalid email or password")
+	errLocked       = errors.New("too many failed attempts; try again later")
+	errUnverified   = errors.New("email address has not been verified")
+	errInvalidToken = errors.New("invalid or expired token")
+	errMailFailed   = errors.New("could not send email")
+)
+
+type user struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Verified  bool      `json:"verified"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// storedUser is a user as kept in shared state.
+type storedUser struct {
+	user
+	PasswordHash string `json:"password_hash"`
+}
+
+// session is a signed-in browser. The cookie holds a random token; only its
+// hash is kept, and ID is a short public handle derived from that hash.
+type session struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+}
+
+// storedSession is a session as kept in shared state.
+type storedSession struct {
+	session
+	UserID string `json:"user_id"`
+}
+
+// ttl returns how long the session stays valid if it is not used again.
+func (s *session) ttl(now time.Time) time.Duration {
+	return min(s.ExpiresAt.Sub(now), sessionIdleTime-now.Sub(s.LastSeen))
+}
+
+// oneTimeToken backs email verification and password reset links.
+type oneTimeToken struct {
+	Purpose string `json:"purpose"`
+	UserID  string `json:"user_id"`
+}
+
+// accounts manages users and their sessions. Everything is kept in shared
+// state, so a session started on one replica works on all of them, and
+// sessions and tokens expire there on their own:
+//
+//	user:<id>            the user, as JSON, with the password hash
+//	user:email:<email>   the ID of the user with that address
+//	user:failed:<id>     failed logins in a row, forgotten after the lockout time
+//	user:locked:<id>     set while the account is locked
+//	session:<hash>       a session, as JSON, by the hash of its cookie
+//	sessions:<id>        hash of the user's session hashes
+//	token:<hash>         a pending verification or reset token, as JSON
+//	tokens:<id>          hash of the user's pending token hashes
+type accounts struct {
+	state         stateStore
+	mailer        mailer
+	baseURL       string
+	secureCookies bool
+	// dummyHash is checked for unknown emails so a login takes as long
+	// whether or not the account exists.
+	dummyHash string
+}
+
+func newAccounts(state stateStore, m mailer, baseURL string, secureCookies bool) *accounts {
+	return &accounts{
+		state:         state,
+		mailer:        m,
+		baseURL:       baseURL,
+		secureCookies: secureCookies,
+		dummyHash:     hashPassword(randomString(16)),
+	}
+}
+
+func userKey(id string) string           { return "user:" + id }
+func userEmailKey(email string) string   { return "user:email:" + email }
+func failedLoginsKey(id string) string   { return "user:failed:" + id }
+func lockedKey(id string) string         { return "user:locked:" + id }
+func sessionKey(hash string) string      { return "session:" + hash }
+func userSessionsKey(id string) string   { return "sessions:" + id }
+func oneTimeTokenKey(hash string) string { return "token:" + hash }
+func userTokensKey(id string) string     { return "tokens:" + id }
+
+// baseURL is the public origin used in emailed links, from BASE_URL.
+func baseURL() string {
+	if u := os.Getenv("BASE_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "http://localhost:8080"
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// getJSON decodes the JSON value at key into v.
+func getJSON(ctx context.Context, state stateStore, key string, v any) (bool, error) {
+	data, ok, err := state.get(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, json.Unmarshal([]byte(data), v)
+}
+
+func setJSON(ctx context.Context, state stateStore, key string, v any, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return state.set(ctx, key, string(data), ttl)
+}
+
+func (a *accounts) stored(ctx context.Context, id string) (*storedUser, bool, error) {
+	u := new(storedUser)
+	ok, err := getJSON(ctx, a.state, userKey(id), u)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return u, true, nil
+}
+
+func (a *accounts) storedByEmail(ctx context.Context, email string) (*storedUser, bool, error) {
+	id, ok, err := a.state.get(ctx, userEmailKey(email))
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return a.stored(ctx, id)
+}
+
+func (a *accounts) put(ctx context.Context, u *storedUser) error {
+	return setJSON(ctx, a.state, userKey(u.ID), u, 0)
+}
+
+// issueToken creates a single-use token for purpose and returns it.
+func (a *accounts) issueToken(ctx context.Context, purpose, userID string, ttl time.Duration) (string, error) {
+	token := randomString(32)
+	h := hashToken(token)
+	if err := setJSON(ctx, a.state, oneTimeTokenKey(h), oneTimeToken{Purpose: purpose, UserID: userID}, ttl); err != nil {
+		return "", err
+	}
+	if err := a.state.hset(ctx, userTokensKey(userID), h, ""); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// redeemToken consumes a token issued for purpose and returns its user.
+// Of concurrent redemptions on any replicas, only one succeeds.
+func (a *accounts) redeemToken(ctx context.Context, purpose, token string) (*storedUser, error) {
+	h := hashToken(token)
+	var t oneTimeToken
+	ok, err := getJSON(ctx, a.state, oneTimeTokenKey(h), &t)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || t.Purpose != purpose {
+		return nil, errInvalidToken
+	}
+	fresh, err := a.state.setNX(ctx, oneTimeTokenKey(h)+":spent", "1", max(verifyTokenTTL, resetTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, errInvalidToken
+	}
+	if err := a.state.del(ctx, oneTimeTokenKey(h)); err != nil {
+		return nil, err
+	}
+	if err := a.state.hdel(ctx, userTokensKey(t.UserID), h); err != nil {
+		return nil, err
+	}
+	u, ok, err := a.stored(ctx, t.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidToken
+	}
+	return u, nil
+}
+
+// register creates an unverified account and emails a verification link.
+// If the email is taken, the owner is told instead so the response does not
+// reveal which addresses have accounts.
+func (a *accounts) register(ctx context.Context, email, password string) error {
+	u := &storedUser{user: user{ID: "u_" + randomString(12), Email: email, CreatedAt: time.Now().UTC()}}
+	fresh, err := a.state.setNX(ctx, userEmailKey(email), u.ID, 0)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return a.send(ctx, mail{
+			To:      email,
+			Subject: "Quote API registration attempt",
+			Body:    "Someone tried to register a new account with this address. If it was you, sign in or reset your password instead.",
+		})
+	}
+	u.PasswordHash = hashPassword(password)
+	if err := a.put(ctx, u); err != nil {
+		// Free the address again, so registering can be retried.
+		a.state.del(ctx, userEmailKey(email))
+		return err
+	}
+	token, err := a.issueToken(ctx, "verify", u.ID, verifyTokenTTL)
+	if err != nil {
+		return err
+	}
+	return a.send(ctx, mail{
+		To:      email,
+		Subject: "Verify your Quote API account",
+		Body:    "Confirm your email address by opening this link within 24 hours:\n\n" + a.baseURL + "/v1/auth/verify?token=" + token,
+	})
+}
+
+func (a *accounts) verify(ctx context.Context, token string) (user, error) {
+	u, err := a.redeemToken(ctx, "verify", token)
+	if err != nil {
+		return user{}, err
+	}
+	u.Verified = true
+	if err := a.put(ctx, u); err != nil {
+		return user{}, err
+	}
+	return u.user, nil
+}
+
+// login checks credentials, applying the lockout, and starts a session.
+func (a *accounts) login(ctx context.Context, email, password string, r *http.Request) (user, string, error) {
+	u, ok, err := a.storedByEmail(ctx, email)
+	if err != nil {
+		return user{}, "", err
+	}
+	hash := a.dummyHash
+	if ok {
+		_, locked, err := a.state.get(ctx, lockedKey(u.ID))
+		if err != nil {
+			return user{}, "", err
+		}
+		if locked {
+			return user{}, "", errLocked
+		}
+		hash = u.PasswordHash
+	}
+
+	match, err := checkPassword(password, hash)
+	if err != nil {
+		return user{}, "", err
+	}
+	if !ok {
+		return user{}, "", errBadLogin
+	}
+	if !match {
+		failed, err := a.state.incr(ctx, failedLoginsKey(u.ID), 1, lockoutDuration)
+		if err != nil {
+			return user{}, "", err
+		}
+		if failed >= maxFailedLogins {
+			if err := a.state.set(ctx, lockedKey(u.ID), "1", lockoutDuration); err != nil {
+				return user{}, "", err
+			}
+			if err := a.state.del(ctx, failedLoginsKey(u.ID)); err != nil {
+				return user{}, "", err
+			}
+			log.Printf("accounts: locked %s after %d failed logins", u.ID, maxFailedLogins)
+		}
+		return user{}, "", errBadLogin
+	}
+	if err := a.state.del(ctx, failedLoginsKey(u.ID)); err != nil {
+		return user{}, "", err
+	}
+	if !u.Verified {
+		return user{}, "", errUnverified
+	}
+
+	var ip string
+	if a := clientIP(r); a.IsValid() {
+		ip = a.String()
+	}
+	token := randomString(32)
+	h := hashToken(token)
+	now := time.Now().UTC()
+	s := &storedSession{
+		session: session{
+			ID:        h[:16],
+			CreatedAt: now,
+			LastSeen:  now,
+			ExpiresAt: now.Add(sessionLifetime),
+			UserAgent: r.UserAgent(),
+			IP:        ip,
+		},
+		UserID: u.ID,
+	}
+	if err := setJSON(ctx, a.state, sessionKey(h), s, s.ttl(now)); err != nil {
+		return user{}, "", err
+	}
+	if err := a.state.hset(ctx, userSessionsKey(u.ID), h, ""); err != nil {
+		return user{}, "", err
+	}
+	// Expired sessions leave their hashes behind in the index.
+	if _, err := a.sessionsOf(ctx, u.ID); err != nil {
+		return user{}, "", err
+	}
+	return u.user, token, nil
+}
+
+// forgotPassword emails a reset link if the address has an account.
+func (a *accounts) forgotPassword(ctx context.Context, email string) error {
+	u, ok, err := a.storedByEmail(ctx, email)
+	if err != nil || !ok {
+		return err
+	}
+	token, err := a.issueToken(ctx, "reset", u.ID, resetTokenTTL)
+	if err != nil {
+		return err
+	}
+	return a.send(ctx, mail{
+		To:      email,
+		Subject: "Reset your Quote API password",
+		Body:    "Reset your password within the next hour by sending this token to /v1/auth/password/reset:\n\n" + token + "\n\nIf you did not ask for this, ignore this email.",
+	})
+}
+
+// resetPassword sets a new password, lifts any lockout and signs the user
+// out everywhere. The token is redeemed before the password is hashed, so
+// bogus tokens cannot tie up the Argon2id slots that sign-ins wait for.
+func (a *accounts) resetPassword(ctx context.Context, token, password string) error {
+	u, err := a.redeemToken(ctx, "reset", token)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = hashPassword(password)
+	// Receiving the reset email proves ownership of the address.
+	u.Verified = true
+	if err := a.put(ctx, u); err != nil {
+		return err
+	}
+	if err := a.state.del(ctx, failedLoginsKey(u.ID), lockedKey(u.ID)); err != nil {
+		return err
+	}
+	return a.revokeSessions(ctx, u.ID, "")
+}
+
+// current returns the user and session behind the request's session cookie.
+func (a *accounts) current(r *http.Request) (user, session, bool, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return user{}, session{}, false, nil
+	}
+	ctx := r.Context()
+	h := hashToken(c.Value)
+	now := time.Now()
+
+	s := new(storedSession)
+	ok, err := getJSON(ctx, a.state, sessionKey(h), s)
+	if err != nil || !ok {
+		return user{}, session{}, false, err
+	}
+	if s.ttl(now) <= 0 {
+		return user{}, session{}, false, a.state.del(ctx, sessionKey(h))
+	}
+	u, ok, err := a.stored(ctx, s.UserID)
+	if err != nil || !ok {
+		return user{}, session{}, false, err
+	}
+	if now.Sub(s.LastSeen) >= sessionTouchInterval {
+		s.LastSeen = now.UTC()
+		if err := setJSON(ctx, a.state, sessionKey(h), s, s.ttl(now)); err != nil {
+			return user{}, session{}, false, err
+		}
+	}
+	return u.user, s.session, true, nil
+}
+
+func (a *accounts) userByID(ctx context.Context, id string) (user, bool, error) {
+	u, ok, err := a.stored(ctx, id)
+	if err != nil || !ok {
+		return user{}, false, err
+	}
+	return u.user, true, nil
+}
+
+func (a *accounts) userByEmail(ctx context.Context, email string) (user, bool, error) {
+	u, ok, err := a.storedByEmail(ctx, email)
+	if err != nil || !ok {
+		return user{}, false, err
+	}
+	return u.user, true, nil
+}
+
+// sessionHashes returns the user's live sessions by the hash of their
+// cookies, dropping expired ones from the index.
+func (a *accounts) sessionHashes(ctx context.Context, userID string) (map[string]*storedSession, error) {
+	hashes, err := a.state.hgetAll(ctx, userSessionsKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]*storedSession)
+	for h := range hashes {
+		s := new(storedSession)
+		ok, err := getJSON(ctx, a.state, sessionKey(h), s)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if err := a.state.hdel(ctx, userSessionsKey(userID), h); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		live[h] = s
+	}
+	return live, nil
+}
+
+// sessionsOf lists a user's sessions, newest first.
+func (a *accounts) sessionsOf(ctx context.Context, userID string) ([]session, error) {
+	live, err := a.sessionHashes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	list := []session{}
+	for _, s := range live {
+		list = append(list, s.session)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list, nil
+}
+
+// revokeSession ends one of the user's sessions by its public ID.
+func (a *accounts) revokeSession(ctx context.Context, userID, id string) (bool, error) {
+	live, err := a.sessionHashes(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for h, s := range live {
+		if s.ID == id {
+			if err := a.state.del(ctx, sessionKey(h)); err != nil {
+				return false, err
+			}
+			return true, a.state.hdel(ctx, userSessionsKey(userID), h)
+		}
+	}
+	return false, nil
+}
+
+// revokeSessions ends all of a user's sessions except keep.
+func (a *accounts) revokeSessions(ctx context.Context, userID, keep string) error {
+	live, err := a.sessionHashes(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for h, s := range live {
+		if s.ID == keep {
+			continue
+		}
+		if err := a.state.del(ctx, sessionKey(h)); err != nil {
+			return err
+		}
+		if err := a.state.hdel(ctx, userSessionsKey(userID), h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *accounts) send(ctx context.Context, m mail) error {
+	if err := a.mailer.Send(ctx, m); err != nil {
+		log.Printf("accounts: sending %q: %v", m.Subject, err)
+		return fmt.Errorf("%w: %v", errMailFailed, err)
+	}
+	return nil
+}
+
+// confirmPassword reports whether password is the user's current one.
+func (a *accounts) confirmPassword(ctx context.Context, userID, password string) (bool, error) {
+	u, ok, err := a.stored(ctx, userID)
+	if err != nil || !ok {
+		return false, err
+	}
+	match, err := checkPassword(password, u.PasswordHash)
+	return err == nil && match, nil
+}
+
+func (a *accounts) exportUser(userID string) (any, error) {
+	ctx := context.Background()
+	u, ok, err := a.userByID(ctx, userID)
+	if err != nil || !ok {
+		return nil, err
+	}
+	sessions, err := a.sessionsOf(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"user": u, "sessions": sessions}, nil
+}
+
+// eraseUser deletes the account, its sessions and any outstanding
+// verification or reset tokens.
+func (a *accounts) eraseUser(userID string) error {
+	ctx := context.Background()
+	if err := a.revokeSessions(ctx, userID, ""); err != nil {
+		return err
+	}
+	tokens, err := a.state.hgetAll(ctx, userTokensKey(userID))
+	if err != nil {
+		return err
+	}
+	keys := []string{userSessionsKey(userID), userTokensKey(userID), failedLoginsKey(userID), lockedKey(userID)}
+	for h := range tokens {
+		keys = append(keys, oneTimeTokenKey(h))
+	}
+	u, ok, err := a.stored(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if ok {
+		keys = append(keys, userEmailKey(u.Email))
+	}
+	// The account goes last, so a failure part way can be retried.
+	if err := a.state.del(ctx, keys...); err != nil {
+		return err
+	}
+	return a.state.del(ctx, userKey(userID))
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// inbox is a mailer that keeps what it sends.
+type inbox struct {
+	mu    sync.Mutex
+	mails []mail
+}
+
+func (in *inbox) Send(_ context.Context, m mail) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.mails = append(in.mails, m)
+	return nil
+}
+
+// last returns the last mail sent to addr and the token it carries: the
+// last word of its body, or the token parameter of the link.
+func (in *inbox) last(t *testing.T, addr string) (mail, string) {
+	t.Helper()
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for i := len(in.mails) - 1; i >= 0; i-- {
+		m := in.mails[i]
+		if m.To != addr {
+			continue
+		}
+		for _, field := range strings.Fields(m.Body) {
+			if _, token, ok := strings.Cut(field, "?token="); ok {
+				return m, token
+			}
+			if len(field) == 43 {
+				return m, field
+			}
+		}
+		return m, ""
+	}
+	t.Fatalf("no mail to %s", addr)
+	return mail{}, ""
+}
+
+// replicas returns two accounts sharing one state, like two pods sharing
+// Redis.
+func replicas() (*accounts, *accounts, *inbox) {
+	state, in := newMemoryState(), new(inbox)
+	return newAccounts(state, in, "https://quotes.test", true), newAccounts(state, in, "https://quotes.test", true), in
+}
+
+func loginRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/v1/auth/login", nil)
+	r.Header.Set("User-Agent", "test")
+	return r
+}
+
+func withSession(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v1/auth/me", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+	return r
+}
+
+// signUp registers and verifies addr with password.
+func signUp(t *testing.T, a *accounts, in *inbox, addr, password string) user {
+	t.Helper()
+	ctx := context.Background()
+	if err := a.register(ctx, addr, password); err != nil {
+		t.Fatal(err)
+	}
+	_, token := in.last(t, addr)
+	u, err := a.verify(ctx, token)
+	if err != nil {
+		t.Fatalf("verify() = %v", err)
+	}
+	return u
+}
+
+func TestRegister(t *testing.T) {
+	ctx := context.Background()
+	a, b, in := replicas()
+	if err := a.register(ctx, "ada@example.com", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	m, token := in.last(t, "ada@example.com")
+	if !strings.HasPrefix(m.Subject, "Verify") || token == "" {
+		t.Fatalf("first mail = %q with token %q, want a verification link", m.Subject, token)
+	}
+	if _, _, err := a.login(ctx, "ada@example.com", "correct horse", loginRequest()); !errors.Is(err, errUnverified) {
+		t.Errorf("login() before verifying = %v, want %v", err, errUnverified)
+	}
+
+	// Registering again does not reveal the account, but tells its owner.
+	if err := b.register(ctx, "ada@example.com", "another password"); err != nil {
+		t.Fatalf("register() a taken address = %v, want nil", err)
+	}
+	if m, _ := in.last(t, "ada@example.com"); !strings.Contains(m.Subject, "registration attempt") {
+		t.Errorf("second mail = %q, want a registration attempt notice", m.Subject)
+	}
+
+	// The token was issued by a and is redeemed by b, once.
+	u, err := b.verify(ctx, token)
+	if err != nil || !u.Verified {
+		t.Fatalf("verify() on another replica = %+v, %v", u, err)
+	}
+	if _, err := a.verify(ctx, token); !errors.Is(err, errInvalidToken) {
+		t.Errorf("verify() twice = %v, want %v", err, errInvalidToken)
+	}
+	if _, _, err := a.login(ctx, "ada@example.com", "another password", loginRequest()); !errors.Is(err, errBadLogin) {
+		t.Errorf("login() with the second password = %v, want %v", err, errBadLogin)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	ctx := context.Background()
+	a, b, in := replicas()
+	signUp(t, a, in, "ada@example.com", "correct horse")
+
+	// Failures count across replicas.
+	for i := 0; i < maxFailedLogins; i++ {
+		r := []*accounts{a, b}[i%2]
+		if _, _, err := r.login(ctx, "ada@example.com", "wrong", loginRequest()); !errors.Is(err, errBadLogin) {
+			t.Fatalf("failed login %d = %v, want %v", i+1, err, errBadLogin)
+		}
+	}
+	for _, r := range []*accounts{a, b} {
+		if _, _, err := r.login(ctx, "ada@example.com", "correct horse", loginRequest()); !errors.Is(err, errLocked) {
+			t.Errorf("login() while locked = %v, want %v", err, errLocked)
+		}
+	}
+	if _, _, err := a.login(ctx, "nobody@example.com", "correct horse", loginRequest()); !errors.Is(err, errBadLogin) {
+		t.Errorf("login() as an unknown user = %v, want %v", err, errBadLogin)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	ctx := context.Background()
+	a, b, in := replicas()
+	u := signUp(t, a, in, "ada@example.com", "correct horse")
+	_, session, err := a.login(ctx, "ada@example.com", "correct horse", loginRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxFailedLogins; i++ {
+		a.login(ctx, "ada@example.com", "wrong", loginRequest())
+	}
+
+	if err := b.resetPassword(ctx, "bogus", "battery staple"); !errors.Is(err, errInvalidToken) {
+		t.Errorf("resetPassword() with a bogus token = %v, want %v", err, errInvalidToken)
+	}
+	// A verification token is not a reset token.
+	if err := a.register(ctx, "bob@example.com", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	_, verifyToken := in.last(t, "bob@example.com")
+	if err := b.resetPassword(ctx, verifyToken, "battery staple"); !errors.Is(err, errInvalidToken) {
+		t.Errorf("resetPassword() with a verification token = %v, want %v", err, errInvalidToken)
+	}
+
+	if err := a.forgotPassword(ctx, "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	_, token := in.last(t, "ada@example.com")
+	if err := b.resetPassword(ctx, token, "battery staple"); err != nil {
+		t.Fatalf("resetPassword() = %v", err)
+	}
+	if err := a.resetPassword(ctx, token, "battery staple 2"); !errors.Is(err, errInvalidToken) {
+		t.Errorf("resetPassword() twice = %v, want %v", err, errInvalidToken)
+	}
+	if _, _, ok, err := a.current(withSession(session)); ok || err != nil {
+		t.Errorf("current() after a reset = %v, %v, want signed out", ok, err)
+	}
+	// The reset lifts the lockout.
+	got, _, err := a.login(ctx, "ada@example.com", "battery staple", loginRequest())
+	if err != nil || got.ID != u.ID {
+		t.Errorf("login() after a reset = %+v, %v", got, err)
+	}
+	if err := a.forgotPassword(ctx, "nobody@example.com"); err != nil {
+		t.Errorf("forgotPassword() for an unknown address = %v, want nil", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ctx := context.Background()
+	a, b, in := replicas()
+	u := signUp(t, a, in, "ada@example.com", "correct horse")
+	_, first, err := a.login(ctx, "ada@example.com", "correct horse", loginRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := a.login(ctx, "ada@example.com", "correct horse", loginRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A session started on one replica is valid on the other.
+	got, s, ok, err := b.current(withSession(first))
+	if err != nil || !ok || got.ID != u.ID {
+		t.Fatalf("current() on another replica = %+v, %v, %v", got, ok, err)
+	}
+	if _, _, ok, _ := b.current(withSession("forged")); ok {
+		t.Error("current() with an unknown token = signed in")
+	}
+	sessions, err := b.sessionsOf(ctx, u.ID)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("sessionsOf() = %d sessions, %v, want 2", len(sessions), err)
+	}
+
+	// Revoking the others keeps the current one.
+	if err := b.revokeSessions(ctx, u.ID, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, _ := a.current(withSession(second)); ok {
+		t.Error("current() with a revoked session = signed in")
+	}
+	if _, _, ok, _ := a.current(withSession(first)); !ok {
+		t.Error("current() with the kept session = signed out")
+	}
+	if ok, err := a.revokeSession(ctx, "u_other", s.ID); ok || err != nil {
+		t.Errorf("revokeSession() of another user's session = %v, %v, want false", ok, err)
+	}
+	if ok, err := a.revokeSession(ctx, u.ID, s.ID); !ok || err != nil {
+		t.Errorf("revokeSession() = %v, %v, want true", ok, err)
+	}
+	if _, _, ok, _ := b.current(withSession(first)); ok {
+		t.Error("current() after revokeSession = signed in")
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	ctx := context.Background()
+	a, b, in := replicas()
+	u := signUp(t, a, in, "ada@example.com", "correct horse")
+	_, session, err := a.login(ctx, "ada@example.com", "correct horse", loginRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.forgotPassword(ctx, "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	_, token := in.last(t, "ada@example.com")
+
+	if err := b.eraseUser(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := a.userByEmail(ctx, "ada@example.com"); ok || err != nil {
+		t.Errorf("userByEmail() after erasure = %v, %v", ok, err)
+	}
+	if _, _, ok, _ := a.current(withSession(session)); ok {
+		t.Error("current() after erasure = signed in")
+	}
+	if err := a.resetPassword(ctx, token, "battery staple"); !errors.Is(err, errInvalidToken) {
+		t.Errorf("resetPassword() after erasure = %v, want %v", err, errInvalidToken)
+	}
+	// The address can be registered again.
+	signUp(t, a, in, "ada@example.com", "battery staple")
+}
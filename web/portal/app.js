@@ -0,0 +1,215 @@
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+async function api(method, path, body) {
+  const opts = { method, headers: {} };
+  if (body !== undefined) {
+    opts.headers["Content-Type"] = "application/json";
+    opts.body = JSON.stringify(body);
+  }
+  let resp = await fetch(path, opts);
+  let data = resp.status === 204 ? null : await resp.json();
+  if (resp.status === 428 && data.challenge) {
+    opts.headers["X-Proof-Of-Work"] = await solve(data.challenge);
+    resp = await fetch(path, opts);
+    data = resp.status === 204 ? null : await resp.json();
+  }
+  if (!resp.ok) {
+    throw Object.assign(new Error(data && data.error ? data.error : resp.statusText), { status: resp.status });
+  }
+  return data;
+}
+
+// solve finds a proof for a proof-of-work challenge: a suffix that gives
+// the SHA-256 of "challenge:suffix" the required number of leading zero bits.
+async function solve({ challenge, difficulty }) {
+  const enc = new TextEncoder();
+  for (let i = 0; ; i++) {
+    const proof = `${challenge}:${i}`;
+    const sum = new Uint8Array(await crypto.subtle.digest("SHA-256", enc.encode(proof)));
+    let zeros = 0;
+    for (const b of sum) {
+      if (b !== 0) {
+        zeros += Math.clz32(b) - 24;
+        break;
+      }
+      zeros += 8;
+    }
+    if (zeros >= difficulty) return proof;
+  }
+}
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  Object.assign(node, attrs);
+  node.append(...children);
+  return node;
+}
+
+const date = (s) => (s ? new Date(s).toLocaleString() : "never");
+
+async function start() {
+  try {
+    const me = await api("GET", "/v1/auth/me");
+    $("email").textContent = me.email;
+    $("whoami").hidden = false;
+    $("dashboard").hidden = false;
+    await Promise.all([loadPlans(), loadKeys(), loadUsage()]);
+  } catch (err) {
+    if (err.status !== 401) throw err;
+    $("signin").hidden = false;
+  }
+}
+
+async function loadPlans() {
+  const [{ plans }, current] = await Promise.all([api("GET", "/v1/portal/plans"), api("GET", "/v1/portal/plan")]);
+  const quota = (n) => (n ? n.toLocaleString() : "unlimited");
+  $("plans").replaceChildren(...plans.map((p) => {
+    return el("div", { className: "plan" + (p.name === current.name ? " current" : "") },
+      el("h3", { textContent: p.name }),
+      el("p", { textContent: p.description }),
+      el("p", { textContent: `${quota(p.daily_quota)} requests a day, ${quota(p.monthly_quota)} a month` }),
+      planAction(p, current));
+  }));
+}
+
+// planAction is the control under a plan: the free plan is switched to
+// directly, plans with a checkout are bought there, and others are arranged
+// with us.
+function planAction(p, current) {
+  if (p.name === current.name) return el("strong", { textContent: "Current plan" });
+  if (p.name !== "free" && !p.checkout) return el("p", { textContent: "Contact us to switch." });
+  const button = el("button", { type: "button", textContent: p.name === "free" ? "Switch to free" : `Upgrade to ${p.name}` });
+  button.onclick = async () => {
+    try {
+      const resp = await api("PUT", "/v1/portal/plan", { plan: p.name });
+      if (resp.checkout_url) {
+        location.assign(resp.checkout_url);
+        return;
+      }
+      loadPlans();
+      loadUsage();
+    } catch (err) {
+      $("plan-message").textContent = err.message;
+    }
+  };
+  return button;
+}
+
+function showSecret(secret) {
+  $("secret").textContent = secret;
+  $("secret").hidden = false;
+}
+
+async function loadKeys() {
+  const { keys } = await api("GET", "/v1/portal/keys");
+  $("keys").replaceChildren(...keys.map((k) => {
+    const actions = el("td", {});
+    if (!k.revoked_at) {
+      const rotate = el("button", { type: "button", textContent: "Rotate" });
+      rotate.onclick = async () => {
+        if (!confirm(`Rotate ${k.name}? The old secret keeps working for 24 hours.`)) return;
+        showSecret((await api("POST", `/v1/portal/keys/${k.id}/rotate`)).secret);
+        loadKeys();
+      };
+      const revoke = el("button", { type: "button", textContent: "Revoke" });
+      revoke.onclick = async () => {
+        if (!confirm(`Revoke ${k.name}? Apps using it stop working immediately.`)) return;
+        await api("DELETE", `/v1/portal/keys/${k.id}`);
+        loadKeys();
+      };
+      actions.append(rotate, " ", revoke);
+    }
+    return el("tr", { className: k.revoked_at ? "revoked" : "" },
+      el("td", { textContent: k.name }),
+      el("td", {}, el("code", { textContent: k.prefix + "…" })),
+      el("td", { textContent: date(k.created_at) }),
+      el("td", { textContent: date(k.last_used) }),
+      actions);
+  }));
+}
+
+// barChart draws one bar per day as an SVG.
+function barChart(dates, values) {
+  const ns = "http://www.w3.org/2000/svg";
+  const width = 720, height = 160, pad = 20;
+  const max = Math.max(1, ...values);
+  const step = (width - pad) / values.length;
+  const svg = document.createElementNS(ns, "svg");
+  svg.setAttribute("class", "chart");
+  svg.setAttribute("viewBox", `0 0 ${width} ${height}`);
+  values.forEach((v, i) => {
+    const h = ((height - 2 * pad) * v) / max;
+    const bar = document.createElementNS(ns, "rect");
+    bar.setAttribute("x", pad + i * step);
+    bar.setAttribute("y", height - pad - h);
+    bar.setAttribute("width", Math.max(1, step - 2));
+    bar.setAttribute("height", h);
+    const title = document.createElementNS(ns, "title");
+    title.textContent = `${dates[i]}: ${v.toLocaleString()} requests`;
+    bar.append(title);
+    svg.append(bar);
+  });
+  for (const [i, anchor] of [[0, "start"], [dates.length - 1, "end"]]) {
+    const label = document.createElementNS(ns, "text");
+    label.setAttribute("x", i === 0 ? pad : width);
+    label.setAttribute("y", height - 4);
+    label.setAttribute("text-anchor", anchor);
+    label.textContent = dates[i];
+    svg.append(label);
+  }
+  return svg;
+}
+
+async function loadUsage() {
+  const { dates, keys } = await api("GET", "/v1/portal/usage?days=30");
+  if (keys.length === 0) {
+    $("usage").replaceChildren(el("p", { textContent: "Create a key to start tracking usage." }));
+    return;
+  }
+  $("usage").replaceChildren(...keys.map((k) => {
+    const routes = Object.entries(k.routes).sort((a, b) => b[1] - a[1]);
+    return el("div", {},
+      el("h3", { textContent: `${k.name}: ${k.total.toLocaleString()} requests` }),
+      barChart(dates, k.daily),
+      el("ul", {}, ...routes.map(([route, n]) => el("li", {}, el("code", { textContent: route }), ` ${n.toLocaleString()}`))));
+  }));
+}
+
+$("login-form").onsubmit = async (e) => {
+  e.preventDefault();
+  const form = new FormData(e.target);
+  try {
+    await api("POST", "/v1/auth/login", { email: form.get("email"), password: form.get("password") });
+    location.reload();
+  } catch (err) {
+    $("signin-message").textContent = err.message;
+  }
+};
+
+$("register").onclick = async () => {
+  const form = new FormData($("login-form"));
+  try {
+    const resp = await api("POST", "/v1/auth/register", { email: form.get("email"), password: form.get("password") });
+    $("signin-message").textContent = resp.status;
+  } catch (err) {
+    $("signin-message").textContent = err.message;
+  }
+};
+
+$("logout").onclick = async () => {
+  await api("POST", "/v1/auth/logout");
+  location.reload();
+};
+
+$("key-form").onsubmit = async (e) => {
+  e.preventDefault();
+  const { secret } = await api("POST", "/v1/portal/keys", { name: new FormData(e.target).get("name") });
+  showSecret(secret);
+  e.target.reset();
+  loadKeys();
+  loadUsage();
+};
+
+start();